@@ -0,0 +1,261 @@
+package auth
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gchalakovmmi/PulpuWEB/db"
+	"github.com/markbates/goth"
+)
+
+// Audit event names stored in auth_audit.event.
+const (
+	AuditLogin            = "login"
+	AuditLoginFailed      = "login_failed"
+	AuditLogout           = "logout"
+	AuditSessionRejected  = "session_rejected"
+	AuditSessionRefreshed = "session_refreshed"
+)
+
+type AuditEntry struct {
+	ID        int64     `json:"id"`
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	Provider  string    `json:"provider"`
+	UserID    string    `json:"user_id"`
+	Email     string    `json:"email"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Reason    string    `json:"reason"`
+}
+
+// AuditQuery filters audit entries; zero fields match everything. Results
+// are newest first.
+type AuditQuery struct {
+	Event    string
+	Provider string
+	UserID   string
+	Email    string
+	IP       string
+	Since    time.Time
+	Until    time.Time
+	Limit    int
+	Offset   int
+}
+
+// AuditLog records login lifecycle events in Postgres. Register it with
+// GoogleAuth.AddHooks(auditLog.Hooks()).
+type AuditLog struct {
+	db db.Querier
+	// TrustProxy takes the client IP from X-Forwarded-For. Only enable it
+	// behind a proxy that sets the header.
+	TrustProxy bool
+	// RejectionInterval is how often a rejected session is recorded for the
+	// same IP and reason; one minute when zero. A bad cookie comes with
+	// every request, so repeats within the interval are dropped.
+	RejectionInterval time.Duration
+
+	mu       sync.Mutex
+	rejected map[string]time.Time
+}
+
+// maxRejectionKeys bounds the IP and reason pairs remembered for
+// RejectionInterval.
+const maxRejectionKeys = 10000
+
+func NewAuditLog(q db.Querier) *AuditLog {
+	return &AuditLog{db: q, rejected: make(map[string]time.Time)}
+}
+
+const auditSchema = `
+CREATE TABLE IF NOT EXISTS auth_audit (
+	id         BIGSERIAL PRIMARY KEY,
+	at         TIMESTAMPTZ NOT NULL DEFAULT now(),
+	event      TEXT NOT NULL,
+	provider   TEXT NOT NULL DEFAULT '',
+	user_id    TEXT NOT NULL DEFAULT '',
+	email      TEXT NOT NULL DEFAULT '',
+	ip         TEXT NOT NULL DEFAULT '',
+	user_agent TEXT NOT NULL DEFAULT '',
+	reason     TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS auth_audit_at_idx ON auth_audit (at DESC);
+CREATE INDEX IF NOT EXISTS auth_audit_email_idx ON auth_audit (email, at DESC);
+`
+
+func (al *AuditLog) Migrate(ctx context.Context) error {
+	_, err := al.db.Exec(ctx, auditSchema)
+	return err
+}
+
+func (al *AuditLog) Record(ctx context.Context, entry AuditEntry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	_, err := al.db.Exec(ctx,
+		`INSERT INTO auth_audit (at, event, provider, user_id, email, ip, user_agent, reason)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		entry.Time, entry.Event, entry.Provider, entry.UserID, entry.Email,
+		entry.IP, entry.UserAgent, entry.Reason)
+	return err
+}
+
+func (al *AuditLog) Hooks() Hooks {
+	return Hooks{
+		OnLogin: func(r *http.Request, user goth.User) {
+			al.record(r, AuditLogin, user, "")
+		},
+		OnLoginFailed: func(r *http.Request, provider, email string, err error) {
+			al.record(r, AuditLoginFailed, goth.User{Provider: provider, Email: email}, err.Error())
+		},
+		OnLogout: func(r *http.Request, session *Session) {
+			al.record(r, AuditLogout, session.User, "")
+		},
+		OnSessionRejected: func(r *http.Request, err error) {
+			if al.firstRejection(al.clientIP(r), err.Error()) {
+				al.record(r, AuditSessionRejected, goth.User{}, err.Error())
+			}
+		},
+		OnSessionRefreshed: func(r *http.Request, session *Session) {
+			al.record(r, AuditSessionRefreshed, session.User, "")
+		},
+	}
+}
+
+// record writes from inside a hook, where there is no caller to return an
+// error to, so failures are logged. The write outlives a canceled request.
+func (al *AuditLog) record(r *http.Request, event string, user goth.User, reason string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 5*time.Second)
+	defer cancel()
+	err := al.Record(ctx, AuditEntry{
+		Event:     event,
+		Provider:  user.Provider,
+		UserID:    user.UserID,
+		Email:     user.Email,
+		IP:        al.clientIP(r),
+		UserAgent: r.UserAgent(),
+		Reason:    reason,
+	})
+	if err != nil {
+		log.Println("auth audit:", err)
+	}
+}
+
+// firstRejection reports whether a session rejection from ip for reason
+// is the first within RejectionInterval and should be recorded.
+func (al *AuditLog) firstRejection(ip, reason string) bool {
+	interval := cmp.Or(al.RejectionInterval, time.Minute)
+	key := ip + "\x00" + reason
+	now := time.Now()
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if last, ok := al.rejected[key]; ok && now.Sub(last) < interval {
+		return false
+	}
+	if len(al.rejected) >= maxRejectionKeys {
+		for k, last := range al.rejected {
+			if now.Sub(last) >= interval {
+				delete(al.rejected, k)
+			}
+		}
+		if len(al.rejected) >= maxRejectionKeys {
+			clear(al.rejected)
+		}
+	}
+	al.rejected[key] = now
+	return true
+}
+
+func (al *AuditLog) clientIP(r *http.Request) string {
+	if al.TrustProxy {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			first, _, _ := strings.Cut(fwd, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (q AuditQuery) where() (string, []any) {
+	var conds []string
+	var args []any
+	add := func(cond string, arg any) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+	if q.Event != "" {
+		add("event = $%d", q.Event)
+	}
+	if q.Provider != "" {
+		add("provider = $%d", q.Provider)
+	}
+	if q.UserID != "" {
+		add("user_id = $%d", q.UserID)
+	}
+	if q.Email != "" {
+		add("email = $%d", normalizeEmail(q.Email))
+	}
+	if q.IP != "" {
+		add("ip = $%d", q.IP)
+	}
+	if !q.Since.IsZero() {
+		add("at >= $%d", q.Since)
+	}
+	if !q.Until.IsZero() {
+		add("at < $%d", q.Until)
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+func (al *AuditLog) Query(ctx context.Context, q AuditQuery) ([]AuditEntry, error) {
+	if q.Limit <= 0 || q.Limit > 1000 {
+		q.Limit = 100
+	}
+	where, args := q.where()
+	args = append(args, q.Limit, q.Offset)
+	sql := fmt.Sprintf(
+		`SELECT id, at, event, provider, user_id, email, ip, user_agent, reason
+		 FROM auth_audit%s ORDER BY at DESC, id DESC LIMIT $%d OFFSET $%d`,
+		where, len(args)-1, len(args))
+
+	rows, err := al.db.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.ID, &e.Time, &e.Event, &e.Provider, &e.UserID,
+			&e.Email, &e.IP, &e.UserAgent, &e.Reason); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// Count returns the number of entries matching q, ignoring Limit and
+// Offset, for paging admin screens.
+func (al *AuditLog) Count(ctx context.Context, q AuditQuery) (int, error) {
+	where, args := q.where()
+	var n int
+	err := al.db.QueryRow(ctx, "SELECT count(*) FROM auth_audit"+where, args...).Scan(&n)
+	return n, err
+}
@@ -25,16 +25,31 @@ type Config struct {
 	CallbackURL     string
 	SecretKey       []byte
 	SessionDuration time.Duration
+	// RefreshWithin re-issues sessions seen by WithGoogleAuth when they
+	// expire within this window. Zero disables sliding sessions.
+	RefreshWithin time.Duration
 }
 
+var (
+	ErrSessionFormat    = errors.New("invalid session format")
+	ErrSessionSignature = errors.New("invalid session signature")
+	ErrSessionExpired   = errors.New("session expired")
+)
+
 type Session struct {
 	User      goth.User `json:"user"`
 	ExpiresAt time.Time `json:"expires_at"`
+	// MFAPending is set while the user still owes a second factor.
+	MFAPending bool `json:"mfa_pending,omitempty"`
+	// StepUpAt is when the user last re-authenticated with a passkey.
+	StepUpAt time.Time `json:"step_up_at,omitzero"`
 }
 
 type GoogleAuth struct {
 	config       *Config
 	providerName string
+	mfa          *TOTPAuth
+	hooks        []Hooks
 }
 
 func NewGoogleAuth(config *Config) *GoogleAuth {
@@ -65,14 +80,31 @@ func (ga *GoogleAuth) BeginAuthHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (ga *GoogleAuth) CompleteUserAuth(w http.ResponseWriter, r *http.Request) (goth.User, error) {
-	return gothic.CompleteUserAuth(w, ga.SetProviderContext(r))
+	user, err := gothic.CompleteUserAuth(w, ga.SetProviderContext(r))
+	if err != nil {
+		ga.loginFailed(r, ga.providerName, "", err)
+		return user, err
+	}
+	ga.loggedIn(r, user)
+	return user, nil
 }
 
 func (ga *GoogleAuth) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if session, err := ga.readSession(r); err == nil {
+		ga.loggedOut(r, session)
+	}
 	gothic.Logout(w, ga.SetProviderContext(r))
 }
 
 func (ga *GoogleAuth) GetSession(r *http.Request) (*Session, error) {
+	session, err := ga.readSession(r)
+	if err != nil && !errors.Is(err, http.ErrNoCookie) {
+		ga.sessionRejected(r, err)
+	}
+	return session, err
+}
+
+func (ga *GoogleAuth) readSession(r *http.Request) (*Session, error) {
 	cookie, err := r.Cookie("auth_session")
 	if err != nil {
 		return nil, err
@@ -80,7 +112,7 @@ func (ga *GoogleAuth) GetSession(r *http.Request) (*Session, error) {
 
 	parts := strings.Split(cookie.Value, ".")
 	if len(parts) != 2 {
-		return nil, errors.New("invalid session format")
+		return nil, ErrSessionFormat
 	}
 
 	data, err := base64.URLEncoding.DecodeString(parts[0])
@@ -94,7 +126,7 @@ func (ga *GoogleAuth) GetSession(r *http.Request) (*Session, error) {
 	}
 
 	if !validSignature(ga.config.SecretKey, data, signature) {
-		return nil, errors.New("invalid session signature")
+		return nil, ErrSessionSignature
 	}
 
 	var session Session
@@ -103,18 +135,51 @@ func (ga *GoogleAuth) GetSession(r *http.Request) (*Session, error) {
 	}
 
 	if time.Now().After(session.ExpiresAt) {
-		return nil, errors.New("session expired")
+		return nil, ErrSessionExpired
 	}
 
 	return &session, nil
 }
 
+// UseMFA makes StoreSession mark sessions as pending MFA for users who
+// have TOTP enabled or enforced.
+func (ga *GoogleAuth) UseMFA(totp *TOTPAuth) {
+	ga.mfa = totp
+}
+
 func (ga *GoogleAuth) StoreSession(w http.ResponseWriter, user goth.User) error {
 	session := Session{
 		User:      user,
 		ExpiresAt: time.Now().Add(ga.config.SessionDuration),
 	}
 
+	if ga.mfa != nil {
+		required, err := ga.mfa.required(context.Background(), user)
+		if err != nil {
+			return err
+		}
+		session.MFAPending = required
+	}
+
+	return ga.writeSession(w, &session)
+}
+
+// RefreshSession re-issues the current session with a new expiry, keeping
+// its MFA and step-up state.
+func (ga *GoogleAuth) RefreshSession(w http.ResponseWriter, r *http.Request) (*Session, error) {
+	session, err := ga.GetSession(r)
+	if err != nil {
+		return nil, err
+	}
+	session.ExpiresAt = time.Now().Add(ga.config.SessionDuration)
+	if err := ga.writeSession(w, session); err != nil {
+		return nil, err
+	}
+	ga.sessionRefreshed(r, session)
+	return session, nil
+}
+
+func (ga *GoogleAuth) writeSession(w http.ResponseWriter, session *Session) error {
 	data, err := json.Marshal(session)
 	if err != nil {
 		return err
@@ -204,22 +269,58 @@ func GetGoogleAuthConfig() (*Config, error) {
 		sessionDuration = duration
 	}
 
+	var refreshWithin time.Duration
+	if durStr := os.Getenv("SESSION_REFRESH_WITHIN"); durStr != "" {
+		duration, err := time.ParseDuration(durStr)
+		if err != nil {
+			return nil, errors.New("invalid SESSION_REFRESH_WITHIN format")
+		}
+		refreshWithin = duration
+	}
+
 	return &Config{
 		GoogleKey:       googleKey,
 		GoogleSecret:    googleSecret,
 		CallbackURL:     domain + "/auth/google/callback",
 		SecretKey:       []byte(sessionSecret),
 		SessionDuration: sessionDuration,
+		RefreshWithin:   refreshWithin,
 	}, nil
 }
 
+// WithGoogleAuth only lets logged in sessions through. Sessions that still
+// owe a second factor are sent to the MFA pages; routes that are part of
+// that flow use WithPendingMFA instead.
 func (ga *GoogleAuth) WithGoogleAuth(handler http.HandlerFunc) http.HandlerFunc {
+		return ga.withSession(handler, false)
+}
+
+// WithPendingMFA is WithGoogleAuth for the MFA verification and enrollment
+// routes, which must accept sessions that are pending MFA.
+func (ga *GoogleAuth) WithPendingMFA(handler http.HandlerFunc) http.HandlerFunc {
+		return ga.withSession(handler, true)
+}
+
+func (ga *GoogleAuth) withSession(handler http.HandlerFunc, allowPending bool) http.HandlerFunc {
 		return func(w http.ResponseWriter, r *http.Request) {
 				session, err := ga.GetSession(r)
 				if err != nil {
 						http.Redirect(w, r, "/auth/google", http.StatusTemporaryRedirect)
 						return
 				}
+				if session.MFAPending && !allowPending {
+						if ga.mfa == nil {
+								http.Redirect(w, r, "/auth/google", http.StatusTemporaryRedirect)
+								return
+						}
+						ga.mfa.redirectPending(w, r, session)
+						return
+				}
+				if ga.config.RefreshWithin > 0 && time.Until(session.ExpiresAt) < ga.config.RefreshWithin {
+						if refreshed, err := ga.RefreshSession(w, r); err == nil {
+								session = refreshed
+						}
+				}
 				// Add session to request context
 				ctx := context.WithValue(r.Context(), "user_session", session)
 				handler(w, r.WithContext(ctx))
@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"net/http"
+
+	"github.com/markbates/goth"
+)
+
+// Hooks are called synchronously on login lifecycle events, from the
+// request that caused them. Nil fields are skipped.
+type Hooks struct {
+	OnLogin func(r *http.Request, user goth.User)
+	// OnLoginFailed gets the login method ("google", "password", "email",
+	// "passkey", "totp") and, when known, the email that was tried.
+	OnLoginFailed      func(r *http.Request, provider, email string, err error)
+	OnLogout           func(r *http.Request, session *Session)
+	OnSessionRejected  func(r *http.Request, err error)
+	OnSessionRefreshed func(r *http.Request, session *Session)
+}
+
+// AddHooks registers hooks in addition to the ones already added, so an
+// audit log and app-specific hooks can be used together.
+func (ga *GoogleAuth) AddHooks(hooks Hooks) {
+	ga.hooks = append(ga.hooks, hooks)
+}
+
+func (ga *GoogleAuth) loggedIn(r *http.Request, user goth.User) {
+	for _, h := range ga.hooks {
+		if h.OnLogin != nil {
+			h.OnLogin(r, user)
+		}
+	}
+}
+
+func (ga *GoogleAuth) loginFailed(r *http.Request, provider, email string, err error) {
+	for _, h := range ga.hooks {
+		if h.OnLoginFailed != nil {
+			h.OnLoginFailed(r, provider, email, err)
+		}
+	}
+}
+
+func (ga *GoogleAuth) loggedOut(r *http.Request, session *Session) {
+	for _, h := range ga.hooks {
+		if h.OnLogout != nil {
+			h.OnLogout(r, session)
+		}
+	}
+}
+
+func (ga *GoogleAuth) sessionRejected(r *http.Request, err error) {
+	for _, h := range ga.hooks {
+		if h.OnSessionRejected != nil {
+			h.OnSessionRejected(r, err)
+		}
+	}
+}
+
+func (ga *GoogleAuth) sessionRefreshed(r *http.Request, session *Session) {
+	for _, h := range ga.hooks {
+		if h.OnSessionRefreshed != nil {
+			h.OnSessionRefreshed(r, session)
+		}
+	}
+}
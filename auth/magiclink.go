@@ -0,0 +1,173 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gchalakovmmi/PulpuWEB/db"
+	"github.com/jackc/pgx/v5"
+	"github.com/markbates/goth"
+)
+
+const tokenMagicLink = "magic_link"
+
+var ErrRateLimited = errors.New("too many requests")
+
+type MagicLinkConfig struct {
+	// LinkURL is the absolute URL of the handler that calls Consume; the
+	// token is appended as the "token" query parameter.
+	LinkURL string
+	TTL     time.Duration
+	From    string
+	Subject string
+	// Body renders the email text around the login link.
+	Body func(link string) string
+	// RateLimit is the number of links an address may request per RateWindow.
+	RateLimit  int
+	RateWindow time.Duration
+}
+
+// MagicLinkAuth logs users in with single-use links sent by email.
+type MagicLinkAuth struct {
+	ga     *GoogleAuth
+	db     db.Querier
+	mailer Mailer
+	config *MagicLinkConfig
+}
+
+func NewMagicLinkAuth(ga *GoogleAuth, q db.Querier, mailer Mailer, config *MagicLinkConfig) (*MagicLinkAuth, error) {
+	if _, err := url.Parse(config.LinkURL); err != nil || config.LinkURL == "" {
+		return nil, errors.New("magic link requires a valid LinkURL")
+	}
+	if config.TTL == 0 {
+		config.TTL = 15 * time.Minute
+	}
+	if config.Subject == "" {
+		config.Subject = "Your login link"
+	}
+	if config.Body == nil {
+		ttl := config.TTL
+		config.Body = func(link string) string {
+			return fmt.Sprintf("Use the link below to log in. It expires in %s and can be used once.\n\n%s\n\nIf you didn't request it, you can ignore this email.\n", ttl, link)
+		}
+	}
+	if config.RateLimit == 0 {
+		config.RateLimit = 5
+	}
+	if config.RateWindow == 0 {
+		config.RateWindow = time.Hour
+	}
+
+	return &MagicLinkAuth{
+		ga:     ga,
+		db:     q,
+		mailer: mailer,
+		config: config,
+	}, nil
+}
+
+// Requests are counted per address in a fixed window that starts with the
+// first request after the previous window ran out.
+const magicLinkSchema = `
+CREATE TABLE IF NOT EXISTS auth_magic_link_limits (
+	email        TEXT PRIMARY KEY,
+	window_start TIMESTAMPTZ NOT NULL,
+	count        INT NOT NULL
+);
+`
+
+func (ml *MagicLinkAuth) Migrate(ctx context.Context) error {
+	_, err := ml.db.Exec(ctx, tokensSchema+magicLinkSchema)
+	return err
+}
+
+// SendLink emails a login link to the address. The limit is counted in
+// Postgres, so it holds across several app instances.
+func (ml *MagicLinkAuth) SendLink(ctx context.Context, email string) error {
+	email = normalizeEmail(email)
+	if !strings.Contains(email, "@") {
+		return errors.New("invalid email address")
+	}
+	if err := ml.countRequest(ctx, email); err != nil {
+		return err
+	}
+
+	token, err := issueToken(ctx, ml.db, tokenMagicLink, email, ml.config.TTL)
+	if err != nil {
+		return err
+	}
+
+	link, err := url.Parse(ml.config.LinkURL)
+	if err != nil {
+		return err
+	}
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+
+	return ml.mailer.Send(ctx, Message{
+		From:    ml.config.From,
+		To:      []string{email},
+		Subject: ml.config.Subject,
+		Body:    ml.config.Body(link.String()),
+	})
+}
+
+// countRequest records a link request for the address, or returns
+// ErrRateLimited when its window is used up. The upsert locks the
+// address's row, so concurrent requests can't both take the last slot.
+func (ml *MagicLinkAuth) countRequest(ctx context.Context, email string) error {
+	now := time.Now()
+	var count int
+	err := ml.db.QueryRow(ctx,
+		`INSERT INTO auth_magic_link_limits AS l (email, window_start, count) VALUES ($1, $2, 1)
+		 ON CONFLICT (email) DO UPDATE SET
+			window_start = CASE WHEN l.window_start <= $3 THEN $2 ELSE l.window_start END,
+			count = CASE WHEN l.window_start <= $3 THEN 1 ELSE l.count + 1 END
+		 WHERE l.window_start <= $3 OR l.count < $4
+		 RETURNING count`,
+		email, now, now.Add(-ml.config.RateWindow), ml.config.RateLimit).Scan(&count)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrRateLimited
+	}
+	return err
+}
+
+// Consume redeems the token in the request and stores a session for the
+// address it was sent to. Some mail scanners prefetch links, so apps may
+// prefer to show a confirmation page and call Consume from its POST.
+func (ml *MagicLinkAuth) Consume(w http.ResponseWriter, r *http.Request) (goth.User, error) {
+	user, err := ml.consume(w, r)
+	if err != nil {
+		ml.ga.loginFailed(r, "email", "", err)
+		return user, err
+	}
+	ml.ga.loggedIn(r, user)
+	return user, nil
+}
+
+func (ml *MagicLinkAuth) consume(w http.ResponseWriter, r *http.Request) (goth.User, error) {
+	token := r.FormValue("token")
+	if token == "" {
+		return goth.User{}, ErrInvalidToken
+	}
+	email, err := consumeToken(r.Context(), ml.db, tokenMagicLink, token)
+	if err != nil {
+		return goth.User{}, err
+	}
+
+	user := goth.User{
+		Provider: "email",
+		UserID:   email,
+		Email:    email,
+	}
+	if err := ml.ga.StoreSession(w, user); err != nil {
+		return goth.User{}, err
+	}
+	return user, nil
+}
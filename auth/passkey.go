@@ -0,0 +1,727 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gchalakovmmi/PulpuWEB/auth/internal/cbor"
+	"github.com/gchalakovmmi/PulpuWEB/db"
+	"github.com/jackc/pgx/v5"
+	"github.com/markbates/goth"
+)
+
+var (
+	ErrPasskeyNotFound  = errors.New("passkey not registered")
+	ErrPasskeyCloned    = errors.New("passkey signature counter went backwards")
+	ErrPasskeyChallenge = errors.New("passkey challenge missing or expired")
+	ErrStepUpRequired   = errors.New("recent re-authentication required")
+)
+
+// Base64URL is a byte slice that travels as unpadded base64url in JSON, the
+// encoding used by PublicKeyCredential.toJSON() in browsers.
+type Base64URL []byte
+
+func (b Base64URL) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *Base64URL) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return err
+	}
+	*b = decoded
+	return nil
+}
+
+type RelyingParty struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type UserEntity struct {
+	ID          Base64URL `json:"id"`
+	Name        string    `json:"name"`
+	DisplayName string    `json:"displayName"`
+}
+
+type CredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int64  `json:"alg"`
+}
+
+type CredentialDescriptor struct {
+	Type       string    `json:"type"`
+	ID         Base64URL `json:"id"`
+	Transports []string  `json:"transports,omitempty"`
+}
+
+type AuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// PublicKeyCredentialCreationOptions is passed to
+// PublicKeyCredential.parseCreationOptionsFromJSON in the browser.
+type PublicKeyCredentialCreationOptions struct {
+	RP                     RelyingParty           `json:"rp"`
+	User                   UserEntity             `json:"user"`
+	Challenge              Base64URL              `json:"challenge"`
+	PubKeyCredParams       []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout,omitempty"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials,omitempty"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// PublicKeyCredentialRequestOptions is passed to
+// PublicKeyCredential.parseRequestOptionsFromJSON in the browser.
+type PublicKeyCredentialRequestOptions struct {
+	Challenge        Base64URL              `json:"challenge"`
+	Timeout          int64                  `json:"timeout,omitempty"`
+	RPID             string                 `json:"rpId"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials,omitempty"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+type AuthenticatorResponse struct {
+	ClientDataJSON    Base64URL `json:"clientDataJSON"`
+	AttestationObject Base64URL `json:"attestationObject,omitempty"`
+	AuthenticatorData Base64URL `json:"authenticatorData,omitempty"`
+	Signature         Base64URL `json:"signature,omitempty"`
+	UserHandle        Base64URL `json:"userHandle,omitempty"`
+	Transports        []string  `json:"transports,omitempty"`
+}
+
+// PublicKeyCredential is the JSON a browser sends back after
+// navigator.credentials.create() or get(), serialized with toJSON().
+type PublicKeyCredential struct {
+	ID       string                `json:"id"`
+	RawID    Base64URL             `json:"rawId"`
+	Type     string                `json:"type"`
+	Response AuthenticatorResponse `json:"response"`
+}
+
+type Passkey struct {
+	ID         []byte
+	User       goth.User
+	Label      string
+	SignCount  uint32
+	Transports []string
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+}
+
+type WebAuthnConfig struct {
+	// RPID is the relying party ID, normally the site's registrable domain.
+	RPID   string
+	RPName string
+	// Origins allowed in client data; defaults to https://RPID.
+	Origins []string
+	Timeout time.Duration
+	// UserVerification is "required", "preferred" or "discouraged".
+	UserVerification string
+	// Where RequireStepUp sends users: the login page when there is no
+	// session, and the step-up page when the session needs a fresh passkey
+	// assertion.
+	LoginURL  string
+	StepUpURL string
+}
+
+// PasskeyAuth implements WebAuthn registration and assertion ceremonies.
+// Passkeys are attached to an existing goth.User, sign in to a normal
+// Session, and can re-authenticate a session for dangerous actions.
+// Attestation is not requested, so authenticators are not vetted.
+type PasskeyAuth struct {
+	ga     *GoogleAuth
+	db     db.Querier
+	config *WebAuthnConfig
+}
+
+func NewPasskeyAuth(ga *GoogleAuth, q db.Querier, config *WebAuthnConfig) (*PasskeyAuth, error) {
+	if config.RPID == "" {
+		return nil, errors.New("WebAuthn requires an RPID")
+	}
+	if config.RPName == "" {
+		config.RPName = config.RPID
+	}
+	if len(config.Origins) == 0 {
+		config.Origins = []string{"https://" + config.RPID}
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 5 * time.Minute
+	}
+	if config.UserVerification == "" {
+		config.UserVerification = "preferred"
+	}
+	if config.LoginURL == "" {
+		config.LoginURL = "/auth/google"
+	}
+	if config.StepUpURL == "" {
+		config.StepUpURL = "/auth/passkey/step-up"
+	}
+
+	return &PasskeyAuth{
+		ga:     ga,
+		db:     q,
+		config: config,
+	}, nil
+}
+
+const passkeySchema = `
+CREATE TABLE IF NOT EXISTS auth_passkeys (
+	credential_id BYTEA PRIMARY KEY,
+	user_key      TEXT NOT NULL,
+	provider      TEXT NOT NULL,
+	user_id       TEXT NOT NULL,
+	email         TEXT NOT NULL DEFAULT '',
+	name          TEXT NOT NULL DEFAULT '',
+	label         TEXT NOT NULL DEFAULT '',
+	public_key    BYTEA NOT NULL,
+	sign_count    BIGINT NOT NULL DEFAULT 0,
+	transports    TEXT[] NOT NULL DEFAULT '{}',
+	created_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+	last_used_at  TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS auth_passkeys_user_idx ON auth_passkeys (user_key);
+
+CREATE TABLE IF NOT EXISTS auth_passkey_challenges (
+	challenge  BYTEA PRIMARY KEY,
+	kind       TEXT NOT NULL,
+	user_key   TEXT NOT NULL DEFAULT '',
+	expires_at TIMESTAMPTZ NOT NULL
+);
+`
+
+func (pa *PasskeyAuth) Migrate(ctx context.Context) error {
+	_, err := pa.db.Exec(ctx, passkeySchema)
+	return err
+}
+
+// The pending ceremony is stored server-side and deleted when it finishes,
+// so each challenge can be answered once. The cookie only holds the
+// challenge to find it again.
+const challengeCookie = "auth_webauthn"
+
+type ceremony struct {
+	Kind      string
+	Challenge []byte
+	UserKey   string
+}
+
+func (pa *PasskeyAuth) startCeremony(ctx context.Context, w http.ResponseWriter, kind, userKey string) ([]byte, error) {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	if _, err := pa.db.Exec(ctx, `DELETE FROM auth_passkey_challenges WHERE expires_at <= now()`); err != nil {
+		return nil, err
+	}
+	expiresAt := time.Now().Add(pa.config.Timeout)
+	_, err := pa.db.Exec(ctx,
+		`INSERT INTO auth_passkey_challenges (challenge, kind, user_key, expires_at) VALUES ($1, $2, $3, $4)`,
+		challenge, kind, userKey, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     challengeCookie,
+		Value:    base64.RawURLEncoding.EncodeToString(challenge),
+		Path:     "/",
+		Expires:  expiresAt,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return challenge, nil
+}
+
+// endCeremony consumes the pending challenge. The single DELETE makes
+// concurrent finishes with the same challenge safe.
+func (pa *PasskeyAuth) endCeremony(w http.ResponseWriter, r *http.Request, kind string) (*ceremony, error) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     challengeCookie,
+		Value:    "",
+		Path:     "/",
+		Expires:  time.Unix(0, 0),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	cookie, err := r.Cookie(challengeCookie)
+	if err != nil {
+		return nil, ErrPasskeyChallenge
+	}
+	challenge, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil || len(challenge) == 0 {
+		return nil, ErrPasskeyChallenge
+	}
+
+	c := ceremony{Kind: kind, Challenge: challenge}
+	err = pa.db.QueryRow(r.Context(),
+		`DELETE FROM auth_passkey_challenges
+		 WHERE challenge = $1 AND kind = $2 AND expires_at > now()
+		 RETURNING user_key`,
+		challenge, kind).Scan(&c.UserKey)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrPasskeyChallenge
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// userHandle derives a stable, opaque WebAuthn user ID so no personal data
+// is stored on the authenticator.
+func (pa *PasskeyAuth) userHandle(user goth.User) []byte {
+	return createSignature(pa.ga.config.SecretKey, []byte("webauthn-user:"+UserKey(user)))
+}
+
+// BeginRegistration starts adding a passkey to user, normally the user of
+// the current session. Send the returned options to the browser as JSON.
+func (pa *PasskeyAuth) BeginRegistration(w http.ResponseWriter, r *http.Request, user goth.User) (*PublicKeyCredentialCreationOptions, error) {
+	existing, err := pa.Passkeys(r.Context(), user)
+	if err != nil {
+		return nil, err
+	}
+	challenge, err := pa.startCeremony(r.Context(), w, "register", UserKey(user))
+	if err != nil {
+		return nil, err
+	}
+
+	name := user.Email
+	if name == "" {
+		name = user.UserID
+	}
+	displayName := user.Name
+	if displayName == "" {
+		displayName = name
+	}
+
+	options := &PublicKeyCredentialCreationOptions{
+		RP:        RelyingParty{ID: pa.config.RPID, Name: pa.config.RPName},
+		User:      UserEntity{ID: pa.userHandle(user), Name: name, DisplayName: displayName},
+		Challenge: challenge,
+		PubKeyCredParams: []CredentialParameter{
+			{Type: "public-key", Alg: COSEAlgES256},
+			{Type: "public-key", Alg: COSEAlgEdDSA},
+			{Type: "public-key", Alg: COSEAlgRS256},
+		},
+		Timeout: pa.config.Timeout.Milliseconds(),
+		AuthenticatorSelection: AuthenticatorSelection{
+			ResidentKey:      "required",
+			UserVerification: pa.config.UserVerification,
+		},
+		Attestation: "none",
+	}
+	for _, pk := range existing {
+		options.ExcludeCredentials = append(options.ExcludeCredentials,
+			CredentialDescriptor{Type: "public-key", ID: pk.ID, Transports: pk.Transports})
+	}
+	return options, nil
+}
+
+// FinishRegistration verifies the browser's attestation response in the
+// request body and stores the new passkey for user.
+func (pa *PasskeyAuth) FinishRegistration(w http.ResponseWriter, r *http.Request, user goth.User, label string) (*Passkey, error) {
+	c, err := pa.endCeremony(w, r, "register")
+	if err != nil {
+		return nil, err
+	}
+	if c.UserKey != UserKey(user) {
+		return nil, errors.New("passkey registration started for a different user")
+	}
+	cred, err := readCredential(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := pa.verifyClientData(cred.Response.ClientDataJSON, "webauthn.create", c.Challenge); err != nil {
+		return nil, err
+	}
+
+	attestation, _, err := cbor.Decode(cred.Response.AttestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("invalid attestation object: %w", err)
+	}
+	m, _ := attestation.(map[any]any)
+	authData, _ := m["authData"].([]byte)
+	ad, err := pa.parseAuthData(authData)
+	if err != nil {
+		return nil, err
+	}
+	if ad.credentialID == nil {
+		return nil, errors.New("attestation has no credential data")
+	}
+	if !bytes.Equal(ad.credentialID, cred.RawID) {
+		return nil, errors.New("credential ID mismatch")
+	}
+	if _, err := parseCOSEKey(ad.publicKey); err != nil {
+		return nil, err
+	}
+
+	pk := &Passkey{
+		ID:         ad.credentialID,
+		User:       user,
+		Label:      label,
+		SignCount:  ad.signCount,
+		Transports: cred.Response.Transports,
+		CreatedAt:  time.Now(),
+	}
+	if pk.Transports == nil {
+		pk.Transports = []string{}
+	}
+	_, err = pa.db.Exec(r.Context(),
+		`INSERT INTO auth_passkeys (credential_id, user_key, provider, user_id, email, name, label, public_key, sign_count, transports)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		pk.ID, UserKey(user), user.Provider, user.UserID, user.Email, user.Name, label,
+		ad.publicKey, int64(ad.signCount), pk.Transports)
+	if err != nil {
+		return nil, err
+	}
+	return pk, nil
+}
+
+// BeginLogin starts a usernameless login with a discoverable passkey.
+func (pa *PasskeyAuth) BeginLogin(w http.ResponseWriter, r *http.Request) (*PublicKeyCredentialRequestOptions, error) {
+	challenge, err := pa.startCeremony(r.Context(), w, "login", "")
+	if err != nil {
+		return nil, err
+	}
+	return &PublicKeyCredentialRequestOptions{
+		Challenge:        challenge,
+		Timeout:          pa.config.Timeout.Milliseconds(),
+		RPID:             pa.config.RPID,
+		UserVerification: pa.config.UserVerification,
+	}, nil
+}
+
+// FinishLogin verifies the assertion in the request body and stores a
+// session for the passkey's user. A user-verified passkey already counts as
+// two factors, so the session is never marked pending MFA.
+func (pa *PasskeyAuth) FinishLogin(w http.ResponseWriter, r *http.Request) (goth.User, error) {
+	user, err := pa.finishLogin(w, r)
+	if err != nil {
+		pa.ga.loginFailed(r, "passkey", "", err)
+		return user, err
+	}
+	pa.ga.loggedIn(r, user)
+	return user, nil
+}
+
+func (pa *PasskeyAuth) finishLogin(w http.ResponseWriter, r *http.Request) (goth.User, error) {
+	c, err := pa.endCeremony(w, r, "login")
+	if err != nil {
+		return goth.User{}, err
+	}
+	pk, ad, err := pa.verifyAssertion(r, c)
+	if err != nil {
+		return goth.User{}, err
+	}
+
+	if ad.userVerified() {
+		err = pa.ga.writeSession(w, &Session{
+			User:      pk.User,
+			ExpiresAt: time.Now().Add(pa.ga.config.SessionDuration),
+		})
+	} else {
+		err = pa.ga.StoreSession(w, pk.User)
+	}
+	if err != nil {
+		return goth.User{}, err
+	}
+	return pk.User, nil
+}
+
+// BeginStepUp asks the current session's user to confirm with one of their
+// passkeys before a dangerous action.
+func (pa *PasskeyAuth) BeginStepUp(w http.ResponseWriter, r *http.Request) (*PublicKeyCredentialRequestOptions, error) {
+	session, err := pa.ga.GetSession(r)
+	if err != nil {
+		return nil, err
+	}
+	passkeys, err := pa.Passkeys(r.Context(), session.User)
+	if err != nil {
+		return nil, err
+	}
+	if len(passkeys) == 0 {
+		return nil, ErrPasskeyNotFound
+	}
+	challenge, err := pa.startCeremony(r.Context(), w, "step-up", UserKey(session.User))
+	if err != nil {
+		return nil, err
+	}
+
+	options := &PublicKeyCredentialRequestOptions{
+		Challenge:        challenge,
+		Timeout:          pa.config.Timeout.Milliseconds(),
+		RPID:             pa.config.RPID,
+		UserVerification: "required",
+	}
+	for _, pk := range passkeys {
+		options.AllowCredentials = append(options.AllowCredentials,
+			CredentialDescriptor{Type: "public-key", ID: pk.ID, Transports: pk.Transports})
+	}
+	return options, nil
+}
+
+// FinishStepUp verifies the assertion and stamps the session with the time
+// of re-authentication, which RequireStepUp checks.
+func (pa *PasskeyAuth) FinishStepUp(w http.ResponseWriter, r *http.Request) error {
+	session, err := pa.ga.GetSession(r)
+	if err != nil {
+		return err
+	}
+	c, err := pa.endCeremony(w, r, "step-up")
+	if err != nil {
+		return err
+	}
+	if c.UserKey != UserKey(session.User) {
+		return errors.New("step-up started for a different user")
+	}
+	pk, ad, err := pa.verifyAssertion(r, c)
+	if err != nil {
+		return err
+	}
+	if UserKey(pk.User) != c.UserKey {
+		return ErrPasskeyNotFound
+	}
+	if !ad.userVerified() {
+		return errors.New("step-up requires user verification")
+	}
+
+	session.StepUpAt = time.Now()
+	session.MFAPending = false
+	return pa.ga.writeSession(w, session)
+}
+
+// RequireStepUp only lets sessions through that re-authenticated with a
+// passkey within maxAge; others are sent to StepUpURL, or to LoginURL
+// without a session.
+func (pa *PasskeyAuth) RequireStepUp(maxAge time.Duration, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, err := pa.ga.GetSession(r)
+		if err != nil {
+			http.Redirect(w, r, pa.config.LoginURL, http.StatusTemporaryRedirect)
+			return
+		}
+		if session.StepUpAt.IsZero() || time.Since(session.StepUpAt) > maxAge {
+			target := pa.config.StepUpURL + "?next=" + url.QueryEscape(r.URL.RequestURI())
+			http.Redirect(w, r, target, http.StatusTemporaryRedirect)
+			return
+		}
+		ctx := context.WithValue(r.Context(), "user_session", session)
+		handler(w, r.WithContext(ctx))
+	}
+}
+
+func (pa *PasskeyAuth) Passkeys(ctx context.Context, user goth.User) ([]Passkey, error) {
+	rows, err := pa.db.Query(ctx,
+		`SELECT credential_id, provider, user_id, email, name, label, sign_count, transports, created_at, last_used_at
+		 FROM auth_passkeys WHERE user_key = $1 ORDER BY created_at`, UserKey(user))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var passkeys []Passkey
+	for rows.Next() {
+		var pk Passkey
+		var count int64
+		if err := rows.Scan(&pk.ID, &pk.User.Provider, &pk.User.UserID, &pk.User.Email, &pk.User.Name,
+			&pk.Label, &count, &pk.Transports, &pk.CreatedAt, &pk.LastUsedAt); err != nil {
+			return nil, err
+		}
+		pk.SignCount = uint32(count)
+		passkeys = append(passkeys, pk)
+	}
+	return passkeys, rows.Err()
+}
+
+func (pa *PasskeyAuth) DeletePasskey(ctx context.Context, user goth.User, id []byte) error {
+	tag, err := pa.db.Exec(ctx,
+		`DELETE FROM auth_passkeys WHERE credential_id = $1 AND user_key = $2`, id, UserKey(user))
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrPasskeyNotFound
+	}
+	return nil
+}
+
+func readCredential(r *http.Request) (*PublicKeyCredential, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+	var cred PublicKeyCredential
+	if err := json.Unmarshal(body, &cred); err != nil {
+		return nil, fmt.Errorf("invalid credential: %w", err)
+	}
+	if cred.Type != "public-key" || len(cred.RawID) == 0 {
+		return nil, errors.New("invalid credential")
+	}
+	return &cred, nil
+}
+
+func (pa *PasskeyAuth) verifyClientData(raw []byte, typ string, challenge []byte) error {
+	var clientData struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		Origin    string `json:"origin"`
+	}
+	if err := json.Unmarshal(raw, &clientData); err != nil {
+		return fmt.Errorf("invalid client data: %w", err)
+	}
+	if clientData.Type != typ {
+		return fmt.Errorf("unexpected client data type %q", clientData.Type)
+	}
+	got, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(clientData.Challenge, "="))
+	if err != nil || subtle.ConstantTimeCompare(got, challenge) != 1 {
+		return errors.New("challenge mismatch")
+	}
+	if !slices.Contains(pa.config.Origins, clientData.Origin) {
+		return fmt.Errorf("unexpected origin %q", clientData.Origin)
+	}
+	return nil
+}
+
+// Authenticator data flags, WebAuthn section 6.1.
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttested     = 0x40
+)
+
+type authenticatorData struct {
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	publicKey    []byte
+}
+
+func (ad *authenticatorData) userVerified() bool {
+	return ad.flags&flagUserVerified != 0
+}
+
+func (pa *PasskeyAuth) parseAuthData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, errors.New("authenticator data too short")
+	}
+	rpIDHash := sha256.Sum256([]byte(pa.config.RPID))
+	if !bytes.Equal(data[:32], rpIDHash[:]) {
+		return nil, errors.New("RP ID mismatch")
+	}
+
+	ad := &authenticatorData{
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	if ad.flags&flagUserPresent == 0 {
+		return nil, errors.New("user presence not asserted")
+	}
+	if pa.config.UserVerification == "required" && !ad.userVerified() {
+		return nil, errors.New("user verification required")
+	}
+
+	if ad.flags&flagAttested != 0 {
+		rest := data[37:]
+		// AAGUID (16 bytes) then a 2-byte credential ID length.
+		if len(rest) < 18 {
+			return nil, errors.New("attested credential data too short")
+		}
+		n := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if len(rest) < n {
+			return nil, errors.New("attested credential data too short")
+		}
+		ad.credentialID = rest[:n]
+		rest = rest[n:]
+		_, after, err := cbor.Decode(rest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid credential public key: %w", err)
+		}
+		ad.publicKey = rest[:len(rest)-len(after)]
+	}
+	return ad, nil
+}
+
+func (pa *PasskeyAuth) verifyAssertion(r *http.Request, c *ceremony) (*Passkey, *authenticatorData, error) {
+	cred, err := readCredential(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := pa.verifyClientData(cred.Response.ClientDataJSON, "webauthn.get", c.Challenge); err != nil {
+		return nil, nil, err
+	}
+
+	ctx := r.Context()
+	var pk Passkey
+	var publicKey []byte
+	var count int64
+	err = pa.db.QueryRow(ctx,
+		`SELECT credential_id, provider, user_id, email, name, label, public_key, sign_count
+		 FROM auth_passkeys WHERE credential_id = $1`, []byte(cred.RawID)).Scan(
+		&pk.ID, &pk.User.Provider, &pk.User.UserID, &pk.User.Email, &pk.User.Name,
+		&pk.Label, &publicKey, &count)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil, ErrPasskeyNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	pk.SignCount = uint32(count)
+	if len(cred.Response.UserHandle) > 0 && !bytes.Equal(cred.Response.UserHandle, pa.userHandle(pk.User)) {
+		return nil, nil, errors.New("user handle mismatch")
+	}
+
+	ad, err := pa.parseAuthData(cred.Response.AuthenticatorData)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := parseCOSEKey(publicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	clientDataHash := sha256.Sum256(cred.Response.ClientDataJSON)
+	signed := append(append([]byte(nil), cred.Response.AuthenticatorData...), clientDataHash[:]...)
+	if err := key.verify(signed, cred.Response.Signature); err != nil {
+		return nil, nil, err
+	}
+
+	// Counters that don't increase hint at a cloned authenticator. Many
+	// passkey providers always report 0, which is allowed. Checking in the
+	// UPDATE keeps two concurrent assertions from both passing.
+	tag, err := pa.db.Exec(ctx,
+		`UPDATE auth_passkeys SET sign_count = $2, last_used_at = now()
+		 WHERE credential_id = $1 AND (sign_count < $2 OR ($2 = 0 AND sign_count = 0))`,
+		pk.ID, int64(ad.signCount))
+	if err != nil {
+		return nil, nil, err
+	}
+	if tag.RowsAffected() == 0 {
+		return nil, nil, ErrPasskeyCloned
+	}
+	pk.SignCount = ad.signCount
+	return &pk, ad, nil
+}
@@ -0,0 +1,372 @@
+package auth_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gchalakovmmi/PulpuWEB/auth"
+	"github.com/gchalakovmmi/PulpuWEB/auth/passkeytest"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/markbates/goth"
+)
+
+// passkeyStore is an in-memory stand-in for the statements PasskeyAuth
+// runs against Postgres.
+type passkeyStore struct {
+	mu         sync.Mutex
+	passkeys   []*storedPasskey
+	challenges map[string]storedChallenge
+}
+
+type storedPasskey struct {
+	id, publicKey             []byte
+	userKey, provider, userID string
+	email, name, label        string
+	signCount                 int64
+	transports                []string
+	createdAt                 time.Time
+	lastUsedAt                *time.Time
+}
+
+type storedChallenge struct {
+	kind, userKey string
+	expiresAt     time.Time
+}
+
+func newPasskeyStore() *passkeyStore {
+	return &passkeyStore{challenges: map[string]storedChallenge{}}
+}
+
+func (s *passkeyStore) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case strings.HasPrefix(sql, "DELETE FROM auth_passkey_challenges WHERE expires_at"):
+		for k, c := range s.challenges {
+			if !c.expiresAt.After(time.Now()) {
+				delete(s.challenges, k)
+			}
+		}
+	case strings.HasPrefix(sql, "INSERT INTO auth_passkey_challenges"):
+		s.challenges[string(args[0].([]byte))] = storedChallenge{
+			kind:      args[1].(string),
+			userKey:   args[2].(string),
+			expiresAt: args[3].(time.Time),
+		}
+	case strings.HasPrefix(sql, "INSERT INTO auth_passkeys"):
+		s.passkeys = append(s.passkeys, &storedPasskey{
+			id: args[0].([]byte), userKey: args[1].(string), provider: args[2].(string),
+			userID: args[3].(string), email: args[4].(string), name: args[5].(string),
+			label: args[6].(string), publicKey: args[7].([]byte), signCount: args[8].(int64),
+			transports: args[9].([]string), createdAt: time.Now(),
+		})
+	case strings.HasPrefix(sql, "UPDATE auth_passkeys SET sign_count"):
+		now := time.Now()
+		pk := s.find(args[0].([]byte))
+		count := args[1].(int64)
+		if pk == nil || !(pk.signCount < count || count == 0 && pk.signCount == 0) {
+			return pgconn.NewCommandTag("UPDATE 0"), nil
+		}
+		pk.signCount = count
+		pk.lastUsedAt = &now
+	default:
+		return pgconn.CommandTag{}, errors.New("unexpected statement: " + sql)
+	}
+	return pgconn.NewCommandTag("OK 1"), nil
+}
+
+func (s *passkeyStore) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !strings.Contains(sql, "FROM auth_passkeys WHERE user_key = $1") {
+		return nil, errors.New("unexpected query: " + sql)
+	}
+	rows := &fakeRows{}
+	for _, pk := range s.passkeys {
+		if pk.userKey == args[0].(string) {
+			rows.values = append(rows.values, []any{pk.id, pk.provider, pk.userID, pk.email, pk.name,
+				pk.label, pk.signCount, pk.transports, pk.createdAt, pk.lastUsedAt})
+		}
+	}
+	return rows, nil
+}
+
+func (s *passkeyStore) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case strings.HasPrefix(sql, "DELETE FROM auth_passkey_challenges"):
+		key := string(args[0].([]byte))
+		c, ok := s.challenges[key]
+		if !ok || c.kind != args[1].(string) || !c.expiresAt.After(time.Now()) {
+			return fakeRow{err: pgx.ErrNoRows}
+		}
+		delete(s.challenges, key)
+		return fakeRow{values: []any{c.userKey}}
+	case strings.Contains(sql, "FROM auth_passkeys WHERE credential_id = $1"):
+		pk := s.find(args[0].([]byte))
+		if pk == nil {
+			return fakeRow{err: pgx.ErrNoRows}
+		}
+		return fakeRow{values: []any{pk.id, pk.provider, pk.userID, pk.email, pk.name,
+			pk.label, pk.publicKey, pk.signCount}}
+	}
+	return fakeRow{err: errors.New("unexpected query: " + sql)}
+}
+
+func (s *passkeyStore) find(id []byte) *storedPasskey {
+	for _, pk := range s.passkeys {
+		if bytes.Equal(pk.id, id) {
+			return pk
+		}
+	}
+	return nil
+}
+
+type fakeRow struct {
+	values []any
+	err    error
+}
+
+func (r fakeRow) Scan(dest ...any) error {
+	if r.err != nil {
+		return r.err
+	}
+	return scanValues(r.values, dest)
+}
+
+// fakeRows implements the pgx.Rows methods PasskeyAuth uses.
+type fakeRows struct {
+	pgx.Rows
+	values [][]any
+	next   int
+}
+
+func (r *fakeRows) Next() bool {
+	r.next++
+	return r.next <= len(r.values)
+}
+
+func (r *fakeRows) Scan(dest ...any) error { return scanValues(r.values[r.next-1], dest) }
+func (r *fakeRows) Err() error             { return nil }
+func (r *fakeRows) Close()                 {}
+
+func scanValues(values, dest []any) error {
+	if len(values) != len(dest) {
+		return errors.New("scan: column count mismatch")
+	}
+	for i, v := range values {
+		target := reflect.ValueOf(dest[i]).Elem()
+		if v == nil || (reflect.ValueOf(v).Kind() == reflect.Pointer && reflect.ValueOf(v).IsNil()) {
+			target.SetZero()
+			continue
+		}
+		target.Set(reflect.ValueOf(v))
+	}
+	return nil
+}
+
+type passkeyTest struct {
+	t     *testing.T
+	store *passkeyStore
+	pa    *auth.PasskeyAuth
+	authn *passkeytest.Authenticator
+	user  goth.User
+}
+
+func newPasskeyTest(t *testing.T) *passkeyTest {
+	secret, err := auth.GenerateSecretKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ga := auth.NewGoogleAuth(&auth.Config{SecretKey: secret})
+	store := newPasskeyStore()
+	pa, err := auth.NewPasskeyAuth(ga, store, &auth.WebAuthnConfig{
+		RPID:     "example.com",
+		LoginURL: "/login",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &passkeyTest{
+		t:     t,
+		store: store,
+		pa:    pa,
+		authn: passkeytest.New("https://example.com"),
+		user:  goth.User{Provider: "google", UserID: "42", Email: "ada@example.com", Name: "Ada"},
+	}
+}
+
+// request builds a finish request that carries the cookies of the begin
+// response and the credential as its body.
+func (pt *passkeyTest) request(cookies []*http.Cookie, cred *auth.PublicKeyCredential) *http.Request {
+	body, err := json.Marshal(cred)
+	if err != nil {
+		pt.t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+func (pt *passkeyTest) register() {
+	w := httptest.NewRecorder()
+	options, err := pt.pa.BeginRegistration(w, httptest.NewRequest(http.MethodGet, "/", nil), pt.user)
+	if err != nil {
+		pt.t.Fatalf("BeginRegistration: %v", err)
+	}
+	cred, err := pt.authn.Create(options)
+	if err != nil {
+		pt.t.Fatalf("Create: %v", err)
+	}
+	_, err = pt.pa.FinishRegistration(httptest.NewRecorder(), pt.request(w.Result().Cookies(), cred), pt.user, "laptop")
+	if err != nil {
+		pt.t.Fatalf("FinishRegistration: %v", err)
+	}
+}
+
+// beginLogin returns the challenge cookie and the authenticator's assertion.
+func (pt *passkeyTest) beginLogin() ([]*http.Cookie, *auth.PublicKeyCredential) {
+	w := httptest.NewRecorder()
+	options, err := pt.pa.BeginLogin(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if err != nil {
+		pt.t.Fatalf("BeginLogin: %v", err)
+	}
+	cred, err := pt.authn.Get(options)
+	if err != nil {
+		pt.t.Fatalf("Get: %v", err)
+	}
+	return w.Result().Cookies(), cred
+}
+
+func TestPasskeyLogin(t *testing.T) {
+	pt := newPasskeyTest(t)
+	pt.register()
+
+	passkeys, err := pt.pa.Passkeys(context.Background(), pt.user)
+	if err != nil || len(passkeys) != 1 || passkeys[0].Label != "laptop" {
+		t.Fatalf("Passkeys = %v, %v; want the registered passkey", passkeys, err)
+	}
+
+	cookies, cred := pt.beginLogin()
+	w := httptest.NewRecorder()
+	user, err := pt.pa.FinishLogin(w, pt.request(cookies, cred))
+	if err != nil {
+		t.Fatalf("FinishLogin: %v", err)
+	}
+	if auth.UserKey(user) != auth.UserKey(pt.user) {
+		t.Errorf("FinishLogin user = %q, want %q", auth.UserKey(user), auth.UserKey(pt.user))
+	}
+	if cookieNamed(w.Result().Cookies(), "auth_session") == nil {
+		t.Error("FinishLogin did not store a session")
+	}
+}
+
+func TestPasskeyChallengeSingleUse(t *testing.T) {
+	pt := newPasskeyTest(t)
+	pt.register()
+
+	cookies, cred := pt.beginLogin()
+	if _, err := pt.pa.FinishLogin(httptest.NewRecorder(), pt.request(cookies, cred)); err != nil {
+		t.Fatalf("FinishLogin: %v", err)
+	}
+	_, err := pt.pa.FinishLogin(httptest.NewRecorder(), pt.request(cookies, cred))
+	if !errors.Is(err, auth.ErrPasskeyChallenge) {
+		t.Errorf("replayed FinishLogin error = %v, want ErrPasskeyChallenge", err)
+	}
+}
+
+func TestPasskeyClonedAuthenticator(t *testing.T) {
+	pt := newPasskeyTest(t)
+	pt.register()
+
+	cookies, cred := pt.beginLogin()
+	if _, err := pt.pa.FinishLogin(httptest.NewRecorder(), pt.request(cookies, cred)); err != nil {
+		t.Fatalf("FinishLogin: %v", err)
+	}
+	pt.authn.SetSignCount(cred.RawID, 0)
+	cookies, cred = pt.beginLogin()
+	_, err := pt.pa.FinishLogin(httptest.NewRecorder(), pt.request(cookies, cred))
+	if !errors.Is(err, auth.ErrPasskeyCloned) {
+		t.Errorf("FinishLogin error = %v, want ErrPasskeyCloned", err)
+	}
+}
+
+func TestPasskeyStepUp(t *testing.T) {
+	pt := newPasskeyTest(t)
+	pt.register()
+
+	cookies, cred := pt.beginLogin()
+	w := httptest.NewRecorder()
+	if _, err := pt.pa.FinishLogin(w, pt.request(cookies, cred)); err != nil {
+		t.Fatalf("FinishLogin: %v", err)
+	}
+	session := []*http.Cookie{cookieNamed(w.Result().Cookies(), "auth_session")}
+
+	reached := false
+	guarded := pt.pa.RequireStepUp(time.Minute, func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	})
+	serve := func(cookies []*http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/danger", nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		guarded(w, r)
+		return w
+	}
+
+	if got := serve(nil).Header().Get("Location"); got != "/login" {
+		t.Errorf("redirect without session = %q, want /login", got)
+	}
+	if got := serve(session).Header().Get("Location"); !strings.HasPrefix(got, "/auth/passkey/step-up?next=") {
+		t.Errorf("redirect without step-up = %q, want the step-up page", got)
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, c := range session {
+		r.AddCookie(c)
+	}
+	options, err := pt.pa.BeginStepUp(w, r)
+	if err != nil {
+		t.Fatalf("BeginStepUp: %v", err)
+	}
+	cred, err = pt.authn.Get(options)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	finish := pt.request(append(session, w.Result().Cookies()...), cred)
+	w = httptest.NewRecorder()
+	if err := pt.pa.FinishStepUp(w, finish); err != nil {
+		t.Fatalf("FinishStepUp: %v", err)
+	}
+
+	serve([]*http.Cookie{cookieNamed(w.Result().Cookies(), "auth_session")})
+	if !reached {
+		t.Error("RequireStepUp refused a session that just stepped up")
+	}
+}
+
+// cookieNamed returns the cookie a response set, ignoring ones it cleared.
+func cookieNamed(cookies []*http.Cookie, name string) *http.Cookie {
+	for _, c := range cookies {
+		if c.Name == name && c.Value != "" {
+			return c
+		}
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+// Package passkeytest provides a software WebAuthn authenticator so code
+// using auth.PasskeyAuth can be exercised in Go unit tests without a
+// browser.
+//
+//	authn := passkeytest.New("https://example.com")
+//	cred, err := authn.Create(creationOptions)
+//	body, _ := json.Marshal(cred) // POST to the FinishRegistration handler
+package passkeytest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"sync"
+
+	"github.com/gchalakovmmi/PulpuWEB/auth"
+	"github.com/gchalakovmmi/PulpuWEB/auth/internal/cbor"
+)
+
+// Authenticator is a platform authenticator that holds ES256 keys in
+// memory. It is safe for concurrent use.
+type Authenticator struct {
+	// Origin is reported in client data, e.g. "https://example.com".
+	Origin string
+	// UserVerified controls the UV flag; it defaults to true.
+	UserVerified bool
+
+	mu          sync.Mutex
+	credentials []*Credential
+}
+
+type Credential struct {
+	ID         []byte
+	RPID       string
+	UserHandle []byte
+	SignCount  uint32
+	Key        *ecdsa.PrivateKey
+}
+
+func New(origin string) *Authenticator {
+	return &Authenticator{
+		Origin:       origin,
+		UserVerified: true,
+	}
+}
+
+// Credentials returns the credentials created so far.
+func (a *Authenticator) Credentials() []*Credential {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]*Credential(nil), a.credentials...)
+}
+
+// SetSignCount overrides a credential's counter, e.g. to simulate a cloned
+// authenticator.
+func (a *Authenticator) SetSignCount(id []byte, count uint32) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, c := range a.credentials {
+		if bytes.Equal(c.ID, id) {
+			c.SignCount = count
+		}
+	}
+}
+
+// Create performs navigator.credentials.create() for the options.
+func (a *Authenticator) Create(options *auth.PublicKeyCredentialCreationOptions) (*auth.PublicKeyCredential, error) {
+	rpID := options.RP.ID
+	if rpID == "" {
+		u, err := url.Parse(a.Origin)
+		if err != nil {
+			return nil, err
+		}
+		rpID = u.Hostname()
+	}
+
+	supported := false
+	for _, p := range options.PubKeyCredParams {
+		if p.Alg == auth.COSEAlgES256 {
+			supported = true
+		}
+	}
+	if !supported {
+		return nil, errors.New("passkeytest: ES256 not offered")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, excluded := range options.ExcludeCredentials {
+		for _, c := range a.credentials {
+			if bytes.Equal(c.ID, excluded.ID) {
+				return nil, errors.New("passkeytest: credential already registered")
+			}
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	cred := &Credential{
+		ID:         id,
+		RPID:       rpID,
+		UserHandle: options.User.ID,
+		Key:        key,
+	}
+
+	ecKey, err := key.PublicKey.ECDH()
+	if err != nil {
+		return nil, err
+	}
+	point := ecKey.Bytes()
+	coseKey, err := cbor.Encode(map[int]any{
+		1:  2,                 // kty: EC2
+		3:  auth.COSEAlgES256, // alg
+		-1: 1,                 // crv: P-256
+		-2: point[1:33],
+		-3: point[33:],
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var attested bytes.Buffer
+	attested.Write(make([]byte, 16)) // AAGUID
+	binary.Write(&attested, binary.BigEndian, uint16(len(id)))
+	attested.Write(id)
+	attested.Write(coseKey)
+	authData := a.authData(rpID, 0x40, 0, attested.Bytes())
+
+	attestation, err := cbor.Encode(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": authData,
+	})
+	if err != nil {
+		return nil, err
+	}
+	clientData, err := a.clientData("webauthn.create", options.Challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	a.credentials = append(a.credentials, cred)
+	return &auth.PublicKeyCredential{
+		ID:    base64.RawURLEncoding.EncodeToString(id),
+		RawID: id,
+		Type:  "public-key",
+		Response: auth.AuthenticatorResponse{
+			ClientDataJSON:    clientData,
+			AttestationObject: attestation,
+			Transports:        []string{"internal"},
+		},
+	}, nil
+}
+
+// Get performs navigator.credentials.get(). With an empty allow list it
+// uses the newest discoverable credential for the RP.
+func (a *Authenticator) Get(options *auth.PublicKeyCredentialRequestOptions) (*auth.PublicKeyCredential, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var cred *Credential
+	for i := len(a.credentials) - 1; i >= 0 && cred == nil; i-- {
+		c := a.credentials[i]
+		if c.RPID != options.RPID {
+			continue
+		}
+		if len(options.AllowCredentials) == 0 {
+			cred = c
+		}
+		for _, allowed := range options.AllowCredentials {
+			if bytes.Equal(allowed.ID, c.ID) {
+				cred = c
+			}
+		}
+	}
+	if cred == nil {
+		return nil, errors.New("passkeytest: no matching credential")
+	}
+
+	cred.SignCount++
+	authData := a.authData(cred.RPID, 0, cred.SignCount, nil)
+	clientData, err := a.clientData("webauthn.get", options.Challenge)
+	if err != nil {
+		return nil, err
+	}
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, cred.Key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &auth.PublicKeyCredential{
+		ID:    base64.RawURLEncoding.EncodeToString(cred.ID),
+		RawID: cred.ID,
+		Type:  "public-key",
+		Response: auth.AuthenticatorResponse{
+			ClientDataJSON:    clientData,
+			AuthenticatorData: authData,
+			Signature:         signature,
+			UserHandle:        cred.UserHandle,
+		},
+	}, nil
+}
+
+func (a *Authenticator) authData(rpID string, flags byte, count uint32, attested []byte) []byte {
+	flags |= 0x01 // UP
+	if a.UserVerified {
+		flags |= 0x04
+	}
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	var buf bytes.Buffer
+	buf.Write(rpIDHash[:])
+	buf.WriteByte(flags)
+	binary.Write(&buf, binary.BigEndian, count)
+	buf.Write(attested)
+	return buf.Bytes()
+}
+
+func (a *Authenticator) clientData(typ string, challenge []byte) ([]byte, error) {
+	return json.Marshal(map[string]any{
+		"type":        typ,
+		"challenge":   base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":      a.Origin,
+		"crossOrigin": false,
+	})
+}
@@ -0,0 +1,436 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gchalakovmmi/PulpuWEB/db"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/markbates/goth"
+	"golang.org/x/crypto/argon2"
+)
+
+var (
+	ErrInvalidCredentials = errors.New("invalid email or password")
+	ErrEmailNotVerified   = errors.New("email address not verified")
+	ErrAccountExists      = errors.New("account already exists")
+	ErrWeakPassword       = errors.New("password does not meet policy")
+)
+
+// PasswordPolicy describes what a new password must look like. Lengths are
+// counted in characters, not bytes.
+type PasswordPolicy struct {
+	MinLength     int
+	MaxLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+}
+
+var DefaultPasswordPolicy = PasswordPolicy{
+	MinLength: 10,
+	MaxLength: 128,
+}
+
+func (p PasswordPolicy) Validate(password string) error {
+	n := utf8.RuneCountInString(password)
+	if p.MinLength > 0 && n < p.MinLength {
+		return fmt.Errorf("%w: must be at least %d characters", ErrWeakPassword, p.MinLength)
+	}
+	if p.MaxLength > 0 && n > p.MaxLength {
+		return fmt.Errorf("%w: must be at most %d characters", ErrWeakPassword, p.MaxLength)
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			symbol = true
+		}
+	}
+	switch {
+	case p.RequireUpper && !upper:
+		return fmt.Errorf("%w: must contain an uppercase letter", ErrWeakPassword)
+	case p.RequireLower && !lower:
+		return fmt.Errorf("%w: must contain a lowercase letter", ErrWeakPassword)
+	case p.RequireDigit && !digit:
+		return fmt.Errorf("%w: must contain a digit", ErrWeakPassword)
+	case p.RequireSymbol && !symbol:
+		return fmt.Errorf("%w: must contain a symbol", ErrWeakPassword)
+	}
+	return nil
+}
+
+// Argon2Params are the argon2id cost parameters. Memory is in KiB.
+type Argon2Params struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	SaltLen uint32
+	KeyLen  uint32
+}
+
+var DefaultArgon2Params = Argon2Params{
+	Time:    1,
+	Memory:  64 * 1024,
+	Threads: 4,
+	SaltLen: 16,
+	KeyLen:  32,
+}
+
+// HashPassword returns an argon2id hash in the PHC string format
+// ($argon2id$v=19$m=...,t=...,p=...$salt$key), which carries its own
+// parameters so they can be raised later without breaking old hashes.
+func HashPassword(password string, params Argon2Params) (string, error) {
+	salt := make([]byte, params.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, params.Memory, params.Time, params.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func VerifyPassword(password, encoded string) (bool, error) {
+	params, salt, key, err := decodeHash(encoded)
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLen)
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func decodeHash(encoded string) (Argon2Params, []byte, []byte, error) {
+	var params Argon2Params
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, errors.New("invalid password hash format")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return params, nil, nil, errors.New("invalid password hash version")
+	}
+	if version != argon2.Version {
+		return params, nil, nil, errors.New("unsupported argon2 version")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return params, nil, nil, errors.New("invalid password hash parameters")
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	params.SaltLen = uint32(len(salt))
+	params.KeyLen = uint32(len(key))
+	return params, salt, key, nil
+}
+
+type Account struct {
+	ID            int64
+	Email         string
+	Name          string
+	EmailVerified bool
+	CreatedAt     time.Time
+}
+
+// User is the goth.User stored in the session, so handlers behind
+// WithGoogleAuth see password logins the same way as Google logins.
+func (a *Account) User() goth.User {
+	return goth.User{
+		Provider: "password",
+		UserID:   strconv.FormatInt(a.ID, 10),
+		Email:    a.Email,
+		Name:     a.Name,
+	}
+}
+
+type PasswordConfig struct {
+	Policy               PasswordPolicy
+	Argon2               Argon2Params
+	VerificationTTL      time.Duration
+	ResetTTL             time.Duration
+	RequireVerifiedEmail bool
+}
+
+// PasswordAuth manages email/password accounts in Postgres. Sessions are
+// issued through the GoogleAuth session cookie.
+type PasswordAuth struct {
+	ga     *GoogleAuth
+	db     db.Querier
+	config *PasswordConfig
+	// dummyHash is verified against for unknown emails so that a login
+	// attempt takes the same time whether or not the account exists.
+	dummyHash string
+}
+
+func NewPasswordAuth(ga *GoogleAuth, q db.Querier, config *PasswordConfig) (*PasswordAuth, error) {
+	if config == nil {
+		config = &PasswordConfig{}
+	}
+	if config.Policy == (PasswordPolicy{}) {
+		config.Policy = DefaultPasswordPolicy
+	}
+	if config.Argon2 == (Argon2Params{}) {
+		config.Argon2 = DefaultArgon2Params
+	}
+	if config.VerificationTTL == 0 {
+		config.VerificationTTL = 48 * time.Hour
+	}
+	if config.ResetTTL == 0 {
+		config.ResetTTL = time.Hour
+	}
+
+	dummy, err := HashPassword("dummy password", config.Argon2)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PasswordAuth{
+		ga:        ga,
+		db:        q,
+		config:    config,
+		dummyHash: dummy,
+	}, nil
+}
+
+const accountsSchema = `
+CREATE TABLE IF NOT EXISTS auth_accounts (
+	id             BIGSERIAL PRIMARY KEY,
+	email          TEXT NOT NULL UNIQUE,
+	name           TEXT NOT NULL DEFAULT '',
+	password_hash  TEXT NOT NULL,
+	email_verified BOOLEAN NOT NULL DEFAULT FALSE,
+	created_at     TIMESTAMPTZ NOT NULL DEFAULT now(),
+	updated_at     TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+`
+
+// Migrate creates the tables used by PasswordAuth if they don't exist.
+func (pa *PasswordAuth) Migrate(ctx context.Context) error {
+	if _, err := pa.db.Exec(ctx, accountsSchema); err != nil {
+		return err
+	}
+	_, err := pa.db.Exec(ctx, tokensSchema)
+	return err
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// Register creates an unverified account and returns it together with an
+// email verification token. Delivering the token is up to the caller.
+func (pa *PasswordAuth) Register(ctx context.Context, email, name, password string) (*Account, string, error) {
+	email = normalizeEmail(email)
+	if !strings.Contains(email, "@") {
+		return nil, "", errors.New("invalid email address")
+	}
+	if err := pa.config.Policy.Validate(password); err != nil {
+		return nil, "", err
+	}
+
+	hash, err := HashPassword(password, pa.config.Argon2)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// The account and its verification token are created together, so a
+	// failed token can't leave an account that never gets a mail.
+	account := Account{Email: email, Name: name}
+	var token string
+	err = inTx(ctx, pa.db, func(q db.Querier) error {
+		err := q.QueryRow(ctx,
+			`INSERT INTO auth_accounts (email, name, password_hash) VALUES ($1, $2, $3)
+			 RETURNING id, created_at`,
+			email, name, hash).Scan(&account.ID, &account.CreatedAt)
+		if err != nil {
+			return err
+		}
+		token, err = issueToken(ctx, q, tokenVerifyEmail, email, pa.config.VerificationTTL)
+		return err
+	})
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return nil, "", ErrAccountExists
+		}
+		return nil, "", err
+	}
+	return &account, token, nil
+}
+
+// ResendVerification issues a fresh verification token, revoking older ones.
+func (pa *PasswordAuth) ResendVerification(ctx context.Context, email string) (string, error) {
+	account, _, err := pa.account(ctx, email)
+	if err != nil {
+		return "", err
+	}
+	if account.EmailVerified {
+		return "", errors.New("email address already verified")
+	}
+	if err := revokeTokens(ctx, pa.db, tokenVerifyEmail, account.Email); err != nil {
+		return "", err
+	}
+	return issueToken(ctx, pa.db, tokenVerifyEmail, account.Email, pa.config.VerificationTTL)
+}
+
+func (pa *PasswordAuth) VerifyEmail(ctx context.Context, token string) error {
+	email, err := consumeToken(ctx, pa.db, tokenVerifyEmail, token)
+	if err != nil {
+		return err
+	}
+	_, err = pa.db.Exec(ctx,
+		`UPDATE auth_accounts SET email_verified = TRUE, updated_at = now() WHERE email = $1`, email)
+	return err
+}
+
+// Login checks the credentials and, on success, stores the same session
+// cookie that StoreSession produces.
+func (pa *PasswordAuth) Login(w http.ResponseWriter, r *http.Request, email, password string) (*Account, error) {
+	account, err := pa.login(w, r, email, password)
+	if err != nil {
+		pa.ga.loginFailed(r, "password", normalizeEmail(email), err)
+		return nil, err
+	}
+	pa.ga.loggedIn(r, account.User())
+	return account, nil
+}
+
+func (pa *PasswordAuth) login(w http.ResponseWriter, r *http.Request, email, password string) (*Account, error) {
+	ctx := r.Context()
+	account, hash, err := pa.account(ctx, email)
+	if errors.Is(err, ErrInvalidCredentials) {
+		VerifyPassword(password, pa.dummyHash)
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := VerifyPassword(password, hash)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+	if pa.config.RequireVerifiedEmail && !account.EmailVerified {
+		return nil, ErrEmailNotVerified
+	}
+
+	// Upgrade hashes made with older parameters while we have the password.
+	if params, _, _, err := decodeHash(hash); err == nil && params != pa.config.Argon2 {
+		if err := pa.setPassword(ctx, account.Email, password); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := pa.ga.StoreSession(w, account.User()); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// RequestPasswordReset returns a reset token for the account. For unknown
+// emails it returns ErrInvalidCredentials; handlers should not reveal that
+// to the client.
+func (pa *PasswordAuth) RequestPasswordReset(ctx context.Context, email string) (string, error) {
+	account, _, err := pa.account(ctx, email)
+	if err != nil {
+		return "", err
+	}
+	return issueToken(ctx, pa.db, tokenResetPassword, account.Email, pa.config.ResetTTL)
+}
+
+// ResetPassword sets a new password using a reset token. Completing a reset
+// also proves ownership of the address, so the email is marked verified.
+func (pa *PasswordAuth) ResetPassword(ctx context.Context, token, password string) error {
+	if err := pa.config.Policy.Validate(password); err != nil {
+		return err
+	}
+	email, err := consumeToken(ctx, pa.db, tokenResetPassword, token)
+	if err != nil {
+		return err
+	}
+	if err := pa.setPassword(ctx, email, password); err != nil {
+		return err
+	}
+	if _, err := pa.db.Exec(ctx,
+		`UPDATE auth_accounts SET email_verified = TRUE WHERE email = $1`, email); err != nil {
+		return err
+	}
+	return revokeTokens(ctx, pa.db, tokenResetPassword, email)
+}
+
+func (pa *PasswordAuth) ChangePassword(ctx context.Context, email, oldPassword, newPassword string) error {
+	_, hash, err := pa.account(ctx, email)
+	if err != nil {
+		return err
+	}
+	ok, err := VerifyPassword(oldPassword, hash)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidCredentials
+	}
+	if err := pa.config.Policy.Validate(newPassword); err != nil {
+		return err
+	}
+	return pa.setPassword(ctx, normalizeEmail(email), newPassword)
+}
+
+func (pa *PasswordAuth) setPassword(ctx context.Context, email, password string) error {
+	hash, err := HashPassword(password, pa.config.Argon2)
+	if err != nil {
+		return err
+	}
+	_, err = pa.db.Exec(ctx,
+		`UPDATE auth_accounts SET password_hash = $2, updated_at = now() WHERE email = $1`,
+		email, hash)
+	return err
+}
+
+func (pa *PasswordAuth) account(ctx context.Context, email string) (*Account, string, error) {
+	var account Account
+	var hash string
+	err := pa.db.QueryRow(ctx,
+		`SELECT id, email, name, email_verified, created_at, password_hash
+		 FROM auth_accounts WHERE email = $1`,
+		normalizeEmail(email)).Scan(&account.ID, &account.Email, &account.Name,
+		&account.EmailVerified, &account.CreatedAt, &hash)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, "", ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return &account, hash, nil
+}
@@ -0,0 +1,271 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+)
+
+type CapturedMessage struct {
+	From       string
+	To         []string
+	Subject    string
+	Body       string
+	Raw        []byte
+	ReceivedAt time.Time
+}
+
+// CaptureServer is a minimal SMTP server that accepts every message and
+// keeps it in memory instead of delivering it. Point an SMTPMailer at it in
+// development, or use it in tests to read the links that were sent. It also
+// implements http.Handler to list the captured messages.
+type CaptureServer struct {
+	listener net.Listener
+	mu       sync.Mutex
+	messages []CapturedMessage
+	notify   chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewCaptureServer listens on addr, e.g. "127.0.0.1:2525" or "127.0.0.1:0"
+// for a random port.
+func NewCaptureServer(addr string) (*CaptureServer, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &CaptureServer{
+		listener: l,
+		notify:   make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+func (s *CaptureServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// SMTPConfig returns a config that sends through this server.
+func (s *CaptureServer) SMTPConfig(from string) *SMTPConfig {
+	addr := s.listener.Addr().(*net.TCPAddr)
+	return &SMTPConfig{
+		Host: addr.IP.String(),
+		Port: addr.Port,
+		From: from,
+	}
+}
+
+func (s *CaptureServer) Messages() []CapturedMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]CapturedMessage(nil), s.messages...)
+}
+
+// Last returns the most recent message sent to the address.
+func (s *CaptureServer) Last(to string) (CapturedMessage, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.messages) - 1; i >= 0; i-- {
+		for _, rcpt := range s.messages[i].To {
+			if strings.EqualFold(rcpt, to) {
+				return s.messages[i], true
+			}
+		}
+	}
+	return CapturedMessage{}, false
+}
+
+// Wait blocks until at least n messages have been captured.
+func (s *CaptureServer) Wait(ctx context.Context, n int) error {
+	for {
+		s.mu.Lock()
+		count, notify := len(s.messages), s.notify
+		s.mu.Unlock()
+		if count >= n {
+			return nil
+		}
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *CaptureServer) Reset() {
+	s.mu.Lock()
+	s.messages = nil
+	s.mu.Unlock()
+}
+
+func (s *CaptureServer) Close() error {
+	err := s.listener.Close()
+	s.wg.Wait()
+	return err
+}
+
+func (s *CaptureServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for i, msg := range s.Messages() {
+		fmt.Fprintf(w, "#%d %s\nFrom: %s\nTo: %s\nSubject: %s\n\n%s\n\n",
+			i+1, msg.ReceivedAt.Format(time.RFC3339), msg.From,
+			strings.Join(msg.To, ", "), msg.Subject, msg.Body)
+	}
+}
+
+func (s *CaptureServer) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+		}()
+	}
+}
+
+func (s *CaptureServer) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) {
+		conn.SetWriteDeadline(time.Now().Add(time.Minute))
+		io.WriteString(conn, line+"\r\n")
+	}
+
+	var from string
+	var to []string
+	reply("220 localhost PulpuWEB capture server")
+	for {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb, arg, _ := strings.Cut(line, " ")
+
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			reply("250-localhost")
+			reply("250-8BITMIME")
+			reply("250 AUTH PLAIN LOGIN")
+		case "HELO":
+			reply("250 localhost")
+		case "AUTH":
+			// Any credentials are accepted; answer continuation prompts too.
+			fields := strings.Fields(arg)
+			prompts := 0
+			switch {
+			case len(fields) == 1 && strings.EqualFold(fields[0], "PLAIN"):
+				prompts = 1
+			case len(fields) >= 1 && strings.EqualFold(fields[0], "LOGIN"):
+				prompts = 2 - (len(fields) - 1)
+			}
+			for ; prompts > 0; prompts-- {
+				reply("334 ")
+				if _, err := r.ReadString('\n'); err != nil {
+					return
+				}
+			}
+			reply("235 Authentication successful")
+		case "MAIL":
+			from = trimPath(arg)
+			to = nil
+			reply("250 OK")
+		case "RCPT":
+			to = append(to, trimPath(arg))
+			reply("250 OK")
+		case "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			data, err := readData(r)
+			if err != nil {
+				return
+			}
+			s.store(from, to, data)
+			from, to = "", nil
+			reply("250 OK")
+		case "RSET":
+			from, to = "", nil
+			reply("250 OK")
+		case "NOOP":
+			reply("250 OK")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+// trimPath extracts the address from "FROM:<a@b>" or "TO:<a@b> SIZE=...".
+func trimPath(arg string) string {
+	_, addr, _ := strings.Cut(arg, ":")
+	addr = strings.TrimSpace(addr)
+	if i := strings.IndexByte(addr, '>'); i >= 0 {
+		addr = addr[:i]
+	}
+	return strings.TrimPrefix(addr, "<")
+}
+
+func readData(r *bufio.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		if line == ".\r\n" || line == ".\n" {
+			return buf.Bytes(), nil
+		}
+		// Undo dot-stuffing.
+		if strings.HasPrefix(line, "..") {
+			line = line[1:]
+		}
+		buf.WriteString(line)
+	}
+}
+
+func (s *CaptureServer) store(from string, to []string, raw []byte) {
+	msg := CapturedMessage{
+		From:       from,
+		To:         to,
+		Raw:        raw,
+		ReceivedAt: time.Now(),
+	}
+	if parsed, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		dec := new(mime.WordDecoder)
+		if subject, err := dec.DecodeHeader(parsed.Header.Get("Subject")); err == nil {
+			msg.Subject = subject
+		}
+		var body io.Reader = parsed.Body
+		if strings.EqualFold(parsed.Header.Get("Content-Transfer-Encoding"), "quoted-printable") {
+			body = quotedprintable.NewReader(body)
+		}
+		if b, err := io.ReadAll(body); err == nil {
+			msg.Body = strings.ReplaceAll(string(b), "\r\n", "\n")
+		}
+	}
+
+	s.mu.Lock()
+	s.messages = append(s.messages, msg)
+	close(s.notify)
+	s.notify = make(chan struct{})
+	s.mu.Unlock()
+}
@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"github.com/gchalakovmmi/PulpuWEB/db"
+	"github.com/jackc/pgx/v5"
+)
+
+// Token purposes stored in auth_tokens.
+const (
+	tokenVerifyEmail   = "verify_email"
+	tokenResetPassword = "reset_password"
+)
+
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+const tokensSchema = `
+CREATE TABLE IF NOT EXISTS auth_tokens (
+	token_hash BYTEA PRIMARY KEY,
+	purpose    TEXT NOT NULL,
+	email      TEXT NOT NULL,
+	expires_at TIMESTAMPTZ NOT NULL,
+	used_at    TIMESTAMPTZ,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS auth_tokens_email_idx ON auth_tokens (email, purpose, created_at);
+`
+
+// Only the SHA-256 of a token is stored, so a leaked table can't be replayed.
+func hashToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func issueToken(ctx context.Context, q db.Querier, purpose, email string, ttl time.Duration) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	_, err = q.Exec(ctx,
+		`INSERT INTO auth_tokens (token_hash, purpose, email, expires_at) VALUES ($1, $2, $3, $4)`,
+		hashToken(token), purpose, email, time.Now().Add(ttl))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// consumeToken marks a token used and returns the email it was issued for.
+// The single UPDATE makes concurrent consumption of the same token safe.
+func consumeToken(ctx context.Context, q db.Querier, purpose, token string) (string, error) {
+	var email string
+	err := q.QueryRow(ctx,
+		`UPDATE auth_tokens SET used_at = now()
+		 WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > now()
+		 RETURNING email`,
+		hashToken(token), purpose).Scan(&email)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrInvalidToken
+	}
+	if err != nil {
+		return "", err
+	}
+	return email, nil
+}
+
+func revokeTokens(ctx context.Context, q db.Querier, purpose, email string) error {
+	_, err := q.Exec(ctx,
+		`UPDATE auth_tokens SET used_at = now() WHERE email = $1 AND purpose = $2 AND used_at IS NULL`,
+		email, purpose)
+	return err
+}
+
+// inTx runs fn in a transaction when q can start one, as pools, connections
+// and transactions can, and directly on q otherwise.
+func inTx(ctx context.Context, q db.Querier, fn func(q db.Querier) error) error {
+	beginner, ok := q.(interface {
+		Begin(ctx context.Context) (pgx.Tx, error)
+	})
+	if !ok {
+		return fn(q)
+	}
+	return pgx.BeginFunc(ctx, beginner, func(tx pgx.Tx) error {
+		return fn(tx)
+	})
+}
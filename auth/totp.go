@@ -0,0 +1,502 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gchalakovmmi/PulpuWEB/db"
+	"github.com/jackc/pgx/v5"
+	"github.com/markbates/goth"
+)
+
+// TOTP parameters from RFC 6238 that every authenticator app supports.
+const (
+	totpPeriod = 30
+	totpDigits = 6
+)
+
+var (
+	ErrInvalidCode   = errors.New("invalid verification code")
+	ErrMFANotEnabled = errors.New("two-factor authentication not enabled")
+	ErrMFALocked     = errors.New("too many failed verification attempts")
+
+	ErrMFAAlreadyEnabled  = errors.New("two-factor authentication already enabled")
+	ErrMFAReenrollPending = errors.New("verify the current code before re-enrolling")
+)
+
+var base32NoPad = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret returns a random 160-bit secret, base32 encoded as
+// authenticator apps expect.
+func GenerateTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base32NoPad.EncodeToString(b), nil
+}
+
+func TOTPCode(secret string, t time.Time) (string, error) {
+	return totpAt(secret, uint64(t.Unix())/totpPeriod)
+}
+
+func totpAt(secret string, step uint64) (string, error) {
+	key, err := base32NoPad.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return "", errors.New("invalid TOTP secret")
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], step)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation, RFC 4226 section 5.3.
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, code%1000000), nil
+}
+
+// validateTOTP returns the time step the code matched, allowing skew steps
+// of clock drift either way.
+func validateTOTP(secret, code string, t time.Time, skew int) (uint64, bool) {
+	code = strings.ReplaceAll(code, " ", "")
+	now := uint64(t.Unix()) / totpPeriod
+	for i := -skew; i <= skew; i++ {
+		step := now + uint64(i)
+		expected, err := totpAt(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// TOTPProvisioningURI returns the otpauth:// URI to render as a QR code for
+// authenticator apps.
+func TOTPProvisioningURI(issuer, account, secret string) string {
+	label := url.PathEscape(issuer + ":" + account)
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+	// Some authenticator apps show "+" literally, so spaces use %20.
+	return "otpauth://totp/" + label + "?" + strings.ReplaceAll(query.Encode(), "+", "%20")
+}
+
+type TOTPConfig struct {
+	Issuer string
+	// Skew is the number of 30 second steps accepted either side of now.
+	Skew          int
+	RecoveryCodes int
+	// MaxAttempts failed codes lock verification for LockoutDuration.
+	MaxAttempts     int
+	LockoutDuration time.Duration
+	// Where RequireMFA sends users: the login page when there is no
+	// session, the code prompt when a code is owed, and the enrollment page
+	// when MFA is enforced but not set up yet.
+	LoginURL  string
+	VerifyURL string
+	EnrollURL string
+}
+
+// TOTPAuth adds an optional TOTP second factor on top of any login method.
+// Register it with GoogleAuth.UseMFA so new sessions start as pending.
+type TOTPAuth struct {
+	ga     *GoogleAuth
+	db     db.Querier
+	config *TOTPConfig
+}
+
+func NewTOTPAuth(ga *GoogleAuth, q db.Querier, config *TOTPConfig) *TOTPAuth {
+	if config.Issuer == "" {
+		config.Issuer = "PulpuWEB"
+	}
+	if config.Skew == 0 {
+		config.Skew = 1
+	}
+	if config.RecoveryCodes == 0 {
+		config.RecoveryCodes = 10
+	}
+	if config.MaxAttempts == 0 {
+		config.MaxAttempts = 5
+	}
+	if config.LockoutDuration == 0 {
+		config.LockoutDuration = 5 * time.Minute
+	}
+	if config.LoginURL == "" {
+		config.LoginURL = "/auth/google"
+	}
+	if config.VerifyURL == "" {
+		config.VerifyURL = "/auth/mfa"
+	}
+	if config.EnrollURL == "" {
+		config.EnrollURL = "/auth/mfa/enroll"
+	}
+
+	return &TOTPAuth{
+		ga:     ga,
+		db:     q,
+		config: config,
+	}
+}
+
+const mfaSchema = `
+CREATE TABLE IF NOT EXISTS auth_mfa (
+	user_key        TEXT PRIMARY KEY,
+	secret          TEXT NOT NULL DEFAULT '',
+	pending_secret  TEXT NOT NULL DEFAULT '',
+	enabled         BOOLEAN NOT NULL DEFAULT FALSE,
+	enforced        BOOLEAN NOT NULL DEFAULT FALSE,
+	last_step       BIGINT NOT NULL DEFAULT 0,
+	failed_attempts INT NOT NULL DEFAULT 0,
+	locked_until    TIMESTAMPTZ,
+	updated_at      TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+ALTER TABLE auth_mfa ADD COLUMN IF NOT EXISTS pending_secret TEXT NOT NULL DEFAULT '';
+CREATE TABLE IF NOT EXISTS auth_recovery_codes (
+	user_key  TEXT NOT NULL,
+	code_hash BYTEA NOT NULL,
+	used_at   TIMESTAMPTZ,
+	PRIMARY KEY (user_key, code_hash)
+);
+`
+
+func (t *TOTPAuth) Migrate(ctx context.Context) error {
+	_, err := t.db.Exec(ctx, mfaSchema)
+	return err
+}
+
+// UserKey identifies a user across login methods that share a provider
+// namespace, e.g. "google:1234" or "password:7".
+func UserKey(user goth.User) string {
+	return user.Provider + ":" + user.UserID
+}
+
+type MFAStatus struct {
+	Enabled  bool
+	Enforced bool
+}
+
+func (t *TOTPAuth) Status(ctx context.Context, user goth.User) (MFAStatus, error) {
+	var status MFAStatus
+	err := t.db.QueryRow(ctx,
+		`SELECT enabled, enforced FROM auth_mfa WHERE user_key = $1`,
+		UserKey(user)).Scan(&status.Enabled, &status.Enforced)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return MFAStatus{}, nil
+	}
+	return status, err
+}
+
+func (t *TOTPAuth) required(ctx context.Context, user goth.User) (bool, error) {
+	status, err := t.Status(ctx, user)
+	if err != nil {
+		return false, err
+	}
+	return status.Enabled || status.Enforced, nil
+}
+
+// SetEnforced makes MFA mandatory (or optional again) for a user. Enforced
+// users without TOTP are sent to the enrollment page by RequireMFA.
+func (t *TOTPAuth) SetEnforced(ctx context.Context, userKey string, enforced bool) error {
+	_, err := t.db.Exec(ctx,
+		`INSERT INTO auth_mfa (user_key, enforced) VALUES ($1, $2)
+		 ON CONFLICT (user_key) DO UPDATE SET enforced = $2, updated_at = now()`,
+		userKey, enforced)
+	return err
+}
+
+// BeginEnrollment creates a new secret for the logged in user and returns
+// it together with its provisioning URI. The secret stays pending until
+// ConfirmEnrollment sees a valid code; until then an existing secret keeps
+// working, so an abandoned rotation doesn't disable MFA.
+func (t *TOTPAuth) BeginEnrollment(r *http.Request) (secret, uri string, err error) {
+	session, err := t.ga.GetSession(r)
+	if err != nil {
+		return "", "", err
+	}
+	status, err := t.Status(r.Context(), session.User)
+	if err != nil {
+		return "", "", err
+	}
+	// Rotating an active secret needs a verified session, otherwise a
+	// pending session could replace the factor it is supposed to prove.
+	if status.Enabled && session.MFAPending {
+		return "", "", ErrMFAReenrollPending
+	}
+
+	secret, err = GenerateTOTPSecret()
+	if err != nil {
+		return "", "", err
+	}
+	_, err = t.db.Exec(r.Context(),
+		`INSERT INTO auth_mfa (user_key, pending_secret) VALUES ($1, $2)
+		 ON CONFLICT (user_key) DO UPDATE SET pending_secret = $2, updated_at = now()`,
+		UserKey(session.User), secret)
+	if err != nil {
+		return "", "", err
+	}
+
+	account := session.User.Email
+	if account == "" {
+		account = session.User.UserID
+	}
+	return secret, TOTPProvisioningURI(t.config.Issuer, account, secret), nil
+}
+
+// ConfirmEnrollment activates the pending secret once the user proves
+// their app works, replacing any previous one, clears a pending session
+// and returns fresh recovery codes. The codes are only shown once; just
+// their hashes are stored. Codes go through the same lockout as Verify.
+func (t *TOTPAuth) ConfirmEnrollment(w http.ResponseWriter, r *http.Request, code string) ([]string, error) {
+	session, err := t.ga.GetSession(r)
+	if err != nil {
+		return nil, err
+	}
+	ctx := r.Context()
+	key := UserKey(session.User)
+
+	var pending string
+	var enabled bool
+	var lockedUntil *time.Time
+	err = t.db.QueryRow(ctx,
+		`SELECT pending_secret, enabled, locked_until FROM auth_mfa WHERE user_key = $1`,
+		key).Scan(&pending, &enabled, &lockedUntil)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrMFANotEnabled
+	}
+	if err != nil {
+		return nil, err
+	}
+	if pending == "" {
+		// Confirming again would hand out new recovery codes for a factor
+		// the session never proved.
+		if enabled {
+			return nil, ErrMFAAlreadyEnabled
+		}
+		return nil, ErrMFANotEnabled
+	}
+	if enabled && session.MFAPending {
+		return nil, ErrMFAReenrollPending
+	}
+
+	if err := t.confirmSecret(ctx, key, pending, lockedUntil, code); err != nil {
+		t.ga.loginFailed(r, "totp", session.User.Email, err)
+		return nil, err
+	}
+
+	codes, err := t.RegenerateRecoveryCodes(ctx, session.User)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.markVerified(w, session); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func (t *TOTPAuth) Disable(ctx context.Context, user goth.User) error {
+	key := UserKey(user)
+	if _, err := t.db.Exec(ctx,
+		`UPDATE auth_mfa SET secret = '', pending_secret = '', enabled = FALSE, last_step = 0, updated_at = now()
+		 WHERE user_key = $1`, key); err != nil {
+		return err
+	}
+	_, err := t.db.Exec(ctx, `DELETE FROM auth_recovery_codes WHERE user_key = $1`, key)
+	return err
+}
+
+func (t *TOTPAuth) RegenerateRecoveryCodes(ctx context.Context, user goth.User) ([]string, error) {
+	key := UserKey(user)
+	if _, err := t.db.Exec(ctx, `DELETE FROM auth_recovery_codes WHERE user_key = $1`, key); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, t.config.RecoveryCodes)
+	for i := range codes {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32NoPad.EncodeToString(b))
+		codes[i] = code[:8] + "-" + code[8:]
+		if _, err := t.db.Exec(ctx,
+			`INSERT INTO auth_recovery_codes (user_key, code_hash) VALUES ($1, $2)`,
+			key, hashToken(codes[i])); err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// Verify checks a TOTP or recovery code for the current session and, if it
+// is valid, re-issues the session as fully verified. Codes are single use:
+// a TOTP step that was already accepted is rejected.
+func (t *TOTPAuth) Verify(w http.ResponseWriter, r *http.Request, code string) error {
+	if err := t.verify(w, r, code); err != nil {
+		var email string
+		if session, err := t.ga.readSession(r); err == nil {
+			email = session.User.Email
+		}
+		t.ga.loginFailed(r, "totp", email, err)
+		return err
+	}
+	return nil
+}
+
+func (t *TOTPAuth) verify(w http.ResponseWriter, r *http.Request, code string) error {
+	session, err := t.ga.GetSession(r)
+	if err != nil {
+		return err
+	}
+	ctx := r.Context()
+	key := UserKey(session.User)
+
+	var secret string
+	var enabled bool
+	var lockedUntil *time.Time
+	err = t.db.QueryRow(ctx,
+		`SELECT secret, enabled, locked_until FROM auth_mfa WHERE user_key = $1`,
+		key).Scan(&secret, &enabled, &lockedUntil)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && !enabled) {
+		return ErrMFANotEnabled
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := t.checkCode(ctx, key, secret, lockedUntil, code); err != nil {
+		return err
+	}
+	return t.markVerified(w, session)
+}
+
+// checkCode accepts a TOTP code or a recovery code for key. A TOTP step
+// that was already accepted is rejected, and MaxAttempts failures lock the
+// user out for LockoutDuration.
+func (t *TOTPAuth) checkCode(ctx context.Context, key, secret string, lockedUntil *time.Time, code string) error {
+	if lockedUntil != nil && time.Now().Before(*lockedUntil) {
+		return ErrMFALocked
+	}
+
+	if step, ok := validateTOTP(secret, code, time.Now(), t.config.Skew); ok {
+		tag, err := t.db.Exec(ctx,
+			`UPDATE auth_mfa SET last_step = $2, failed_attempts = 0, locked_until = NULL
+			 WHERE user_key = $1 AND last_step < $2`, key, int64(step))
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 1 {
+			return nil
+		}
+	} else {
+		tag, err := t.db.Exec(ctx,
+			`UPDATE auth_recovery_codes SET used_at = now()
+			 WHERE user_key = $1 AND code_hash = $2 AND used_at IS NULL`,
+			key, hashToken(strings.ToLower(strings.TrimSpace(code))))
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 1 {
+			_, err := t.db.Exec(ctx,
+				`UPDATE auth_mfa SET failed_attempts = 0, locked_until = NULL WHERE user_key = $1`, key)
+			return err
+		}
+	}
+
+	return t.codeFailed(ctx, key)
+}
+
+// confirmSecret swaps in the pending secret when code matches it. The
+// UPDATE only applies if the pending secret wasn't replaced meanwhile.
+func (t *TOTPAuth) confirmSecret(ctx context.Context, key, pending string, lockedUntil *time.Time, code string) error {
+	if lockedUntil != nil && time.Now().Before(*lockedUntil) {
+		return ErrMFALocked
+	}
+	if step, ok := validateTOTP(pending, code, time.Now(), t.config.Skew); ok {
+		tag, err := t.db.Exec(ctx,
+			`UPDATE auth_mfa SET secret = pending_secret, pending_secret = '', enabled = TRUE, last_step = $3,
+			 failed_attempts = 0, locked_until = NULL, updated_at = now()
+			 WHERE user_key = $1 AND pending_secret = $2`, key, pending, int64(step))
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 1 {
+			return nil
+		}
+	}
+	return t.codeFailed(ctx, key)
+}
+
+// codeFailed counts a wrong code and locks verification at MaxAttempts
+func (t *TOTPAuth) codeFailed(ctx context.Context, key string) error {
+	_, err := t.db.Exec(ctx,
+		`UPDATE auth_mfa SET failed_attempts = failed_attempts + 1,
+		 locked_until = CASE WHEN failed_attempts + 1 >= $2 THEN $3 ELSE locked_until END
+		 WHERE user_key = $1`,
+		key, t.config.MaxAttempts, time.Now().Add(t.config.LockoutDuration))
+	if err != nil {
+		return err
+	}
+	return ErrInvalidCode
+}
+
+func (t *TOTPAuth) markVerified(w http.ResponseWriter, session *Session) error {
+	if !session.MFAPending {
+		return nil
+	}
+	session.MFAPending = false
+	return t.ga.writeSession(w, session)
+}
+
+// RequireMFA only lets fully verified sessions through. Pending sessions
+// are sent to VerifyURL, or to EnrollURL when MFA is enforced but the user
+// has not set it up yet.
+func (t *TOTPAuth) RequireMFA(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, err := t.ga.GetSession(r)
+		if err != nil {
+			http.Redirect(w, r, t.config.LoginURL, http.StatusTemporaryRedirect)
+			return
+		}
+		if session.MFAPending {
+			t.redirectPending(w, r, session)
+			return
+		}
+		ctx := context.WithValue(r.Context(), "user_session", session)
+		handler(w, r.WithContext(ctx))
+	}
+}
+
+// redirectPending sends a session that owes a second factor to VerifyURL,
+// or to EnrollURL when MFA is enforced but not set up yet
+func (t *TOTPAuth) redirectPending(w http.ResponseWriter, r *http.Request, session *Session) {
+	target := t.config.VerifyURL
+	status, err := t.Status(r.Context(), session.User)
+	if err != nil {
+		http.Error(w, "MFA lookup failed", http.StatusInternalServerError)
+		return
+	}
+	if !status.Enabled {
+		target = t.config.EnrollURL
+	}
+	http.Redirect(w, r, target, http.StatusTemporaryRedirect)
+}
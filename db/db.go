@@ -6,6 +6,8 @@ import (
 	"context"
 	"net/http"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
 
 	"errors"
 	"os"
@@ -20,10 +22,36 @@ type ConnectionDetails struct {
 	Schema string
 }
 
+// Querier is the query surface shared by *pgx.Conn, *pgxpool.Pool and pgx.Tx.
+// Packages that keep state in Postgres accept a Querier so callers can pick
+// the connection strategy.
+type Querier interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+func (cd ConnectionDetails) URL() string {
+	return fmt.Sprintf("postgres://%s:%s@%s:%d/%s", cd.User, cd.Password, cd.ServerIP, cd.Port, cd.Schema)
+}
+
+// NewPool opens a connection pool, for long-lived stores that outlive a
+// single request.
+func NewPool(ctx context.Context, cd ConnectionDetails) (*pgxpool.Pool, error) {
+	pool, err := pgxpool.New(ctx, cd.URL())
+	if err != nil {
+		return nil, err
+	}
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return pool, nil
+}
+
 func WithDB(cd ConnectionDetails, handler func(w http.ResponseWriter, r *http.Request, conn *pgx.Conn)) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		url := fmt.Sprintf("postgres://%s:%s@%s:%d/%s", cd.User, cd.Password, cd.ServerIP, cd.Port, cd.Schema)
-		conn, err := pgx.Connect(context.Background(), url)
+		conn, err := pgx.Connect(context.Background(), cd.URL())
 		if err != nil {
 			log.Println(err)
 			http.Error(w, "Database error", http.StatusInternalServerError)
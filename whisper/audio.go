@@ -0,0 +1,106 @@
+package whisper
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// PCM is decoded audio. Samples are interleaved by channel and scaled to
+// [-1, 1].
+type PCM struct {
+    SampleRate int
+    Channels   int
+    Samples    []float32
+}
+
+// Frames returns the number of samples per channel
+func (p *PCM) Frames() int {
+    if p.Channels == 0 {
+        return 0
+    }
+    return len(p.Samples) / p.Channels
+}
+
+// Duration returns the length of the audio
+func (p *PCM) Duration() time.Duration {
+    if p.SampleRate == 0 {
+        return 0
+    }
+    return time.Duration(p.Frames()) * time.Second / time.Duration(p.SampleRate)
+}
+
+// Slice returns the frames in [start, end) sharing the underlying samples
+func (p *PCM) Slice(start, end int) *PCM {
+    start = max(0, min(start, p.Frames()))
+    end = max(start, min(end, p.Frames()))
+    return &PCM{
+        SampleRate: p.SampleRate,
+        Channels:   p.Channels,
+        Samples:    p.Samples[start*p.Channels : end*p.Channels],
+    }
+}
+
+// Decoder turns an encoded audio stream into PCM
+type Decoder func(r io.Reader) (*PCM, error)
+
+var (
+    decodersMu sync.RWMutex
+    decoders   = map[string]Decoder{
+        "wav": DecodeWAV,
+    }
+)
+
+// RegisterDecoder makes a decoder available for a format, named by its file
+// extension without the dot (e.g. "mp3"). It replaces any existing decoder,
+// so the built-in WAV decoder can be swapped for an external one.
+func RegisterDecoder(format string, decoder Decoder) {
+    decodersMu.Lock()
+    defer decodersMu.Unlock()
+    if decoder == nil {
+        panic("whisper: RegisterDecoder decoder is nil")
+    }
+    decoders[strings.ToLower(format)] = decoder
+}
+
+// decoderFor returns the decoder for the format sniffed from header, or
+// for the file name's extension when the content is not recognized
+func decoderFor(header []byte, fileName string) (Decoder, bool) {
+    format := SniffFormat(header)
+    if format == "" {
+        format = strings.ToLower(strings.TrimPrefix(filepath.Ext(fileName), "."))
+    }
+    decodersMu.RLock()
+    defer decodersMu.RUnlock()
+    decoder, ok := decoders[format]
+    return decoder, ok
+}
+
+// DecoderFormats returns the sorted formats that can be decoded
+func DecoderFormats() []string {
+    decodersMu.RLock()
+    defer decodersMu.RUnlock()
+    formats := make([]string, 0, len(decoders))
+    for format := range decoders {
+        formats = append(formats, format)
+    }
+    sort.Strings(formats)
+    return formats
+}
+
+// DecodeAudio decodes r with the decoder registered for its format, which
+// is sniffed from the content or else taken from fileName's extension
+func DecodeAudio(r io.Reader, fileName string) (*PCM, error) {
+    br := bufio.NewReader(r)
+    header, _ := br.Peek(sniffLen)
+    decoder, ok := decoderFor(header, fileName)
+    if !ok {
+        return nil, fmt.Errorf("no decoder for %q (supported: %v): %w", fileName, DecoderFormats(), ErrUnsupportedFormat)
+    }
+    return decoder(br)
+}
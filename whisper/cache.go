@@ -0,0 +1,403 @@
+package whisper
+
+import (
+    "bytes"
+    "cmp"
+    "container/list"
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/gchalakovmmi/PulpuWEB/db"
+    "github.com/jackc/pgx/v5"
+)
+
+// DefaultCacheTTL is how long cached transcripts are kept when
+// TranscribeService.CacheTTL is not set
+const DefaultCacheTTL = 30 * 24 * time.Hour
+
+// Cache stores transcripts by CacheKey. Get reports a miss for expired
+// entries; a ttl of 0 never expires.
+type Cache interface {
+    Get(ctx context.Context, key string) (*TranscribeResponse, bool, error)
+    Set(ctx context.Context, key string, resp *TranscribeResponse, ttl time.Duration) error
+}
+
+// CacheKey identifies a transcript by the SHA-256 of the audio and every
+// option that changes the result. settings describe how the service
+// processes the audio before sending it: its Normalize, VAD and Chunking.
+//
+// provider is the name of the service's backend. For a failover chain that
+// is the chain name, not the member that answered: the lookup happens before
+// a member is picked, and the members of a chain are meant to be
+// interchangeable, so a transcript from any of them serves the chain.
+func CacheKey(audioSum []byte, provider string, req *TranscribeRequest, settings ...string) string {
+    h := sha256.New()
+    h.Write(audioSum)
+    // Fields are length-prefixed so values cannot run into each other
+    for _, field := range append([]string{
+        provider, req.Model, req.Language, cmp.Or(req.Task, TaskTranscribe), req.OutputFormat,
+        req.prompt(), strconv.FormatFloat(req.Temperature, 'g', -1, 64),
+        strings.Join(req.TimestampGranularities, ","), strconv.FormatBool(req.ShouldEncode),
+    }, settings...) {
+        fmt.Fprintf(h, "%d:%s", len(field), field)
+    }
+    return hex.EncodeToString(h.Sum(nil))
+}
+
+// cacheSettings returns the Normalize, VAD and Chunking settings for
+// CacheKey, with defaults filled in so equal settings give equal keys
+func (ts *TranscribeService) cacheSettings() []string {
+    settings := []string{"normalize=" + cmp.Or(ts.Normalize, NormalizeAuto), "vad=off", "chunking=off"}
+    if ts.VAD != nil {
+        settings[1] = fmt.Sprintf("vad=%+v", ts.VAD.withDefaults())
+    }
+    if ts.Chunking != nil {
+        // Concurrency does not change the transcript
+        cfg := ts.Chunking.withDefaults()
+        settings[2] = fmt.Sprintf("chunking=%s/%s", cfg.MaxDuration, cfg.Overlap)
+    }
+    return settings
+}
+
+// hashAudio returns the SHA-256 of the request audio and a copy of the
+// request that can still be read. Seekable audio is rewound instead of
+// being held in memory.
+func hashAudio(req *TranscribeRequest) ([]byte, *TranscribeRequest, error) {
+    h := sha256.New()
+    hashed := *req
+    if seeker, ok := req.Audio.(io.ReadSeeker); ok {
+        start, err := seeker.Seek(0, io.SeekCurrent)
+        if err != nil {
+            return nil, nil, err
+        }
+        if _, err := io.Copy(h, seeker); err != nil {
+            return nil, nil, fmt.Errorf("failed to read audio: %w", err)
+        }
+        if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+            return nil, nil, err
+        }
+        return h.Sum(nil), &hashed, nil
+    }
+
+    data, err := io.ReadAll(req.audio())
+    if err != nil {
+        return nil, nil, fmt.Errorf("failed to read audio: %w", err)
+    }
+    h.Write(data)
+    hashed.Audio = bytes.NewReader(data)
+    hashed.AudioData = nil
+    return h.Sum(nil), &hashed, nil
+}
+
+// cacheLookup returns a cached transcript for the request, and the key to
+// store a fresh one under
+func (ts *TranscribeService) cacheLookup(ctx context.Context, backend Transcriber, req *TranscribeRequest) (*TranscribeResponse, string, *TranscribeRequest, error) {
+    sum, req, err := hashAudio(req)
+    if err != nil {
+        return nil, "", nil, err
+    }
+    keyReq := *req
+    keyReq.Model = cmp.Or(req.Model, ts.Model)
+    key := CacheKey(sum, backend.Name(), &keyReq, ts.cacheSettings()...)
+    if req.NoCache {
+        return nil, key, req, nil
+    }
+
+    resp, ok, err := ts.Cache.Get(ctx, key)
+    if err != nil || !ok {
+        // A broken cache must not fail the transcription
+        return nil, key, req, nil
+    }
+    resp.Cached = true
+    return resp, key, req, nil
+}
+
+// cacheStore saves a fresh transcript, ignoring cache failures
+func (ts *TranscribeService) cacheStore(ctx context.Context, key string, resp *TranscribeResponse) {
+    ttl := ts.CacheTTL
+    if ttl == 0 {
+        ttl = DefaultCacheTTL
+    }
+    ts.Cache.Set(context.WithoutCancel(ctx), key, resp, max(ttl, 0))
+}
+
+// cacheEntry is a transcript with its expiry
+type cacheEntry struct {
+    Key     string              `json:"key"`
+    Expires time.Time           `json:"expires,omitzero"`
+    Resp    *TranscribeResponse `json:"response"`
+}
+
+// expired reports whether the entry is past its expiry
+func (e *cacheEntry) expired() bool {
+    return !e.Expires.IsZero() && time.Now().After(e.Expires)
+}
+
+// expiry returns the expiry for a ttl, zero for none
+func expiry(ttl time.Duration) time.Time {
+    if ttl <= 0 {
+        return time.Time{}
+    }
+    return time.Now().Add(ttl)
+}
+
+// cloneResponse deep-copies a transcript so callers cannot change cached
+// entries
+func cloneResponse(resp *TranscribeResponse) (*TranscribeResponse, error) {
+    data, err := json.Marshal(resp)
+    if err != nil {
+        return nil, err
+    }
+    var clone TranscribeResponse
+    if err := json.Unmarshal(data, &clone); err != nil {
+        return nil, err
+    }
+    return &clone, nil
+}
+
+// MemoryCache is an in-process LRU cache
+type MemoryCache struct {
+    mu      sync.Mutex
+    max     int
+    order   *list.List // Front is most recently used
+    entries map[string]*list.Element
+}
+
+// NewMemoryCache creates an LRU cache holding up to maxEntries
+// transcripts, 1000 when maxEntries is 0
+func NewMemoryCache(maxEntries int) *MemoryCache {
+    if maxEntries <= 0 {
+        maxEntries = 1000
+    }
+    return &MemoryCache{
+        max:     maxEntries,
+        order:   list.New(),
+        entries: make(map[string]*list.Element),
+    }
+}
+
+// Get returns a cached transcript
+func (c *MemoryCache) Get(ctx context.Context, key string) (*TranscribeResponse, bool, error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    elem, ok := c.entries[key]
+    if !ok {
+        return nil, false, nil
+    }
+    entry := elem.Value.(*cacheEntry)
+    if entry.expired() {
+        c.order.Remove(elem)
+        delete(c.entries, key)
+        return nil, false, nil
+    }
+    c.order.MoveToFront(elem)
+    resp, err := cloneResponse(entry.Resp)
+    if err != nil {
+        return nil, false, err
+    }
+    return resp, true, nil
+}
+
+// Set stores a transcript, evicting the least recently used when full
+func (c *MemoryCache) Set(ctx context.Context, key string, resp *TranscribeResponse, ttl time.Duration) error {
+    clone, err := cloneResponse(resp)
+    if err != nil {
+        return err
+    }
+    entry := &cacheEntry{Key: key, Expires: expiry(ttl), Resp: clone}
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if elem, ok := c.entries[key]; ok {
+        elem.Value = entry
+        c.order.MoveToFront(elem)
+        return nil
+    }
+    c.entries[key] = c.order.PushFront(entry)
+    for c.order.Len() > c.max {
+        oldest := c.order.Back()
+        c.order.Remove(oldest)
+        delete(c.entries, oldest.Value.(*cacheEntry).Key)
+    }
+    return nil
+}
+
+// FileCache keeps transcripts as JSON files in a directory, so they
+// survive restarts and can be checked into test fixtures
+type FileCache struct {
+    dir string
+}
+
+// NewFileCache creates a cache in dir, creating the directory if needed
+func NewFileCache(dir string) (*FileCache, error) {
+    if err := os.MkdirAll(dir, 0o755); err != nil {
+        return nil, fmt.Errorf("failed to create cache directory: %w", err)
+    }
+    return &FileCache{dir: dir}, nil
+}
+
+// path returns the file for a key, sharded by its first two characters
+func (c *FileCache) path(key string) string {
+    return filepath.Join(c.dir, key[:2], key+".json")
+}
+
+// Get returns a cached transcript, removing it if it expired
+func (c *FileCache) Get(ctx context.Context, key string) (*TranscribeResponse, bool, error) {
+    if len(key) < 2 {
+        return nil, false, nil
+    }
+    data, err := os.ReadFile(c.path(key))
+    if errors.Is(err, os.ErrNotExist) {
+        return nil, false, nil
+    }
+    if err != nil {
+        return nil, false, err
+    }
+    var entry cacheEntry
+    if err := json.Unmarshal(data, &entry); err != nil {
+        return nil, false, fmt.Errorf("failed to decode cache entry: %w", err)
+    }
+    if entry.expired() {
+        os.Remove(c.path(key))
+        return nil, false, nil
+    }
+    return entry.Resp, true, nil
+}
+
+// Set writes a transcript atomically
+func (c *FileCache) Set(ctx context.Context, key string, resp *TranscribeResponse, ttl time.Duration) error {
+    if len(key) < 2 {
+        return fmt.Errorf("invalid cache key %q", key)
+    }
+    data, err := json.Marshal(cacheEntry{Key: key, Expires: expiry(ttl), Resp: resp})
+    if err != nil {
+        return err
+    }
+    path := c.path(key)
+    if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+        return err
+    }
+    tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+    if err != nil {
+        return err
+    }
+    if _, err := tmp.Write(data); err != nil {
+        tmp.Close()
+        os.Remove(tmp.Name())
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        os.Remove(tmp.Name())
+        return err
+    }
+    return os.Rename(tmp.Name(), path)
+}
+
+// PostgresCache keeps transcripts in Postgres, shared by every instance
+type PostgresCache struct {
+    db db.Querier
+}
+
+// NewPostgresCache creates a cache in the whisper_cache table; call
+// Migrate once to create it
+func NewPostgresCache(q db.Querier) *PostgresCache {
+    return &PostgresCache{db: q}
+}
+
+const cacheSchema = `
+CREATE TABLE IF NOT EXISTS whisper_cache (
+    key        TEXT PRIMARY KEY,
+    response   JSONB NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS whisper_cache_expires_idx ON whisper_cache (expires_at);
+`
+
+// Migrate creates the cache table
+func (c *PostgresCache) Migrate(ctx context.Context) error {
+    _, err := c.db.Exec(ctx, cacheSchema)
+    return err
+}
+
+// Get returns a cached transcript that has not expired
+func (c *PostgresCache) Get(ctx context.Context, key string) (*TranscribeResponse, bool, error) {
+    var data []byte
+    err := c.db.QueryRow(ctx,
+        `SELECT response FROM whisper_cache
+         WHERE key = $1 AND (expires_at IS NULL OR expires_at > now())`,
+        key).Scan(&data)
+    if errors.Is(err, pgx.ErrNoRows) {
+        return nil, false, nil
+    }
+    if err != nil {
+        return nil, false, err
+    }
+    var resp TranscribeResponse
+    if err := json.Unmarshal(data, &resp); err != nil {
+        return nil, false, fmt.Errorf("failed to decode cache entry: %w", err)
+    }
+    return &resp, true, nil
+}
+
+// Set stores or replaces a transcript
+func (c *PostgresCache) Set(ctx context.Context, key string, resp *TranscribeResponse, ttl time.Duration) error {
+    data, err := json.Marshal(resp)
+    if err != nil {
+        return err
+    }
+    var expires *time.Time
+    if ttl > 0 {
+        t := time.Now().Add(ttl)
+        expires = &t
+    }
+    _, err = c.db.Exec(ctx,
+        `INSERT INTO whisper_cache (key, response, expires_at) VALUES ($1, $2, $3)
+         ON CONFLICT (key) DO UPDATE SET response = $2, created_at = now(), expires_at = $3`,
+        key, data, expires)
+    return err
+}
+
+// Purge deletes expired entries
+func (c *PostgresCache) Purge(ctx context.Context) (int64, error) {
+    tag, err := c.db.Exec(ctx, `DELETE FROM whisper_cache WHERE expires_at <= now()`)
+    if err != nil {
+        return 0, err
+    }
+    return tag.RowsAffected(), nil
+}
+
+// cacheFromEnv builds the cache named by WHISPER_CACHE: "memory",
+// "memory:<entries>" or "file:<dir>"
+func cacheFromEnv(value string) (Cache, error) {
+    kind, arg, _ := strings.Cut(value, ":")
+    switch kind {
+    case "memory":
+        entries := 0
+        if arg != "" {
+            var err error
+            entries, err = strconv.Atoi(arg)
+            if err != nil {
+                return nil, fmt.Errorf("invalid WHISPER_CACHE value: %w", err)
+            }
+        }
+        return NewMemoryCache(entries), nil
+    case "file":
+        if arg == "" {
+            return nil, fmt.Errorf("invalid WHISPER_CACHE value: %q needs a directory", value)
+        }
+        return NewFileCache(arg)
+    }
+    return nil, fmt.Errorf("invalid WHISPER_CACHE value: %q", value)
+}
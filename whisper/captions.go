@@ -0,0 +1,345 @@
+package whisper
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "io"
+    "math"
+    "mime"
+    "net/http"
+    "path/filepath"
+    "strings"
+    "time"
+    "unicode/utf8"
+)
+
+// Caption formats understood by Render
+const (
+    FormatSRT  = "srt"
+    FormatVTT  = "vtt"
+    FormatTSV  = "tsv"
+    FormatText = "txt"
+)
+
+// ErrNoSegments is returned when a timed format is requested for a
+// transcript without segments
+var ErrNoSegments = errors.New("transcript has no segments")
+
+// CaptionOptions controls how segments are laid out as cues. Zero fields
+// take the defaults noted below, which follow common subtitle guidelines.
+type CaptionOptions struct {
+    MaxLineLength int           // Characters per line, 42
+    MaxLines      int           // Lines per cue, 2
+    MaxDuration   time.Duration // Longest cue, 7s
+    MinDuration   time.Duration // Shorter cues are merged with the next, 1s
+}
+
+// withDefaults fills the zero fields
+func (opts CaptionOptions) withDefaults() CaptionOptions {
+    if opts.MaxLineLength <= 0 {
+        opts.MaxLineLength = 42
+    }
+    if opts.MaxLines <= 0 {
+        opts.MaxLines = 2
+    }
+    if opts.MaxDuration <= 0 {
+        opts.MaxDuration = 7 * time.Second
+    }
+    if opts.MinDuration <= 0 {
+        opts.MinDuration = time.Second
+    }
+    return opts
+}
+
+// Cue is one caption shown on screen
+type Cue struct {
+    Start time.Duration
+    End   time.Duration
+    Lines []string
+}
+
+// Text returns the cue's lines joined by spaces
+func (c Cue) Text() string {
+    return strings.Join(c.Lines, " ")
+}
+
+// Cues lays out the segments of resp as captions. Text is normalized and
+// times are rounded to milliseconds so that every provider renders the same.
+func Cues(resp *TranscribeResponse, opts CaptionOptions) []Cue {
+    opts = opts.withDefaults()
+    maxChars := opts.MaxLineLength * opts.MaxLines
+
+    // Normalize
+    var cues []Cue
+    for _, seg := range resp.Segments {
+        text := strings.Join(strings.Fields(seg.Text), " ")
+        if text == "" {
+            continue
+        }
+        start := secondsToDuration(seg.Start)
+        end := max(start, secondsToDuration(seg.End))
+        cues = append(cues, Cue{Start: start, End: end, Lines: []string{text}})
+    }
+
+    // Merge short cues into the next one while the result still fits
+    var merged []Cue
+    for i := 0; i < len(cues); i++ {
+        cue := cues[i]
+        for i+1 < len(cues) && cue.End-cue.Start < opts.MinDuration {
+            next := cues[i+1]
+            text := cue.Text() + " " + next.Text()
+            if utf8.RuneCountInString(text) > maxChars || next.End-cue.Start > opts.MaxDuration {
+                break
+            }
+            cue = Cue{Start: cue.Start, End: next.End, Lines: []string{text}}
+            i++
+        }
+        merged = append(merged, cue)
+    }
+
+    // Split long cues and wrap their lines
+    var result []Cue
+    for _, cue := range merged {
+        result = append(result, splitCue(cue, opts)...)
+    }
+    return result
+}
+
+// splitCue breaks a cue into pieces that fit the line and duration limits,
+// sharing its time in proportion to their length
+func splitCue(cue Cue, opts CaptionOptions) []Cue {
+    words := strings.Fields(cue.Text())
+
+    // Fill cues line by line
+    var groups [][]string
+    for len(words) > 0 {
+        lines := wrapWords(words, opts.MaxLineLength)
+        n := 0
+        for _, line := range lines[:min(len(lines), opts.MaxLines)] {
+            n += len(strings.Fields(line))
+        }
+        groups = append(groups, words[:n])
+        words = words[n:]
+    }
+
+    // Split further when the pieces would stay on screen too long
+    needed := int(math.Ceil(float64(cue.End-cue.Start) / float64(opts.MaxDuration)))
+    if needed > len(groups) {
+        groups = splitEvenly(strings.Fields(cue.Text()), needed)
+    }
+
+    total := 0
+    for _, group := range groups {
+        total += utf8.RuneCountInString(strings.Join(group, " "))
+    }
+
+    cues := make([]Cue, 0, len(groups))
+    start, done := cue.Start, 0
+    for i, group := range groups {
+        text := strings.Join(group, " ")
+        done += utf8.RuneCountInString(text)
+        end := cue.End
+        if i < len(groups)-1 && total > 0 {
+            end = cue.Start + time.Duration(float64(cue.End-cue.Start)*float64(done)/float64(total)).Round(time.Millisecond)
+        }
+        cues = append(cues, Cue{Start: start, End: end, Lines: wrapBalanced(group, opts.MaxLineLength)})
+        start = end
+    }
+    return cues
+}
+
+// wrapWords breaks words into lines of at most width characters. A word
+// longer than width gets a line of its own.
+func wrapWords(words []string, width int) []string {
+    var lines []string
+    var line strings.Builder
+    for _, word := range words {
+        if line.Len() > 0 && utf8.RuneCountInString(line.String())+1+utf8.RuneCountInString(word) > width {
+            lines = append(lines, line.String())
+            line.Reset()
+        }
+        if line.Len() > 0 {
+            line.WriteByte(' ')
+        }
+        line.WriteString(word)
+    }
+    if line.Len() > 0 {
+        lines = append(lines, line.String())
+    }
+    return lines
+}
+
+// splitEvenly divides words into n groups of about the same length in
+// characters
+func splitEvenly(words []string, n int) [][]string {
+    total := 0
+    for _, word := range words {
+        total += utf8.RuneCountInString(word) + 1
+    }
+
+    groups := make([][]string, 0, n)
+    start, done := 0, 0
+    for i, word := range words {
+        size := utf8.RuneCountInString(word) + 1
+        // Cut before the word when its middle falls into the next group
+        if i > start && (done+size/2)*n/total > len(groups) {
+            groups = append(groups, words[start:i])
+            start = i
+        }
+        done += size
+    }
+    return append(groups, words[start:])
+}
+
+// wrapBalanced wraps words into as few lines as wrapWords but with line
+// lengths as even as possible
+func wrapBalanced(words []string, width int) []string {
+    lines := wrapWords(words, width)
+    if len(lines) < 2 {
+        return lines
+    }
+    low, high := 1, width
+    for low < high {
+        mid := (low + high) / 2
+        if len(wrapWords(words, mid)) <= len(lines) {
+            high = mid
+        } else {
+            low = mid + 1
+        }
+    }
+    return wrapWords(words, low)
+}
+
+// secondsToDuration converts provider seconds to milliseconds precision
+func secondsToDuration(seconds float64) time.Duration {
+    return time.Duration(math.Round(seconds*1000)) * time.Millisecond
+}
+
+// formatTimestamp renders hh:mm:ss followed by sep and milliseconds
+func formatTimestamp(d time.Duration, sep string) string {
+    ms := d.Milliseconds()
+    return fmt.Sprintf("%02d:%02d:%02d%s%03d", ms/3600000, ms/60000%60, ms/1000%60, sep, ms%1000)
+}
+
+// WriteSRT writes resp as SubRip subtitles
+func WriteSRT(w io.Writer, resp *TranscribeResponse, opts CaptionOptions) error {
+    if len(resp.Segments) == 0 {
+        return ErrNoSegments
+    }
+    bw := bufio.NewWriter(w)
+    for i, cue := range Cues(resp, opts) {
+        fmt.Fprintf(bw, "%d\n%s --> %s\n%s\n\n", i+1,
+            formatTimestamp(cue.Start, ","), formatTimestamp(cue.End, ","),
+            strings.Join(cue.Lines, "\n"))
+    }
+    return bw.Flush()
+}
+
+// WriteVTT writes resp as WebVTT captions
+func WriteVTT(w io.Writer, resp *TranscribeResponse, opts CaptionOptions) error {
+    if len(resp.Segments) == 0 {
+        return ErrNoSegments
+    }
+    bw := bufio.NewWriter(w)
+    bw.WriteString("WEBVTT\n\n")
+    for _, cue := range Cues(resp, opts) {
+        // "-->" may not appear in cue text
+        text := strings.ReplaceAll(strings.Join(cue.Lines, "\n"), "-->", "->")
+        fmt.Fprintf(bw, "%s --> %s\n%s\n\n",
+            formatTimestamp(cue.Start, "."), formatTimestamp(cue.End, "."), text)
+    }
+    return bw.Flush()
+}
+
+// WriteTSV writes resp as tab-separated start and end milliseconds and text,
+// the layout of the reference whisper implementation
+func WriteTSV(w io.Writer, resp *TranscribeResponse, opts CaptionOptions) error {
+    if len(resp.Segments) == 0 {
+        return ErrNoSegments
+    }
+    bw := bufio.NewWriter(w)
+    bw.WriteString("start\tend\ttext\n")
+    for _, cue := range Cues(resp, opts) {
+        text := strings.ReplaceAll(cue.Text(), "\t", " ")
+        fmt.Fprintf(bw, "%d\t%d\t%s\n", cue.Start.Milliseconds(), cue.End.Milliseconds(), text)
+    }
+    return bw.Flush()
+}
+
+// WriteText writes the transcript as plain text, one segment per line
+func WriteText(w io.Writer, resp *TranscribeResponse) error {
+    bw := bufio.NewWriter(w)
+    if len(resp.Segments) == 0 {
+        if text := strings.Join(strings.Fields(resp.Text), " "); text != "" {
+            bw.WriteString(text + "\n")
+        }
+        return bw.Flush()
+    }
+    for _, seg := range resp.Segments {
+        if text := strings.Join(strings.Fields(seg.Text), " "); text != "" {
+            bw.WriteString(text + "\n")
+        }
+    }
+    return bw.Flush()
+}
+
+// Render writes resp in the given caption format
+func Render(w io.Writer, format string, resp *TranscribeResponse, opts CaptionOptions) error {
+    switch format {
+    case FormatSRT:
+        return WriteSRT(w, resp, opts)
+    case FormatVTT:
+        return WriteVTT(w, resp, opts)
+    case FormatTSV:
+        return WriteTSV(w, resp, opts)
+    case FormatText, "text":
+        return WriteText(w, resp)
+    }
+    return fmt.Errorf("unknown caption format %q", format)
+}
+
+// CaptionContentType returns the MIME type of a caption format
+func CaptionContentType(format string) string {
+    switch format {
+    case FormatSRT:
+        return "application/x-subrip; charset=utf-8"
+    case FormatVTT:
+        return "text/vtt; charset=utf-8"
+    case FormatTSV:
+        return "text/tab-separated-values; charset=utf-8"
+    }
+    return "text/plain; charset=utf-8"
+}
+
+// ServeCaptions renders resp as a download. The format comes from the
+// "format" query parameter and defaults to SRT; fileName's extension is
+// replaced to match it.
+func ServeCaptions(w http.ResponseWriter, r *http.Request, resp *TranscribeResponse, fileName string, opts CaptionOptions) {
+    format := r.URL.Query().Get("format")
+    if format == "" {
+        format = FormatSRT
+    }
+    if format == "text" {
+        format = FormatText
+    }
+
+    var buf strings.Builder
+    if err := Render(&buf, format, resp, opts); err != nil {
+        status := http.StatusBadRequest
+        if errors.Is(err, ErrNoSegments) {
+            status = http.StatusUnprocessableEntity
+        }
+        http.Error(w, "Failed to render captions: "+err.Error(), status)
+        return
+    }
+
+    if fileName == "" {
+        fileName = "transcript"
+    }
+    fileName = strings.TrimSuffix(fileName, filepath.Ext(fileName)) + "." + format
+
+    w.Header().Set("Content-Type", CaptionContentType(format))
+    w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fileName}))
+    io.WriteString(w, buf.String())
+}
@@ -0,0 +1,136 @@
+package whisper_test
+
+import (
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+    "unicode/utf8"
+
+    "github.com/gchalakovmmi/PulpuWEB/whisper"
+)
+
+var dialogue = &whisper.TranscribeResponse{
+    Text: "Hello there. General Kenobi!",
+    Segments: []whisper.Segment{
+        {Start: 0, End: 2.5, Text: " Hello there."},
+        {Start: 2.5, End: 3725.042, Text: " General  Kenobi! --> exit"},
+    },
+}
+
+func TestRender(t *testing.T) {
+    tests := []struct {
+        format, want string
+    }{
+        {whisper.FormatSRT, "1\n00:00:00,000 --> 00:00:02,500\nHello there.\n\n" +
+            "2\n00:00:02,500 --> 01:02:05,042\nGeneral Kenobi! --> exit\n\n"},
+        {whisper.FormatVTT, "WEBVTT\n\n00:00:00.000 --> 00:00:02.500\nHello there.\n\n" +
+            "00:00:02.500 --> 01:02:05.042\nGeneral Kenobi! -> exit\n\n"},
+        {whisper.FormatTSV, "start\tend\ttext\n0\t2500\tHello there.\n2500\t3725042\tGeneral Kenobi! --> exit\n"},
+        {whisper.FormatText, "Hello there.\nGeneral Kenobi! --> exit\n"},
+    }
+    opts := whisper.CaptionOptions{MaxDuration: 2 * time.Hour}
+    for _, tt := range tests {
+        var out strings.Builder
+        if err := whisper.Render(&out, tt.format, dialogue, opts); err != nil {
+            t.Fatalf("%s: %v", tt.format, err)
+        }
+        if out.String() != tt.want {
+            t.Errorf("%s:\n%q\nwant\n%q", tt.format, out.String(), tt.want)
+        }
+    }
+
+    var out strings.Builder
+    if err := whisper.Render(&out, "docx", dialogue, opts); err == nil {
+        t.Error("rendered an unknown format")
+    }
+    textOnly := &whisper.TranscribeResponse{Text: "Just  text."}
+    if err := whisper.Render(&out, whisper.FormatSRT, textOnly, opts); !errors.Is(err, whisper.ErrNoSegments) {
+        t.Errorf("err = %v, want ErrNoSegments", err)
+    }
+    if err := whisper.Render(&out, whisper.FormatText, textOnly, opts); err != nil || out.String() != "Just text.\n" {
+        t.Errorf("text = %q, %v", out.String(), err)
+    }
+}
+
+func TestCuesMergeShort(t *testing.T) {
+    resp := &whisper.TranscribeResponse{Segments: []whisper.Segment{
+        {Start: 0, End: 0.4, Text: " Hi."},
+        {Start: 0.4, End: 2, Text: " How are you?"},
+        {Start: 2, End: 4, Text: " Fine."},
+    }}
+    cues := whisper.Cues(resp, whisper.CaptionOptions{})
+    if len(cues) != 2 {
+        t.Fatalf("got %d cues, want 2: %+v", len(cues), cues)
+    }
+    if cues[0].Text() != "Hi. How are you?" || cues[0].Start != 0 || cues[0].End != 2*time.Second {
+        t.Errorf("first cue = %+v", cues[0])
+    }
+}
+
+func TestCuesSplitLong(t *testing.T) {
+    text := strings.Repeat(" the quick brown fox jumps over the lazy dog", 6)
+    resp := &whisper.TranscribeResponse{Segments: []whisper.Segment{{Start: 10, End: 40, Text: text}}}
+    opts := whisper.CaptionOptions{MaxLineLength: 32, MaxLines: 2, MaxDuration: 5 * time.Second}
+    cues := whisper.Cues(resp, opts)
+
+    var words []string
+    prevEnd := 10 * time.Second
+    for i, cue := range cues {
+        if cue.Start != prevEnd {
+            t.Errorf("cue %d starts at %s, want %s", i, cue.Start, prevEnd)
+        }
+        if d := cue.End - cue.Start; d > opts.MaxDuration {
+            t.Errorf("cue %d lasts %s", i, d)
+        }
+        if len(cue.Lines) > opts.MaxLines {
+            t.Errorf("cue %d has %d lines", i, len(cue.Lines))
+        }
+        for _, line := range cue.Lines {
+            if utf8.RuneCountInString(line) > opts.MaxLineLength {
+                t.Errorf("cue %d line %q is too long", i, line)
+            }
+        }
+        words = append(words, strings.Fields(cue.Text())...)
+        prevEnd = cue.End
+    }
+    if prevEnd != 40*time.Second {
+        t.Errorf("last cue ends at %s, want 40s", prevEnd)
+    }
+    if got := strings.Join(words, " "); got != strings.TrimSpace(text) {
+        t.Errorf("cues lost words: %q", got)
+    }
+}
+
+func TestCuesBalanceLines(t *testing.T) {
+    resp := &whisper.TranscribeResponse{Segments: []whisper.Segment{
+        {Start: 0, End: 3, Text: " This sentence is a little too long for one line"},
+    }}
+    cues := whisper.Cues(resp, whisper.CaptionOptions{MaxLineLength: 42})
+    if len(cues) != 1 || len(cues[0].Lines) != 2 {
+        t.Fatalf("cues = %+v, want one cue on two lines", cues)
+    }
+    // Both lines are about as long, instead of one full and one short
+    first, second := len(cues[0].Lines[0]), len(cues[0].Lines[1])
+    if first-second > 8 || second-first > 8 {
+        t.Errorf("lines %q are unbalanced", cues[0].Lines)
+    }
+}
+
+func TestServeCaptions(t *testing.T) {
+    w := httptest.NewRecorder()
+    r := httptest.NewRequest(http.MethodGet, "/captions?format=vtt", nil)
+    whisper.ServeCaptions(w, r, dialogue, "talk.mp3", whisper.CaptionOptions{})
+
+    if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), "WEBVTT\n") {
+        t.Fatalf("got %d %q", w.Code, w.Body.String())
+    }
+    if ct := w.Header().Get("Content-Type"); ct != whisper.CaptionContentType(whisper.FormatVTT) {
+        t.Errorf("Content-Type = %q", ct)
+    }
+    if cd := w.Header().Get("Content-Disposition"); !strings.Contains(cd, "talk.vtt") {
+        t.Errorf("Content-Disposition = %q, want talk.vtt", cd)
+    }
+}
@@ -0,0 +1,320 @@
+package whisper
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+    "unicode"
+)
+
+// ChunkConfig controls how long recordings are split
+type ChunkConfig struct {
+    MaxDuration time.Duration // Longest chunk, 10m when zero
+    Overlap     time.Duration // Audio shared by neighbouring chunks, 5s when zero
+    Concurrency int           // Chunks transcribed at once, 4 when zero
+}
+
+// withDefaults fills the zero fields
+func (cfg ChunkConfig) withDefaults() ChunkConfig {
+    if cfg.MaxDuration <= 0 {
+        cfg.MaxDuration = 10 * time.Minute
+    }
+    if cfg.Overlap <= 0 {
+        cfg.Overlap = 5 * time.Second
+    }
+    if cfg.Overlap > cfg.MaxDuration/2 {
+        cfg.Overlap = cfg.MaxDuration / 2
+    }
+    if cfg.Concurrency <= 0 {
+        cfg.Concurrency = 4
+    }
+    return cfg
+}
+
+// Chunk is a piece of a longer recording
+type Chunk struct {
+    Offset time.Duration // Start within the whole recording
+    PCM    *PCM
+}
+
+// SplitPCM cuts pcm into chunks of at most maxDuration where consecutive
+// chunks share overlap worth of audio
+func SplitPCM(pcm *PCM, maxDuration, overlap time.Duration) []Chunk {
+    frames := pcm.Frames()
+    size := int(maxDuration.Seconds() * float64(pcm.SampleRate))
+    shared := int(overlap.Seconds() * float64(pcm.SampleRate))
+    if size <= 0 || frames <= size {
+        return []Chunk{{PCM: pcm}}
+    }
+    if shared >= size {
+        shared = size / 2
+    }
+
+    var chunks []Chunk
+    for start := 0; ; start += size - shared {
+        end := min(start+size, frames)
+        chunks = append(chunks, Chunk{
+            Offset: time.Duration(start) * time.Second / time.Duration(pcm.SampleRate),
+            PCM:    pcm.Slice(start, end),
+        })
+        if end == frames {
+            return chunks
+        }
+    }
+}
+
+// MergeChunks stitches the responses of overlapping chunks into one. Segment
+// times are shifted by each chunk's offset. In the overlap the earlier chunk
+// keeps segments before the middle and the later one those after it, and
+// words repeated across the cut are dropped.
+func MergeChunks(chunks []Chunk, responses []*TranscribeResponse) *TranscribeResponse {
+    merged := &TranscribeResponse{}
+    var texts []string
+
+    for i, resp := range responses {
+        if resp == nil {
+            continue
+        }
+        if merged.Language == "" {
+            merged.Language = resp.Language
+        }
+        if merged.Provider == "" {
+            merged.Provider = resp.Provider
+        }
+        offset := chunks[i].Offset.Seconds()
+
+        // Middle of the overlap with the previous and next chunk
+        from, until := -1.0, -1.0
+        if i > 0 {
+            prevEnd := chunks[i-1].Offset.Seconds() + chunks[i-1].PCM.Duration().Seconds()
+            from = (offset + prevEnd) / 2
+        }
+        if i < len(chunks)-1 {
+            end := offset + chunks[i].PCM.Duration().Seconds()
+            until = (chunks[i+1].Offset.Seconds() + end) / 2
+        }
+
+        if len(resp.Segments) == 0 {
+            texts = append(texts, resp.Text)
+            continue
+        }
+
+        first := true
+        for _, seg := range resp.Segments {
+            seg.Start += offset
+            seg.End += offset
+            seg.Seek += int(offset * 100)
+            seg.Words = shiftWords(seg.Words, offset)
+            mid := (seg.Start + seg.End) / 2
+            if (from >= 0 && mid < from) || (until >= 0 && mid >= until) {
+                continue
+            }
+            if first && len(merged.Segments) > 0 {
+                prev := merged.Segments[len(merged.Segments)-1].Text
+                text := dropRepeatedWords(prev, seg.Text)
+                if strings.TrimSpace(text) == "" {
+                    continue
+                }
+                dropped := len(strings.Fields(seg.Text)) - len(strings.Fields(text))
+                if dropped > 0 && dropped < len(seg.Words) {
+                    seg.Words = seg.Words[dropped:]
+                    seg.Start = seg.Words[0].Start
+                }
+                seg.Text = text
+            }
+            first = false
+            seg.ID = len(merged.Segments)
+            merged.Segments = append(merged.Segments, seg)
+        }
+    }
+
+    if n := len(chunks); n > 0 {
+        merged.Duration = (chunks[n-1].Offset + chunks[n-1].PCM.Duration()).Seconds()
+    }
+
+    if len(merged.Segments) > 0 {
+        linkWords(merged)
+        var text strings.Builder
+        for _, seg := range merged.Segments {
+            text.WriteString(seg.Text)
+        }
+        merged.Text = strings.TrimSpace(text.String())
+        return merged
+    }
+
+    // Text-only responses: cut the repeated words at each seam
+    for i, text := range texts {
+        if i > 0 {
+            text = dropRepeatedWords(merged.Text, text)
+        }
+        merged.Text = strings.TrimSpace(merged.Text + " " + strings.TrimSpace(text))
+    }
+    return merged
+}
+
+// shiftWords returns a copy of words moved by offset seconds
+func shiftWords(words []Word, offset float64) []Word {
+    if len(words) == 0 {
+        return nil
+    }
+    shifted := make([]Word, len(words))
+    for i, word := range words {
+        word.Start += offset
+        word.End += offset
+        shifted[i] = word
+    }
+    return shifted
+}
+
+// maxRepeatedWords bounds the words compared at a chunk seam
+const maxRepeatedWords = 30
+
+// dropRepeatedWords removes the leading words of next that repeat the
+// trailing words of prev, comparing case and punctuation insensitively
+func dropRepeatedWords(prev, next string) string {
+    prevWords := strings.Fields(prev)
+    nextWords := strings.Fields(next)
+    limit := min(len(prevWords), len(nextWords), maxRepeatedWords)
+
+    for n := limit; n > 0; n-- {
+        match := true
+        for j := 0; j < n; j++ {
+            if normalizeWord(prevWords[len(prevWords)-n+j]) != normalizeWord(nextWords[j]) {
+                match = false
+                break
+            }
+        }
+        if match {
+            rest := strings.Join(nextWords[n:], " ")
+            if rest == "" {
+                return ""
+            }
+            return " " + rest
+        }
+    }
+    return next
+}
+
+// normalizeWord lowercases a word and strips punctuation
+func normalizeWord(word string) string {
+    return strings.Map(func(r rune) rune {
+        if unicode.IsPunct(r) {
+            return -1
+        }
+        return unicode.ToLower(r)
+    }, word)
+}
+
+// chunkDuration returns the longest chunk that fits the provider's upload
+// limit once encoded as WAV
+func chunkDuration(pcm *PCM, cfg ChunkConfig, maxFileSize int64) time.Duration {
+    maxDuration := cfg.MaxDuration
+    if maxFileSize > 0 {
+        bytesPerSecond := float64(pcm.SampleRate * pcm.Channels * 2)
+        fits := time.Duration(float64(maxFileSize-1024) * 0.95 / bytesPerSecond * float64(time.Second))
+        maxDuration = min(maxDuration, fits)
+    }
+    return maxDuration
+}
+
+// transcribeChunked splits decodable audio that is too long or too large for
+// the provider and transcribes the chunks in parallel. Other audio is sent
+// in one piece. The audio is decoded in place, so it must be seekable.
+func (ts *TranscribeService) transcribeChunked(ctx context.Context, backend Transcriber, req *TranscribeRequest, cfg ChunkConfig) (*TranscribeResponse, error) {
+    cfg = cfg.withDefaults()
+
+    audio, ok := seekableAudio(req)
+    if !ok {
+        return backend.Transcribe(ctx, req)
+    }
+    decoder, ok := ts.decoderFor(audioHeader(audio), req.FileName)
+    if !ok {
+        return backend.Transcribe(ctx, req)
+    }
+
+    pcm, err := decoder(audio)
+    if err != nil {
+        // Let the provider judge audio we cannot decode
+        return backend.Transcribe(ctx, req)
+    }
+
+    maxFileSize := backend.Features().MaxFileSize
+    maxDuration := chunkDuration(pcm, cfg, maxFileSize)
+    if pcm.Duration() <= maxDuration && (maxFileSize == 0 || audio.Size() <= maxFileSize) {
+        return backend.Transcribe(ctx, req)
+    }
+
+    chunks := SplitPCM(pcm, maxDuration, cfg.Overlap)
+    responses := make([]*TranscribeResponse, len(chunks))
+
+    var progressMu sync.Mutex
+    done := 0
+    progress := func(finished int) {
+        if req.Progress == nil {
+            return
+        }
+        progressMu.Lock()
+        defer progressMu.Unlock()
+        done += finished
+        req.Progress(done, len(chunks))
+    }
+    progress(0)
+
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+
+    var (
+        wg       sync.WaitGroup
+        errOnce  sync.Once
+        firstErr error
+        sem      = make(chan struct{}, cfg.Concurrency)
+    )
+    base := strings.TrimSuffix(req.FileName, filepath.Ext(req.FileName))
+    for i, chunk := range chunks {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            select {
+            case sem <- struct{}{}:
+                defer func() { <-sem }()
+            case <-ctx.Done():
+                return
+            }
+
+            var buf bytes.Buffer
+            if err := EncodeWAV(&buf, chunk.PCM); err != nil {
+                errOnce.Do(func() { firstErr = err; cancel() })
+                return
+            }
+            chunkReq := *req
+            chunkReq.Audio = bytes.NewReader(buf.Bytes())
+            chunkReq.AudioData = nil
+            chunkReq.FileName = fmt.Sprintf("%s-%03d.wav", base, i)
+            chunkReq.Progress = nil
+
+            resp, err := backend.Transcribe(ctx, &chunkReq)
+            if err != nil {
+                errOnce.Do(func() {
+                    firstErr = fmt.Errorf("failed to transcribe chunk %d of %d: %w", i+1, len(chunks), err)
+                    cancel()
+                })
+                return
+            }
+            responses[i] = resp
+            progress(1)
+        }()
+    }
+    wg.Wait()
+
+    if firstErr != nil {
+        return nil, firstErr
+    }
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    return MergeChunks(chunks, responses), nil
+}
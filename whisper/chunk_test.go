@@ -0,0 +1,178 @@
+package whisper_test
+
+import (
+    "bytes"
+    "context"
+    "math"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/gchalakovmmi/PulpuWEB/whisper"
+    "github.com/gchalakovmmi/PulpuWEB/whisper/whispertest"
+)
+
+func TestSplitPCM(t *testing.T) {
+    pcm := tone(16000, 1, 10, 440)
+    chunks := whisper.SplitPCM(pcm, 4*time.Second, time.Second)
+
+    wantOffsets := []time.Duration{0, 3 * time.Second, 6 * time.Second}
+    if len(chunks) != len(wantOffsets) {
+        t.Fatalf("got %d chunks, want %d", len(chunks), len(wantOffsets))
+    }
+    for i, chunk := range chunks {
+        if chunk.Offset != wantOffsets[i] {
+            t.Errorf("chunk %d offset = %s, want %s", i, chunk.Offset, wantOffsets[i])
+        }
+        if chunk.PCM.Duration() != 4*time.Second {
+            t.Errorf("chunk %d is %s long, want 4s", i, chunk.PCM.Duration())
+        }
+    }
+
+    if chunks := whisper.SplitPCM(pcm, time.Minute, time.Second); len(chunks) != 1 || chunks[0].PCM != pcm {
+        t.Errorf("short audio was split into %d chunks", len(chunks))
+    }
+}
+
+// chunkAt is a chunk of silence starting at offset seconds
+func chunkAt(offset, seconds float64) whisper.Chunk {
+    return whisper.Chunk{
+        Offset: time.Duration(offset * float64(time.Second)),
+        PCM:    &whisper.PCM{SampleRate: 100, Channels: 1, Samples: make([]float32, int(seconds*100))},
+    }
+}
+
+func TestMergeChunks(t *testing.T) {
+    chunks := []whisper.Chunk{chunkAt(0, 4), chunkAt(3, 4)}
+    responses := []*whisper.TranscribeResponse{
+        {Language: "en", Segments: []whisper.Segment{
+            {Start: 0, End: 3.2, Text: " The quick brown fox"},
+        }},
+        {Language: "en", Segments: []whisper.Segment{
+            // Ends before the middle of the overlap, so the first chunk's
+            // copy is kept
+            {Start: 0, End: 0.4, Text: " quick"},
+            {Start: 0.2, End: 2, Text: " brown fox jumps over", Words: []whisper.Word{
+                {Word: " brown", Start: 0.2, End: 0.6},
+                {Word: " fox", Start: 0.6, End: 1},
+                {Word: " jumps", Start: 1, End: 1.5},
+                {Word: " over", Start: 1.5, End: 2},
+            }},
+            {Start: 2, End: 3.5, Text: " the lazy dog."},
+        }},
+    }
+
+    merged := whisper.MergeChunks(chunks, responses)
+    if want := "The quick brown fox jumps over the lazy dog."; merged.Text != want {
+        t.Errorf("text = %q, want %q", merged.Text, want)
+    }
+    if merged.Duration != 7 || merged.Language != "en" {
+        t.Errorf("duration = %v, language = %q", merged.Duration, merged.Language)
+    }
+    if len(merged.Segments) != 3 {
+        t.Fatalf("got %d segments, want 3", len(merged.Segments))
+    }
+
+    // Repeated words are cut from the later segment, which then starts
+    // at its first new word, on the whole recording's timeline
+    seam := merged.Segments[1]
+    if seam.Text != " jumps over" || seam.Start != 4 || seam.End != 5 || len(seam.Words) != 2 {
+        t.Errorf("seam segment = %+v", seam)
+    }
+    if last := merged.Segments[2]; last.Start != 5 || last.End != 6.5 || last.ID != 2 {
+        t.Errorf("last segment = %+v", last)
+    }
+    if len(merged.Words) != 2 || merged.Words[0].Word != " jumps" || merged.Words[0].Start != 4 {
+        t.Errorf("words = %+v", merged.Words)
+    }
+}
+
+func TestMergeChunksText(t *testing.T) {
+    chunks := []whisper.Chunk{chunkAt(0, 4), chunkAt(3, 4), chunkAt(6, 2)}
+    responses := []*whisper.TranscribeResponse{
+        {Text: "We choose to go to the Moon"},
+        {Text: "to the moon in this decade"},
+        {Text: "This decade, and do the other things."},
+    }
+    merged := whisper.MergeChunks(chunks, responses)
+    if want := "We choose to go to the Moon in this decade and do the other things."; merged.Text != want {
+        t.Errorf("text = %q, want %q", merged.Text, want)
+    }
+}
+
+func TestTranscribeChunked(t *testing.T) {
+    srv := whispertest.New()
+    defer srv.Close()
+    // Chunks are sent in parallel, so replies go out in arrival order;
+    // each one speaks in the middle of its chunk
+    words := []string{"alpha", "bravo", "charlie"}
+    for _, word := range words {
+        srv.Respond(whispertest.Reply{
+            Text:     " " + word,
+            Segments: []whisper.Segment{{Start: 1, End: 2, Text: " " + word}},
+            Duration: 4,
+        })
+    }
+
+    service := srv.Service("groq")
+    service.Chunking = &whisper.ChunkConfig{MaxDuration: 4 * time.Second, Overlap: time.Second}
+    var progress []int
+    req := &whisper.TranscribeRequest{
+        // Not seekable, so it is spooled before it is decoded
+        Audio:        strings.NewReader(string(wavBytes(t, tone(16000, 1, 10, 440)))),
+        FileName:     "talk.wav",
+        OutputFormat: "verbose_json",
+        Progress:     func(done, total int) { progress = append(progress, done) },
+    }
+    resp, err := service.SendToWhisper(context.Background(), req)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // Match each chunk to the reply it got
+    requests := srv.Requests()
+    if len(requests) != 3 {
+        t.Fatalf("got %d requests, want 3", len(requests))
+    }
+    spoken := make([]string, len(requests))
+    for i, r := range requests {
+        var index int
+        switch r.FileName {
+        case "talk-000.wav":
+            index = 0
+        case "talk-001.wav":
+            index = 1
+        case "talk-002.wav":
+            index = 2
+        default:
+            t.Fatalf("unexpected chunk name %q", r.FileName)
+        }
+        spoken[index] = words[i]
+
+        pcm, err := whisper.DecodeWAV(bytes.NewReader(r.Audio))
+        if err != nil {
+            t.Fatal(err)
+        }
+        if pcm.Duration() != 4*time.Second {
+            t.Errorf("%s is %s long, want 4s", r.FileName, pcm.Duration())
+        }
+    }
+
+    if want := strings.Join(spoken, " "); resp.Text != want {
+        t.Errorf("text = %q, want %q", resp.Text, want)
+    }
+    if len(resp.Segments) != 3 {
+        t.Fatalf("got %d segments, want 3", len(resp.Segments))
+    }
+    for i, want := range []float64{1, 4, 7} {
+        if seg := resp.Segments[i]; math.Abs(seg.Start-want) > 1e-9 {
+            t.Errorf("segment %d starts at %v, want %v", i, seg.Start, want)
+        }
+    }
+    if resp.Duration != 10 {
+        t.Errorf("duration = %v, want 10", resp.Duration)
+    }
+    if len(progress) != 4 || progress[3] != 3 {
+        t.Errorf("progress = %v, want 0 to 3", progress)
+    }
+}
@@ -0,0 +1,445 @@
+// Command whisperbatch transcribes directories of recordings.
+//
+//	whisperbatch [flags] path...
+//
+// Each path is an audio file, a directory searched recursively or a glob
+// such as "calls/*.mp3". Transcripts are written next to each recording as
+// name.json (the whole TranscribeResponse) and, by default, name.srt and
+// name.vtt. Recordings whose outputs are newer than the audio are skipped,
+// so an interrupted run picks up where it stopped. The provider is
+// configured by the same WHISPER_* environment variables as
+// whisper.NewTranscribeService.
+//
+// The exit status is 1 when any file failed or the run was interrupted.
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io/fs"
+    "os"
+    "os/signal"
+    "path/filepath"
+    "slices"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+
+    "github.com/gchalakovmmi/PulpuWEB/whisper"
+)
+
+// defaultExtensions are the audio files picked up in directories
+const defaultExtensions = "wav,mp3,ogg,oga,opus,webm,weba,flac,m4a,mp4,mpeg,mpga"
+
+// options are the command line flags
+type options struct {
+    formats    []string
+    extensions map[string]bool
+    jobs       int
+    force      bool
+    language   string
+    task       string
+    prompt     string
+    words      bool
+    encode     bool // Send ShouldEncode
+}
+
+// file is one recording to transcribe
+type file struct {
+    path string
+    base string // Output path without the extension
+}
+
+// result is the outcome of one file
+type result struct {
+    file     file
+    skipped  bool
+    audio    time.Duration
+    elapsed  time.Duration
+    err      error
+    canceled bool
+}
+
+func main() {
+    var opts options
+    var formats, extensions string
+    flag.StringVar(&formats, "formats", "json,srt,vtt", "outputs to write: json, srt, vtt, tsv and txt")
+    flag.StringVar(&extensions, "ext", defaultExtensions, "extensions of audio files in directories and globs")
+    flag.IntVar(&opts.jobs, "j", 4, "files transcribed at once")
+    flag.BoolVar(&opts.force, "force", false, "transcribe files that are already done")
+    flag.StringVar(&opts.language, "language", "", "language of the recordings, detected when empty")
+    flag.StringVar(&opts.task, "task", whisper.TaskTranscribe, "transcribe or translate (into English)")
+    flag.StringVar(&opts.prompt, "prompt", "", "initial prompt for the model")
+    flag.BoolVar(&opts.words, "words", false, "ask for word timings")
+    flag.Usage = func() {
+        fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] path...\n\n", filepath.Base(os.Args[0]))
+        fmt.Fprintln(flag.CommandLine.Output(), "Paths are audio files, directories or globs. The provider is set by WHISPER_* variables.")
+        fmt.Fprintln(flag.CommandLine.Output())
+        flag.PrintDefaults()
+    }
+    flag.Parse()
+
+    if flag.NArg() == 0 {
+        flag.Usage()
+        os.Exit(2)
+    }
+    for _, format := range strings.Split(formats, ",") {
+        format = strings.TrimSpace(format)
+        switch format {
+        case "json", whisper.FormatSRT, whisper.FormatVTT, whisper.FormatTSV, whisper.FormatText:
+            if !slices.Contains(opts.formats, format) {
+                opts.formats = append(opts.formats, format)
+            }
+        case "":
+        default:
+            fatalf("unknown output format %q", format)
+        }
+    }
+    if len(opts.formats) == 0 {
+        fatalf("no output formats given")
+    }
+    opts.extensions = make(map[string]bool)
+    for _, ext := range strings.Split(extensions, ",") {
+        if ext = strings.TrimPrefix(strings.TrimSpace(ext), "."); ext != "" {
+            opts.extensions["."+strings.ToLower(ext)] = true
+        }
+    }
+    opts.jobs = max(opts.jobs, 1)
+
+    files, err := collect(flag.Args(), opts)
+    if err != nil {
+        fatalf("%v", err)
+    }
+    if len(files) == 0 {
+        fatalf("no audio files found")
+    }
+
+    service, err := whisper.NewTranscribeService()
+    if err != nil {
+        fatalf("%v", err)
+    }
+    features, err := service.Features()
+    if err != nil {
+        fatalf("%v", err)
+    }
+    // Servers that decode any format are told to, so mp3 or m4a files are
+    // not read as raw samples
+    opts.encode = features.Encode
+
+    // Ctrl-C stops new files and cancels the running ones; they are
+    // transcribed again on the next run
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+
+    start := time.Now()
+    results := run(ctx, service, files, opts)
+    if !summarize(results, time.Since(start)) {
+        os.Exit(1)
+    }
+}
+
+// fatalf prints an error and exits
+func fatalf(format string, args ...any) {
+    fmt.Fprintf(os.Stderr, "whisperbatch: "+format+"\n", args...)
+    os.Exit(2)
+}
+
+// collect expands the paths into a sorted list of audio files
+func collect(paths []string, opts options) ([]file, error) {
+    seen := make(map[string]bool)
+    var found []string
+    add := func(path string) {
+        if path, err := filepath.Abs(path); err == nil && !seen[path] {
+            seen[path] = true
+            found = append(found, path)
+        }
+    }
+
+    for _, pattern := range paths {
+        matches := []string{pattern}
+        isGlob := strings.ContainsAny(pattern, "*?[")
+        if isGlob {
+            var err error
+            matches, err = filepath.Glob(pattern)
+            if err != nil {
+                return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+            }
+        }
+        for _, path := range matches {
+            info, err := os.Stat(path)
+            if err != nil {
+                return nil, err
+            }
+            if !info.IsDir() {
+                // Files named explicitly are taken whatever their extension
+                if !isGlob || opts.extensions[strings.ToLower(filepath.Ext(path))] {
+                    add(path)
+                }
+                continue
+            }
+            err = filepath.WalkDir(path, func(path string, entry fs.DirEntry, err error) error {
+                if err != nil {
+                    return err
+                }
+                if entry.Type().IsRegular() && opts.extensions[strings.ToLower(filepath.Ext(path))] {
+                    add(path)
+                }
+                return nil
+            })
+            if err != nil {
+                return nil, err
+            }
+        }
+    }
+    slices.Sort(found)
+
+    // talk.wav and talk.mp3 would both write talk.json, so such files
+    // keep their extension in the output names
+    bases := make(map[string]int)
+    for _, path := range found {
+        bases[strings.TrimSuffix(path, filepath.Ext(path))]++
+    }
+    files := make([]file, len(found))
+    for i, path := range found {
+        base := strings.TrimSuffix(path, filepath.Ext(path))
+        if bases[base] > 1 {
+            base = path
+        }
+        files[i] = file{path: path, base: base}
+    }
+    return files, nil
+}
+
+// done reports whether every output of f exists and is newer than the audio
+func done(f file, opts options) bool {
+    audio, err := os.Stat(f.path)
+    if err != nil {
+        return false
+    }
+    for _, format := range opts.formats {
+        output, err := os.Stat(f.base + "." + format)
+        if err != nil || output.ModTime().Before(audio.ModTime()) {
+            return false
+        }
+    }
+    return true
+}
+
+// run transcribes the files, at most opts.jobs at a time
+func run(ctx context.Context, service *whisper.TranscribeService, files []file, opts options) []result {
+    results := make([]result, len(files))
+    var printMu sync.Mutex
+    report := func(i int, r result) {
+        results[i] = r
+        printMu.Lock()
+        defer printMu.Unlock()
+        name := relative(r.file.path)
+        switch {
+        case r.skipped:
+            fmt.Printf("[%d/%d] skip %s\n", i+1, len(files), name)
+        case r.canceled:
+            fmt.Printf("[%d/%d] stop %s\n", i+1, len(files), name)
+        case r.err != nil:
+            fmt.Printf("[%d/%d] FAIL %s: %v\n", i+1, len(files), name, r.err)
+        default:
+            fmt.Printf("[%d/%d] ok   %s (%s of audio in %s)\n", i+1, len(files), name,
+                formatDuration(r.audio), formatDuration(r.elapsed))
+        }
+    }
+
+    sem := make(chan struct{}, opts.jobs)
+    var wg sync.WaitGroup
+    for i, f := range files {
+        if !opts.force && done(f, opts) {
+            report(i, result{file: f, skipped: true})
+            continue
+        }
+        select {
+        case sem <- struct{}{}:
+        case <-ctx.Done():
+        }
+        if ctx.Err() != nil {
+            results[i] = result{file: f, canceled: true}
+            continue
+        }
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            defer func() { <-sem }()
+            r := transcribe(ctx, service, f, opts)
+            r.canceled = r.err != nil && ctx.Err() != nil
+            report(i, r)
+        }()
+    }
+    wg.Wait()
+    return results
+}
+
+// transcribe sends one file and writes its outputs
+func transcribe(ctx context.Context, service *whisper.TranscribeService, f file, opts options) result {
+    r := result{file: f}
+    start := time.Now()
+
+    audio, err := os.Open(f.path)
+    if err != nil {
+        r.err = err
+        return r
+    }
+    defer audio.Close()
+    stat, err := audio.Stat()
+    if err != nil {
+        r.err = err
+        return r
+    }
+    if info, err := whisper.ProbeAudio(audio, stat.Size()); err == nil {
+        r.audio = info.Duration
+    }
+
+    req := &whisper.TranscribeRequest{
+        Audio:        audio,
+        FileName:     filepath.Base(f.path),
+        Language:     opts.language,
+        Task:         opts.task,
+        OutputFormat: "verbose_json", // Captions need segments
+        Prompt:       opts.prompt,
+        ShouldEncode: opts.encode,
+    }
+    if opts.words {
+        req.TimestampGranularities = []string{whisper.GranularitySegment, whisper.GranularityWord}
+    }
+    resp, err := service.SendToWhisper(ctx, req)
+    if err != nil {
+        r.err = err
+        return r
+    }
+    if resp.Duration > 0 {
+        r.audio = time.Duration(resp.Duration * float64(time.Second))
+    }
+
+    // The JSON goes last, so a file is only done once it has everything
+    formats := slices.Clone(opts.formats)
+    if i := slices.Index(formats, "json"); i >= 0 {
+        formats = append(slices.Delete(formats, i, i+1), "json")
+    }
+    for _, format := range formats {
+        data, err := render(format, resp)
+        if err != nil {
+            r.err = err
+            return r
+        }
+        if err := writeFile(f.base+"."+format, data); err != nil {
+            r.err = err
+            return r
+        }
+    }
+    r.elapsed = time.Since(start)
+    return r
+}
+
+// render formats the transcript
+func render(format string, resp *whisper.TranscribeResponse) ([]byte, error) {
+    if format == "json" {
+        data, err := json.MarshalIndent(resp, "", "  ")
+        return append(data, '\n'), err
+    }
+    var buf bytes.Buffer
+    err := whisper.Render(&buf, format, resp, whisper.CaptionOptions{})
+    if errors.Is(err, whisper.ErrNoSegments) && strings.TrimSpace(resp.Text) == "" {
+        // Nothing was said
+        buf.Reset()
+        if format == whisper.FormatVTT {
+            buf.WriteString("WEBVTT\n\n")
+        }
+        err = nil
+    }
+    if err != nil {
+        return nil, fmt.Errorf("failed to render %s: %w", format, err)
+    }
+    return buf.Bytes(), nil
+}
+
+// writeFile replaces path atomically, so an interrupted run leaves no
+// half-written output
+func writeFile(path string, data []byte) error {
+    tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+    if err != nil {
+        return fmt.Errorf("failed to create output: %w", err)
+    }
+    defer os.Remove(tmp.Name())
+    if _, err := tmp.Write(data); err != nil {
+        tmp.Close()
+        return fmt.Errorf("failed to write %s: %w", path, err)
+    }
+    if err := tmp.Close(); err != nil {
+        return fmt.Errorf("failed to write %s: %w", path, err)
+    }
+    if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+        return err
+    }
+    return os.Rename(tmp.Name(), path)
+}
+
+// summarize prints the totals and failures and reports whether all files
+// succeeded
+func summarize(results []result, elapsed time.Duration) bool {
+    var transcribed, skipped, canceled int
+    var audio time.Duration
+    var failed []result
+    for _, r := range results {
+        switch {
+        case r.skipped:
+            skipped++
+        case r.canceled:
+            canceled++
+        case r.err != nil:
+            failed = append(failed, r)
+        default:
+            transcribed++
+            audio += r.audio
+        }
+    }
+
+    fmt.Println()
+    fmt.Printf("%d transcribed, %d skipped, %d failed", transcribed, skipped, len(failed))
+    if canceled > 0 {
+        fmt.Printf(", %d interrupted", canceled)
+    }
+    fmt.Printf(" in %s\n", formatDuration(elapsed))
+    if transcribed > 0 {
+        fmt.Printf("%s of audio", formatDuration(audio))
+        if elapsed > 0 && audio > 0 {
+            fmt.Printf(", %.1fx real time", audio.Seconds()/elapsed.Seconds())
+        }
+        fmt.Println()
+    }
+    if len(failed) > 0 {
+        fmt.Println("\nFailed:")
+        for _, r := range failed {
+            fmt.Printf("  %s: %v\n", relative(r.file.path), r.err)
+        }
+    }
+    return len(failed) == 0 && canceled == 0
+}
+
+// relative shortens path to the working directory when it is inside it
+func relative(path string) string {
+    wd, err := os.Getwd()
+    if err != nil {
+        return path
+    }
+    rel, err := filepath.Rel(wd, path)
+    if err != nil || strings.HasPrefix(rel, "..") {
+        return path
+    }
+    return rel
+}
+
+// formatDuration rounds d for display
+func formatDuration(d time.Duration) string {
+    return d.Round(100 * time.Millisecond).String()
+}
@@ -0,0 +1,100 @@
+package whisper
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+)
+
+func init() {
+    RegisterProvider("docker", newDockerTranscriber)
+}
+
+// dockerTranscriber talks to the whisper-asr-webservice container (/asr)
+type dockerTranscriber struct {
+    url    string
+    client *http.Client
+}
+
+func newDockerTranscriber(cfg ProviderConfig) (Transcriber, error) {
+    if cfg.URL == "" {
+        return nil, fmt.Errorf("URL is required for docker provider")
+    }
+    return &dockerTranscriber{url: cfg.URL, client: cfg.client()}, nil
+}
+
+// Name returns the provider name
+func (d *dockerTranscriber) Name() string {
+    return "docker"
+}
+
+// Features reports what the ASR webservice supports
+func (d *dockerTranscriber) Features() Features {
+    return Features{
+        Translate:      true,
+        Segments:       true,
+        WordTimestamps: true,
+        Prompt:         true,
+        Encode:         true,
+    }
+}
+
+// Health checks that the container answers
+func (d *dockerTranscriber) Health(ctx context.Context) error {
+    return probeURL(ctx, d.client, rootURL(d.url), "")
+}
+
+// Transcribe sends request to the Docker container
+func (d *dockerTranscriber) Transcribe(ctx context.Context, req *TranscribeRequest) (*TranscribeResponse, error) {
+    body, contentType := pipeMultipart(nil, "audio_file", req.FileName, req.audio())
+    defer body.Close()
+
+    // Build the URL with query parameters
+    query := url.Values{}
+    query.Set("encode", fmt.Sprint(req.ShouldEncode))
+    query.Set("task", req.Task)
+    query.Set("language", req.Language)
+    // The service's json output already has segments, and the response
+    // is always decoded as JSON
+    query.Set("output", "json")
+    if prompt := req.prompt(); prompt != "" {
+        query.Set("initial_prompt", prompt)
+    }
+    if req.wantsWords() {
+        query.Set("word_timestamps", "true")
+    }
+    whisperURL := d.url + "?" + query.Encode()
+
+    httpReq, err := http.NewRequestWithContext(ctx, "POST", whisperURL, body)
+    if err != nil {
+        return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+    }
+
+    httpReq.Header.Set("Content-Type", contentType)
+
+    resp, err := d.client.Do(httpReq)
+    if err != nil {
+        return nil, sendError("Whisper", ctx, err)
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return nil, statusError("Whisper", resp)
+    }
+
+    respBody, err := io.ReadAll(resp.Body)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read response body: %w", err)
+    }
+
+    var result TranscribeResponse
+    if err := json.Unmarshal(respBody, &result); err != nil {
+        return nil, fmt.Errorf("failed to parse Whisper response: %w", err)
+    }
+    linkWords(&result)
+
+    return &result, nil
+}
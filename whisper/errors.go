@@ -0,0 +1,131 @@
+package whisper
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Errors wrapped by provider failures, for use with errors.Is
+var (
+    ErrRateLimited         = errors.New("rate limited by provider")
+    ErrTooLarge            = errors.New("audio too large for provider")
+    ErrUnsupportedFormat   = errors.New("audio format not supported by provider")
+    ErrProviderUnavailable = errors.New("provider unavailable")
+)
+
+// ProviderError is a non-OK response from a provider
+type ProviderError struct {
+    Provider   string
+    StatusCode int
+    Status     string
+    Body       string
+    RetryAfter time.Duration // How long the provider asked us to wait, 0 if unknown
+    Err        error         // One of the Err* values above, or nil
+}
+
+func (e *ProviderError) Error() string {
+    msg := fmt.Sprintf("%s service returned non-OK status: %s", e.Provider, e.Status)
+    if e.Body != "" {
+        msg += " - " + e.Body
+    }
+    return msg
+}
+
+func (e *ProviderError) Unwrap() error {
+    return e.Err
+}
+
+// HTTPStatus returns the status a handler should answer with for err
+func HTTPStatus(err error) int {
+    switch {
+    case errors.Is(err, ErrRateLimited):
+        return http.StatusTooManyRequests
+    case errors.Is(err, ErrTooLarge), errors.Is(err, ErrTooLong):
+        return http.StatusRequestEntityTooLarge
+    case errors.Is(err, ErrUnsupportedFormat):
+        return http.StatusUnsupportedMediaType
+    case errors.Is(err, ErrNotSupported):
+        return http.StatusBadRequest
+    case errors.Is(err, ErrProviderUnavailable):
+        return http.StatusServiceUnavailable
+    case errors.Is(err, context.DeadlineExceeded):
+        return http.StatusGatewayTimeout
+    }
+    return http.StatusBadGateway
+}
+
+// maxErrorBody bounds how much of an error response is kept
+const maxErrorBody = 4 << 10
+
+// statusError classifies a non-OK response
+func statusError(provider string, resp *http.Response) error {
+    body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+    e := &ProviderError{
+        Provider:   provider,
+        StatusCode: resp.StatusCode,
+        Status:     resp.Status,
+        Body:       strings.TrimSpace(string(body)),
+        RetryAfter: retryAfter(resp.Header),
+    }
+
+    switch resp.StatusCode {
+    case http.StatusTooManyRequests:
+        e.Err = ErrRateLimited
+    case http.StatusRequestEntityTooLarge:
+        e.Err = ErrTooLarge
+    case http.StatusUnsupportedMediaType:
+        e.Err = ErrUnsupportedFormat
+    case http.StatusBadRequest, http.StatusUnprocessableEntity:
+        // Groq and OpenAI report undecodable files as bad requests
+        lower := strings.ToLower(e.Body)
+        if strings.Contains(lower, "media file") || strings.Contains(lower, "file format") ||
+            strings.Contains(lower, "invalid file") || strings.Contains(lower, "decode") {
+            e.Err = ErrUnsupportedFormat
+        }
+    case http.StatusInternalServerError, http.StatusBadGateway,
+        http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+        e.Err = ErrProviderUnavailable
+    }
+    return e
+}
+
+// sendError wraps a failed request. Connection failures mean the provider
+// is unavailable unless the caller gave up.
+func sendError(provider string, ctx context.Context, err error) error {
+    if ctx.Err() != nil {
+        return fmt.Errorf("failed to send request to %s: %w", provider, err)
+    }
+    return fmt.Errorf("failed to send request to %s: %w: %w", provider, ErrProviderUnavailable, err)
+}
+
+// retryAfter reads Retry-After, or the Groq rate-limit reset headers for
+// the exhausted limits
+func retryAfter(header http.Header) time.Duration {
+    if value := header.Get("Retry-After"); value != "" {
+        if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+            return time.Duration(seconds * float64(time.Second))
+        }
+        if at, err := http.ParseTime(value); err == nil {
+            return max(0, time.Until(at))
+        }
+    }
+
+    // Groq sends e.g. x-ratelimit-remaining-requests: 0 and
+    // x-ratelimit-reset-requests: 2m59.56s
+    var wait time.Duration
+    for _, limit := range []string{"requests", "tokens", "audio-seconds"} {
+        if header.Get("X-Ratelimit-Remaining-"+limit) != "0" {
+            continue
+        }
+        if reset, err := time.ParseDuration(header.Get("X-Ratelimit-Reset-" + limit)); err == nil {
+            wait = max(wait, reset)
+        }
+    }
+    return wait
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-    "encoding/json"
     "fmt"
     "html/template"
     "log"
@@ -24,8 +23,12 @@ func main() {
     // Setup routes
     http.HandleFunc("/", homeHandler)
     http.HandleFunc("/record", recordHandler)
-    http.HandleFunc("/transcribe", transcribeHandler)
+    // OpenAI-compatible API at /v1/audio/transcriptions
+    http.Handle("/v1/audio/", whisper.Handler(whisperService, whisper.HandlerOptions{}))
     http.HandleFunc("/result", resultHandler)
+    // Live captions over a WebSocket
+    http.Handle("/live", whisper.LiveHandler(whisperService, whisper.LiveOptions{}))
+    http.HandleFunc("/live.js", whisper.LiveScript)
 
     log.Println("Server running on :8000")
     log.Fatal(http.ListenAndServe(":8000", nil))
@@ -42,6 +45,35 @@ func homeHandler(w http.ResponseWriter, r *http.Request) {
         <h1>Audio Recorder</h1>
         <button id="recordButton">Record</button>
         <button id="stopButton" disabled>Stop</button>
+        <h2>Live captions</h2>
+        <button id="liveButton">Start</button>
+        <p><span id="liveText"></span> <i id="liveDraft"></i></p>
+        <script src="/live.js"></script>
+        <script>
+            let live;
+            document.getElementById('liveButton').addEventListener('click', async event => {
+                const button = event.target;
+                button.disabled = true;
+                if (live) {
+                    await live.stop();
+                    live = null;
+                    button.textContent = 'Start';
+                } else {
+                    const draft = document.getElementById('liveDraft');
+                    live = await startLiveTranscription('/live', {
+                        language: 'en',
+                        onPartial: e => { draft.textContent = e.text; },
+                        onFinal: e => {
+                            draft.textContent = '';
+                            document.getElementById('liveText').textContent += ' ' + e.text;
+                        },
+                        onError: e => console.error(e.message),
+                    });
+                    button.textContent = 'Stop';
+                }
+                button.disabled = false;
+            });
+        </script>
         <script>
             let mediaRecorder;
             let audioChunks = [];
@@ -65,11 +97,13 @@ func homeHandler(w http.ResponseWriter, r *http.Request) {
                 document.getElementById('stopButton').disabled = true;
                 
                 mediaRecorder.addEventListener('stop', () => {
-                    const audioBlob = new Blob(audioChunks);
+                    const audioBlob = new Blob(audioChunks, { type: mediaRecorder.mimeType });
                     const formData = new FormData();
-                    formData.append('audio', audioBlob, 'recording.wav');
+                    // The server corrects the extension from the content
+                    formData.append('file', audioBlob, 'recording');
+                    formData.append('language', 'en');
                     
-                    fetch('/transcribe', {
+                    fetch('/v1/audio/transcriptions', {
                         method: 'POST',
                         body: formData
                     }).then(response => response.json())
@@ -92,38 +126,6 @@ func recordHandler(w http.ResponseWriter, r *http.Request) {
     http.ServeFile(w, r, "record.html")
 }
 
-func transcribeHandler(w http.ResponseWriter, r *http.Request) {
-    if r.Method != "POST" {
-        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-        return
-    }
-
-    audioData, filename, err := whisper.ParseAudioFromRequest(r)
-    if err != nil {
-        http.Error(w, "Failed to parse audio: "+err.Error(), http.StatusBadRequest)
-        return
-    }
-
-    req := &whisper.TranscribeRequest{
-        AudioData:    audioData,
-        FileName:     filename,
-        Language:     "en",
-        Task:         "transcribe",
-        OutputFormat: "json",
-        ShouldEncode: true,
-        Model:        "", // Use the model from environment variables
-    }
-
-    result, err := whisperService.SendToWhisper(req)
-    if err != nil {
-        http.Error(w, "Transcription failed: "+err.Error(), http.StatusInternalServerError)
-        return
-    }
-
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(result)
-}
-
 func resultHandler(w http.ResponseWriter, r *http.Request) {
     tmpl := `
     <!DOCTYPE html>
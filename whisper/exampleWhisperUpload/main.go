@@ -62,15 +62,16 @@ func transcribeHandler(w http.ResponseWriter, r *http.Request) {
     }
 
     // Parse the uploaded file
-    audioData, filename, err := whisper.ParseAudioFromRequest(r)
+    audio, filename, err := whisper.OpenAudioFromRequest(r)
     if err != nil {
         http.Error(w, "Failed to parse audio: "+err.Error(), http.StatusBadRequest)
         return
     }
+    defer audio.Close()
 
     // Prepare the transcription request
     req := &whisper.TranscribeRequest{
-        AudioData:    audioData,
+        Audio:        audio,
         FileName:     filename,
         Language:     "en",
         Task:         "transcribe",
@@ -80,9 +81,9 @@ func transcribeHandler(w http.ResponseWriter, r *http.Request) {
     }
 
     // Send to Whisper service
-    result, err := whisperService.SendToWhisper(req)
+    result, err := whisperService.SendToWhisper(r.Context(), req)
     if err != nil {
-        http.Error(w, "Transcription failed: "+err.Error(), http.StatusInternalServerError)
+        http.Error(w, "Transcription failed: "+err.Error(), whisper.HTTPStatus(err))
         return
     }
 
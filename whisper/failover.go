@@ -0,0 +1,437 @@
+package whisper
+
+import (
+    "cmp"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "net/url"
+    "os"
+    "slices"
+    "strings"
+    "sync"
+    "time"
+)
+
+// ProviderSpec configures one provider of a failover chain
+type ProviderSpec struct {
+    Provider      string `json:"provider"`
+    URL           string `json:"url,omitempty"`
+    APIKey        string `json:"api_key,omitempty"`
+    Model         string `json:"model,omitempty"`
+    MaxConcurrent int    `json:"max_concurrent,omitempty"`
+}
+
+// BreakerConfig controls when a failing provider is skipped. Zero fields
+// take the defaults noted below.
+type BreakerConfig struct {
+    FailureThreshold int           // Consecutive failures that open the breaker, 3
+    OpenDuration     time.Duration // Time before a request may try it again, 30s
+    ProbeInterval    time.Duration // Time between health probes while open, 15s
+    // AttemptTimeout bounds one provider's attempt, 5m, so a hung provider
+    // counts as a failure and the next one is tried
+    AttemptTimeout time.Duration
+}
+
+// withDefaults fills the zero fields
+func (cfg BreakerConfig) withDefaults() BreakerConfig {
+    if cfg.FailureThreshold <= 0 {
+        cfg.FailureThreshold = 3
+    }
+    if cfg.OpenDuration <= 0 {
+        cfg.OpenDuration = 30 * time.Second
+    }
+    if cfg.ProbeInterval <= 0 {
+        cfg.ProbeInterval = 15 * time.Second
+    }
+    if cfg.AttemptTimeout <= 0 {
+        cfg.AttemptTimeout = 5 * time.Minute
+    }
+    return cfg
+}
+
+// HealthChecker is implemented by providers that can be probed without
+// sending audio
+type HealthChecker interface {
+    Health(ctx context.Context) error
+}
+
+// breaker is a circuit breaker for one provider
+type breaker struct {
+    cfg BreakerConfig
+
+    mu        sync.Mutex
+    failures  int
+    open      bool
+    openedAt  time.Time
+    trial     bool // A request is trying the open provider
+    probing   bool
+    lastProbe time.Time
+}
+
+// allow reports whether a request may use the provider. After OpenDuration
+// one request at a time is let through to test it.
+func (b *breaker) allow(now time.Time) bool {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if !b.open {
+        return true
+    }
+    if !b.trial && now.Sub(b.openedAt) >= b.cfg.OpenDuration {
+        b.trial = true
+        return true
+    }
+    return false
+}
+
+// success closes the breaker
+func (b *breaker) success() {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    b.failures = 0
+    b.open = false
+    b.trial = false
+}
+
+// failure counts a failed call and opens the breaker at the threshold
+func (b *breaker) failure(now time.Time) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    b.failures++
+    b.trial = false
+    if b.open || b.failures >= b.cfg.FailureThreshold {
+        b.open = true
+        b.openedAt = now
+    }
+}
+
+// release gives back a trial slot that was not used
+func (b *breaker) release() {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    b.trial = false
+}
+
+// shouldProbe reports whether an open breaker is due for a health probe
+// and marks the probe as started
+func (b *breaker) shouldProbe(now time.Time) bool {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if !b.open || b.probing || now.Sub(b.lastProbe) < b.cfg.ProbeInterval {
+        return false
+    }
+    b.probing = true
+    b.lastProbe = now
+    return true
+}
+
+// probed records the outcome of a health probe
+func (b *breaker) probed(healthy bool) {
+    b.mu.Lock()
+    b.probing = false
+    b.mu.Unlock()
+    if healthy {
+        b.success()
+    }
+}
+
+// isOpen reports whether the provider is being skipped
+func (b *breaker) isOpen() bool {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.open
+}
+
+// failoverMember is a provider in the chain
+type failoverMember struct {
+    Transcriber
+    health  HealthChecker // The unwrapped provider's, or nil
+    breaker *breaker
+}
+
+// FailoverTranscriber tries providers in order, skipping those whose
+// circuit breaker is open. Open providers that implement HealthChecker are
+// probed in the background and rejoin the chain once healthy.
+type FailoverTranscriber struct {
+    members        []*failoverMember
+    attemptTimeout time.Duration
+
+    // prepare adapts the request to a provider before it is tried, e.g.
+    // converting audio for WAV-only providers
+    prepare func(backend Transcriber, req *TranscribeRequest) (*TranscribeRequest, error)
+}
+
+// NewFailover chains transcribers in order of preference
+func NewFailover(cfg BreakerConfig, transcribers ...Transcriber) (*FailoverTranscriber, error) {
+    if len(transcribers) == 0 {
+        return nil, fmt.Errorf("failover needs at least one provider")
+    }
+    cfg = cfg.withDefaults()
+    f := &FailoverTranscriber{attemptTimeout: cfg.AttemptTimeout}
+    for _, t := range transcribers {
+        member := &failoverMember{Transcriber: t, breaker: &breaker{cfg: cfg}}
+        member.health, _ = unwrapTranscriber(t).(HealthChecker)
+        f.members = append(f.members, member)
+    }
+    return f, nil
+}
+
+// unwrapTranscriber strips the retry and concurrency wrappers
+func unwrapTranscriber(t Transcriber) Transcriber {
+    for {
+        switch wrapped := t.(type) {
+        case *retryTranscriber:
+            t = wrapped.Transcriber
+        case *limitTranscriber:
+            t = wrapped.Transcriber
+        default:
+            return t
+        }
+    }
+}
+
+// Name returns the provider names in order
+func (f *FailoverTranscriber) Name() string {
+    names := make([]string, len(f.members))
+    for i, member := range f.members {
+        names[i] = member.Name()
+    }
+    return "failover(" + strings.Join(names, ",") + ")"
+}
+
+// Features reports what at least one provider supports. WAVOnly is only set
+// when every provider needs WAV, since audio is converted for each provider
+// as it is tried. MaxFileSize is the smallest limit so that chunked audio
+// fits every provider.
+func (f *FailoverTranscriber) Features() Features {
+    var features Features
+    for _, member := range f.members {
+        mf := member.Features()
+        features.Translate = features.Translate || mf.Translate
+        features.Segments = features.Segments || mf.Segments
+        features.WordTimestamps = features.WordTimestamps || mf.WordTimestamps
+        features.Prompt = features.Prompt || mf.Prompt
+        features.Temperature = features.Temperature || mf.Temperature
+        features.Encode = features.Encode || mf.Encode
+        features.RequiresModel = features.RequiresModel || mf.RequiresModel
+        if mf.MaxFileSize > 0 && (features.MaxFileSize == 0 || mf.MaxFileSize < features.MaxFileSize) {
+            features.MaxFileSize = mf.MaxFileSize
+        }
+    }
+    features.WAVOnly = !slices.ContainsFunc(f.members, func(member *failoverMember) bool {
+        return !member.Features().WAVOnly
+    })
+    return features
+}
+
+// withPrepare returns the chain with prepare run for each provider tried.
+// The copy shares the providers and their breakers.
+func (f *FailoverTranscriber) withPrepare(prepare func(Transcriber, *TranscribeRequest) (*TranscribeRequest, error)) *FailoverTranscriber {
+    prepared := *f
+    prepared.prepare = prepare
+    return &prepared
+}
+
+// forMember adapts req to one provider: through prepare when set, and with
+// ShouldEncode only for providers that re-encode
+func (f *FailoverTranscriber) forMember(member *failoverMember, req *TranscribeRequest) (*TranscribeRequest, error) {
+    if f.prepare != nil {
+        prepared, err := f.prepare(member.Transcriber, req)
+        if err != nil {
+            return nil, err
+        }
+        req = prepared
+    }
+    if req.ShouldEncode && !member.Features().Encode {
+        memberReq := *req
+        memberReq.ShouldEncode = false
+        req = &memberReq
+    }
+    return req, nil
+}
+
+// Transcribe sends the request to the first provider that is available and
+// able to honor it, moving on when one fails
+func (f *FailoverTranscriber) Transcribe(ctx context.Context, req *TranscribeRequest) (*TranscribeResponse, error) {
+    var errs []error
+    for _, member := range f.members {
+        now := time.Now()
+        if member.health != nil && member.breaker.shouldProbe(now) {
+            go f.probe(member)
+        }
+        if !member.breaker.allow(now) {
+            errs = append(errs, fmt.Errorf("%s: circuit open", member.Name()))
+            continue
+        }
+        if err := checkFeatures(member, req); err != nil {
+            member.breaker.release()
+            errs = append(errs, err)
+            continue
+        }
+        if len(errs) > 0 && rewindAudio(req) != nil {
+            member.breaker.release()
+            break // The stream was consumed by the previous provider
+        }
+        memberReq, err := f.forMember(member, req)
+        if err != nil {
+            member.breaker.release()
+            errs = append(errs, fmt.Errorf("%s: %w", member.Name(), err))
+            continue
+        }
+
+        // The attempt's own deadline never outlives the caller's
+        attemptCtx, cancel := context.WithTimeout(ctx, f.attemptTimeout)
+        resp, err := member.Transcribe(attemptCtx, memberReq)
+        timedOut := attemptCtx.Err() != nil
+        cancel()
+        if err == nil {
+            member.breaker.success()
+            if resp.Provider == "" {
+                resp.Provider = member.Name()
+            }
+            return resp, nil
+        }
+        if ctx.Err() != nil {
+            member.breaker.release()
+            return nil, err
+        }
+        if timedOut || Retryable(err) || errors.Is(err, context.DeadlineExceeded) {
+            member.breaker.failure(time.Now())
+        } else {
+            // The request was at fault, which says nothing about the
+            // provider's health
+            member.breaker.release()
+        }
+        errs = append(errs, fmt.Errorf("%s: %w", member.Name(), err))
+    }
+    return nil, fmt.Errorf("all whisper providers failed: %w", errors.Join(errs...))
+}
+
+// probe checks an open provider's health
+func (f *FailoverTranscriber) probe(member *failoverMember) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+    member.breaker.probed(member.health.Health(ctx) == nil)
+}
+
+// ProviderStatus is the state of a provider in the chain
+type ProviderStatus struct {
+    Provider string `json:"provider"`
+    Open     bool   `json:"open"` // Skipped because of recent failures
+}
+
+// Status returns the state of each provider in order
+func (f *FailoverTranscriber) Status() []ProviderStatus {
+    status := make([]ProviderStatus, len(f.members))
+    for i, member := range f.members {
+        status[i] = ProviderStatus{Provider: member.Name(), Open: member.breaker.isOpen()}
+    }
+    return status
+}
+
+// probeURL reports an error when url cannot be reached or answers with a
+// server error. Any other status means the server is up.
+func probeURL(ctx context.Context, client *http.Client, url, apiKey string) error {
+    req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+    if err != nil {
+        return err
+    }
+    if apiKey != "" {
+        req.Header.Set("Authorization", "Bearer "+apiKey)
+    }
+    resp, err := client.Do(req)
+    if err != nil {
+        return fmt.Errorf("%w: %w", ErrProviderUnavailable, err)
+    }
+    resp.Body.Close()
+    if resp.StatusCode >= 500 {
+        return fmt.Errorf("%w: health check returned %s", ErrProviderUnavailable, resp.Status)
+    }
+    return nil
+}
+
+// rootURL returns the scheme and host of rawURL, where most servers answer
+// a plain GET
+func rootURL(rawURL string) string {
+    u, err := url.Parse(rawURL)
+    if err != nil {
+        return rawURL
+    }
+    return u.Scheme + "://" + u.Host + "/"
+}
+
+// failoverConfig is the layout of the WHISPER_CONFIG file
+type failoverConfig struct {
+    Providers []ProviderSpec `json:"providers"`
+    Breaker   struct {
+        FailureThreshold int    `json:"failure_threshold"`
+        OpenDuration     string `json:"open_duration"`
+        ProbeInterval    string `json:"probe_interval"`
+        AttemptTimeout   string `json:"attempt_timeout"`
+    } `json:"breaker"`
+}
+
+// LoadProviderConfig reads a JSON file listing providers in order of
+// preference. ${VAR} references are replaced from the environment so keys
+// can stay out of the file.
+func LoadProviderConfig(path string) ([]ProviderSpec, BreakerConfig, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, BreakerConfig{}, fmt.Errorf("failed to read whisper config: %w", err)
+    }
+
+    var cfg failoverConfig
+    if err := json.Unmarshal([]byte(os.ExpandEnv(string(data))), &cfg); err != nil {
+        return nil, BreakerConfig{}, fmt.Errorf("failed to parse whisper config: %w", err)
+    }
+    if len(cfg.Providers) == 0 {
+        return nil, BreakerConfig{}, fmt.Errorf("whisper config %s lists no providers", path)
+    }
+
+    breaker := BreakerConfig{FailureThreshold: cfg.Breaker.FailureThreshold}
+    if cfg.Breaker.OpenDuration != "" {
+        if breaker.OpenDuration, err = time.ParseDuration(cfg.Breaker.OpenDuration); err != nil {
+            return nil, BreakerConfig{}, fmt.Errorf("invalid breaker open_duration: %w", err)
+        }
+    }
+    if cfg.Breaker.ProbeInterval != "" {
+        if breaker.ProbeInterval, err = time.ParseDuration(cfg.Breaker.ProbeInterval); err != nil {
+            return nil, BreakerConfig{}, fmt.Errorf("invalid breaker probe_interval: %w", err)
+        }
+    }
+    if cfg.Breaker.AttemptTimeout != "" {
+        if breaker.AttemptTimeout, err = time.ParseDuration(cfg.Breaker.AttemptTimeout); err != nil {
+            return nil, BreakerConfig{}, fmt.Errorf("invalid breaker attempt_timeout: %w", err)
+        }
+    }
+    return cfg.Providers, breaker, nil
+}
+
+// providerSpecsFromEnv reads WHISPER_PROVIDERS, a comma-separated list of
+// provider names. Each is configured by WHISPER_<NAME>_URL, _KEY and _MODEL;
+// the first falls back to WHISPER_URL, WHISPER_KEY and WHISPER_MODEL.
+func providerSpecsFromEnv(list string) []ProviderSpec {
+    var specs []ProviderSpec
+    for _, name := range strings.Split(list, ",") {
+        name = strings.TrimSpace(name)
+        if name == "" {
+            continue
+        }
+        prefix := "WHISPER_" + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(name)) + "_"
+        spec := ProviderSpec{
+            Provider: name,
+            URL:      os.Getenv(prefix + "URL"),
+            APIKey:   os.Getenv(prefix + "KEY"),
+            Model:    os.Getenv(prefix + "MODEL"),
+        }
+        if len(specs) == 0 {
+            spec.URL = cmp.Or(spec.URL, os.Getenv("WHISPER_URL"))
+            spec.APIKey = cmp.Or(spec.APIKey, os.Getenv("WHISPER_KEY"))
+            spec.Model = cmp.Or(spec.Model, os.Getenv("WHISPER_MODEL"))
+        }
+        specs = append(specs, spec)
+    }
+    return specs
+}
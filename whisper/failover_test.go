@@ -0,0 +1,238 @@
+package whisper_test
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "testing"
+    "time"
+
+    "github.com/gchalakovmmi/PulpuWEB/whisper"
+    "github.com/gchalakovmmi/PulpuWEB/whisper/whispertest"
+)
+
+// withoutHealth hides a provider's health check, so an open breaker stays
+// open until OpenDuration has passed
+type withoutHealth struct {
+    whisper.Transcriber
+}
+
+// failoverService chains primary as groq and backup as openai
+func failoverService(t *testing.T, primary, backup *whispertest.Server, cfg whisper.BreakerConfig, probe bool) (*whisper.TranscribeService, *whisper.FailoverTranscriber) {
+    t.Helper()
+    groq, err := whisper.NewTranscriber("groq", whisper.ProviderConfig{
+        URL: primary.GroqURL(), APIKey: "test", Model: "whisper-large-v3", HTTPClient: primary.Client(),
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    openai, err := whisper.NewTranscriber("openai", whisper.ProviderConfig{
+        URL: backup.OpenAIURL(), APIKey: "test", Model: "whisper-1", HTTPClient: backup.Client(),
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !probe {
+        groq = withoutHealth{groq}
+    }
+
+    failover, err := whisper.NewFailover(cfg, groq, openai)
+    if err != nil {
+        t.Fatal(err)
+    }
+    service := primary.Service("groq")
+    service.Backend = failover
+    return service, failover
+}
+
+// breakerConfig opens a breaker at the first failure and keeps it open
+var breakerConfig = whisper.BreakerConfig{FailureThreshold: 1, OpenDuration: time.Hour, ProbeInterval: time.Hour}
+
+func TestFailover(t *testing.T) {
+    primary, backup := whispertest.New(), whispertest.New()
+    defer primary.Close()
+    defer backup.Close()
+    primary.SetDefault(whispertest.Fail(http.StatusServiceUnavailable))
+    service, failover := failoverService(t, primary, backup, breakerConfig, false)
+
+    resp, err := service.SendToWhisper(context.Background(), wavRequest(t))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if resp.Provider != "openai" || resp.Text != "Hello world." {
+        t.Errorf("got %q from %q, want the backup's answer", resp.Text, resp.Provider)
+    }
+    if backup.Requests()[0].Param("model") != "whisper-1" {
+        t.Errorf("backup got model %q", backup.Requests()[0].Param("model"))
+    }
+    if status := failover.Status(); !status[0].Open || status[1].Open {
+        t.Errorf("status = %+v, want only groq open", status)
+    }
+
+    // The open provider is skipped
+    if _, err := service.SendToWhisper(context.Background(), wavRequest(t)); err != nil {
+        t.Fatal(err)
+    }
+    if len(primary.Requests()) != 1 || len(backup.Requests()) != 2 {
+        t.Errorf("got %d primary and %d backup requests, want 1 and 2", len(primary.Requests()), len(backup.Requests()))
+    }
+}
+
+func TestFailoverBadRequest(t *testing.T) {
+    primary, backup := whispertest.New(), whispertest.New()
+    defer primary.Close()
+    defer backup.Close()
+    primary.Respond(whispertest.Fail(http.StatusBadRequest))
+    service, failover := failoverService(t, primary, backup, breakerConfig, false)
+
+    resp, err := service.SendToWhisper(context.Background(), wavRequest(t))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if resp.Provider != "openai" {
+        t.Errorf("provider = %q, want openai", resp.Provider)
+    }
+    // A rejected request says nothing about the provider's health
+    if failover.Status()[0].Open {
+        t.Error("groq is open after a bad request")
+    }
+    resp, err = service.SendToWhisper(context.Background(), wavRequest(t))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if resp.Provider != "groq" {
+        t.Errorf("provider = %q, want groq", resp.Provider)
+    }
+}
+
+func TestFailoverAttemptTimeout(t *testing.T) {
+    primary, backup := whispertest.New(), whispertest.New()
+    defer primary.Close()
+    defer backup.Close()
+    primary.SetDefault(whispertest.Reply{Text: "too slow", Latency: 10 * time.Second})
+    cfg := breakerConfig
+    cfg.AttemptTimeout = 100 * time.Millisecond
+    service, failover := failoverService(t, primary, backup, cfg, false)
+
+    start := time.Now()
+    resp, err := service.SendToWhisper(context.Background(), wavRequest(t))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if elapsed := time.Since(start); elapsed > 5*time.Second {
+        t.Errorf("took %s, want the hung provider cut off after 100ms", elapsed)
+    }
+    if resp.Provider != "openai" {
+        t.Errorf("provider = %q, want openai", resp.Provider)
+    }
+    if !failover.Status()[0].Open {
+        t.Error("the hung provider is not open")
+    }
+}
+
+func TestFailoverCallerDeadline(t *testing.T) {
+    primary, backup := whispertest.New(), whispertest.New()
+    defer primary.Close()
+    defer backup.Close()
+    primary.SetDefault(whispertest.Reply{Text: "too slow", Latency: 10 * time.Second})
+    service, failover := failoverService(t, primary, backup, breakerConfig, false)
+
+    ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+    defer cancel()
+    _, err := service.SendToWhisper(ctx, wavRequest(t))
+    if !errors.Is(err, context.DeadlineExceeded) {
+        t.Errorf("err = %v, want the caller's deadline", err)
+    }
+    // The caller gave up, so neither provider is to blame
+    if failover.Status()[0].Open {
+        t.Error("groq is open after the caller gave up")
+    }
+    if len(backup.Requests()) != 0 {
+        t.Errorf("backup got %d requests after the caller gave up", len(backup.Requests()))
+    }
+}
+
+func TestFailoverAllFail(t *testing.T) {
+    primary, backup := whispertest.New(), whispertest.New()
+    defer primary.Close()
+    defer backup.Close()
+    primary.SetDefault(whispertest.Fail(http.StatusServiceUnavailable))
+    backup.SetDefault(whispertest.Fail(http.StatusBadGateway))
+    service, _ := failoverService(t, primary, backup, breakerConfig, false)
+
+    _, err := service.SendToWhisper(context.Background(), wavRequest(t))
+    if !errors.Is(err, whisper.ErrProviderUnavailable) {
+        t.Errorf("err = %v, want ErrProviderUnavailable", err)
+    }
+    if whisper.HTTPStatus(err) != http.StatusServiceUnavailable {
+        t.Errorf("HTTPStatus = %d, want 503", whisper.HTTPStatus(err))
+    }
+
+    // Both are open now
+    _, err = service.SendToWhisper(context.Background(), wavRequest(t))
+    if err == nil || len(primary.Requests()) != 1 || len(backup.Requests()) != 1 {
+        t.Errorf("err = %v after %d and %d requests, want both skipped", err, len(primary.Requests()), len(backup.Requests()))
+    }
+}
+
+func TestFailoverProbe(t *testing.T) {
+    primary, backup := whispertest.New(), whispertest.New()
+    defer primary.Close()
+    defer backup.Close()
+    primary.Respond(whispertest.Fail(http.StatusServiceUnavailable))
+    cfg := breakerConfig
+    cfg.ProbeInterval = time.Millisecond
+    service, failover := failoverService(t, primary, backup, cfg, true)
+
+    if _, err := service.SendToWhisper(context.Background(), wavRequest(t)); err != nil {
+        t.Fatal(err)
+    }
+    // The next request starts a health probe, which succeeds
+    if _, err := service.SendToWhisper(context.Background(), wavRequest(t)); err != nil {
+        t.Fatal(err)
+    }
+    deadline := time.Now().Add(5 * time.Second)
+    for failover.Status()[0].Open {
+        if time.Now().After(deadline) {
+            t.Fatal("groq did not rejoin after a healthy probe")
+        }
+        time.Sleep(5 * time.Millisecond)
+    }
+
+    resp, err := service.SendToWhisper(context.Background(), wavRequest(t))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if resp.Provider != "groq" {
+        t.Errorf("provider = %q, want groq", resp.Provider)
+    }
+}
+
+func TestFailoverFeatures(t *testing.T) {
+    cpp, err := whisper.NewTranscriber("whispercpp", whisper.ProviderConfig{URL: "http://localhost:8080/inference"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    docker, err := whisper.NewTranscriber("docker", whisper.ProviderConfig{URL: "http://localhost:9000/asr"})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    mixed, err := whisper.NewFailover(whisper.BreakerConfig{}, cpp, docker)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // Audio is converted per provider, so one WAV-only member does not
+    // force conversion for the others
+    if features := mixed.Features(); features.WAVOnly || !features.Encode {
+        t.Errorf("features = %+v, want WAVOnly off and Encode on", features)
+    }
+
+    wavOnly, err := whisper.NewFailover(whisper.BreakerConfig{}, cpp, cpp)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !wavOnly.Features().WAVOnly {
+        t.Error("a chain of WAV-only providers is not WAVOnly")
+    }
+}
@@ -0,0 +1,283 @@
+package whisper
+
+import (
+    "bytes"
+    "cmp"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "slices"
+    "strconv"
+    "strings"
+)
+
+// Response formats accepted by Handler
+var ResponseFormats = []string{"json", "text", FormatSRT, FormatVTT, "verbose_json"}
+
+// Middleware wraps an http.Handler, e.g. to check credentials or quotas
+type Middleware func(http.Handler) http.Handler
+
+// HandlerOptions configures Handler. Zero fields take the defaults noted
+// below.
+type HandlerOptions struct {
+    Prefix string       // Path before /transcriptions and /translations, "/v1/audio"
+    Upload UploadConfig // Limits for the upload; FieldName defaults to "file"
+    // Models maps the model names clients send to provider models, "" for
+    // the service default; other names are rejected. When nil the model
+    // field is ignored, since OpenAI clients always send one, e.g.
+    // "whisper-1".
+    Models   map[string]string
+    Captions CaptionOptions // Layout of srt and vtt responses
+    // Middleware wraps the endpoints, the first one outermost. Use
+    // WriteAPIError to reject requests in the API's error format.
+    Middleware []Middleware
+    // BeforeTranscribe is called with the validated upload before it is
+    // sent, e.g. to charge its duration against a quota. Returning an
+    // *APIError sets the status, other errors give 403.
+    BeforeTranscribe func(r *http.Request, upload *Upload) error
+}
+
+// withDefaults fills the zero fields
+func (opts HandlerOptions) withDefaults() HandlerOptions {
+    if opts.Prefix == "" {
+        opts.Prefix = "/v1/audio"
+    }
+    opts.Prefix = strings.TrimSuffix(opts.Prefix, "/")
+    if opts.Upload.FieldName == "" {
+        opts.Upload.FieldName = "file"
+    }
+    opts.Upload = opts.Upload.withDefaults()
+    return opts
+}
+
+// APIError is an error in the OpenAI error format
+type APIError struct {
+    Status  int    `json:"-"`
+    Message string `json:"message"`
+    Type    string `json:"type"`
+    Param   string `json:"param,omitempty"`
+    Code    string `json:"code,omitempty"`
+}
+
+func (e *APIError) Error() string {
+    return e.Message
+}
+
+// errorType names the OpenAI error type of a status
+func errorType(status int) string {
+    switch {
+    case status == http.StatusUnauthorized:
+        return "authentication_error"
+    case status == http.StatusForbidden:
+        return "permission_error"
+    case status == http.StatusTooManyRequests:
+        return "rate_limit_error"
+    case status >= 500:
+        return "server_error"
+    }
+    return "invalid_request_error"
+}
+
+// WriteAPIError writes err as {"error": {...}}. The status of an *APIError
+// is used as is; other errors are mapped with HTTPStatus.
+func WriteAPIError(w http.ResponseWriter, err error) {
+    var apiErr *APIError
+    if !errors.As(err, &apiErr) {
+        apiErr = &APIError{Status: HTTPStatus(err), Message: err.Error()}
+    }
+    e := *apiErr
+    if e.Status == 0 {
+        e.Status = http.StatusBadRequest
+    }
+    if e.Type == "" {
+        e.Type = errorType(e.Status)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(e.Status)
+    json.NewEncoder(w).Encode(map[string]*APIError{"error": &e})
+}
+
+// BearerAuth rejects requests without an "Authorization: Bearer" token
+// accepted by check
+func BearerAuth(check func(r *http.Request, token string) bool) Middleware {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+            if !ok || token == "" || !check(r, token) {
+                w.Header().Set("WWW-Authenticate", `Bearer realm="whisper"`)
+                WriteAPIError(w, &APIError{
+                    Status:  http.StatusUnauthorized,
+                    Message: "missing or invalid API key",
+                    Code:    "invalid_api_key",
+                })
+                return
+            }
+            next.ServeHTTP(w, r)
+        })
+    }
+}
+
+// apiHandler serves the OpenAI-compatible endpoints
+type apiHandler struct {
+    service *TranscribeService
+    opts    HandlerOptions
+}
+
+// Handler serves an OpenAI-compatible transcription API backed by service:
+// POST {Prefix}/transcriptions and {Prefix}/translations take a multipart
+// upload with the fields file, model, language, prompt, temperature,
+// response_format and timestamp_granularities[]. Errors are JSON in the
+// OpenAI format.
+func Handler(service *TranscribeService, opts HandlerOptions) http.Handler {
+    h := &apiHandler{service: service, opts: opts.withDefaults()}
+
+    mux := http.NewServeMux()
+    mux.HandleFunc(h.opts.Prefix+"/transcriptions", h.endpoint(TaskTranscribe))
+    mux.HandleFunc(h.opts.Prefix+"/translations", h.endpoint(TaskTranslate))
+    mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+        WriteAPIError(w, &APIError{Status: http.StatusNotFound, Message: "unknown endpoint " + r.URL.Path})
+    })
+
+    var handler http.Handler = mux
+    for _, middleware := range slices.Backward(h.opts.Middleware) {
+        handler = middleware(handler)
+    }
+    return handler
+}
+
+// endpoint returns the handler for a task
+func (h *apiHandler) endpoint(task string) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+            w.Header().Set("Allow", http.MethodPost)
+            WriteAPIError(w, &APIError{Status: http.StatusMethodNotAllowed, Message: "use POST"})
+            return
+        }
+
+        r.Body = http.MaxBytesReader(w, r.Body, h.opts.Upload.MaxSize+1<<20)
+        upload, err := ReadAudioUpload(r, h.opts.Upload)
+        if err != nil {
+            WriteAPIError(w, &APIError{Status: UploadStatus(err), Message: err.Error(), Param: h.opts.Upload.FieldName})
+            return
+        }
+        defer upload.Close()
+
+        req, format, err := parseRequest(r, h.service, h.opts.Models, task)
+        if err != nil {
+            WriteAPIError(w, err)
+            return
+        }
+        req.Audio = upload
+        req.FileName = upload.FileName
+
+        if h.opts.BeforeTranscribe != nil {
+            if err := h.opts.BeforeTranscribe(r, upload); err != nil {
+                var apiErr *APIError
+                if !errors.As(err, &apiErr) {
+                    err = &APIError{Status: http.StatusForbidden, Message: err.Error()}
+                }
+                WriteAPIError(w, err)
+                return
+            }
+        }
+
+        resp, err := h.service.SendToWhisper(r.Context(), req)
+        if err != nil {
+            WriteAPIError(w, err)
+            return
+        }
+        h.write(w, format, task, resp)
+    }
+}
+
+// parseRequest builds a TranscribeRequest from the form fields of an upload
+// and returns the response format. models works as HandlerOptions.Models.
+// Errors are *APIError.
+func parseRequest(r *http.Request, service *TranscribeService, models map[string]string, task string) (*TranscribeRequest, string, error) {
+    format := cmp.Or(r.FormValue("response_format"), "json")
+    if !slices.Contains(ResponseFormats, format) {
+        return nil, "", &APIError{
+            Message: fmt.Sprintf("response_format must be one of %s", strings.Join(ResponseFormats, ", ")),
+            Param:   "response_format",
+        }
+    }
+
+    features, err := service.Features()
+    if err != nil {
+        return nil, "", &APIError{Status: http.StatusInternalServerError, Message: err.Error()}
+    }
+    req := &TranscribeRequest{
+        // Browsers upload WebM or Ogg, which the server has to decode
+        ShouldEncode:           features.Encode,
+        Language:               r.FormValue("language"),
+        Task:                   task,
+        OutputFormat:           "json",
+        Prompt:                 r.FormValue("prompt"),
+        TimestampGranularities: r.Form["timestamp_granularities[]"],
+    }
+    // Captions need segments
+    if format != "json" && format != "text" {
+        req.OutputFormat = "verbose_json"
+    }
+
+    if models != nil {
+        model, ok := models[r.FormValue("model")]
+        if !ok {
+            return nil, "", &APIError{
+                Message: fmt.Sprintf("model %q does not exist", r.FormValue("model")),
+                Param:   "model",
+                Code:    "model_not_found",
+            }
+        }
+        req.Model = model
+    }
+
+    if temp := r.FormValue("temperature"); temp != "" {
+        req.Temperature, err = strconv.ParseFloat(temp, 64)
+        if err != nil || req.Temperature < 0 || req.Temperature > 1 {
+            return nil, "", &APIError{Message: "temperature must be a number between 0 and 1", Param: "temperature"}
+        }
+    }
+    return req, format, nil
+}
+
+// write sends the transcript in the requested format
+func (h *apiHandler) write(w http.ResponseWriter, format, task string, resp *TranscribeResponse) {
+    switch format {
+    case "json":
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]string{"text": resp.Text})
+    case "verbose_json":
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(struct {
+            Task string `json:"task"`
+            *TranscribeResponse
+        }{task, resp})
+    case "text":
+        w.Header().Set("Content-Type", CaptionContentType(FormatText))
+        io.WriteString(w, strings.TrimSpace(resp.Text)+"\n")
+    default:
+        var buf bytes.Buffer
+        err := Render(&buf, format, resp, h.opts.Captions)
+        if errors.Is(err, ErrNoSegments) && strings.TrimSpace(resp.Text) == "" {
+            // Nothing was said
+            buf.Reset()
+            if format == FormatVTT {
+                buf.WriteString("WEBVTT\n\n")
+            }
+            err = nil
+        }
+        if err != nil {
+            WriteAPIError(w, &APIError{
+                Status:  http.StatusBadGateway,
+                Message: fmt.Sprintf("failed to render %s: %v", format, err),
+            })
+            return
+        }
+        w.Header().Set("Content-Type", CaptionContentType(format))
+        w.Write(buf.Bytes())
+    }
+}
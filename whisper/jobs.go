@@ -0,0 +1,781 @@
+package whisper
+
+import (
+    "bytes"
+    "context"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "net/url"
+    "slices"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/gchalakovmmi/PulpuWEB/db"
+    "github.com/jackc/pgx/v5"
+)
+
+// JobStatus is the state of an asynchronous transcription
+type JobStatus string
+
+// Job states
+const (
+    JobQueued    JobStatus = "queued"
+    JobRunning   JobStatus = "running"
+    JobSucceeded JobStatus = "succeeded"
+    JobFailed    JobStatus = "failed"
+    JobCanceled  JobStatus = "canceled"
+)
+
+var (
+    ErrJobNotFound       = errors.New("transcription job not found")
+    ErrJobFinished       = errors.New("transcription job already finished")
+    ErrWebhookNotAllowed = errors.New("webhook URL not allowed")
+)
+
+// Job is an asynchronous transcription. The audio is kept in Postgres
+// until the job finishes.
+type Job struct {
+    ID          string              `json:"id"`
+    Status      JobStatus           `json:"status"`
+    FileName    string              `json:"file_name"`
+    Attempts    int                 `json:"attempts"`
+    MaxAttempts int                 `json:"max_attempts"`
+    ChunksDone  int                 `json:"chunks_done"`  // Chunks transcribed so far
+    ChunksTotal int                 `json:"chunks_total"` // 0 until the audio is split
+    Result      *TranscribeResponse `json:"result,omitempty"`
+    Error       string              `json:"error,omitempty"`
+    WebhookURL  string              `json:"-"`
+    CreatedAt   time.Time           `json:"created_at"`
+    UpdatedAt   time.Time           `json:"updated_at"`
+    FinishedAt  *time.Time          `json:"finished_at,omitempty"`
+}
+
+// Done reports whether the job reached a final state
+func (j *Job) Done() bool {
+    return j.Status == JobSucceeded || j.Status == JobFailed || j.Status == JobCanceled
+}
+
+// JobConfig tunes a JobQueue. Zero fields take the defaults noted below.
+type JobConfig struct {
+    Workers     int           // Jobs transcribed at once by this process, 2
+    MaxAttempts int           // Tries per job including the first, 3
+    Retry       RetryConfig   // Backoff between tries, from 10s up to 10m
+    Poll        time.Duration // How often idle workers and SSE streams look for changes, 1s
+    // Heartbeat is how often a running job is marked alive, 10s. Jobs
+    // without a heartbeat for StaleAfter, 1m, are picked up again, e.g.
+    // after a crash.
+    Heartbeat  time.Duration
+    StaleAfter time.Duration
+    BasePath   string       // Path the handler is mounted at, "/transcriptions"
+    Upload     UploadConfig // Limits for submitted files
+    // Models maps the model names clients send to provider models, as
+    // HandlerOptions.Models does
+    Models map[string]string
+
+    // AllowWebhook decides which webhook URLs jobs may be submitted with.
+    // The server POSTs to them, so the default, nil, refuses all of them;
+    // WebhookHosts builds an allow-list.
+    AllowWebhook func(u *url.URL) bool
+    // WebhookSecret, when set, signs webhook bodies with HMAC-SHA256 in
+    // the X-Whisper-Signature header
+    WebhookSecret string
+    // HTTPClient sends webhooks. The default has a 30s timeout and does
+    // not follow redirects, which could lead away from allowed hosts.
+    HTTPClient *http.Client
+}
+
+// WebhookHosts allows https webhooks to the given hosts, e.g.
+// "hooks.example.com" or "hooks.example.com:8443"
+func WebhookHosts(hosts ...string) func(u *url.URL) bool {
+    return func(u *url.URL) bool {
+        return u.Scheme == "https" && u.User == nil && slices.Contains(hosts, u.Host)
+    }
+}
+
+// withDefaults fills the zero fields
+func (cfg JobConfig) withDefaults() JobConfig {
+    if cfg.Workers <= 0 {
+        cfg.Workers = 2
+    }
+    if cfg.MaxAttempts <= 0 {
+        cfg.MaxAttempts = 3
+    }
+    if cfg.Retry.BaseDelay <= 0 {
+        cfg.Retry.BaseDelay = 10 * time.Second
+    }
+    if cfg.Retry.MaxDelay <= 0 {
+        cfg.Retry.MaxDelay = 10 * time.Minute
+    }
+    if cfg.Poll <= 0 {
+        cfg.Poll = time.Second
+    }
+    if cfg.Heartbeat <= 0 {
+        cfg.Heartbeat = 10 * time.Second
+    }
+    if cfg.StaleAfter <= 0 {
+        cfg.StaleAfter = time.Minute
+    }
+    if cfg.BasePath == "" {
+        cfg.BasePath = "/transcriptions"
+    }
+    cfg.BasePath = strings.TrimSuffix(cfg.BasePath, "/")
+    if cfg.HTTPClient == nil {
+        cfg.HTTPClient = &http.Client{
+            Timeout: 30 * time.Second,
+            CheckRedirect: func(*http.Request, []*http.Request) error {
+                return http.ErrUseLastResponse
+            },
+        }
+    }
+    cfg.Upload = cfg.Upload.withDefaults()
+    return cfg
+}
+
+// jobOptions are the request fields stored with a job
+type jobOptions struct {
+    Language               string   `json:"language,omitempty"`
+    Task                   string   `json:"task,omitempty"`
+    OutputFormat           string   `json:"output_format,omitempty"`
+    ShouldEncode           bool     `json:"should_encode,omitempty"`
+    Model                  string   `json:"model,omitempty"`
+    Prompt                 string   `json:"prompt,omitempty"`
+    Vocabulary             []string `json:"vocabulary,omitempty"`
+    Temperature            float64  `json:"temperature,omitempty"`
+    TimestampGranularities []string `json:"timestamp_granularities,omitempty"`
+}
+
+// JobQueue runs transcriptions in the background, keeping their state in
+// Postgres so several processes can share the work. It serves the status
+// API as an http.Handler.
+type JobQueue struct {
+    service *TranscribeService
+    db      db.Querier
+    cfg     JobConfig
+    mux     *http.ServeMux
+    wake    chan struct{}
+
+    mu      sync.Mutex
+    running map[string]context.CancelFunc
+}
+
+// NewJobQueue creates a queue that transcribes with service. Call Migrate
+// once and Run to start the workers.
+func NewJobQueue(service *TranscribeService, q db.Querier, cfg JobConfig) *JobQueue {
+    jq := &JobQueue{
+        service: service,
+        db:      q,
+        cfg:     cfg.withDefaults(),
+        wake:    make(chan struct{}, 1),
+        running: make(map[string]context.CancelFunc),
+    }
+
+    base := jq.cfg.BasePath
+    jq.mux = http.NewServeMux()
+    jq.mux.HandleFunc("POST "+base, jq.submitHandler)
+    jq.mux.HandleFunc("GET "+base+"/{id}", jq.getHandler)
+    jq.mux.HandleFunc("DELETE "+base+"/{id}", jq.cancelHandler)
+    jq.mux.HandleFunc("GET "+base+"/{id}/events", jq.eventsHandler)
+    return jq
+}
+
+const jobsSchema = `
+CREATE TABLE IF NOT EXISTS whisper_jobs (
+    id           TEXT PRIMARY KEY,
+    status       TEXT NOT NULL,
+    file_name    TEXT NOT NULL DEFAULT '',
+    options      JSONB NOT NULL,
+    audio        BYTEA,
+    webhook_url  TEXT NOT NULL DEFAULT '',
+    attempts     INT NOT NULL DEFAULT 0,
+    max_attempts INT NOT NULL,
+    chunks_done  INT NOT NULL DEFAULT 0,
+    chunks_total INT NOT NULL DEFAULT 0,
+    result       JSONB,
+    error        TEXT NOT NULL DEFAULT '',
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    run_at       TIMESTAMPTZ NOT NULL DEFAULT now(),
+    heartbeat_at TIMESTAMPTZ,
+    finished_at  TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS whisper_jobs_queue_idx ON whisper_jobs (run_at) WHERE status IN ('queued', 'running');
+`
+
+// Migrate creates the jobs table
+func (jq *JobQueue) Migrate(ctx context.Context) error {
+    _, err := jq.db.Exec(ctx, jobsSchema)
+    return err
+}
+
+// newJobID returns a random job ID
+func newJobID() (string, error) {
+    b := make([]byte, 16)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(b), nil
+}
+
+// Submit stores the request's audio and options as a queued job. The audio
+// is read completely; the Timeout and Progress fields are not kept. Job
+// changes are POSTed to webhookURL when it is not empty and
+// JobConfig.AllowWebhook accepts it.
+func (jq *JobQueue) Submit(ctx context.Context, req *TranscribeRequest, webhookURL string) (*Job, error) {
+    if webhookURL != "" {
+        u, err := url.Parse(webhookURL)
+        if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+            return nil, fmt.Errorf("invalid webhook URL %q", webhookURL)
+        }
+        if jq.cfg.AllowWebhook == nil || !jq.cfg.AllowWebhook(u) {
+            return nil, fmt.Errorf("%w: %s", ErrWebhookNotAllowed, webhookURL)
+        }
+    }
+
+    audio, err := io.ReadAll(req.audio())
+    if err != nil {
+        return nil, fmt.Errorf("failed to read audio: %w", err)
+    }
+    options, err := json.Marshal(jobOptions{
+        Language:               req.Language,
+        Task:                   req.Task,
+        OutputFormat:           req.OutputFormat,
+        ShouldEncode:           req.ShouldEncode,
+        Model:                  req.Model,
+        Prompt:                 req.Prompt,
+        Vocabulary:             req.Vocabulary,
+        Temperature:            req.Temperature,
+        TimestampGranularities: req.TimestampGranularities,
+    })
+    if err != nil {
+        return nil, err
+    }
+    id, err := newJobID()
+    if err != nil {
+        return nil, fmt.Errorf("failed to generate job ID: %w", err)
+    }
+
+    _, err = jq.db.Exec(ctx,
+        `INSERT INTO whisper_jobs (id, status, file_name, options, audio, webhook_url, max_attempts)
+         VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+        id, JobQueued, req.FileName, options, audio, webhookURL, jq.cfg.MaxAttempts)
+    if err != nil {
+        return nil, fmt.Errorf("failed to store job: %w", err)
+    }
+
+    select {
+    case jq.wake <- struct{}{}:
+    default:
+    }
+    return jq.Get(ctx, id)
+}
+
+const jobColumns = `id, status, file_name, attempts, max_attempts, chunks_done, chunks_total,
+    result, error, webhook_url, created_at, updated_at, finished_at`
+
+// scanJob reads a row selected with jobColumns
+func scanJob(row pgx.Row) (*Job, error) {
+    var job Job
+    var result []byte
+    err := row.Scan(&job.ID, &job.Status, &job.FileName, &job.Attempts, &job.MaxAttempts,
+        &job.ChunksDone, &job.ChunksTotal, &result, &job.Error, &job.WebhookURL,
+        &job.CreatedAt, &job.UpdatedAt, &job.FinishedAt)
+    if errors.Is(err, pgx.ErrNoRows) {
+        return nil, ErrJobNotFound
+    }
+    if err != nil {
+        return nil, err
+    }
+    if result != nil {
+        if err := json.Unmarshal(result, &job.Result); err != nil {
+            return nil, fmt.Errorf("failed to decode job result: %w", err)
+        }
+    }
+    return &job, nil
+}
+
+// Get returns a job by ID, with the result once it succeeded
+func (jq *JobQueue) Get(ctx context.Context, id string) (*Job, error) {
+    return scanJob(jq.db.QueryRow(ctx, `SELECT `+jobColumns+` FROM whisper_jobs WHERE id = $1`, id))
+}
+
+// Cancel stops a queued or running job. A job running in another process
+// stops at its next heartbeat.
+func (jq *JobQueue) Cancel(ctx context.Context, id string) (*Job, error) {
+    job, err := scanJob(jq.db.QueryRow(ctx,
+        `UPDATE whisper_jobs SET status = $2, audio = NULL, updated_at = now(), finished_at = now()
+         WHERE id = $1 AND status IN ('queued', 'running')
+         RETURNING `+jobColumns,
+        id, JobCanceled))
+    if errors.Is(err, ErrJobNotFound) {
+        if _, err := jq.Get(ctx, id); err != nil {
+            return nil, err
+        }
+        return nil, ErrJobFinished
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    jq.mu.Lock()
+    if cancel, ok := jq.running[id]; ok {
+        cancel()
+    }
+    jq.mu.Unlock()
+
+    jq.notify(job)
+    return job, nil
+}
+
+// Run transcribes queued jobs with cfg.Workers workers until ctx is done.
+// Jobs interrupted by the shutdown are queued again.
+func (jq *JobQueue) Run(ctx context.Context) {
+    var wg sync.WaitGroup
+    for range jq.cfg.Workers {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            jq.work(ctx)
+        }()
+    }
+    wg.Wait()
+}
+
+// work claims and runs jobs until ctx is done
+func (jq *JobQueue) work(ctx context.Context) {
+    ticker := time.NewTicker(jq.cfg.Poll)
+    defer ticker.Stop()
+    for {
+        claimed, err := jq.claim(ctx)
+        if err != nil && ctx.Err() == nil {
+            log.Println("whisper jobs:", err)
+        }
+        if claimed != nil {
+            jq.run(ctx, claimed)
+            continue
+        }
+
+        select {
+        case <-ctx.Done():
+            return
+        case <-jq.wake:
+        case <-ticker.C:
+        }
+    }
+}
+
+// claimedJob is a job taken by a worker
+type claimedJob struct {
+    id          string
+    fileName    string
+    options     jobOptions
+    audio       []byte
+    attempts    int
+    maxAttempts int
+}
+
+// claim takes the next due job, or a running job whose worker went silent
+// and that has attempts left. SKIP LOCKED lets workers in several processes
+// claim concurrently.
+func (jq *JobQueue) claim(ctx context.Context) (*claimedJob, error) {
+    if err := jq.failStale(ctx); err != nil {
+        return nil, err
+    }
+
+    var job claimedJob
+    var options []byte
+    err := jq.db.QueryRow(ctx,
+        `UPDATE whisper_jobs
+         SET status = 'running', attempts = attempts + 1, chunks_done = 0, heartbeat_at = now(), updated_at = now()
+         WHERE id = (
+             SELECT id FROM whisper_jobs
+             WHERE (status = 'queued' AND run_at <= now())
+                OR (status = 'running' AND heartbeat_at < now() - make_interval(secs => $1)
+                    AND attempts < max_attempts)
+             ORDER BY run_at
+             LIMIT 1
+             FOR UPDATE SKIP LOCKED)
+         RETURNING id, file_name, options, audio, attempts, max_attempts`,
+        jq.cfg.StaleAfter.Seconds()).Scan(&job.id, &job.fileName, &options, &job.audio, &job.attempts, &job.maxAttempts)
+    if errors.Is(err, pgx.ErrNoRows) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, fmt.Errorf("failed to claim job: %w", err)
+    }
+    if err := json.Unmarshal(options, &job.options); err != nil {
+        return nil, fmt.Errorf("failed to decode options of job %s: %w", job.id, err)
+    }
+    return &job, nil
+}
+
+// failStale fails running jobs whose worker went silent on their last
+// attempt, e.g. because the job keeps crashing it
+func (jq *JobQueue) failStale(ctx context.Context) error {
+    rows, err := jq.db.Query(ctx,
+        `UPDATE whisper_jobs
+         SET status = $2, error = $3, audio = NULL, updated_at = now(), finished_at = now()
+         WHERE status = 'running' AND heartbeat_at < now() - make_interval(secs => $1)
+           AND attempts >= max_attempts
+         RETURNING `+jobColumns,
+        jq.cfg.StaleAfter.Seconds(), JobFailed, "worker stopped responding on the last attempt")
+    if err != nil {
+        return fmt.Errorf("failed to expire stale jobs: %w", err)
+    }
+    var failed []*Job
+    for rows.Next() {
+        job, err := scanJob(rows)
+        if err != nil {
+            rows.Close()
+            return err
+        }
+        failed = append(failed, job)
+    }
+    if err := rows.Err(); err != nil {
+        return fmt.Errorf("failed to expire stale jobs: %w", err)
+    }
+    for _, job := range failed {
+        jq.notify(job)
+    }
+    return nil
+}
+
+// run transcribes a claimed job and records the outcome
+func (jq *JobQueue) run(ctx context.Context, job *claimedJob) {
+    jobCtx, cancel := context.WithCancel(ctx)
+    defer cancel()
+    jq.mu.Lock()
+    jq.running[job.id] = cancel
+    jq.mu.Unlock()
+    defer func() {
+        jq.mu.Lock()
+        delete(jq.running, job.id)
+        jq.mu.Unlock()
+    }()
+
+    // Outcomes are stored even when the worker is shutting down
+    store := context.WithoutCancel(ctx)
+
+    go jq.heartbeat(jobCtx, job.id, cancel)
+
+    opts := job.options
+    req := &TranscribeRequest{
+        Audio:                  bytes.NewReader(job.audio),
+        FileName:               job.fileName,
+        Language:               opts.Language,
+        Task:                   opts.Task,
+        OutputFormat:           opts.OutputFormat,
+        ShouldEncode:           opts.ShouldEncode,
+        Model:                  opts.Model,
+        Prompt:                 opts.Prompt,
+        Vocabulary:             opts.Vocabulary,
+        Temperature:            opts.Temperature,
+        TimestampGranularities: opts.TimestampGranularities,
+        Progress: func(done, total int) {
+            _, err := jq.db.Exec(store,
+                `UPDATE whisper_jobs SET chunks_done = $2, chunks_total = $3, updated_at = now()
+                 WHERE id = $1 AND status = 'running'`,
+                job.id, done, total)
+            if err != nil {
+                log.Println("whisper jobs:", err)
+            }
+        },
+    }
+
+    resp, err := jq.service.SendToWhisper(jobCtx, req)
+    switch {
+    case err == nil:
+        result, err := json.Marshal(resp)
+        if err != nil {
+            jq.finish(store, job.id, JobFailed, nil, err)
+            return
+        }
+        jq.finish(store, job.id, JobSucceeded, result, nil)
+    case ctx.Err() != nil:
+        // Shutting down: hand the job to the next worker without
+        // counting this attempt
+        _, err := jq.db.Exec(store,
+            `UPDATE whisper_jobs SET status = 'queued', attempts = attempts - 1, updated_at = now()
+             WHERE id = $1 AND status = 'running'`,
+            job.id)
+        if err != nil {
+            log.Println("whisper jobs:", err)
+        }
+    case jobCtx.Err() != nil:
+        // Canceled; Cancel already recorded it
+    case Retryable(err) && job.attempts < job.maxAttempts:
+        _, dbErr := jq.db.Exec(store,
+            `UPDATE whisper_jobs
+             SET status = 'queued', error = $2, run_at = now() + make_interval(secs => $3), updated_at = now()
+             WHERE id = $1 AND status = 'running'`,
+            job.id, err.Error(), jq.cfg.Retry.backoff(job.attempts).Seconds())
+        if dbErr != nil {
+            log.Println("whisper jobs:", dbErr)
+        }
+    default:
+        jq.finish(store, job.id, JobFailed, nil, err)
+    }
+}
+
+// heartbeat keeps a running job claimed and cancels it once it was
+// canceled elsewhere
+func (jq *JobQueue) heartbeat(ctx context.Context, id string, cancel context.CancelFunc) {
+    ticker := time.NewTicker(jq.cfg.Heartbeat)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+        tag, err := jq.db.Exec(ctx,
+            `UPDATE whisper_jobs SET heartbeat_at = now() WHERE id = $1 AND status = 'running'`, id)
+        if err != nil {
+            if ctx.Err() == nil {
+                log.Println("whisper jobs:", err)
+            }
+            continue
+        }
+        if tag.RowsAffected() == 0 {
+            cancel()
+            return
+        }
+    }
+}
+
+// finish records a final state, drops the audio and sends the webhook
+func (jq *JobQueue) finish(ctx context.Context, id string, status JobStatus, result []byte, jobErr error) {
+    message := ""
+    if jobErr != nil {
+        message = jobErr.Error()
+    }
+    job, err := scanJob(jq.db.QueryRow(ctx,
+        `UPDATE whisper_jobs
+         SET status = $2, result = $3, error = $4, audio = NULL, updated_at = now(), finished_at = now()
+         WHERE id = $1 AND status = 'running'
+         RETURNING `+jobColumns,
+        id, status, result, message))
+    if errors.Is(err, ErrJobNotFound) {
+        return // Canceled meanwhile
+    }
+    if err != nil {
+        log.Println("whisper jobs:", err)
+        return
+    }
+    jq.notify(job)
+}
+
+// notify POSTs the job to its webhook in the background
+func (jq *JobQueue) notify(job *Job) {
+    if job.WebhookURL == "" {
+        return
+    }
+    go func() {
+        if err := jq.sendWebhook(job); err != nil {
+            log.Printf("whisper jobs: webhook for %s: %v", job.ID, err)
+        }
+    }()
+}
+
+// sendWebhook delivers a job, retrying failed deliveries a few times
+func (jq *JobQueue) sendWebhook(job *Job) error {
+    body, err := json.Marshal(job)
+    if err != nil {
+        return err
+    }
+    retry := RetryConfig{BaseDelay: time.Second, MaxDelay: 30 * time.Second}.withDefaults()
+    for attempt := 1; ; attempt++ {
+        err = jq.postWebhook(job, body)
+        if err == nil || attempt >= 5 {
+            return err
+        }
+        time.Sleep(retry.backoff(attempt))
+    }
+}
+
+// postWebhook makes one delivery attempt
+func (jq *JobQueue) postWebhook(job *Job, body []byte) error {
+    httpReq, err := http.NewRequest(http.MethodPost, job.WebhookURL, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    httpReq.Header.Set("Content-Type", "application/json")
+    httpReq.Header.Set("X-Whisper-Job", job.ID)
+    if jq.cfg.WebhookSecret != "" {
+        mac := hmac.New(sha256.New, []byte(jq.cfg.WebhookSecret))
+        mac.Write(body)
+        httpReq.Header.Set("X-Whisper-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+    }
+
+    resp, err := jq.cfg.HTTPClient.Do(httpReq)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    io.Copy(io.Discard, io.LimitReader(resp.Body, maxErrorBody))
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        return fmt.Errorf("webhook returned %s", resp.Status)
+    }
+    return nil
+}
+
+// ServeHTTP serves the job API under cfg.BasePath:
+//
+//	POST   /transcriptions             submit a multipart upload, 202 with the job
+//	GET    /transcriptions/{id}        job status, with the result when done
+//	DELETE /transcriptions/{id}        cancel
+//	GET    /transcriptions/{id}/events Server-Sent Events until the job is done
+func (jq *JobQueue) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    jq.mux.ServeHTTP(w, r)
+}
+
+// writeJobJSON writes v as a JSON response
+func writeJobJSON(w http.ResponseWriter, status int, v any) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(v)
+}
+
+// writeJobError writes err as a JSON error response
+func writeJobError(w http.ResponseWriter, status int, err error) {
+    writeJobJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// jobErrorStatus maps a job API error to an HTTP status
+func jobErrorStatus(err error) int {
+    switch {
+    case errors.Is(err, ErrJobNotFound):
+        return http.StatusNotFound
+    case errors.Is(err, ErrJobFinished):
+        return http.StatusConflict
+    }
+    return http.StatusInternalServerError
+}
+
+// submitHandler queues an uploaded file with the optional fields language,
+// task, response_format, model, prompt, temperature,
+// timestamp_granularities[] and webhook_url. They are checked as Handler
+// checks them.
+func (jq *JobQueue) submitHandler(w http.ResponseWriter, r *http.Request) {
+    r.Body = http.MaxBytesReader(w, r.Body, jq.cfg.Upload.MaxSize+1<<20)
+    upload, err := ReadAudioUpload(r, jq.cfg.Upload)
+    if err != nil {
+        writeJobError(w, UploadStatus(err), err)
+        return
+    }
+    defer upload.Close()
+
+    req, _, err := parseRequest(r, jq.service, jq.cfg.Models, r.FormValue("task"))
+    if err == nil {
+        req.Audio = upload
+        req.FileName = upload.FileName
+        err = jq.checkRequest(req)
+    }
+    if err != nil {
+        var apiErr *APIError
+        if errors.As(err, &apiErr) && apiErr.Status != 0 {
+            writeJobError(w, apiErr.Status, err)
+        } else {
+            writeJobError(w, http.StatusBadRequest, err)
+        }
+        return
+    }
+
+    job, err := jq.Submit(r.Context(), req, r.FormValue("webhook_url"))
+    if errors.Is(err, ErrWebhookNotAllowed) {
+        writeJobError(w, http.StatusForbidden, err)
+        return
+    }
+    if err != nil {
+        writeJobError(w, http.StatusBadRequest, err)
+        return
+    }
+    w.Header().Set("Location", jq.cfg.BasePath+"/"+job.ID)
+    writeJobJSON(w, http.StatusAccepted, job)
+}
+
+// checkRequest rejects options the provider cannot honor before the job
+// is queued
+func (jq *JobQueue) checkRequest(req *TranscribeRequest) error {
+    backend, err := jq.service.backend()
+    if err != nil {
+        return &APIError{Status: http.StatusInternalServerError, Message: err.Error()}
+    }
+    return checkFeatures(backend, req)
+}
+
+// getHandler returns a job
+func (jq *JobQueue) getHandler(w http.ResponseWriter, r *http.Request) {
+    job, err := jq.Get(r.Context(), r.PathValue("id"))
+    if err != nil {
+        writeJobError(w, jobErrorStatus(err), err)
+        return
+    }
+    writeJobJSON(w, http.StatusOK, job)
+}
+
+// cancelHandler cancels a job
+func (jq *JobQueue) cancelHandler(w http.ResponseWriter, r *http.Request) {
+    job, err := jq.Cancel(r.Context(), r.PathValue("id"))
+    if err != nil {
+        writeJobError(w, jobErrorStatus(err), err)
+        return
+    }
+    writeJobJSON(w, http.StatusOK, job)
+}
+
+// eventsHandler streams a "job" event with the job's JSON whenever it
+// changes, ending after the final state. Polling the table lets the job
+// run in any process.
+func (jq *JobQueue) eventsHandler(w http.ResponseWriter, r *http.Request) {
+    flusher, ok := w.(http.Flusher)
+    if !ok {
+        writeJobError(w, http.StatusInternalServerError, errors.New("streaming not supported"))
+        return
+    }
+    id := r.PathValue("id")
+    job, err := jq.Get(r.Context(), id)
+    if err != nil {
+        writeJobError(w, jobErrorStatus(err), err)
+        return
+    }
+
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.WriteHeader(http.StatusOK)
+
+    ticker := time.NewTicker(jq.cfg.Poll)
+    defer ticker.Stop()
+    var last time.Time
+    for {
+        if !job.UpdatedAt.Equal(last) {
+            last = job.UpdatedAt
+            data, err := json.Marshal(job)
+            if err != nil {
+                return
+            }
+            fmt.Fprintf(w, "event: job\ndata: %s\n\n", data)
+            flusher.Flush()
+        }
+        if job.Done() {
+            return
+        }
+
+        select {
+        case <-r.Context().Done():
+            return
+        case <-ticker.C:
+        }
+        if job, err = jq.Get(r.Context(), id); err != nil {
+            return
+        }
+    }
+}
@@ -0,0 +1,505 @@
+package whisper
+
+import (
+    "bytes"
+    "context"
+    _ "embed"
+    "encoding/binary"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "math"
+    "net"
+    "net/http"
+    "net/url"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// LiveOptions configures LiveHandler. Zero fields take the defaults noted
+// below.
+type LiveOptions struct {
+    MaxSessions    int           // Sessions at once, 16; more are refused with 503
+    MaxSessionTime time.Duration // Longest session, 1h
+    IdleTimeout    time.Duration // Sessions without audio for this long are closed, 30s
+    MaxMessageSize int64         // Largest WebSocket message in bytes, 1 MB
+
+    // EndSilence is the pause that ends an utterance, 700ms. Utterances
+    // longer than MaxUtterance, 30s, are cut.
+    EndSilence   time.Duration
+    MaxUtterance time.Duration
+    // PartialInterval is how much new speech triggers a partial result,
+    // 2s. Partials are skipped while one is still being transcribed.
+    PartialInterval time.Duration
+    // MaxPending is how many finished utterances may wait for the
+    // provider, 4. When they pile up the session stops reading audio,
+    // which slows the client down through TCP flow control.
+    MaxPending int
+    VAD        VADConfig // Speech detection thresholds
+
+    // CheckOrigin accepts the browser's Origin header. By default only
+    // pages from the same host may connect.
+    CheckOrigin func(r *http.Request) bool
+}
+
+// withDefaults fills the zero fields
+func (opts LiveOptions) withDefaults() LiveOptions {
+    if opts.MaxSessions <= 0 {
+        opts.MaxSessions = 16
+    }
+    if opts.MaxSessionTime <= 0 {
+        opts.MaxSessionTime = time.Hour
+    }
+    if opts.IdleTimeout <= 0 {
+        opts.IdleTimeout = 30 * time.Second
+    }
+    if opts.MaxMessageSize <= 0 {
+        opts.MaxMessageSize = 1 << 20
+    }
+    if opts.EndSilence <= 0 {
+        opts.EndSilence = 700 * time.Millisecond
+    }
+    if opts.MaxUtterance <= 0 {
+        opts.MaxUtterance = 30 * time.Second
+    }
+    if opts.PartialInterval <= 0 {
+        opts.PartialInterval = 2 * time.Second
+    }
+    if opts.MaxPending <= 0 {
+        opts.MaxPending = 4
+    }
+    if opts.CheckOrigin == nil {
+        opts.CheckOrigin = sameOrigin
+    }
+    opts.VAD = opts.VAD.withDefaults()
+    return opts
+}
+
+// sameOrigin accepts requests without an Origin header or from the same
+// host
+func sameOrigin(r *http.Request) bool {
+    origin := r.Header.Get("Origin")
+    if origin == "" {
+        return true
+    }
+    u, err := url.Parse(origin)
+    return err == nil && u.Host == r.Host
+}
+
+// Live event types
+const (
+    LiveReady   = "ready"   // Session started
+    LivePartial = "partial" // Provisional text of the current utterance
+    LiveFinal   = "final"   // Final text of an utterance
+    LiveError   = "error"   // An utterance failed; the session goes on
+    LiveDone    = "done"    // All audio was transcribed, the socket closes
+)
+
+// LiveEvent is a JSON message sent to the client
+type LiveEvent struct {
+    Type      string    `json:"type"`
+    Utterance int       `json:"utterance,omitempty"` // Numbered from 1
+    Text      string    `json:"text,omitempty"`
+    Start     float64   `json:"start,omitempty"` // Seconds since the session started
+    End       float64   `json:"end,omitempty"`
+    Segments  []Segment `json:"segments,omitempty"` // Final events, on the session timeline
+    Message   string    `json:"message,omitempty"`
+}
+
+//go:embed live.js
+var liveJS []byte
+
+// LiveScript serves the browser client for LiveHandler. It defines
+// startLiveTranscription(url, {onPartial, onFinal, onError, language}),
+// which records the microphone and returns an object with a stop method.
+func LiveScript(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+    w.Write(liveJS)
+}
+
+// liveHandler serves WebSocket transcription sessions
+type liveHandler struct {
+    service  *TranscribeService
+    opts     LiveOptions
+    sessions chan struct{}
+}
+
+// LiveHandler transcribes speech while it is recorded. The browser opens
+// a WebSocket, optionally with sample_rate (16000 by default), language,
+// task and prompt query parameters, and sends binary messages of 16-bit
+// little-endian mono PCM. Speech is cut into utterances at pauses; the
+// handler answers with LiveEvent JSON messages: partial results while an
+// utterance goes on and a final result after it. A text message
+// {"type": "stop"} finishes the remaining audio, sends "done" and closes
+// the socket.
+func LiveHandler(service *TranscribeService, opts LiveOptions) http.Handler {
+    opts = opts.withDefaults()
+    return &liveHandler{
+        service:  service,
+        opts:     opts,
+        sessions: make(chan struct{}, opts.MaxSessions),
+    }
+}
+
+// ServeHTTP runs one session
+func (h *liveHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    if !isWebSocketUpgrade(r) {
+        http.Error(w, "WebSocket upgrade required", http.StatusUpgradeRequired)
+        return
+    }
+    if !h.opts.CheckOrigin(r) {
+        http.Error(w, "origin not allowed", http.StatusForbidden)
+        return
+    }
+
+    query := r.URL.Query()
+    rate := WhisperSampleRate
+    if rateStr := query.Get("sample_rate"); rateStr != "" {
+        var err error
+        rate, err = strconv.Atoi(rateStr)
+        if err != nil || rate < 8000 || rate > 192000 {
+            http.Error(w, "sample_rate must be between 8000 and 192000", http.StatusBadRequest)
+            return
+        }
+    }
+    backend, err := h.service.backend()
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    template := TranscribeRequest{
+        Language: query.Get("language"),
+        Task:     query.Get("task"),
+        Prompt:   query.Get("prompt"),
+    }
+    if err := checkFeatures(backend, &template); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    select {
+    case h.sessions <- struct{}{}:
+        defer func() { <-h.sessions }()
+    default:
+        http.Error(w, "too many live sessions", http.StatusServiceUnavailable)
+        return
+    }
+
+    conn, err := upgradeWebSocket(w, r, h.opts.MaxMessageSize)
+    if err != nil {
+        return
+    }
+
+    s := &liveSession{
+        service:  h.service,
+        opts:     h.opts,
+        conn:     conn,
+        rate:     rate,
+        template: template,
+        prompts:  backend.Features().Prompt,
+        finals:   make(chan liveUtterance, h.opts.MaxPending),
+        floor:    math.Inf(1),
+    }
+    s.run(r.Context())
+}
+
+// liveUtterance is audio queued for a final transcription
+type liveUtterance struct {
+    id      int
+    start   time.Duration // Offset in the session
+    samples []float32
+}
+
+// liveSession is one WebSocket connection
+type liveSession struct {
+    service  *TranscribeService
+    opts     LiveOptions
+    conn     *wsConn
+    rate     int
+    template TranscribeRequest
+    prompts  bool // The provider takes a prompt, so context is passed on
+
+    finals     chan liveUtterance
+    partials   sync.WaitGroup
+    partialRun atomic.Bool  // A partial transcription is in flight
+    finalized  atomic.Int64 // Last utterance with a final result
+
+    // Read loop state
+    pending   []float32     // Samples not yet analyzed, less than a frame
+    samples   []float32     // The current utterance, with some lead-in
+    start     time.Duration // Session offset of samples[0]
+    utterance int           // Number of the current utterance
+    speech    bool          // The current utterance has speech
+    silence   time.Duration // Trailing silence of the current utterance
+    partialAt time.Duration // Utterance length at the last partial
+    floor     float64       // Running noise floor in dBFS
+
+    mu      sync.Mutex
+    context string // Recent final text, the prompt for the next utterance
+}
+
+// duration converts a number of samples to time
+func (s *liveSession) duration(samples int) time.Duration {
+    return time.Duration(samples) * time.Second / time.Duration(s.rate)
+}
+
+// send writes an event to the client
+func (s *liveSession) send(event LiveEvent) error {
+    data, err := json.Marshal(event)
+    if err != nil {
+        return err
+    }
+    return s.conn.writeFrame(wsText, data)
+}
+
+// run reads audio until the client stops, then drains the queue
+func (s *liveSession) run(ctx context.Context) {
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+
+    var wg sync.WaitGroup
+    wg.Add(1)
+    go func() {
+        defer wg.Done()
+        s.transcribeFinals(ctx)
+    }()
+
+    s.send(LiveEvent{Type: LiveReady})
+    closeCode, closeReason, finish := s.read(ctx)
+    if finish {
+        s.flush(ctx)
+    } else {
+        cancel() // Nobody is listening any more
+    }
+    close(s.finals)
+    wg.Wait()
+    s.partials.Wait()
+
+    if finish {
+        s.send(LiveEvent{Type: LiveDone})
+    }
+    s.conn.close(closeCode, closeReason)
+}
+
+// read consumes messages until the client stops or a limit is hit. It
+// returns the close code to end the session with, and whether the client
+// still waits for the remaining results.
+func (s *liveSession) read(ctx context.Context) (int, string, bool) {
+    deadline := time.Now().Add(s.opts.MaxSessionTime)
+    for {
+        readDeadline := time.Now().Add(s.opts.IdleTimeout)
+        if deadline.Before(readDeadline) {
+            readDeadline = deadline
+        }
+        s.conn.conn.SetReadDeadline(readDeadline)
+
+        opcode, data, err := s.conn.readMessage()
+        if err != nil {
+            var closeErr *wsCloseError
+            var netErr net.Error
+            switch {
+            case errors.As(err, &closeErr):
+                // The client closed, or broke the protocol
+                return closeErr.Code, closeErr.Reason, false
+            case errors.As(err, &netErr) && netErr.Timeout():
+                if time.Now().After(deadline) {
+                    return wsClosePolicy, "session time limit reached", true
+                }
+                return wsClosePolicy, "idle timeout", true
+            }
+            return wsCloseGoingAway, "", false
+        }
+
+        switch opcode {
+        case wsBinary:
+            if len(data)%2 != 0 {
+                return wsCloseInvalidData, "audio must be 16-bit PCM", false
+            }
+            samples := make([]float32, len(data)/2)
+            for i := range samples {
+                samples[i] = float32(int16(binary.LittleEndian.Uint16(data[2*i:]))) / 32768
+            }
+            if !s.addAudio(ctx, samples) {
+                return wsCloseGoingAway, "", false
+            }
+        case wsText:
+            var msg struct {
+                Type string `json:"type"`
+            }
+            if json.Unmarshal(data, &msg) != nil || msg.Type != "stop" {
+                return wsCloseUnsupported, "unknown message", false
+            }
+            return wsCloseNormal, "", true
+        }
+    }
+}
+
+// addAudio runs voice activity detection over new samples, cutting
+// utterances at pauses. It blocks while the final queue is full and
+// returns false if ctx ends meanwhile.
+func (s *liveSession) addAudio(ctx context.Context, samples []float32) bool {
+    s.pending = append(s.pending, samples...)
+    frameLen := max(1, int(s.opts.VAD.FrameDuration.Seconds()*float64(s.rate)))
+    frameTime := s.duration(frameLen)
+    lead := s.opts.VAD.Padding
+
+    for len(s.pending) >= frameLen {
+        frame := s.pending[:frameLen]
+        s.pending = s.pending[frameLen:]
+        s.samples = append(s.samples, frame...)
+
+        level, crossings := frameStats(frame)
+        // The floor drops at once and rises slowly, so speech does not
+        // raise it much
+        if level < s.floor {
+            s.floor = level
+        } else {
+            s.floor += (level - s.floor) * 0.002
+        }
+        if s.opts.VAD.isSpeech(level, crossings, s.floor) {
+            s.speech = true
+            s.silence = 0
+        } else {
+            s.silence += frameTime
+        }
+
+        length := s.duration(len(s.samples))
+        switch {
+        case !s.speech && length > lead:
+            // Keep a short lead-in before speech starts
+            drop := len(s.samples) - int(lead.Seconds()*float64(s.rate))
+            s.samples = s.samples[drop:]
+            s.start += s.duration(drop)
+        case s.speech && (s.silence >= s.opts.EndSilence || length >= s.opts.MaxUtterance):
+            if !s.finish(ctx) {
+                return false
+            }
+        case s.speech && length-s.partialAt >= s.opts.PartialInterval:
+            s.partialAt = length
+            s.partial(ctx)
+        }
+    }
+    // Release the memory of trimmed lead-in from time to time
+    if cap(s.samples) > 4*len(s.samples)+s.rate {
+        s.samples = append([]float32(nil), s.samples...)
+    }
+    return true
+}
+
+// finish queues the current utterance for a final result
+func (s *liveSession) finish(ctx context.Context) bool {
+    s.utterance++
+    u := liveUtterance{id: s.utterance, start: s.start, samples: s.samples}
+    s.start += s.duration(len(s.samples))
+    s.samples = nil
+    s.speech = false
+    s.silence = 0
+    s.partialAt = 0
+
+    select {
+    case s.finals <- u:
+        return true
+    case <-ctx.Done():
+        return false
+    }
+}
+
+// flush queues what is left when the client stops
+func (s *liveSession) flush(ctx context.Context) {
+    s.samples = append(s.samples, s.pending...)
+    s.pending = nil
+    if s.speech {
+        s.finish(ctx)
+    }
+}
+
+// partial transcribes the utterance so far in the background, unless a
+// partial is already running
+func (s *liveSession) partial(ctx context.Context) {
+    if !s.partialRun.CompareAndSwap(false, true) {
+        return
+    }
+    u := liveUtterance{id: s.utterance + 1, start: s.start, samples: append([]float32(nil), s.samples...)}
+    s.partials.Add(1)
+    go func() {
+        defer s.partials.Done()
+        defer s.partialRun.Store(false)
+        resp, err := s.transcribe(ctx, u)
+        // Drop partials overtaken by the final result
+        if err != nil || s.finalized.Load() >= int64(u.id) {
+            return
+        }
+        s.send(LiveEvent{
+            Type:      LivePartial,
+            Utterance: u.id,
+            Text:      resp.Text,
+            Start:     u.start.Seconds(),
+            End:       (u.start + s.duration(len(u.samples))).Seconds(),
+        })
+    }()
+}
+
+// transcribeFinals transcribes queued utterances in order
+func (s *liveSession) transcribeFinals(ctx context.Context) {
+    for u := range s.finals {
+        resp, err := s.transcribe(ctx, u)
+        s.finalized.Store(int64(u.id))
+        if err != nil {
+            if ctx.Err() != nil {
+                continue
+            }
+            s.send(LiveEvent{Type: LiveError, Utterance: u.id, Message: err.Error()})
+            continue
+        }
+
+        offset := u.start.Seconds()
+        for i := range resp.Segments {
+            resp.Segments[i].Start += offset
+            resp.Segments[i].End += offset
+            resp.Segments[i].Words = shiftWords(resp.Segments[i].Words, offset)
+        }
+        s.mu.Lock()
+        s.context = lastRunes(s.context+" "+resp.Text, 200)
+        s.mu.Unlock()
+
+        s.send(LiveEvent{
+            Type:      LiveFinal,
+            Utterance: u.id,
+            Text:      resp.Text,
+            Start:     offset,
+            End:       (u.start + s.duration(len(u.samples))).Seconds(),
+            Segments:  resp.Segments,
+        })
+    }
+}
+
+// lastRunes returns the end of text, at most n runes
+func lastRunes(text string, n int) string {
+    runes := []rune(text)
+    return string(runes[max(0, len(runes)-n):])
+}
+
+// transcribe sends one utterance to the provider. Utterances are neither
+// cached nor run through the service's VAD and chunking again.
+func (s *liveSession) transcribe(ctx context.Context, u liveUtterance) (*TranscribeResponse, error) {
+    var buf bytes.Buffer
+    pcm := &PCM{SampleRate: s.rate, Channels: 1, Samples: u.samples}
+    if err := EncodeWAV(&buf, Normalize(pcm)); err != nil {
+        return nil, err
+    }
+
+    req := s.template
+    req.Audio = bytes.NewReader(buf.Bytes())
+    req.FileName = fmt.Sprintf("live-%04d.wav", u.id)
+    req.OutputFormat = "verbose_json"
+    if s.prompts {
+        s.mu.Lock()
+        if s.context != "" {
+            req.Prompt = lastRunes(s.template.Prompt+" "+s.context, 200)
+        }
+        s.mu.Unlock()
+    }
+    return s.service.sendDirect(ctx, &req)
+}
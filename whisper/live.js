@@ -0,0 +1,116 @@
+// Browser client for whisper.LiveHandler.
+//
+//   const live = await startLiveTranscription('/live', {
+//       language: 'en',
+//       onPartial: event => { ... },
+//       onFinal: event => { ... },
+//       onError: event => { ... },
+//   });
+//   ...
+//   await live.stop();
+//
+// The microphone is captured with an AudioWorklet, converted to 16-bit PCM
+// and sent over a WebSocket. Events are the JSON messages of the handler.
+async function startLiveTranscription(url, options = {}) {
+    const stream = await navigator.mediaDevices.getUserMedia({
+        audio: { channelCount: 1, echoCancellation: true, noiseSuppression: true },
+    });
+    const context = new AudioContext();
+
+    // Batches of about 100ms keep the message count low
+    const worklet = `
+        class PCMCapture extends AudioWorkletProcessor {
+            constructor() {
+                super();
+                this.buffer = new Int16Array(Math.round(sampleRate / 10));
+                this.length = 0;
+            }
+            process(inputs) {
+                const input = inputs[0][0];
+                if (input) {
+                    for (let i = 0; i < input.length; i++) {
+                        const s = Math.max(-1, Math.min(1, input[i]));
+                        this.buffer[this.length++] = s < 0 ? s * 0x8000 : s * 0x7FFF;
+                        if (this.length === this.buffer.length) {
+                            this.port.postMessage(this.buffer.slice().buffer, []);
+                            this.length = 0;
+                        }
+                    }
+                }
+                return true;
+            }
+        }
+        registerProcessor('pcm-capture', PCMCapture);
+    `;
+    const moduleURL = URL.createObjectURL(new Blob([worklet], { type: 'text/javascript' }));
+    await context.audioWorklet.addModule(moduleURL);
+    URL.revokeObjectURL(moduleURL);
+
+    const params = new URLSearchParams({ sample_rate: context.sampleRate });
+    for (const name of ['language', 'task', 'prompt']) {
+        if (options[name]) {
+            params.set(name, options[name]);
+        }
+    }
+    const socketURL = new URL(url, location.href);
+    socketURL.protocol = socketURL.protocol === 'https:' ? 'wss:' : 'ws:';
+    socketURL.search = params;
+    const socket = new WebSocket(socketURL);
+    socket.binaryType = 'arraybuffer';
+
+    const source = context.createMediaStreamSource(stream);
+    const capture = new AudioWorkletNode(context, 'pcm-capture');
+    capture.port.onmessage = event => {
+        if (socket.readyState === WebSocket.OPEN) {
+            socket.send(event.data);
+        }
+    };
+
+    let stopped = false;
+    const release = () => {
+        capture.port.onmessage = null;
+        source.disconnect();
+        stream.getTracks().forEach(track => track.stop());
+        context.close();
+    };
+    const closed = new Promise(resolve => {
+        socket.onclose = event => {
+            release();
+            if (!stopped && event.code !== 1000 && options.onError) {
+                options.onError({ type: 'error', message: event.reason || 'connection closed' });
+            }
+            resolve();
+        };
+    });
+
+    socket.onmessage = event => {
+        const message = JSON.parse(event.data);
+        const handler = {
+            partial: options.onPartial,
+            final: options.onFinal,
+            error: options.onError,
+        }[message.type];
+        if (handler) {
+            handler(message);
+        }
+    };
+    await new Promise((resolve, reject) => {
+        socket.onopen = resolve;
+        socket.onerror = () => reject(new Error('failed to connect to ' + socketURL));
+    });
+    source.connect(capture);
+
+    return {
+        // stop ends recording and resolves once the last final result arrived
+        stop() {
+            if (!stopped) {
+                stopped = true;
+                source.disconnect();
+                if (socket.readyState === WebSocket.OPEN) {
+                    socket.send(JSON.stringify({ type: 'stop' }));
+                }
+            }
+            return closed;
+        },
+    };
+}
@@ -0,0 +1,258 @@
+package whisper
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "io"
+    "math"
+    "os/exec"
+    "sync"
+)
+
+// WhisperSampleRate is the rate Whisper models are trained on
+const WhisperSampleRate = 16000
+
+// Normalization modes for TranscribeService.Normalize
+const (
+    NormalizeAuto   = "auto"   // When the provider benefits, see needsNormalize
+    NormalizeAlways = "always" // Whenever the audio can be decoded
+    NormalizeOff    = "off"
+)
+
+// Downmix averages the channels into mono
+func Downmix(pcm *PCM) *PCM {
+    if pcm.Channels <= 1 {
+        return pcm
+    }
+    frames := pcm.Frames()
+    mono := make([]float32, frames)
+    scale := 1 / float32(pcm.Channels)
+    for i := range mono {
+        var sum float32
+        for _, s := range pcm.Samples[i*pcm.Channels : (i+1)*pcm.Channels] {
+            sum += s
+        }
+        mono[i] = sum * scale
+    }
+    return &PCM{SampleRate: pcm.SampleRate, Channels: 1, Samples: mono}
+}
+
+// Resampling kernel: a Hann-windowed sinc reaching sincZeros zero
+// crossings on each side, tabulated at sincResolution points per crossing
+const (
+    sincZeros      = 8
+    sincResolution = 512
+)
+
+var (
+    sincOnce  sync.Once
+    sincTable []float64
+)
+
+// kernel returns the windowed sinc at x zero crossings from the center
+func kernel(x float64) float64 {
+    sincOnce.Do(func() {
+        sincTable = make([]float64, sincZeros*sincResolution+2)
+        for i := range sincTable {
+            t := float64(i) / sincResolution
+            if t >= sincZeros {
+                continue
+            }
+            window := 0.5 * (1 + math.Cos(math.Pi*t/sincZeros))
+            sinc := 1.0
+            if t > 0 {
+                sinc = math.Sin(math.Pi*t) / (math.Pi * t)
+            }
+            sincTable[i] = sinc * window
+        }
+    })
+    pos := math.Abs(x) * sincResolution
+    i := int(pos)
+    if i >= len(sincTable)-1 {
+        return 0
+    }
+    frac := pos - float64(i)
+    return sincTable[i]*(1-frac) + sincTable[i+1]*frac
+}
+
+// Resample converts pcm to rate with band-limited interpolation, filtering
+// out frequencies above the new Nyquist limit when downsampling
+func Resample(pcm *PCM, rate int) *PCM {
+    if pcm.SampleRate == rate || pcm.SampleRate == 0 || rate <= 0 {
+        return pcm
+    }
+    ratio := float64(rate) / float64(pcm.SampleRate)
+    cutoff := min(1, ratio) * 0.97  // Fraction of the source Nyquist rate
+    halfWidth := sincZeros / cutoff // Kernel reach in source samples
+
+    frames := pcm.Frames()
+    outFrames := int(float64(frames) * ratio)
+    out := make([]float32, outFrames*pcm.Channels)
+    for c := 0; c < pcm.Channels; c++ {
+        for i := 0; i < outFrames; i++ {
+            center := float64(i) / ratio
+            first := max(0, int(math.Ceil(center-halfWidth)))
+            last := min(frames-1, int(math.Floor(center+halfWidth)))
+            var sum, weights float64
+            for j := first; j <= last; j++ {
+                w := kernel((center - float64(j)) * cutoff)
+                sum += w * float64(pcm.Samples[j*pcm.Channels+c])
+                weights += w
+            }
+            if weights != 0 {
+                out[i*pcm.Channels+c] = float32(sum / weights)
+            }
+        }
+    }
+    return &PCM{SampleRate: rate, Channels: pcm.Channels, Samples: out}
+}
+
+// Normalize converts pcm to 16 kHz mono
+func Normalize(pcm *PCM) *PCM {
+    return Resample(Downmix(pcm), WhisperSampleRate)
+}
+
+// NormalizeWAV decodes audio, normalizes it and encodes it as 16-bit WAV
+func NormalizeWAV(w io.Writer, r io.Reader, fileName string) error {
+    pcm, err := DecodeAudio(r, fileName)
+    if err != nil {
+        return err
+    }
+    return EncodeWAV(w, Normalize(pcm))
+}
+
+// CommandDecoder returns a Decoder that pipes the audio through an external
+// program which must write a WAV file to its standard output, for example
+//
+//	whisper.CommandDecoder("ffmpeg", "-i", "pipe:0", "-f", "wav", "-ac", "1", "-ar", "16000", "pipe:1")
+//
+// Register it for the formats Go cannot decode with RegisterDecoder.
+func CommandDecoder(name string, args ...string) Decoder {
+    return func(r io.Reader) (*PCM, error) {
+        cmd := exec.CommandContext(context.Background(), name, args...)
+        cmd.Stdin = r
+        var stdout, stderr bytes.Buffer
+        cmd.Stdout = &stdout
+        cmd.Stderr = &stderr
+        if err := cmd.Run(); err != nil {
+            return nil, fmt.Errorf("%s failed: %w: %s", name, err, bytes.TrimSpace(stderr.Bytes()))
+        }
+        return DecodeWAV(&stdout)
+    }
+}
+
+// FFmpegDecoder decodes any format ffmpeg understands
+func FFmpegDecoder() Decoder {
+    return CommandDecoder("ffmpeg", "-nostdin", "-loglevel", "error", "-i", "pipe:0",
+        "-f", "wav", "-ac", "1", "-ar", "16000", "pipe:1")
+}
+
+// needsNormalize decides whether to convert audio of the sniffed format
+// before sending it. Providers that only read 16 kHz WAV always get it.
+// Others get it for WAV that is not 16 kHz mono already, which shrinks the
+// upload; compressed formats would grow, so they are sent as they are.
+func needsNormalize(mode string, features Features, format string, info *AudioInfo) bool {
+    switch mode {
+    case NormalizeOff:
+        return false
+    case NormalizeAlways:
+        return true
+    }
+    if features.WAVOnly {
+        return format != AudioWAV || info == nil || info.SampleRate != WhisperSampleRate || info.Channels != 1
+    }
+    return format == AudioWAV && info != nil && (info.SampleRate > WhisperSampleRate || info.Channels > 1)
+}
+
+// normalizeRequest returns req with its audio converted to 16 kHz mono WAV
+// when the mode and provider call for it and the audio can be decoded
+func (ts *TranscribeService) normalizeRequest(backend Transcriber, req *TranscribeRequest) (*TranscribeRequest, error) {
+    mode := ts.Normalize
+    if mode == "" {
+        mode = NormalizeAuto
+    }
+    if mode == NormalizeOff {
+        return req, nil
+    }
+    features := backend.Features()
+
+    // Seekable audio is inspected in place and only read when converted
+    original := req
+    audio, ok := seekableAudio(req)
+    if !ok {
+        if mode == NormalizeAuto && !features.WAVOnly {
+            // Only WAV input benefits; avoid buffering other streams
+            return req, nil
+        }
+        data, err := io.ReadAll(req.audio())
+        if err != nil {
+            return nil, fmt.Errorf("failed to read audio: %w", err)
+        }
+        buffered := *req
+        buffered.Audio = bytes.NewReader(data)
+        buffered.AudioData = nil
+        original = &buffered
+        audio = io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data)))
+    }
+
+    header := audioHeader(audio)
+    info, _ := ProbeAudio(audio, audio.Size())
+    if !needsNormalize(mode, features, SniffFormat(header), info) {
+        return original, nil
+    }
+
+    decoder, ok := ts.decoderFor(header, req.FileName)
+    if !ok {
+        return original, nil // The provider may still cope
+    }
+    pcm, err := decoder(audio)
+    if err != nil {
+        return original, nil
+    }
+
+    var buf bytes.Buffer
+    if err := EncodeWAV(&buf, Normalize(pcm)); err != nil {
+        return nil, err
+    }
+    normalized := *original
+    normalized.Audio = bytes.NewReader(buf.Bytes())
+    normalized.AudioData = nil
+    normalized.FileName = FixFileName(req.FileName, AudioWAV)
+    normalized.ShouldEncode = false
+    return &normalized, nil
+}
+
+// decoderFor returns the service's Decoder for formats other than WAV, or
+// else the registered decoder for the format
+func (ts *TranscribeService) decoderFor(header []byte, fileName string) (Decoder, bool) {
+    if ts.Decoder != nil && SniffFormat(header) != AudioWAV {
+        return ts.Decoder, true
+    }
+    return decoderFor(header, fileName)
+}
+
+// audioHeader returns the first bytes of audio for sniffing its format
+func audioHeader(audio *io.SectionReader) []byte {
+    header := make([]byte, min(audio.Size(), sniffLen))
+    n, _ := audio.ReadAt(header, 0)
+    return header[:n]
+}
+
+// seekableAudio returns the unread part of the request audio when it can be
+// read at offsets without consuming it
+func seekableAudio(req *TranscribeRequest) (*io.SectionReader, bool) {
+    audio, ok := req.audio().(interface {
+        io.ReaderAt
+        io.Seeker
+    })
+    size := audioSize(req)
+    if !ok || size < 0 {
+        return nil, false
+    }
+    start, err := audio.Seek(0, io.SeekCurrent)
+    if err != nil || start > size {
+        return nil, false
+    }
+    return io.NewSectionReader(audio, start, size-start), true
+}
@@ -0,0 +1,91 @@
+package whisper_test
+
+import (
+    "bytes"
+    "math"
+    "testing"
+
+    "github.com/gchalakovmmi/PulpuWEB/whisper"
+)
+
+// rms is the root mean square of the samples, skipping the edges where the
+// resampling filter runs out of input
+func rms(samples []float32) float64 {
+    edge := len(samples) / 10
+    var sum float64
+    for _, s := range samples[edge : len(samples)-edge] {
+        sum += float64(s) * float64(s)
+    }
+    return math.Sqrt(sum / float64(len(samples)-2*edge))
+}
+
+// zeroCrossings counts sign changes
+func zeroCrossings(samples []float32) int {
+    n := 0
+    for i := 1; i < len(samples); i++ {
+        if (samples[i-1] < 0) != (samples[i] < 0) {
+            n++
+        }
+    }
+    return n
+}
+
+func TestResample(t *testing.T) {
+    tests := []struct {
+        name      string
+        from, to  int
+        freq      float64
+        wantRMS   float64 // Of the 0.5 amplitude input
+        crossings int     // Per second, 0 to skip
+    }{
+        {"downsample", 48000, 16000, 1000, 0.5 / math.Sqrt2, 2000},
+        {"upsample", 8000, 16000, 1000, 0.5 / math.Sqrt2, 2000},
+        {"odd ratio", 44100, 16000, 440, 0.5 / math.Sqrt2, 880},
+        // Above the new Nyquist frequency of 8 kHz, so filtered out
+        {"aliasing removed", 48000, 16000, 12000, 0, 0},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            out := whisper.Resample(tone(tt.from, 1, 1, tt.freq), tt.to)
+            if out.SampleRate != tt.to || out.Frames() != tt.to {
+                t.Fatalf("got %d frames at %d Hz, want %d", out.Frames(), out.SampleRate, tt.to)
+            }
+            if got := rms(out.Samples); math.Abs(got-tt.wantRMS) > 0.02 {
+                t.Errorf("rms = %.3f, want %.3f", got, tt.wantRMS)
+            }
+            if tt.crossings > 0 {
+                if got := zeroCrossings(out.Samples); math.Abs(float64(got-tt.crossings)) > 2 {
+                    t.Errorf("got %d zero crossings, want %d", got, tt.crossings)
+                }
+            }
+        })
+    }
+
+    pcm := tone(16000, 1, 0.1, 440)
+    if whisper.Resample(pcm, 16000) != pcm {
+        t.Error("audio at the target rate was copied")
+    }
+}
+
+func TestDownmix(t *testing.T) {
+    stereo := &whisper.PCM{SampleRate: 8000, Channels: 2, Samples: []float32{0.5, -0.5, 0.25, 0.75}}
+    mono := whisper.Downmix(stereo)
+    if mono.Channels != 1 || len(mono.Samples) != 2 || mono.Samples[0] != 0 || mono.Samples[1] != 0.5 {
+        t.Errorf("got %+v", mono)
+    }
+}
+
+func TestNormalizeWAV(t *testing.T) {
+    var buf bytes.Buffer
+    input := bytes.NewReader(wavBytes(t, tone(44100, 2, 2, 440)))
+    if err := whisper.NormalizeWAV(&buf, input, "clip.wav"); err != nil {
+        t.Fatal(err)
+    }
+    pcm, err := whisper.DecodeWAV(&buf)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if pcm.SampleRate != whisper.WhisperSampleRate || pcm.Channels != 1 || pcm.Frames() != 32000 {
+        t.Errorf("got %d frames at %d Hz in %d channels, want 16 kHz mono", pcm.Frames(), pcm.SampleRate, pcm.Channels)
+    }
+}
@@ -0,0 +1,208 @@
+package whisper
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "strconv"
+    "strings"
+)
+
+func init() {
+    RegisterProvider("groq", func(cfg ProviderConfig) (Transcriber, error) {
+        return newOpenAITranscriber("groq", "Groq", cfg, openAIDefaults{
+            url:          "https://api.groq.com/openai/v1/audio/transcriptions",
+            requireKey:   true,
+            requireModel: true,
+            maxSize:      25 << 20,
+        })
+    })
+    RegisterProvider("openai", func(cfg ProviderConfig) (Transcriber, error) {
+        return newOpenAITranscriber("openai", "OpenAI", cfg, openAIDefaults{
+            url:          "https://api.openai.com/v1/audio/transcriptions",
+            model:        "whisper-1",
+            requireKey:   true,
+            requireModel: true,
+            maxSize:      25 << 20,
+        })
+    })
+    RegisterProvider("faster-whisper", func(cfg ProviderConfig) (Transcriber, error) {
+        return newOpenAITranscriber("faster-whisper", "faster-whisper", cfg, openAIDefaults{
+            url: "http://localhost:8000/v1/audio/transcriptions",
+        })
+    })
+}
+
+// openAIDefaults are the per-provider settings of the OpenAI-compatible API
+type openAIDefaults struct {
+    url          string
+    model        string
+    requireKey   bool
+    requireModel bool
+    maxSize      int64
+}
+
+// openAITranscriber speaks the OpenAI /audio/transcriptions protocol, which
+// Groq and faster-whisper servers implement as well
+type openAITranscriber struct {
+    name         string
+    label        string // Used in error messages
+    url          string
+    apiKey       string
+    model        string
+    requireKey   bool
+    requireModel bool
+    maxSize      int64
+    client       *http.Client
+    translateURL string // Empty when the endpoint cannot be derived
+}
+
+func newOpenAITranscriber(name, label string, cfg ProviderConfig, defaults openAIDefaults) (Transcriber, error) {
+    t := &openAITranscriber{
+        name:         name,
+        label:        label,
+        url:          cfg.URL,
+        apiKey:       cfg.APIKey,
+        model:        cfg.Model,
+        requireKey:   defaults.requireKey,
+        requireModel: defaults.requireModel,
+        maxSize:      defaults.maxSize,
+        client:       cfg.client(),
+    }
+    if t.url == "" {
+        t.url = defaults.url
+    }
+    if t.model == "" {
+        t.model = defaults.model
+    }
+    // Translation lives next to transcription in every implementation
+    if base, ok := strings.CutSuffix(strings.TrimRight(t.url, "/"), "/transcriptions"); ok {
+        t.translateURL = base + "/translations"
+    }
+    return t, nil
+}
+
+// Name returns the provider name
+func (o *openAITranscriber) Name() string {
+    return o.name
+}
+
+// Features reports what the OpenAI-compatible API supports
+func (o *openAITranscriber) Features() Features {
+    return Features{
+        Translate:      o.translateURL != "",
+        Segments:       true,
+        WordTimestamps: true,
+        Prompt:         true,
+        Temperature:    true,
+        RequiresModel:  o.requireModel,
+        MaxFileSize:    o.maxSize,
+    }
+}
+
+// Health lists the models, which checks the API key as well
+func (o *openAITranscriber) Health(ctx context.Context) error {
+    healthURL := rootURL(o.url)
+    if base, ok := strings.CutSuffix(strings.TrimRight(o.url, "/"), "/audio/transcriptions"); ok {
+        healthURL = base + "/models"
+    }
+    return probeURL(ctx, o.client, healthURL, o.apiKey)
+}
+
+// Transcribe sends request to the OpenAI-compatible API
+func (o *openAITranscriber) Transcribe(ctx context.Context, req *TranscribeRequest) (*TranscribeResponse, error) {
+    // Use the model from the service (set via env) unless overridden in the request
+    model := o.model
+    if req.Model != "" {
+        model = req.Model
+    }
+
+    if model == "" && o.requireModel {
+        return nil, fmt.Errorf("model is required for %s provider", o.label)
+    }
+
+    if o.apiKey == "" && o.requireKey {
+        return nil, fmt.Errorf("API key is required for %s provider", o.label)
+    }
+
+    if size := audioSize(req); o.maxSize > 0 && size > o.maxSize {
+        return nil, fmt.Errorf("%d byte upload exceeds the %s limit of %d bytes: %w", size, o.label, o.maxSize, ErrTooLarge)
+    }
+
+    // Add model parameter
+    var fields []formField
+    if model != "" {
+        fields = append(fields, formField{"model", model})
+    }
+
+    // Add response format; timestamps are only returned with verbose_json
+    responseFormat := "json"
+    if req.OutputFormat == "verbose_json" || len(req.TimestampGranularities) > 0 {
+        responseFormat = "verbose_json"
+    }
+    fields = append(fields, formField{"response_format", responseFormat})
+
+    if prompt := req.prompt(); prompt != "" {
+        fields = append(fields, formField{"prompt", prompt})
+    }
+    if req.Temperature != 0 {
+        fields = append(fields, formField{"temperature", strconv.FormatFloat(req.Temperature, 'f', -1, 64)})
+    }
+
+    // The translations endpoint always outputs English and has no
+    // language or timestamp granularity parameters
+    endpoint := o.url
+    if req.Task == TaskTranslate {
+        if req.wantsWords() {
+            return nil, fmt.Errorf("word timestamps are %w with translation by %s", ErrNotSupported, o.label)
+        }
+        endpoint = o.translateURL
+    } else {
+        for _, granularity := range req.TimestampGranularities {
+            fields = append(fields, formField{"timestamp_granularities[]", granularity})
+        }
+        if req.Language != "" && req.Language != "auto" {
+            fields = append(fields, formField{"language", req.Language})
+        }
+    }
+
+    // The audio file goes last and is streamed
+    body, contentType := pipeMultipart(fields, "file", req.FileName, req.audio())
+    defer body.Close()
+
+    httpReq, err := http.NewRequestWithContext(ctx, "POST", endpoint, body)
+    if err != nil {
+        return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+    }
+
+    httpReq.Header.Set("Content-Type", contentType)
+    if o.apiKey != "" {
+        httpReq.Header.Set("Authorization", "Bearer "+o.apiKey)
+    }
+
+    resp, err := o.client.Do(httpReq)
+    if err != nil {
+        return nil, sendError(o.label, ctx, err)
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return nil, statusError(o.label, resp)
+    }
+
+    respBody, err := io.ReadAll(resp.Body)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read response body: %w", err)
+    }
+
+    // The verbose_json fields match TranscribeResponse, json is a subset
+    var result TranscribeResponse
+    if err := json.Unmarshal(respBody, &result); err != nil {
+        return nil, fmt.Errorf("failed to parse %s response: %w", o.label, err)
+    }
+    linkWords(&result)
+
+    return &result, nil
+}
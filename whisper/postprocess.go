@@ -0,0 +1,645 @@
+package whisper
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "regexp"
+    "slices"
+    "strconv"
+    "strings"
+    "time"
+    "unicode"
+    "unicode/utf8"
+)
+
+// maxGlossary bounds the vocabulary added to prompts, in bytes. Whisper
+// reads at most 224 prompt tokens and drops the start of longer prompts.
+const maxGlossary = 600
+
+// DefaultProfanity are the words masked by PostprocessConfig.MaskProfanity
+// when ProfanityWords is nil. A trailing * matches any word with the prefix.
+var DefaultProfanity = []string{
+    "fuck*", "motherfuck*", "shit", "shits", "shitty", "shitting", "bullshit*",
+    "bitch*", "asshole*", "bastard*", "cunt*", "dickhead*", "wanker*", "twat", "twats",
+}
+
+// RegexRule replaces matches of Pattern with Replace, which may refer to
+// groups as $1 or ${name}
+type RegexRule struct {
+    Pattern string `json:"pattern"`
+    Replace string `json:"replace"`
+}
+
+// PostprocessConfig lists the corrections applied to transcripts. They run
+// in the order of the fields.
+type PostprocessConfig struct {
+    // Vocabulary lists the correct spelling of names and terms. It is
+    // added to the prompt of providers that take one, and whole-word
+    // matches in any case are written as listed.
+    Vocabulary []string `json:"vocabulary"`
+    // Replacements maps misheard words or phrases to the right ones. Keys
+    // match whole words in any case and with any spacing. Replacements
+    // without capitals follow the case of the match, e.g. at the start of
+    // a sentence; others are written as given.
+    Replacements map[string]string `json:"replacements"`
+    // Numbers writes spelled-out English numbers of 10 and more, and
+    // compound ones, as digits: "twenty-five" becomes "25", "nineteen
+    // eighty four" "1984" and "twenty first" "21st". Numbers ending in
+    // "second" stay words, since "thirty second" may be a duration.
+    Numbers bool `json:"numbers"`
+    // DateLayout, when set, rewrites full dates like "May 3rd, 2024" or
+    // "the 3rd of May 2024" in this time.Format layout, e.g. "2006-01-02"
+    DateLayout string `json:"date_layout"`
+    // Rules are applied in order
+    Rules []RegexRule `json:"rules"`
+    // MaskProfanity replaces all but the first letter of ProfanityWords,
+    // DefaultProfanity when nil, with asterisks
+    MaskProfanity  bool     `json:"mask_profanity"`
+    ProfanityWords []string `json:"profanity_words"`
+    // SentenceCase capitalizes the first letter of every sentence
+    SentenceCase bool `json:"sentence_case"`
+}
+
+// LoadPostprocessConfig reads a PostprocessConfig from a JSON file
+func LoadPostprocessConfig(path string) (PostprocessConfig, error) {
+    var cfg PostprocessConfig
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return cfg, fmt.Errorf("failed to read postprocess config: %w", err)
+    }
+    if err := json.Unmarshal(data, &cfg); err != nil {
+        return cfg, fmt.Errorf("failed to parse postprocess config: %w", err)
+    }
+    return cfg, nil
+}
+
+// phraseRule replaces whole-word matches of a phrase
+type phraseRule struct {
+    re      *regexp.Regexp
+    replace string
+    adapt   bool // Follow the case of the match
+}
+
+// Postprocessor applies a PostprocessConfig. It is safe for concurrent use.
+type Postprocessor struct {
+    cfg       PostprocessConfig
+    phrases   []phraseRule
+    rules     []*regexp.Regexp
+    profanity *regexp.Regexp
+}
+
+// NewPostprocessor compiles cfg
+func NewPostprocessor(cfg PostprocessConfig) (*Postprocessor, error) {
+    p := &Postprocessor{cfg: cfg}
+
+    for _, term := range cfg.Vocabulary {
+        if strings.TrimSpace(term) != "" {
+            p.phrases = append(p.phrases, phraseRule{re: phrasePattern(term), replace: strings.TrimSpace(term)})
+        }
+    }
+    // Longer phrases first, so they win over the words they contain
+    keys := make([]string, 0, len(cfg.Replacements))
+    for key := range cfg.Replacements {
+        if strings.TrimSpace(key) != "" {
+            keys = append(keys, key)
+        }
+    }
+    slices.SortFunc(keys, func(a, b string) int {
+        if len(a) != len(b) {
+            return len(b) - len(a)
+        }
+        return strings.Compare(a, b)
+    })
+    for _, key := range keys {
+        replace := cfg.Replacements[key]
+        p.phrases = append(p.phrases, phraseRule{
+            re:      phrasePattern(key),
+            replace: replace,
+            adapt:   strings.ToLower(replace) == replace,
+        })
+    }
+
+    for i, rule := range cfg.Rules {
+        re, err := regexp.Compile(rule.Pattern)
+        if err != nil {
+            return nil, fmt.Errorf("invalid postprocess rule %d: %w", i+1, err)
+        }
+        p.rules = append(p.rules, re)
+    }
+
+    if cfg.DateLayout != "" && time.Date(2024, 5, 3, 0, 0, 0, 0, time.UTC).Format(cfg.DateLayout) == cfg.DateLayout {
+        return nil, fmt.Errorf("invalid postprocess date layout %q", cfg.DateLayout)
+    }
+
+    if cfg.MaskProfanity {
+        words := cfg.ProfanityWords
+        if words == nil {
+            words = DefaultProfanity
+        }
+        var alternatives []string
+        for _, word := range words {
+            prefix, wildcard := strings.CutSuffix(strings.TrimSpace(word), "*")
+            if prefix == "" {
+                continue
+            }
+            pattern := regexp.QuoteMeta(prefix)
+            if wildcard {
+                pattern += `\pL*`
+            }
+            alternatives = append(alternatives, pattern)
+        }
+        if len(alternatives) > 0 {
+            p.profanity = regexp.MustCompile(`(?i)(?:` + strings.Join(alternatives, "|") + `)`)
+        }
+    }
+    return p, nil
+}
+
+// phrasePattern matches a phrase in any case and with any spacing
+func phrasePattern(phrase string) *regexp.Regexp {
+    words := strings.Fields(phrase)
+    for i, word := range words {
+        words[i] = regexp.QuoteMeta(word)
+    }
+    return regexp.MustCompile(`(?i)` + strings.Join(words, `[\s-]+`))
+}
+
+// Vocabulary returns the terms to add to prompts
+func (p *Postprocessor) Vocabulary() []string {
+    return p.cfg.Vocabulary
+}
+
+// Apply corrects the text of resp and of each segment. Word timings are
+// left as the provider returned them.
+func (p *Postprocessor) Apply(resp *TranscribeResponse) {
+    resp.Text = p.fix(resp.Text, true)
+
+    sentenceStart := true
+    for i := range resp.Segments {
+        seg := &resp.Segments[i]
+        seg.Text = p.fix(seg.Text, sentenceStart)
+        if text := strings.TrimSpace(seg.Text); text != "" {
+            sentenceStart = endsSentence(text)
+        }
+    }
+}
+
+// ApplyText corrects one piece of text that starts a sentence
+func (p *Postprocessor) ApplyText(text string) string {
+    return p.fix(text, true)
+}
+
+// fix runs the stages over text; sentenceStart tells whether text starts a
+// new sentence
+func (p *Postprocessor) fix(text string, sentenceStart bool) string {
+    for _, phrase := range p.phrases {
+        text = replaceWords(text, phrase)
+    }
+    if p.cfg.Numbers {
+        text = normalizeNumbers(text)
+    }
+    if p.cfg.DateLayout != "" {
+        text = normalizeDates(text, p.cfg.DateLayout)
+    }
+    for i, re := range p.rules {
+        text = re.ReplaceAllString(text, p.cfg.Rules[i].Replace)
+    }
+    if p.profanity != nil {
+        text = replaceWholeWords(text, p.profanity, func(match string) string {
+            first, size := utf8.DecodeRuneInString(match)
+            return string(first) + strings.Repeat("*", utf8.RuneCountInString(match[size:]))
+        })
+    }
+    if p.cfg.SentenceCase {
+        text = sentenceCase(text, sentenceStart)
+    }
+    return text
+}
+
+// isWordRune reports whether r is part of a word
+func isWordRune(r rune) bool {
+    return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// replaceWholeWords replaces the matches of re that are not inside a
+// longer word. Go's \b only knows ASCII, so boundaries are checked here.
+func replaceWholeWords(text string, re *regexp.Regexp, replace func(match string) string) string {
+    var out strings.Builder
+    last, pos := 0, 0
+    for pos <= len(text) {
+        loc := re.FindStringIndex(text[pos:])
+        if loc == nil {
+            break
+        }
+        start, end := pos+loc[0], pos+loc[1]
+        before, _ := utf8.DecodeLastRuneInString(text[:start])
+        after, _ := utf8.DecodeRuneInString(text[end:])
+        if end == start || isWordRune(before) || isWordRune(after) {
+            // Try again from the next rune
+            _, size := utf8.DecodeRuneInString(text[start:])
+            pos = start + max(size, 1)
+            continue
+        }
+        out.WriteString(text[last:start])
+        out.WriteString(replace(text[start:end]))
+        last, pos = end, end
+    }
+    if last == 0 {
+        return text
+    }
+    out.WriteString(text[last:])
+    return out.String()
+}
+
+// replaceWords applies a phrase rule
+func replaceWords(text string, rule phraseRule) string {
+    return replaceWholeWords(text, rule.re, func(match string) string {
+        if !rule.adapt {
+            return rule.replace
+        }
+        return matchCase(rule.replace, match)
+    })
+}
+
+// matchCase gives replace the case of match: all capitals, a capital
+// first letter or lower case
+func matchCase(replace, match string) string {
+    first, _ := utf8.DecodeRuneInString(match)
+    switch {
+    case !unicode.IsUpper(first):
+        return replace
+    case utf8.RuneCountInString(match) > 1 && strings.ToUpper(match) == match:
+        return strings.ToUpper(replace)
+    }
+    return capitalize(replace)
+}
+
+// Punctuation that ends a sentence, and that may come before its first
+// letter
+const (
+    sentenceMarks   = ".!?…。！？"
+    sentenceOpeners = "\"'“‘«(¿¡-"
+)
+
+// capitalize upper-cases the first letter of text
+func capitalize(text string) string {
+    for i, r := range text {
+        if unicode.IsLetter(r) {
+            return text[:i] + string(unicode.ToUpper(r)) + text[i+utf8.RuneLen(r):]
+        }
+        if !unicode.IsSpace(r) && !strings.ContainsRune(sentenceOpeners, r) {
+            return text // Starts with a digit or symbol
+        }
+    }
+    return text
+}
+
+// endsSentence reports whether text ends with a sentence mark, ignoring
+// closing quotes and brackets
+func endsSentence(text string) bool {
+    text = strings.TrimRight(text, `"'”’)] `)
+    last, _ := utf8.DecodeLastRuneInString(text)
+    return strings.ContainsRune(sentenceMarks, last)
+}
+
+// sentenceCase capitalizes the first letter after every sentence mark
+func sentenceCase(text string, sentenceStart bool) string {
+    var out strings.Builder
+    out.Grow(len(text))
+    start := sentenceStart
+    var prev rune
+    for _, r := range text {
+        switch {
+        case start && unicode.IsLetter(r):
+            r = unicode.ToUpper(r)
+            start = false
+        case start && !unicode.IsSpace(r) && !strings.ContainsRune(sentenceOpeners, r):
+            start = false // Starts with a digit or symbol
+        case strings.ContainsRune(sentenceMarks, prev) && unicode.IsSpace(r):
+            start = true
+        }
+        out.WriteRune(r)
+        prev = r
+    }
+    return out.String()
+}
+
+// Number words
+var (
+    numberUnits = map[string]int{
+        "zero": 0, "one": 1, "two": 2, "three": 3, "four": 4, "five": 5, "six": 6,
+        "seven": 7, "eight": 8, "nine": 9, "ten": 10, "eleven": 11, "twelve": 12,
+        "thirteen": 13, "fourteen": 14, "fifteen": 15, "sixteen": 16,
+        "seventeen": 17, "eighteen": 18, "nineteen": 19,
+    }
+    numberTens = map[string]int{
+        "twenty": 20, "thirty": 30, "forty": 40, "fifty": 50, "sixty": 60,
+        "seventy": 70, "eighty": 80, "ninety": 90,
+    }
+    numberScales = map[string]int{
+        "hundred": 100, "thousand": 1_000, "million": 1_000_000, "billion": 1_000_000_000,
+    }
+    numberOrdinals = map[string]string{
+        "first": "one", "second": "two", "third": "three", "fifth": "five",
+        "eighth": "eight", "ninth": "nine", "twelfth": "twelve",
+    }
+    numberRun = numberRunPattern()
+)
+
+// numberRunPattern matches a run of cardinal and ordinal number words
+func numberRunPattern() *regexp.Regexp {
+    var words []string
+    ordinals := make(map[string]string, len(numberOrdinals))
+    for ordinal, cardinal := range numberOrdinals {
+        ordinals[cardinal] = ordinal
+    }
+    for _, group := range []map[string]int{numberUnits, numberTens, numberScales} {
+        for word := range group {
+            ordinal, ok := ordinals[word]
+            if !ok {
+                if stem, ok := strings.CutSuffix(word, "y"); ok {
+                    ordinal = stem + "ieth"
+                } else {
+                    ordinal = word + "th"
+                }
+            }
+            words = append(words, word, ordinal)
+        }
+    }
+    // Longest first, so "seventeen" is not read as "seven"
+    slices.SortFunc(words, func(a, b string) int { return len(b) - len(a) })
+    word := `(?:` + strings.Join(words, "|") + `)`
+    return regexp.MustCompile(`(?i)\b` + word + `(?:(?:[\s-]+|\s+and\s+)` + word + `)*\b`)
+}
+
+// numberWord returns the cardinal form of an English number word and
+// whether it was an ordinal, or false if it is not a number word
+func numberWord(word string) (string, bool, bool) {
+    word = strings.ToLower(word)
+    if isNumberWord(word) {
+        return word, false, true
+    }
+    if cardinal, ok := numberOrdinals[word]; ok {
+        return cardinal, true, true
+    }
+    if stem, ok := strings.CutSuffix(word, "ieth"); ok && isNumberWord(stem+"y") {
+        return stem + "y", true, true
+    }
+    if stem, ok := strings.CutSuffix(word, "th"); ok && stem != "" && isNumberWord(stem) {
+        return stem, true, true
+    }
+    return "", false, false
+}
+
+// isNumberWord reports whether word is a cardinal number word
+func isNumberWord(word string) bool {
+    _, unit := numberUnits[word]
+    _, tens := numberTens[word]
+    _, scale := numberScales[word]
+    return unit || tens || scale
+}
+
+// ordinalSuffix returns st, nd, rd or th for n
+func ordinalSuffix(n int) string {
+    if n%100 >= 11 && n%100 <= 13 {
+        return "th"
+    }
+    switch n % 10 {
+    case 1:
+        return "st"
+    case 2:
+        return "nd"
+    case 3:
+        return "rd"
+    }
+    return "th"
+}
+
+// spelledNumber is a number being read from words
+type spelledNumber struct {
+    total, current int
+    words          int
+    last           string // "unit", "teen", "tens" or "scale"
+    scale          int    // Smallest scale above hundred used so far
+    ordinal        bool
+}
+
+// add takes the next word and reports whether it belongs to the number
+func (n *spelledNumber) add(word string) bool {
+    if n.ordinal {
+        return false
+    }
+    if value, ok := numberUnits[word]; ok {
+        kind := "unit"
+        if value >= 10 {
+            kind = "teen"
+        }
+        switch {
+        case n.words == 0, n.last == "scale":
+        case n.last == "tens" && kind == "unit" && value > 0:
+        default:
+            return false
+        }
+        n.current += value
+        n.last = kind
+    } else if value, ok := numberTens[word]; ok {
+        if n.words > 0 && n.last != "scale" {
+            return false
+        }
+        n.current += value
+        n.last = "tens"
+    } else {
+        value := numberScales[word]
+        switch {
+        case n.current == 0:
+            return false
+        case value == 100:
+            if n.current >= 100 {
+                return false
+            }
+            n.current *= 100
+        default:
+            if n.scale != 0 && value >= n.scale || n.current >= 1000 {
+                return false
+            }
+            n.total += n.current * value
+            n.current = 0
+            n.scale = value
+        }
+        n.last = "scale"
+    }
+    n.words++
+    return true
+}
+
+// accepts reports whether add would take word, without taking it
+func (n spelledNumber) accepts(word string) bool {
+    return n.add(word)
+}
+
+// value returns the number read so far
+func (n *spelledNumber) value() int {
+    return n.total + n.current
+}
+
+// normalizeNumbers writes spelled-out numbers as digits
+func normalizeNumbers(text string) string {
+    return numberRun.ReplaceAllStringFunc(text, func(run string) string {
+        fields := strings.FieldsFunc(run, func(r rune) bool { return unicode.IsSpace(r) || r == '-' })
+        // Keep the original spelling of words that are not numbers,
+        // including the separators before them
+        var out []string
+        var numbers []spelledNumber
+        var n spelledNumber
+        var spelling []string
+        flush := func() {
+            if n.words == 0 {
+                return
+            }
+            // Small numbers read better as words
+            if n.words == 1 && n.value() < 10 {
+                out = append(out, spelling...)
+            } else {
+                numbers = append(numbers, n)
+                out = append(out, "\x00")
+            }
+            n = spelledNumber{}
+            spelling = nil
+        }
+        for i, field := range fields {
+            cardinal, ordinal, ok := numberWord(field)
+            if strings.EqualFold(field, "and") {
+                // Only "hundred and five" and the like
+                next := ""
+                if i+1 < len(fields) {
+                    next, _, _ = numberWord(fields[i+1])
+                }
+                if n.last == "scale" && next != "" && numberScales[next] == 0 {
+                    spelling = append(spelling, field)
+                    continue
+                }
+                ok = false
+            }
+            // "thirty second" may be a position or a duration, so the
+            // number is left as it was said
+            if ok && ordinal && n.words > 0 && strings.EqualFold(field, "second") && n.accepts(cardinal) {
+                out = append(out, spelling...)
+                out = append(out, field)
+                n = spelledNumber{}
+                spelling = nil
+                continue
+            }
+            if !ok {
+                flush()
+                out = append(out, field)
+                continue
+            }
+            if !n.add(cardinal) {
+                flush()
+                if !n.add(cardinal) {
+                    out = append(out, field)
+                    continue
+                }
+            }
+            n.ordinal = ordinal
+            spelling = append(spelling, field)
+        }
+        flush()
+        if len(numbers) == 0 {
+            return run
+        }
+
+        // Two numbers from 10 to 99 in a row are a year: "nineteen eighty"
+        var digits []string
+        for i := 0; i < len(numbers); i++ {
+            value := numbers[i].value()
+            if i+1 < len(numbers) && value >= 10 && value <= 99 && !numbers[i].ordinal && numbers[i].scale == 0 &&
+                numbers[i+1].value() >= 10 && numbers[i+1].value() <= 99 && numbers[i+1].scale == 0 {
+                next := numbers[i+1]
+                digit := strconv.Itoa(value*100 + next.value())
+                if next.ordinal {
+                    digit += ordinalSuffix(next.value())
+                }
+                digits = append(digits, digit, "")
+                i++
+                continue
+            }
+            digit := strconv.Itoa(value)
+            if numbers[i].ordinal {
+                digit += ordinalSuffix(value)
+            }
+            digits = append(digits, digit)
+        }
+
+        var result []string
+        for _, word := range out {
+            if word != "\x00" {
+                result = append(result, word)
+                continue
+            }
+            if digits[0] != "" {
+                result = append(result, digits[0])
+            }
+            digits = digits[1:]
+        }
+        return strings.Join(result, " ")
+    })
+}
+
+// Dates written out in full
+var (
+    monthNames   = `(January|February|March|April|May|June|July|August|September|October|November|December)`
+    dayPattern   = `(\d{1,2})(?:st|nd|rd|th)?`
+    monthDayYear = regexp.MustCompile(`(?i)\b` + monthNames + `\s+(?:the\s+)?` + dayPattern + `,?\s+(\d{4})\b`)
+    dayMonthYear = regexp.MustCompile(`(?i)\b(?:the\s+)?` + dayPattern + `\s+(?:of\s+)?` + monthNames + `,?\s+(\d{4})\b`)
+)
+
+// normalizeDates rewrites full dates in layout
+func normalizeDates(text, layout string) string {
+    format := func(month, day, year string) (string, bool) {
+        date, err := time.Parse("January 2 2006", capitalize(strings.ToLower(month))+" "+day+" "+year)
+        if err != nil {
+            return "", false
+        }
+        return date.Format(layout), true
+    }
+    text = monthDayYear.ReplaceAllStringFunc(text, func(match string) string {
+        groups := monthDayYear.FindStringSubmatch(match)
+        if date, ok := format(groups[1], groups[2], groups[3]); ok {
+            return date
+        }
+        return match
+    })
+    return dayMonthYear.ReplaceAllStringFunc(text, func(match string) string {
+        groups := dayMonthYear.FindStringSubmatch(match)
+        if date, ok := format(groups[2], groups[1], groups[3]); ok {
+            return date
+        }
+        return match
+    })
+}
+
+// withVocabulary adds the postprocessing vocabulary to the prompt of
+// providers that take one
+func (ts *TranscribeService) withVocabulary(backend Transcriber, req *TranscribeRequest) *TranscribeRequest {
+    if ts.Postprocess == nil || len(ts.Postprocess.Vocabulary()) == 0 || !backend.Features().Prompt {
+        return req
+    }
+    vocabulary := slices.Clone(req.Vocabulary)
+    size := len(strings.Join(vocabulary, ", "))
+    for _, term := range ts.Postprocess.Vocabulary() {
+        term = strings.TrimSpace(term)
+        if term == "" || slices.ContainsFunc(vocabulary, func(v string) bool { return strings.EqualFold(v, term) }) {
+            continue
+        }
+        if size+len(term)+2 > maxGlossary {
+            break
+        }
+        vocabulary = append(vocabulary, term)
+        size += len(term) + 2
+    }
+    withVocabulary := *req
+    withVocabulary.Vocabulary = vocabulary
+    return &withVocabulary
+}
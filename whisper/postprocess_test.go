@@ -0,0 +1,34 @@
+package whisper
+
+import "testing"
+
+func TestNormalizeNumbers(t *testing.T) {
+    tests := []struct {
+        text, want string
+    }{
+        {"twenty-five people", "25 people"},
+        {"nineteen eighty four", "1984"},
+        {"one hundred and five", "105"},
+        {"two thousand and twenty", "2020"},
+        {"the twenty first century", "the 21st century"},
+        {"the eleventh hour", "the 11th hour"},
+        {"twelfth night", "12th night"},
+        {"seven dwarfs", "seven dwarfs"},
+        {"the third time", "the third time"},
+        {"one and two", "one and two"},
+
+        // "second" after a number may be a position or a duration
+        {"the twenty second of May", "the twenty second of May"},
+        {"on the thirty second floor", "on the thirty second floor"},
+        {"forty second street", "forty second street"},
+        {"a thirty second delay", "a thirty second delay"},
+        {"one hundred and second", "one hundred and second"},
+        {"the second time", "the second time"},
+        {"twenty two second", "22 second"},
+    }
+    for _, tt := range tests {
+        if got := normalizeNumbers(tt.text); got != tt.want {
+            t.Errorf("normalizeNumbers(%q) = %q, want %q", tt.text, got, tt.want)
+        }
+    }
+}
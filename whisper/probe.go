@@ -0,0 +1,578 @@
+package whisper
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "math"
+    "strings"
+    "time"
+)
+
+// Audio container formats recognized by SniffFormat
+const (
+    AudioWAV  = "wav"
+    AudioMP3  = "mp3"
+    AudioOGG  = "ogg" // Opus or Vorbis
+    AudioWebM = "webm"
+    AudioFLAC = "flac"
+    AudioM4A  = "m4a"
+)
+
+// AudioFormats lists every format SniffFormat recognizes
+var AudioFormats = []string{AudioWAV, AudioMP3, AudioOGG, AudioWebM, AudioFLAC, AudioM4A}
+
+// AudioInfo describes an audio file. Fields the container does not carry
+// are left zero.
+type AudioInfo struct {
+    Format     string        `json:"format"`
+    Codec      string        `json:"codec,omitempty"`
+    Duration   time.Duration `json:"duration"`
+    SampleRate int           `json:"sample_rate,omitempty"`
+    Channels   int           `json:"channels,omitempty"`
+    Size       int64         `json:"size"`
+}
+
+// sniffLen is how much of a file SniffFormat needs
+const sniffLen = 64
+
+// SniffFormat identifies the container from the first bytes of a file by
+// their magic numbers. It returns "" for anything else.
+func SniffFormat(header []byte) string {
+    switch {
+    case len(header) >= 12 && string(header[0:4]) == "RIFF" && string(header[8:12]) == "WAVE":
+        return AudioWAV
+    case bytes.HasPrefix(header, []byte("fLaC")):
+        return AudioFLAC
+    case bytes.HasPrefix(header, []byte("OggS")):
+        return AudioOGG
+    case bytes.HasPrefix(header, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+        return AudioWebM
+    case len(header) >= 8 && string(header[4:8]) == "ftyp":
+        return AudioM4A
+    case bytes.HasPrefix(header, []byte("ID3")):
+        return AudioMP3
+    case len(header) >= 4:
+        if _, ok := parseMP3Header(header); ok {
+            return AudioMP3
+        }
+    }
+    return ""
+}
+
+// ProbeAudio reads the format, duration, sample rate and channel count from
+// the container headers without decoding the audio
+func ProbeAudio(r io.ReaderAt, size int64) (*AudioInfo, error) {
+    header := make([]byte, sniffLen)
+    n, err := r.ReadAt(header, 0)
+    if err != nil && err != io.EOF {
+        return nil, fmt.Errorf("failed to read audio header: %w", err)
+    }
+    header = header[:n]
+
+    info := &AudioInfo{Format: SniffFormat(header), Size: size}
+    switch info.Format {
+    case AudioWAV:
+        err = probeWAV(r, size, info)
+    case AudioFLAC:
+        err = probeFLAC(r, info)
+    case AudioMP3:
+        err = probeMP3(r, size, info)
+    case AudioOGG:
+        err = probeOGG(r, size, info)
+    case AudioWebM:
+        err = probeWebM(r, size, info)
+    case AudioM4A:
+        err = probeM4A(r, size, info)
+    default:
+        return nil, ErrUnsupportedFormat
+    }
+    if err != nil {
+        return nil, fmt.Errorf("failed to read %s metadata: %w", info.Format, err)
+    }
+    return info, nil
+}
+
+// readAt reads exactly n bytes at off
+func readAt(r io.ReaderAt, off int64, n int) ([]byte, error) {
+    buf := make([]byte, n)
+    if _, err := r.ReadAt(buf, off); err != nil {
+        if err == io.EOF {
+            return nil, io.ErrUnexpectedEOF
+        }
+        return nil, err
+    }
+    return buf, nil
+}
+
+// probeWAV walks the RIFF chunks
+func probeWAV(r io.ReaderAt, size int64, info *AudioInfo) error {
+    var blockAlign int
+    for off := int64(12); off+8 <= size; {
+        chunk, err := readAt(r, off, 8)
+        if err != nil {
+            return err
+        }
+        chunkSize := int64(binary.LittleEndian.Uint32(chunk[4:8]))
+
+        switch string(chunk[0:4]) {
+        case "fmt ":
+            fmtChunk, err := readAt(r, off+8, 16)
+            if err != nil {
+                return err
+            }
+            info.Channels = int(binary.LittleEndian.Uint16(fmtChunk[2:4]))
+            info.SampleRate = int(binary.LittleEndian.Uint32(fmtChunk[4:8]))
+            blockAlign = int(binary.LittleEndian.Uint16(fmtChunk[12:14]))
+            info.Codec = fmt.Sprintf("pcm_%d", binary.LittleEndian.Uint16(fmtChunk[14:16]))
+        case "data":
+            if blockAlign == 0 || info.SampleRate == 0 {
+                return fmt.Errorf("data chunk before fmt chunk")
+            }
+            // Streamed recordings often leave the size unset
+            if chunkSize == 0 || chunkSize == math.MaxUint32 || off+8+chunkSize > size {
+                chunkSize = size - off - 8
+            }
+            frames := chunkSize / int64(blockAlign)
+            info.Duration = time.Duration(frames) * time.Second / time.Duration(info.SampleRate)
+            return nil
+        }
+        off += 8 + chunkSize + chunkSize%2
+    }
+    return fmt.Errorf("no data chunk")
+}
+
+// probeFLAC reads the STREAMINFO block, which always comes first
+func probeFLAC(r io.ReaderAt, info *AudioInfo) error {
+    d, err := readAt(r, 8, 18)
+    if err != nil {
+        return err
+    }
+    info.Codec = "flac"
+    info.SampleRate = int(d[10])<<12 | int(d[11])<<4 | int(d[12])>>4
+    info.Channels = int(d[12]>>1&7) + 1
+    samples := uint64(d[13]&0x0F)<<32 | uint64(binary.BigEndian.Uint32(d[14:18]))
+    if info.SampleRate > 0 {
+        info.Duration = time.Duration(samples) * time.Second / time.Duration(info.SampleRate)
+    }
+    return nil
+}
+
+// mp3Frame is a decoded MPEG audio frame header
+type mp3Frame struct {
+    version    int // 1, 2 or 25 for MPEG 2.5
+    layer      int
+    bitrate    int // bits per second
+    sampleRate int
+    channels   int
+}
+
+// samplesPerFrame returns the samples each frame decodes to
+func (f mp3Frame) samplesPerFrame() int {
+    switch {
+    case f.layer == 1:
+        return 384
+    case f.layer == 3 && f.version != 1:
+        return 576
+    }
+    return 1152
+}
+
+// sideInfoLen returns the Layer III side information size
+func (f mp3Frame) sideInfoLen() int {
+    switch {
+    case f.version == 1 && f.channels == 1:
+        return 17
+    case f.version == 1:
+        return 32
+    case f.channels == 1:
+        return 9
+    }
+    return 17
+}
+
+// MPEG audio bitrates in kbit/s by version/layer and index
+var (
+    mp3BitratesV1 = [4][16]int{
+        1: {0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+        2: {0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+        3: {0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+    }
+    mp3BitratesV2 = [4][16]int{
+        1: {0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+        2: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+        3: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+    }
+    mp3SampleRates = map[int][3]int{
+        1:  {44100, 48000, 32000},
+        2:  {22050, 24000, 16000},
+        25: {11025, 12000, 8000},
+    }
+)
+
+// parseMP3Header decodes a frame header, rejecting reserved values
+func parseMP3Header(b []byte) (mp3Frame, bool) {
+    if len(b) < 4 || b[0] != 0xFF || b[1]&0xE0 != 0xE0 {
+        return mp3Frame{}, false
+    }
+    var f mp3Frame
+    switch b[1] >> 3 & 3 {
+    case 0:
+        f.version = 25
+    case 2:
+        f.version = 2
+    case 3:
+        f.version = 1
+    default:
+        return f, false
+    }
+    f.layer = 4 - int(b[1]>>1&3)
+    bitrateIndex := int(b[2] >> 4)
+    rateIndex := int(b[2] >> 2 & 3)
+    if f.layer == 4 || bitrateIndex == 0 || bitrateIndex == 15 || rateIndex == 3 {
+        return f, false
+    }
+    if f.version == 1 {
+        f.bitrate = mp3BitratesV1[f.layer][bitrateIndex] * 1000
+    } else {
+        f.bitrate = mp3BitratesV2[f.layer][bitrateIndex] * 1000
+    }
+    f.sampleRate = mp3SampleRates[f.version][rateIndex]
+    f.channels = 2
+    if b[3]>>6 == 3 {
+        f.channels = 1
+    }
+    return f, true
+}
+
+// probeMP3 reads the first frame and its Xing/Info or VBRI header, falling
+// back to a constant bitrate estimate
+func probeMP3(r io.ReaderAt, size int64, info *AudioInfo) error {
+    off := int64(0)
+    if id3, err := readAt(r, 0, 10); err == nil && string(id3[0:3]) == "ID3" {
+        tagSize := int64(id3[6])<<21 | int64(id3[7])<<14 | int64(id3[8])<<7 | int64(id3[9])
+        off = 10 + tagSize
+        if id3[5]&0x10 != 0 {
+            off += 10 // Footer
+        }
+    }
+
+    // Find the first frame
+    window := int64(64 << 10)
+    buf := make([]byte, min(window, max(0, size-off)))
+    n, _ := r.ReadAt(buf, off)
+    buf = buf[:n]
+    var frame mp3Frame
+    found := false
+    for i := 0; i+4 <= len(buf); i++ {
+        if f, ok := parseMP3Header(buf[i:]); ok {
+            frame, found = f, true
+            off += int64(i)
+            buf = buf[i:]
+            break
+        }
+    }
+    if !found {
+        return fmt.Errorf("no MPEG audio frame found")
+    }
+
+    info.Codec = fmt.Sprintf("mp%d", frame.layer)
+    info.SampleRate = frame.sampleRate
+    info.Channels = frame.channels
+
+    // VBR files carry the frame count
+    frames := int64(0)
+    if xing := 4 + frame.sideInfoLen(); len(buf) >= xing+12 {
+        tag := string(buf[xing : xing+4])
+        if (tag == "Xing" || tag == "Info") && binary.BigEndian.Uint32(buf[xing+4:xing+8])&1 != 0 {
+            frames = int64(binary.BigEndian.Uint32(buf[xing+8 : xing+12]))
+        }
+    }
+    if frames == 0 && len(buf) >= 36+18 && string(buf[36:40]) == "VBRI" {
+        frames = int64(binary.BigEndian.Uint32(buf[50:54]))
+    }
+
+    if frames > 0 {
+        info.Duration = time.Duration(frames*int64(frame.samplesPerFrame())) * time.Second / time.Duration(frame.sampleRate)
+    } else if frame.bitrate > 0 {
+        info.Duration = time.Duration((size-off)*8) * time.Second / time.Duration(frame.bitrate)
+    }
+    return nil
+}
+
+// probeOGG reads the codec header from the first page and the end position
+// from the last one
+func probeOGG(r io.ReaderAt, size int64, info *AudioInfo) error {
+    page, err := readAt(r, 0, 27)
+    if err != nil {
+        return err
+    }
+    segments := int(page[26])
+    packet, err := readAt(r, 27+int64(segments), 19)
+    if err != nil {
+        return err
+    }
+
+    preSkip, rate := int64(0), int64(0)
+    switch {
+    case bytes.HasPrefix(packet, []byte("OpusHead")):
+        info.Codec = "opus"
+        info.Channels = int(packet[9])
+        preSkip = int64(binary.LittleEndian.Uint16(packet[10:12]))
+        info.SampleRate = int(binary.LittleEndian.Uint32(packet[12:16]))
+        rate = 48000 // Opus granule positions always count 48 kHz samples
+        if info.SampleRate == 0 {
+            info.SampleRate = 48000
+        }
+    case bytes.HasPrefix(packet, []byte("\x01vorbis")):
+        info.Codec = "vorbis"
+        info.Channels = int(packet[11])
+        info.SampleRate = int(binary.LittleEndian.Uint32(packet[12:16]))
+        rate = int64(info.SampleRate)
+    default:
+        return nil // Another codec; the format is still known
+    }
+
+    // The last page's granule position is the total sample count
+    tailLen := min(size, 64<<10)
+    tail, err := readAt(r, size-tailLen, int(tailLen))
+    if err != nil {
+        return err
+    }
+    last := bytes.LastIndex(tail, []byte("OggS"))
+    if last < 0 || len(tail)-last < 14 || rate == 0 {
+        return nil
+    }
+    granule := int64(binary.LittleEndian.Uint64(tail[last+6 : last+14]))
+    if granule > preSkip {
+        info.Duration = time.Duration(granule-preSkip) * time.Second / time.Duration(rate)
+    }
+    return nil
+}
+
+// Matroska element IDs used by probeWebM
+const (
+    ebmlSegment       = 0x18538067
+    ebmlInfo          = 0x1549A966
+    ebmlTimecodeScale = 0x2AD7B1
+    ebmlDuration      = 0x4489
+    ebmlTracks        = 0x1654AE6B
+    ebmlTrackEntry    = 0xAE
+    ebmlTrackType     = 0x83
+    ebmlCodecID       = 0x86
+    ebmlAudio         = 0xE1
+    ebmlSampleRate    = 0xB5
+    ebmlChannels      = 0x9F
+    ebmlCluster       = 0x1F43B675
+    ebmlTimecode      = 0xE7
+    ebmlSimpleBlock   = 0xA3
+    ebmlBlockGroup    = 0xA0
+    ebmlBlock         = 0xA1
+)
+
+// ebmlMasters are descended into rather than skipped
+var ebmlMasters = map[uint64]bool{
+    ebmlSegment: true, ebmlInfo: true, ebmlTracks: true, ebmlTrackEntry: true,
+    ebmlAudio: true, ebmlCluster: true, ebmlBlockGroup: true,
+}
+
+// readVint decodes an EBML variable-length integer. IDs keep their length
+// marker, sizes drop it; unknown reports an all-ones (unknown) size.
+func readVint(b []byte, keepMarker bool) (value uint64, length int, unknown bool) {
+    if len(b) == 0 || b[0] == 0 {
+        return 0, 0, false
+    }
+    length = 1
+    for mask := byte(0x80); b[0]&mask == 0; mask >>= 1 {
+        length++
+    }
+    if length > len(b) {
+        return 0, 0, false
+    }
+    first := uint64(b[0])
+    if !keepMarker {
+        first &= 0xFF >> length
+    }
+    value = first
+    allOnes := first == uint64(0xFF>>length)
+    for _, c := range b[1:length] {
+        value = value<<8 | uint64(c)
+        allOnes = allOnes && c == 0xFF
+    }
+    return value, length, allOnes && !keepMarker
+}
+
+// probeWebM scans the element tree. The duration comes from the Info
+// element or, for live recordings that lack it, the last block's timecode.
+func probeWebM(r io.ReaderAt, size int64, info *AudioInfo) error {
+    scale := int64(1000000) // Nanoseconds per timecode unit
+    var declared float64
+    var cluster, lastTimecode int64
+    var trackCodec string
+    var trackAudio bool
+
+    for off := int64(0); off < size; {
+        head := make([]byte, 12)
+        n, _ := r.ReadAt(head, off)
+        head = head[:n]
+        id, idLen, _ := readVint(head, true)
+        elemSize, sizeLen, unknown := readVint(head[min(idLen, len(head)):], false)
+        if idLen == 0 || sizeLen == 0 {
+            break
+        }
+        off += int64(idLen + sizeLen)
+
+        if ebmlMasters[id] {
+            if id == ebmlTrackEntry {
+                trackCodec, trackAudio = "", false
+            }
+            continue // Children follow inline
+        }
+        if unknown {
+            break
+        }
+
+        switch id {
+        case ebmlTimecodeScale, ebmlChannels, ebmlTimecode, ebmlTrackType:
+            data, err := readAt(r, off, int(min(elemSize, 8)))
+            if err != nil {
+                return err
+            }
+            var v int64
+            for _, c := range data {
+                v = v<<8 | int64(c)
+            }
+            switch id {
+            case ebmlTimecodeScale:
+                scale = v
+            case ebmlChannels:
+                info.Channels = int(v)
+            case ebmlTimecode:
+                cluster = v
+                lastTimecode = max(lastTimecode, v)
+            case ebmlTrackType:
+                trackAudio = v == 2
+            }
+        case ebmlDuration, ebmlSampleRate:
+            data, err := readAt(r, off, int(min(elemSize, 8)))
+            if err != nil {
+                return err
+            }
+            var v float64
+            if len(data) == 4 {
+                v = float64(math.Float32frombits(binary.BigEndian.Uint32(data)))
+            } else if len(data) == 8 {
+                v = math.Float64frombits(binary.BigEndian.Uint64(data))
+            }
+            if id == ebmlDuration {
+                declared = v
+            } else if info.SampleRate == 0 {
+                info.SampleRate = int(v)
+            }
+        case ebmlCodecID:
+            data, err := readAt(r, off, int(min(elemSize, 64)))
+            if err != nil {
+                return err
+            }
+            // A_OPUS, A_VORBIS, ...
+            trackCodec = strings.ToLower(strings.TrimPrefix(string(bytes.TrimRight(data, "\x00")), "A_"))
+        case ebmlSimpleBlock, ebmlBlock:
+            // Track number vint, then a signed 16-bit relative timecode
+            data, err := readAt(r, off, int(min(elemSize, 10)))
+            if err == nil {
+                if _, trackLen, _ := readVint(data, false); trackLen > 0 && trackLen+2 <= len(data) {
+                    rel := int64(int16(binary.BigEndian.Uint16(data[trackLen : trackLen+2])))
+                    lastTimecode = max(lastTimecode, cluster+rel)
+                }
+            }
+        }
+        off += int64(elemSize)
+
+        if trackAudio && trackCodec != "" && info.Codec == "" {
+            info.Codec = trackCodec
+        }
+    }
+
+    if declared > 0 {
+        info.Duration = time.Duration(declared * float64(scale))
+    } else {
+        info.Duration = time.Duration(lastTimecode * scale)
+    }
+    return nil
+}
+
+// mp4Containers are boxes whose children are boxes
+var mp4Containers = map[string]bool{
+    "moov": true, "trak": true, "mdia": true, "minf": true, "stbl": true,
+}
+
+// mp4AudioEntries are sample entry types of audio codecs
+var mp4AudioEntries = map[string]string{
+    "mp4a": "aac", "alac": "alac", "Opus": "opus", "fLaC": "flac",
+    "ac-3": "ac3", "ec-3": "eac3", "samr": "amr",
+}
+
+// probeM4A walks the box tree for the movie header and the audio sample
+// entry
+func probeM4A(r io.ReaderAt, size int64, info *AudioInfo) error {
+    for off := int64(0); off+8 <= size; {
+        head, err := readAt(r, off, 8)
+        if err != nil {
+            return err
+        }
+        boxSize := int64(binary.BigEndian.Uint32(head[0:4]))
+        boxType := string(head[4:8])
+        headerLen := int64(8)
+        switch boxSize {
+        case 0:
+            boxSize = size - off
+        case 1:
+            large, err := readAt(r, off+8, 8)
+            if err != nil {
+                return err
+            }
+            boxSize = int64(binary.BigEndian.Uint64(large))
+            headerLen = 16
+        }
+        if boxSize < headerLen {
+            return fmt.Errorf("invalid %q box size", boxType)
+        }
+
+        if mp4Containers[boxType] {
+            off += headerLen
+            continue
+        }
+
+        switch boxType {
+        case "mvhd":
+            box, err := readAt(r, off+headerLen, 32)
+            if err != nil {
+                return err
+            }
+            var timescale, duration uint64
+            if box[0] == 1 {
+                timescale = uint64(binary.BigEndian.Uint32(box[20:24]))
+                duration = binary.BigEndian.Uint64(box[24:32])
+            } else {
+                timescale = uint64(binary.BigEndian.Uint32(box[12:16]))
+                duration = uint64(binary.BigEndian.Uint32(box[16:20]))
+            }
+            if timescale > 0 {
+                info.Duration = time.Duration(duration) * time.Second / time.Duration(timescale)
+            }
+        case "stsd":
+            entry, err := readAt(r, off+headerLen+8, 36)
+            if err != nil {
+                return err
+            }
+            if codec, ok := mp4AudioEntries[string(entry[4:8])]; ok && info.Codec == "" {
+                info.Codec = codec
+                info.Channels = int(binary.BigEndian.Uint16(entry[24:26]))
+                info.SampleRate = int(binary.BigEndian.Uint16(entry[32:34]))
+            }
+        }
+        off += boxSize
+    }
+    return nil
+}
@@ -0,0 +1,217 @@
+package whisper_test
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "math"
+    "testing"
+    "time"
+
+    "github.com/gchalakovmmi/PulpuWEB/whisper"
+)
+
+// flacFile is a FLAC stream with only a STREAMINFO block
+func flacFile(rate, channels int, samples uint64) []byte {
+    info := make([]byte, 34)
+    info[10] = byte(rate >> 12)
+    info[11] = byte(rate >> 4)
+    info[12] = byte(rate<<4) | byte(channels-1)<<1
+    info[13] = byte(samples >> 32 & 0x0F)
+    binary.BigEndian.PutUint32(info[14:18], uint32(samples))
+    return append([]byte("fLaC\x80\x00\x00\x22"), info...)
+}
+
+// mp3Frame is the header of an MPEG-1 Layer III frame at 128 kbit/s and
+// 44.1 kHz, stereo
+var mp3Frame = []byte{0xFF, 0xFB, 0x90, 0x44}
+
+// mp3File is size bytes of MPEG audio after an optional ID3 tag
+func mp3File(tag bool, size int) []byte {
+    var file []byte
+    if tag {
+        // 100 bytes of tag, the size in 7-bit bytes
+        file = append([]byte("ID3\x04\x00\x00\x00\x00\x00\x64"), make([]byte, 100)...)
+    }
+    audio := make([]byte, size)
+    copy(audio, mp3Frame)
+    return append(file, audio...)
+}
+
+// xingFile is an MP3 whose first frame carries a Xing frame count
+func xingFile(frames uint32) []byte {
+    file := mp3File(false, 4096)
+    xing := 4 + 32 // Header and MPEG-1 stereo side information
+    copy(file[xing:], "Xing")
+    binary.BigEndian.PutUint32(file[xing+4:], 1)
+    binary.BigEndian.PutUint32(file[xing+8:], frames)
+    return file
+}
+
+// oggPage is an Ogg page with one packet
+func oggPage(headerType byte, granule uint64, packet []byte) []byte {
+    page := []byte("OggS\x00")
+    page = append(page, headerType)
+    page = binary.LittleEndian.AppendUint64(page, granule)
+    page = append(page, make([]byte, 12)...) // Serial, sequence and CRC
+    page = append(page, 1, byte(len(packet)))
+    return append(page, packet...)
+}
+
+// opusFile is an Ogg Opus stream of the given length
+func opusFile(seconds float64) []byte {
+    head := []byte("OpusHead\x01\x02")
+    head = binary.LittleEndian.AppendUint16(head, 312)
+    head = binary.LittleEndian.AppendUint32(head, 16000)
+    head = append(head, 0, 0, 0)
+    file := oggPage(2, 0, head)
+    file = append(file, oggPage(0, 0, make([]byte, 200))...)
+    return append(file, oggPage(4, uint64(seconds*48000)+312, make([]byte, 100))...)
+}
+
+// ebml is a Matroska element with a one-byte size
+func ebml(id []byte, children ...[]byte) []byte {
+    var data []byte
+    for _, child := range children {
+        data = append(data, child...)
+    }
+    return append(append(id, 0x80|byte(len(data))), data...)
+}
+
+// webmFile is a WebM file with an Opus track
+func webmFile(duration float32) []byte {
+    header := ebml([]byte{0x1A, 0x45, 0xDF, 0xA3}, ebml([]byte{0x42, 0x82}, []byte("webm")))
+    info := ebml([]byte{0x15, 0x49, 0xA9, 0x66},
+        ebml([]byte{0x2A, 0xD7, 0xB1}, []byte{0x0F, 0x42, 0x40}),
+        ebml([]byte{0x44, 0x89}, binary.BigEndian.AppendUint32(nil, math.Float32bits(duration))),
+    )
+    tracks := ebml([]byte{0x16, 0x54, 0xAE, 0x6B}, ebml([]byte{0xAE},
+        ebml([]byte{0x83}, []byte{2}),
+        ebml([]byte{0x86}, []byte("A_OPUS")),
+        ebml([]byte{0xE1},
+            ebml([]byte{0xB5}, binary.BigEndian.AppendUint32(nil, math.Float32bits(48000))),
+            ebml([]byte{0x9F}, []byte{1}),
+        ),
+    ))
+    // A segment of unknown size, as recorders write it
+    segment := append([]byte{0x18, 0x53, 0x80, 0x67, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, info...)
+    return append(header, append(segment, tracks...)...)
+}
+
+// mp4Box is an ISO media box
+func mp4Box(boxType string, children ...[]byte) []byte {
+    var data []byte
+    for _, child := range children {
+        data = append(data, child...)
+    }
+    box := binary.BigEndian.AppendUint32(nil, uint32(8+len(data)))
+    return append(append(box, boxType...), data...)
+}
+
+// m4aFile is an M4A file with an AAC track
+func m4aFile(timescale, duration uint32) []byte {
+    mvhd := make([]byte, 100)
+    binary.BigEndian.PutUint32(mvhd[12:16], timescale)
+    binary.BigEndian.PutUint32(mvhd[16:20], duration)
+
+    entry := make([]byte, 36)
+    binary.BigEndian.PutUint32(entry[0:4], 36)
+    copy(entry[4:8], "mp4a")
+    binary.BigEndian.PutUint16(entry[24:26], 2)
+    binary.BigEndian.PutUint16(entry[32:34], 44100)
+    stsd := append([]byte{0, 0, 0, 0, 0, 0, 0, 1}, entry...)
+
+    return append(
+        mp4Box("ftyp", []byte("M4A \x00\x00\x00\x00isom")),
+        mp4Box("moov",
+            mp4Box("mvhd", mvhd),
+            mp4Box("trak", mp4Box("mdia", mp4Box("minf", mp4Box("stbl", mp4Box("stsd", stsd))))),
+        )...,
+    )
+}
+
+func TestSniffFormat(t *testing.T) {
+    tests := []struct {
+        name   string
+        header []byte
+        want   string
+    }{
+        {"wav", []byte("RIFF\x24\x00\x00\x00WAVEfmt "), whisper.AudioWAV},
+        {"flac", []byte("fLaC\x00\x00\x00\x22"), whisper.AudioFLAC},
+        {"ogg", []byte("OggS\x00\x02"), whisper.AudioOGG},
+        {"webm", []byte{0x1A, 0x45, 0xDF, 0xA3, 0x9F}, whisper.AudioWebM},
+        {"m4a", []byte("\x00\x00\x00\x20ftypM4A "), whisper.AudioM4A},
+        {"mp3 with tag", []byte("ID3\x04\x00"), whisper.AudioMP3},
+        {"mp3 frame", mp3Frame, whisper.AudioMP3},
+        {"avi", []byte("RIFF\x24\x00\x00\x00AVI LIST"), ""},
+        {"reserved mp3 bitrate", []byte{0xFF, 0xFB, 0xF0, 0x44}, ""},
+        {"text", []byte("hello world"), ""},
+        {"empty", nil, ""},
+    }
+    for _, tt := range tests {
+        if got := whisper.SniffFormat(tt.header); got != tt.want {
+            t.Errorf("%s: SniffFormat = %q, want %q", tt.name, got, tt.want)
+        }
+    }
+}
+
+func TestProbeAudio(t *testing.T) {
+    tests := []struct {
+        name string
+        file []byte
+        want whisper.AudioInfo
+    }{
+        {"wav", wavBytes(t, tone(16000, 2, 1.5, 440)), whisper.AudioInfo{
+            Format: whisper.AudioWAV, Codec: "pcm_16", Duration: 1500 * time.Millisecond, SampleRate: 16000, Channels: 2,
+        }},
+        {"flac", flacFile(44100, 2, 441000), whisper.AudioInfo{
+            Format: whisper.AudioFLAC, Codec: "flac", Duration: 10 * time.Second, SampleRate: 44100, Channels: 2,
+        }},
+        {"mp3 constant bitrate", mp3File(false, 32000), whisper.AudioInfo{
+            Format: whisper.AudioMP3, Codec: "mp3", Duration: 2 * time.Second, SampleRate: 44100, Channels: 2,
+        }},
+        {"mp3 after ID3 tag", mp3File(true, 16000), whisper.AudioInfo{
+            Format: whisper.AudioMP3, Codec: "mp3", Duration: time.Second, SampleRate: 44100, Channels: 2,
+        }},
+        {"mp3 with Xing header", xingFile(1000), whisper.AudioInfo{
+            Format: whisper.AudioMP3, Codec: "mp3", Duration: 1152000 * time.Second / 44100, SampleRate: 44100, Channels: 2,
+        }},
+        {"opus", opusFile(3), whisper.AudioInfo{
+            Format: whisper.AudioOGG, Codec: "opus", Duration: 3 * time.Second, SampleRate: 16000, Channels: 2,
+        }},
+        {"webm", webmFile(2500), whisper.AudioInfo{
+            Format: whisper.AudioWebM, Codec: "opus", Duration: 2500 * time.Millisecond, SampleRate: 48000, Channels: 1,
+        }},
+        {"m4a", m4aFile(1000, 4500), whisper.AudioInfo{
+            Format: whisper.AudioM4A, Codec: "aac", Duration: 4500 * time.Millisecond, SampleRate: 44100, Channels: 2,
+        }},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            info, err := whisper.ProbeAudio(bytes.NewReader(tt.file), int64(len(tt.file)))
+            if err != nil {
+                t.Fatal(err)
+            }
+            tt.want.Size = int64(len(tt.file))
+            if *info != tt.want {
+                t.Errorf("got %+v, want %+v", *info, tt.want)
+            }
+        })
+    }
+}
+
+func TestProbeAudioErrors(t *testing.T) {
+    if _, err := whisper.ProbeAudio(bytes.NewReader([]byte("not audio")), 9); !errors.Is(err, whisper.ErrUnsupportedFormat) {
+        t.Errorf("err = %v, want ErrUnsupportedFormat", err)
+    }
+
+    for name, file := range map[string][]byte{
+        "truncated flac":   flacFile(44100, 2, 441000)[:20],
+        "wav without data": riffWAV(riffChunk("fmt ", fmtChunk(1, 1, 8000, 16))),
+        "truncated m4a":    m4aFile(1000, 4500)[:40],
+    } {
+        if _, err := whisper.ProbeAudio(bytes.NewReader(file), int64(len(file))); err == nil {
+            t.Errorf("%s: probed without an error", name)
+        }
+    }
+}
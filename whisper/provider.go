@@ -0,0 +1,123 @@
+package whisper
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net/http"
+    "sort"
+    "sync"
+)
+
+// Features describes what a transcription backend supports
+type Features struct {
+    Translate      bool  // Can translate speech to English
+    Segments       bool  // Returns timestamped segments
+    WordTimestamps bool  // Returns word-level timestamps
+    Prompt         bool  // Accepts an initial prompt
+    Temperature    bool  // Accepts a sampling temperature
+    Encode         bool  // Re-encodes arbitrary input on the server side
+    RequiresModel  bool  // A model name must be sent with each request
+    WAVOnly        bool  // Only decodes 16 kHz WAV
+    MaxFileSize    int64 // Largest accepted upload in bytes, 0 if unknown
+}
+
+// Transcriber is implemented by every transcription backend
+type Transcriber interface {
+    Name() string
+    Features() Features
+    Transcribe(ctx context.Context, req *TranscribeRequest) (*TranscribeResponse, error)
+}
+
+// ProviderConfig holds the settings a provider is built from
+type ProviderConfig struct {
+    URL        string // Endpoint, falls back to the provider's default when empty
+    APIKey     string
+    Model      string
+    HTTPClient *http.Client // Falls back to a shared default client when nil
+}
+
+// client returns the configured HTTP client or the shared default
+func (cfg ProviderConfig) client() *http.Client {
+    if cfg.HTTPClient != nil {
+        return cfg.HTTPClient
+    }
+    return defaultHTTPClient
+}
+
+// ErrNotSupported is returned, wrapped, for request options the provider
+// cannot honor
+var ErrNotSupported = errors.New("not supported")
+
+// checkFeatures fails when req asks for something the backend lacks
+func checkFeatures(backend Transcriber, req *TranscribeRequest) error {
+    features := backend.Features()
+    unsupported := func(option string) error {
+        return fmt.Errorf("%s is %w by whisper provider %s", option, ErrNotSupported, backend.Name())
+    }
+
+    switch req.Task {
+    case "", TaskTranscribe:
+    case TaskTranslate:
+        if !features.Translate {
+            return unsupported("translation")
+        }
+    default:
+        return fmt.Errorf("unknown task %q", req.Task)
+    }
+    if req.prompt() != "" && !features.Prompt {
+        return unsupported("prompt")
+    }
+    if req.Temperature != 0 && !features.Temperature {
+        return unsupported("temperature")
+    }
+    if req.wantsWords() && !features.WordTimestamps {
+        return unsupported("word timestamps")
+    }
+    return nil
+}
+
+// ProviderFactory builds a Transcriber from its configuration
+type ProviderFactory func(cfg ProviderConfig) (Transcriber, error)
+
+var (
+    providersMu sync.RWMutex
+    providers   = map[string]ProviderFactory{}
+)
+
+// RegisterProvider makes a provider available by name to NewTranscriber
+// and the WHISPER_PROVIDER variable. It panics if the name is taken.
+func RegisterProvider(name string, factory ProviderFactory) {
+    providersMu.Lock()
+    defer providersMu.Unlock()
+    if factory == nil {
+        panic("whisper: RegisterProvider factory is nil")
+    }
+    if _, dup := providers[name]; dup {
+        panic("whisper: RegisterProvider called twice for provider " + name)
+    }
+    providers[name] = factory
+}
+
+// NewTranscriber builds the named provider
+func NewTranscriber(name string, cfg ProviderConfig) (Transcriber, error) {
+    providersMu.RLock()
+    factory, ok := providers[name]
+    providersMu.RUnlock()
+    if !ok {
+        return nil, fmt.Errorf("unknown whisper provider %q (registered: %v)", name, Providers())
+    }
+    return factory(cfg)
+}
+
+// Providers returns the sorted names of the registered providers
+func Providers() []string {
+    providersMu.RLock()
+    defer providersMu.RUnlock()
+    names := make([]string, 0, len(providers))
+    for name := range providers {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
@@ -0,0 +1,275 @@
+package whisper
+
+import (
+    "fmt"
+    "math"
+    "slices"
+    "strings"
+)
+
+// Segment flags set by CheckQuality
+const (
+    FlagNoSpeech      = "no_speech"      // Probably silence or noise
+    FlagLowConfidence = "low_confidence" // Low average log probability
+    FlagRepetitive    = "repetitive"     // High compression ratio or a repeated phrase
+    FlagHallucination = "hallucination"  // Only a phrase Whisper invents on silence
+)
+
+// Quality actions
+const (
+    QualityFlag = "flag" // Mark segments and keep them
+    QualityDrop = "drop" // Remove flagged segments and collapse loops
+)
+
+// DefaultHallucinations are phrases Whisper is known to produce on silent
+// or noisy audio, learned from subtitled videos
+var DefaultHallucinations = []string{
+    "Thanks for watching!",
+    "Thank you for watching.",
+    "Thank you for watching!",
+    "Thanks for watching, and I'll see you next time.",
+    "Please subscribe to my channel.",
+    "Don't forget to like and subscribe.",
+    "Subtitles by the Amara.org community",
+    "Transcription by CastingWords",
+}
+
+// QualityConfig sets the thresholds of CheckQuality. Zero fields take the
+// defaults noted below, which are the ones Whisper itself uses.
+type QualityConfig struct {
+    Action string // QualityFlag or QualityDrop, QualityFlag
+
+    // LogprobThreshold flags segments with a lower avg_logprob, -1
+    LogprobThreshold float64
+    // CompressionRatioThreshold flags segments whose text compresses
+    // better than this, a sign of repetition, 2.4
+    CompressionRatioThreshold float64
+    // NoSpeechThreshold marks segments as silence when no_speech_prob is
+    // above it and avg_logprob is below LogprobThreshold, 0.6
+    NoSpeechThreshold float64
+
+    // MaxRepeats is how often a phrase may occur in a row before it counts
+    // as a loop, 4
+    MaxRepeats int
+    // Hallucinations are flagged when they make up a whole segment,
+    // DefaultHallucinations when nil
+    Hallucinations []string
+}
+
+// withDefaults fills the zero fields
+func (cfg QualityConfig) withDefaults() QualityConfig {
+    if cfg.Action == "" {
+        cfg.Action = QualityFlag
+    }
+    if cfg.LogprobThreshold == 0 {
+        cfg.LogprobThreshold = -1
+    }
+    if cfg.CompressionRatioThreshold <= 0 {
+        cfg.CompressionRatioThreshold = 2.4
+    }
+    if cfg.NoSpeechThreshold <= 0 {
+        cfg.NoSpeechThreshold = 0.6
+    }
+    if cfg.MaxRepeats <= 1 {
+        cfg.MaxRepeats = 4
+    }
+    if cfg.Hallucinations == nil {
+        cfg.Hallucinations = DefaultHallucinations
+    }
+    return cfg
+}
+
+// QualityReport summarizes CheckQuality
+type QualityReport struct {
+    // Score estimates how trustworthy the transcript is, from 0 to 1: the
+    // duration-weighted confidence of the segments, 0 for flagged ones
+    Score   float64 `json:"score"`
+    Flagged int     `json:"flagged"` // Segments with at least one flag
+    Dropped int     `json:"dropped"` // Segments removed by QualityDrop
+    Loops   int     `json:"loops"`   // Repeated-phrase loops found
+}
+
+// normalizePhrase lowercases text and strips punctuation for comparison
+func normalizePhrase(text string) string {
+    return strings.Join(strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+        return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r > 127 || r == '\'')
+    }), " ")
+}
+
+// findLoop returns the start and length in words of the first phrase of up
+// to 8 words repeated at least minRepeats times in a row, and the number
+// of repeats
+func findLoop(words []string, minRepeats int) (start, size, repeats int) {
+    norm := make([]string, len(words))
+    for i, w := range words {
+        norm[i] = normalizeWord(w)
+    }
+    for start = range norm {
+        for size = 1; size <= 8 && start+size*minRepeats <= len(norm); size++ {
+            repeats = 1
+            for next := start + size; next+size <= len(norm) && slices.Equal(norm[start:start+size], norm[next:next+size]); next += size {
+                repeats++
+            }
+            if repeats >= minRepeats {
+                return start, size, repeats
+            }
+        }
+    }
+    return 0, 0, 0
+}
+
+// collapseLoops keeps one occurrence of every repeated-phrase loop and
+// returns the text with the number of loops removed
+func collapseLoops(text string, minRepeats int) (string, int) {
+    words := strings.Fields(text)
+    loops := 0
+    for {
+        start, size, repeats := findLoop(words, minRepeats)
+        if repeats == 0 {
+            break
+        }
+        words = slices.Delete(words, start+size, start+size*repeats)
+        loops++
+    }
+    if loops == 0 {
+        return text, 0
+    }
+    return strings.Join(words, " "), loops
+}
+
+// segmentFlags returns the flags of one segment
+func segmentFlags(seg *Segment, cfg QualityConfig, hallucinations map[string]bool) []string {
+    var flags []string
+    // Zero statistics mean the provider did not report them
+    if seg.NoSpeechProb > cfg.NoSpeechThreshold && seg.AvgLogprob < cfg.LogprobThreshold {
+        flags = append(flags, FlagNoSpeech)
+    } else if seg.AvgLogprob != 0 && seg.AvgLogprob < cfg.LogprobThreshold {
+        flags = append(flags, FlagLowConfidence)
+    }
+    if seg.CompressionRatio > cfg.CompressionRatioThreshold {
+        flags = append(flags, FlagRepetitive)
+    } else if _, _, repeats := findLoop(strings.Fields(seg.Text), cfg.MaxRepeats); repeats > 0 {
+        flags = append(flags, FlagRepetitive)
+    }
+    if hallucinations[normalizePhrase(seg.Text)] {
+        flags = append(flags, FlagHallucination)
+    }
+    return flags
+}
+
+// segmentConfidence estimates how likely a segment is correct speech
+func segmentConfidence(seg *Segment) float64 {
+    if seg.AvgLogprob == 0 && seg.NoSpeechProb == 0 {
+        return 1 // Not reported
+    }
+    return math.Exp(min(seg.AvgLogprob, 0)) * (1 - seg.NoSpeechProb)
+}
+
+// CheckQuality sets Segment.Flags from the decoder statistics, repeated
+// phrases and known hallucinations, and scores the transcript. With
+// QualityDrop flagged segments are removed, loops are collapsed and Text
+// and Words are rebuilt.
+func CheckQuality(resp *TranscribeResponse, cfg QualityConfig) *QualityReport {
+    cfg = cfg.withDefaults()
+    hallucinations := make(map[string]bool, len(cfg.Hallucinations))
+    for _, phrase := range cfg.Hallucinations {
+        hallucinations[normalizePhrase(phrase)] = true
+    }
+
+    report := &QualityReport{}
+    if len(resp.Segments) == 0 {
+        // Only the text to go on
+        _, _, repeats := findLoop(strings.Fields(resp.Text), cfg.MaxRepeats)
+        hallucinated := hallucinations[normalizePhrase(resp.Text)]
+        report.Score = 1
+        if repeats > 0 || hallucinated {
+            report.Score = 0
+            report.Loops = min(repeats, 1)
+        }
+        if cfg.Action == QualityDrop {
+            if hallucinated {
+                resp.Text = ""
+            }
+            resp.Text, _ = collapseLoops(resp.Text, cfg.MaxRepeats)
+        }
+        return report
+    }
+
+    var weighted, total float64
+    var changed bool
+    kept := resp.Segments[:0:0]
+    for i := range resp.Segments {
+        seg := &resp.Segments[i]
+        seg.Flags = segmentFlags(seg, cfg, hallucinations)
+        length := max(seg.End-seg.Start, 0.01)
+        total += length
+        if len(seg.Flags) == 0 {
+            weighted += length * segmentConfidence(seg)
+        } else {
+            report.Flagged++
+        }
+
+        text, loops := collapseLoops(seg.Text, cfg.MaxRepeats)
+        report.Loops += loops
+        if cfg.Action != QualityDrop {
+            continue
+        }
+        // A loop in otherwise sound speech is collapsed, not dropped
+        loopOnly := loops > 0 && slices.Equal(seg.Flags, []string{FlagRepetitive}) &&
+            seg.CompressionRatio <= cfg.CompressionRatioThreshold
+        if len(seg.Flags) > 0 && !loopOnly {
+            report.Dropped++
+            changed = true
+            continue
+        }
+        if loops > 0 {
+            seg.Text = " " + text
+            seg.Words = nil
+            changed = true
+        }
+        kept = append(kept, *seg)
+    }
+    if total > 0 {
+        report.Score = weighted / total
+    }
+
+    if changed {
+        resp.Segments = kept
+        rebuildText(resp)
+    }
+    return report
+}
+
+// rebuildText derives Text and Words from the remaining segments
+func rebuildText(resp *TranscribeResponse) {
+    var text strings.Builder
+    for _, seg := range resp.Segments {
+        text.WriteString(seg.Text)
+    }
+    resp.Text = strings.TrimSpace(text.String())
+
+    if len(resp.Words) == 0 {
+        return
+    }
+    words := resp.Words[:0:0]
+    for _, w := range resp.Words {
+        for _, seg := range resp.Segments {
+            if seg.Words != nil && w.Start >= seg.Start && w.End <= seg.End+0.01 {
+                words = append(words, w)
+                break
+            }
+        }
+    }
+    resp.Words = words
+}
+
+// parseQualityAction validates WHISPER_QUALITY
+func parseQualityAction(value string) (*QualityConfig, error) {
+    switch value {
+    case "", "off":
+        return nil, nil
+    case QualityFlag, QualityDrop:
+        return &QualityConfig{Action: value}, nil
+    }
+    return nil, fmt.Errorf("invalid WHISPER_QUALITY value: %q", value)
+}
@@ -0,0 +1,90 @@
+package whisper_test
+
+import (
+    "slices"
+    "testing"
+
+    "github.com/gchalakovmmi/PulpuWEB/whisper"
+)
+
+func TestCheckQualityFlags(t *testing.T) {
+    tests := []struct {
+        name string
+        seg  whisper.Segment
+        want []string
+    }{
+        {"clean", whisper.Segment{Text: " We met on Monday.", AvgLogprob: -0.2, CompressionRatio: 1.3, NoSpeechProb: 0.01}, nil},
+        {"statistics not reported", whisper.Segment{Text: " We met on Monday."}, nil},
+        {"no speech", whisper.Segment{Text: " you", AvgLogprob: -1.4, NoSpeechProb: 0.9}, []string{whisper.FlagNoSpeech}},
+        {"confident despite silence odds", whisper.Segment{Text: " Yes.", AvgLogprob: -0.3, NoSpeechProb: 0.9}, nil},
+        {"low confidence", whisper.Segment{Text: " Grumble mumble.", AvgLogprob: -1.6, NoSpeechProb: 0.1}, []string{whisper.FlagLowConfidence}},
+        {"compresses too well", whisper.Segment{Text: " la la la", AvgLogprob: -0.3, CompressionRatio: 3.1}, []string{whisper.FlagRepetitive}},
+        {"repeated phrase", whisper.Segment{Text: " I'm sorry. I'm sorry. I'm sorry. I'm sorry.", AvgLogprob: -0.3}, []string{whisper.FlagRepetitive}},
+        {"hallucination", whisper.Segment{Text: " Thanks for watching!", AvgLogprob: -0.5}, []string{whisper.FlagHallucination}},
+        {"hallucination in other case", whisper.Segment{Text: " thank you for watching", AvgLogprob: -0.5}, []string{whisper.FlagHallucination}},
+        {"phrase inside speech", whisper.Segment{Text: " Thanks for watching the kids yesterday.", AvgLogprob: -0.2}, nil},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            tt.seg.End = 2
+            resp := &whisper.TranscribeResponse{Segments: []whisper.Segment{tt.seg}}
+            report := whisper.CheckQuality(resp, whisper.QualityConfig{})
+            if got := resp.Segments[0].Flags; !slices.Equal(got, tt.want) {
+                t.Errorf("flags = %v, want %v", got, tt.want)
+            }
+            if (report.Flagged == 1) != (tt.want != nil) {
+                t.Errorf("flagged = %d", report.Flagged)
+            }
+        })
+    }
+}
+
+func TestCheckQualityDrop(t *testing.T) {
+    resp := &whisper.TranscribeResponse{
+        Text: "ignored",
+        Segments: []whisper.Segment{
+            {Start: 0, End: 2, Text: " Let's begin.", AvgLogprob: -0.1, CompressionRatio: 1.1},
+            {Start: 2, End: 6, Text: " I think I think I think I think we should go.", AvgLogprob: -0.2, CompressionRatio: 1.6},
+            {Start: 6, End: 9, Text: " Thanks for watching!", AvgLogprob: -0.6, CompressionRatio: 1},
+        },
+        Words: []whisper.Word{
+            {Word: " Let's", Start: 0, End: 1},
+            {Word: " begin.", Start: 1, End: 2},
+            {Word: " Thanks", Start: 6, End: 7},
+        },
+    }
+    resp.Segments[0].Words = resp.Words[:2]
+    resp.Segments[2].Words = resp.Words[2:]
+
+    report := whisper.CheckQuality(resp, whisper.QualityConfig{Action: whisper.QualityDrop})
+    if want := "Let's begin. I think we should go."; resp.Text != want {
+        t.Errorf("text = %q, want %q", resp.Text, want)
+    }
+    if report.Dropped != 1 || report.Flagged != 2 || report.Loops != 1 {
+        t.Errorf("report = %+v, want 1 dropped, 2 flagged, 1 loop", report)
+    }
+    if len(resp.Segments) != 2 || len(resp.Words) != 2 {
+        t.Errorf("kept %d segments and %d words, want 2 and 2", len(resp.Segments), len(resp.Words))
+    }
+    if report.Score <= 0 || report.Score >= 0.5 {
+        t.Errorf("score = %v, want the clean 2 of 9 seconds", report.Score)
+    }
+}
+
+func TestCheckQualityTextOnly(t *testing.T) {
+    tests := []struct {
+        text, want string
+        score      float64
+    }{
+        {"See you tomorrow.", "See you tomorrow.", 1},
+        {"Thank you for watching.", "", 0},
+        {"go go go go go now", "go now", 0},
+    }
+    for _, tt := range tests {
+        resp := &whisper.TranscribeResponse{Text: tt.text}
+        report := whisper.CheckQuality(resp, whisper.QualityConfig{Action: whisper.QualityDrop})
+        if resp.Text != tt.want || report.Score != tt.score {
+            t.Errorf("%q: got %q with score %v, want %q with %v", tt.text, resp.Text, report.Score, tt.want, tt.score)
+        }
+    }
+}
@@ -0,0 +1,140 @@
+package whisper
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "math/rand/v2"
+    "time"
+)
+
+// RetryConfig controls retries of rate-limited and unavailable providers.
+// Zero fields take the defaults noted below.
+type RetryConfig struct {
+    MaxAttempts int           // Tries including the first, 3
+    BaseDelay   time.Duration // Backoff before the second try, 500ms
+    MaxDelay    time.Duration // Longest backoff, 30s
+    // MaxRetryAfter is the longest Retry-After we wait for before giving
+    // up, 1m
+    MaxRetryAfter time.Duration
+}
+
+// withDefaults fills the zero fields
+func (cfg RetryConfig) withDefaults() RetryConfig {
+    if cfg.MaxAttempts <= 0 {
+        cfg.MaxAttempts = 3
+    }
+    if cfg.BaseDelay <= 0 {
+        cfg.BaseDelay = 500 * time.Millisecond
+    }
+    if cfg.MaxDelay <= 0 {
+        cfg.MaxDelay = 30 * time.Second
+    }
+    if cfg.MaxRetryAfter <= 0 {
+        cfg.MaxRetryAfter = time.Minute
+    }
+    return cfg
+}
+
+// backoff returns the jittered delay before retry number attempt (1-based)
+func (cfg RetryConfig) backoff(attempt int) time.Duration {
+    ceiling := cfg.MaxDelay
+    if shift := attempt - 1; shift < 30 {
+        ceiling = min(ceiling, cfg.BaseDelay<<shift)
+    }
+    // Full jitter spreads out clients that failed together
+    return time.Duration(rand.Int64N(int64(ceiling) + 1))
+}
+
+// Retryable reports whether err is worth another attempt
+func Retryable(err error) bool {
+    return errors.Is(err, ErrRateLimited) || errors.Is(err, ErrProviderUnavailable)
+}
+
+// retryTranscriber retries a Transcriber with backoff
+type retryTranscriber struct {
+    Transcriber
+    cfg RetryConfig
+}
+
+// WithRetry retries rate-limited and unavailable calls to t. The audio is
+// sent again from the start, so it must be seekable (AudioData, a
+// bytes.Reader or a spooled file); other streams are tried once.
+func WithRetry(t Transcriber, cfg RetryConfig) Transcriber {
+    return &retryTranscriber{Transcriber: t, cfg: cfg.withDefaults()}
+}
+
+// Transcribe calls the wrapped Transcriber until it succeeds, fails for
+// good or runs out of attempts
+func (rt *retryTranscriber) Transcribe(ctx context.Context, req *TranscribeRequest) (*TranscribeResponse, error) {
+    for attempt := 1; ; attempt++ {
+        resp, err := rt.Transcriber.Transcribe(ctx, req)
+        if err == nil || !Retryable(err) || attempt >= rt.cfg.MaxAttempts {
+            return resp, err
+        }
+
+        delay := rt.cfg.backoff(attempt)
+        var providerErr *ProviderError
+        if errors.As(err, &providerErr) && providerErr.RetryAfter > 0 {
+            if providerErr.RetryAfter > rt.cfg.MaxRetryAfter {
+                return nil, err
+            }
+            delay = max(delay, providerErr.RetryAfter)
+        }
+        if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+            return nil, err
+        }
+        if rewindAudio(req) != nil {
+            return nil, err
+        }
+
+        timer := time.NewTimer(delay)
+        select {
+        case <-timer.C:
+        case <-ctx.Done():
+            timer.Stop()
+            return nil, err
+        }
+    }
+}
+
+// rewindAudio moves seekable audio back to its start so the request can be
+// sent again. It fails for streams that cannot be replayed.
+func rewindAudio(req *TranscribeRequest) error {
+    if req.Audio == nil {
+        return nil // AudioData is read through a fresh reader each time
+    }
+    seeker, ok := req.Audio.(io.Seeker)
+    if !ok {
+        return fmt.Errorf("audio stream cannot be replayed, enable spooling to retry")
+    }
+    _, err := seeker.Seek(0, io.SeekStart)
+    return err
+}
+
+// limitTranscriber bounds the calls in flight to a Transcriber
+type limitTranscriber struct {
+    Transcriber
+    sem chan struct{}
+}
+
+// WithConcurrencyLimit lets at most n calls to t run at once; the others
+// wait for a slot or their context
+func WithConcurrencyLimit(t Transcriber, n int) Transcriber {
+    if n <= 0 {
+        return t
+    }
+    return &limitTranscriber{Transcriber: t, sem: make(chan struct{}, n)}
+}
+
+// Transcribe waits for a free slot and calls the wrapped Transcriber
+func (lt *limitTranscriber) Transcribe(ctx context.Context, req *TranscribeRequest) (*TranscribeResponse, error) {
+    select {
+    case lt.sem <- struct{}{}:
+        defer func() { <-lt.sem }()
+    case <-ctx.Done():
+        return nil, ctx.Err()
+    }
+    return lt.Transcriber.Transcribe(ctx, req)
+}
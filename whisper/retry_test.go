@@ -0,0 +1,121 @@
+package whisper_test
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "testing"
+    "time"
+
+    "github.com/gchalakovmmi/PulpuWEB/whisper"
+    "github.com/gchalakovmmi/PulpuWEB/whisper/whispertest"
+)
+
+func TestRetry(t *testing.T) {
+    tests := []struct {
+        name     string
+        replies  []whispertest.Reply
+        requests int
+        wantErr  error
+    }{
+        {"unavailable then ok", []whispertest.Reply{whispertest.Fail(http.StatusServiceUnavailable), {Text: "ok"}}, 2, nil},
+        {"rate limited then ok", []whispertest.Reply{{Status: http.StatusTooManyRequests}, {Text: "ok"}}, 2, nil},
+        {"gives up after three attempts", []whispertest.Reply{
+            whispertest.Fail(http.StatusBadGateway),
+            whispertest.Fail(http.StatusBadGateway),
+            whispertest.Fail(http.StatusBadGateway),
+            {Text: "too late"},
+        }, 3, whisper.ErrProviderUnavailable},
+        {"bad request is not retried", []whispertest.Reply{whispertest.Fail(http.StatusBadRequest), {Text: "ok"}}, 1, nil},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            srv := whispertest.New()
+            defer srv.Close()
+            srv.Respond(tt.replies...)
+
+            resp, err := srv.Service("groq").SendToWhisper(context.Background(), wavRequest(t))
+            if got := len(srv.Requests()); got != tt.requests {
+                t.Errorf("got %d requests, want %d", got, tt.requests)
+            }
+            switch {
+            case tt.wantErr != nil:
+                if !errors.Is(err, tt.wantErr) {
+                    t.Errorf("err = %v, want %v", err, tt.wantErr)
+                }
+            case tt.requests == 1:
+                if err == nil || whisper.Retryable(err) {
+                    t.Errorf("err = %v, want a final error", err)
+                }
+            case err != nil:
+                t.Fatal(err)
+            case resp.Text != "ok":
+                t.Errorf("text = %q", resp.Text)
+            }
+        })
+    }
+}
+
+func TestRetryAfter(t *testing.T) {
+    srv := whispertest.New()
+    defer srv.Close()
+    srv.Respond(whispertest.RateLimited(time.Second), whispertest.Reply{Text: "ok"})
+
+    start := time.Now()
+    resp, err := srv.Service("groq").SendToWhisper(context.Background(), wavRequest(t))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if elapsed := time.Since(start); elapsed < time.Second {
+        t.Errorf("retried after %s, want the 1s the provider asked for", elapsed)
+    }
+    if resp.Text != "ok" || len(srv.Requests()) != 2 {
+        t.Errorf("got %q after %d requests", resp.Text, len(srv.Requests()))
+    }
+}
+
+func TestRetryAfterTooLong(t *testing.T) {
+    tests := []struct {
+        name    string
+        reply   whispertest.Reply
+        atLeast time.Duration
+    }{
+        {"seconds", whispertest.RateLimited(time.Minute), time.Minute},
+        {"date", whispertest.Reply{
+            Status: http.StatusTooManyRequests,
+            Header: http.Header{"Retry-After": {time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)}},
+        }, 59 * time.Minute},
+        {"groq reset", whispertest.Reply{
+            Status: http.StatusTooManyRequests,
+            Header: http.Header{
+                "X-Ratelimit-Remaining-Requests": {"0"},
+                "X-Ratelimit-Reset-Requests":     {"2m59.56s"},
+            },
+        }, 2*time.Minute + 59*time.Second},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            srv := whispertest.New()
+            defer srv.Close()
+            srv.Respond(tt.reply)
+
+            service := srv.Service("groq")
+            service.Retry.MaxRetryAfter = 10 * time.Second
+            _, err := service.SendToWhisper(context.Background(), wavRequest(t))
+
+            var providerErr *whisper.ProviderError
+            if !errors.As(err, &providerErr) {
+                t.Fatalf("err = %v, want a ProviderError", err)
+            }
+            if providerErr.RetryAfter < tt.atLeast {
+                t.Errorf("RetryAfter = %s, want at least %s", providerErr.RetryAfter, tt.atLeast)
+            }
+            if whisper.HTTPStatus(err) != http.StatusTooManyRequests {
+                t.Errorf("HTTPStatus = %d", whisper.HTTPStatus(err))
+            }
+            if got := len(srv.Requests()); got != 1 {
+                t.Errorf("got %d requests, want 1 without waiting", got)
+            }
+        })
+    }
+}
@@ -0,0 +1,132 @@
+package whisper
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "mime/multipart"
+    "net/http"
+    "os"
+)
+
+// maxFieldSize bounds the text fields read ahead of the audio part
+const maxFieldSize = 1 << 20
+
+// OpenAudioFromRequest returns the audio file of a multipart upload as a
+// stream, without buffering it in memory or on disk. The field name, size
+// limit and accepted formats come from DefaultUploadConfig; the returned
+// name has the extension of the sniffed format. Text fields sent before the
+// file are stored in r.Form and r.PostForm; fields after it are not read.
+func OpenAudioFromRequest(r *http.Request) (io.ReadCloser, string, error) {
+    return openAudioPart(r, DefaultUploadConfig.withDefaults())
+}
+
+// formField is a text field of an outbound multipart request
+type formField struct {
+    name  string
+    value string
+}
+
+// pipeBody is a streamed multipart request body
+type pipeBody struct {
+    *io.PipeReader
+    done chan struct{}
+}
+
+// Close stops the copy and waits until the audio is no longer being read,
+// so it can be rewound for another attempt
+func (b *pipeBody) Close() error {
+    err := b.PipeReader.Close()
+    <-b.done
+    return err
+}
+
+// pipeMultipart streams the fields followed by the audio file as a
+// multipart body. The audio is copied as the HTTP client reads the body, so
+// it never sits in memory as a whole. Closing the body stops the copy.
+func pipeMultipart(fields []formField, fileField, fileName string, audio io.Reader) (io.ReadCloser, string) {
+    pr, pw := io.Pipe()
+    writer := multipart.NewWriter(pw)
+    body := &pipeBody{PipeReader: pr, done: make(chan struct{})}
+    go func() {
+        defer close(body.done)
+        pw.CloseWithError(writeMultipart(writer, fields, fileField, fileName, audio))
+    }()
+    return body, writer.FormDataContentType()
+}
+
+// writeMultipart writes the form parts and closes the writer
+func writeMultipart(writer *multipart.Writer, fields []formField, fileField, fileName string, audio io.Reader) error {
+    for _, field := range fields {
+        if err := writer.WriteField(field.name, field.value); err != nil {
+            return fmt.Errorf("failed to write %s field: %w", field.name, err)
+        }
+    }
+
+    part, err := writer.CreateFormFile(fileField, fileName)
+    if err != nil {
+        return fmt.Errorf("failed to create form file: %w", err)
+    }
+
+    if _, err := io.Copy(part, audio); err != nil {
+        return fmt.Errorf("failed to write audio data to form: %w", err)
+    }
+
+    if err := writer.Close(); err != nil {
+        return fmt.Errorf("failed to close multipart writer: %w", err)
+    }
+    return nil
+}
+
+// audioSize returns the length of the request audio, or -1 when it is a
+// stream of unknown length
+func audioSize(req *TranscribeRequest) int64 {
+    switch audio := req.Audio.(type) {
+    case nil:
+        return int64(len(req.AudioData))
+    case *SpooledFile:
+        return audio.Size
+    case interface{ Size() int64 }: // bytes.Reader, strings.Reader
+        return audio.Size()
+    }
+    return -1
+}
+
+// SpooledFile is audio buffered to a temporary file so it can be sent more
+// than once, for example when a provider call is retried
+type SpooledFile struct {
+    *os.File
+    Size int64
+}
+
+// Spool copies r into a temporary file in dir, or the default temp
+// directory when dir is empty. Close removes the file.
+func Spool(r io.Reader, dir string) (*SpooledFile, error) {
+    file, err := os.CreateTemp(dir, "whisper-*.audio")
+    if err != nil {
+        return nil, fmt.Errorf("failed to create spool file: %w", err)
+    }
+
+    size, err := io.Copy(file, r)
+    if err == nil {
+        _, err = file.Seek(0, io.SeekStart)
+    }
+    if err != nil {
+        file.Close()
+        os.Remove(file.Name())
+        return nil, fmt.Errorf("failed to spool audio: %w", err)
+    }
+
+    return &SpooledFile{File: file, Size: size}, nil
+}
+
+// Rewind moves back to the start of the audio
+func (f *SpooledFile) Rewind() error {
+    _, err := f.Seek(0, io.SeekStart)
+    return err
+}
+
+// Close closes and removes the temporary file
+func (f *SpooledFile) Close() error {
+    return errors.Join(f.File.Close(), os.Remove(f.Name()))
+}
@@ -0,0 +1,63 @@
+package whisper
+
+import (
+    "net"
+    "net/http"
+    "time"
+)
+
+// DefaultTimeout bounds a transcription when WHISPER_TIMEOUT is not set.
+// Long recordings on CPU backends can take minutes.
+const DefaultTimeout = 5 * time.Minute
+
+// defaultHTTPClient is used by providers built without a client
+var defaultHTTPClient = NewHTTPClient(TransportConfig{})
+
+// TransportConfig tunes the connection pool of the outbound HTTP client.
+// Zero fields take the defaults noted below.
+type TransportConfig struct {
+    MaxIdleConns          int           // 100
+    MaxIdleConnsPerHost   int           // 10
+    IdleConnTimeout       time.Duration // 90s
+    DialTimeout           time.Duration // 10s
+    TLSHandshakeTimeout   time.Duration // 10s
+    ResponseHeaderTimeout time.Duration // 0, the request context bounds it
+}
+
+// NewHTTPClient builds a client with a pooled transport. It has no overall
+// timeout; deadlines come from the context passed to SendToWhisper.
+func NewHTTPClient(cfg TransportConfig) *http.Client {
+    if cfg.MaxIdleConns == 0 {
+        cfg.MaxIdleConns = 100
+    }
+    if cfg.MaxIdleConnsPerHost == 0 {
+        cfg.MaxIdleConnsPerHost = 10
+    }
+    if cfg.IdleConnTimeout == 0 {
+        cfg.IdleConnTimeout = 90 * time.Second
+    }
+    if cfg.DialTimeout == 0 {
+        cfg.DialTimeout = 10 * time.Second
+    }
+    if cfg.TLSHandshakeTimeout == 0 {
+        cfg.TLSHandshakeTimeout = 10 * time.Second
+    }
+
+    dialer := &net.Dialer{
+        Timeout:   cfg.DialTimeout,
+        KeepAlive: 30 * time.Second,
+    }
+    return &http.Client{
+        Transport: &http.Transport{
+            Proxy:                 http.ProxyFromEnvironment,
+            DialContext:           dialer.DialContext,
+            ForceAttemptHTTP2:     true,
+            MaxIdleConns:          cfg.MaxIdleConns,
+            MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+            IdleConnTimeout:       cfg.IdleConnTimeout,
+            TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout,
+            ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+            ExpectContinueTimeout: time.Second,
+        },
+    }
+}
@@ -0,0 +1,239 @@
+package whisper
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "io"
+    "mime/multipart"
+    "net/http"
+    "path/filepath"
+    "slices"
+    "strings"
+    "time"
+)
+
+// ErrTooLong is returned for audio above UploadConfig.MaxDuration
+var ErrTooLong = errors.New("audio too long")
+
+// UploadConfig validates audio uploads. Zero fields take the defaults noted
+// below.
+type UploadConfig struct {
+    FieldName   string        // Multipart field holding the file, "audio"
+    MaxSize     int64         // Largest file in bytes, 25 MB
+    MaxDuration time.Duration // Longest audio, unlimited when zero
+    Formats     []string      // Accepted formats, AudioFormats when empty
+    SpoolDir    string        // Temp directory for ReadAudioUpload
+}
+
+// DefaultUploadConfig is used by ParseAudioFromRequest and
+// OpenAudioFromRequest
+var DefaultUploadConfig = UploadConfig{}
+
+// withDefaults fills the zero fields
+func (cfg UploadConfig) withDefaults() UploadConfig {
+    if cfg.FieldName == "" {
+        cfg.FieldName = "audio"
+    }
+    if cfg.MaxSize <= 0 {
+        cfg.MaxSize = 25 << 20
+    }
+    if len(cfg.Formats) == 0 {
+        cfg.Formats = AudioFormats
+    }
+    return cfg
+}
+
+// checkFormat sniffs the header and matches it against the allow-list
+func (cfg UploadConfig) checkFormat(header []byte) (string, error) {
+    format := SniffFormat(header)
+    if format == "" {
+        return "", fmt.Errorf("unrecognized audio content: %w", ErrUnsupportedFormat)
+    }
+    if !slices.Contains(cfg.Formats, format) {
+        return "", fmt.Errorf("%s audio is not accepted: %w", format, ErrUnsupportedFormat)
+    }
+    return format, nil
+}
+
+// checkDuration enforces MaxDuration
+func (cfg UploadConfig) checkDuration(info *AudioInfo) error {
+    if cfg.MaxDuration > 0 && info.Duration > cfg.MaxDuration {
+        return fmt.Errorf("audio is %s long, the limit is %s: %w",
+            info.Duration.Round(time.Second), cfg.MaxDuration, ErrTooLong)
+    }
+    return nil
+}
+
+// FixFileName replaces the extension of name with the one matching format,
+// so providers that go by the extension decode the file correctly
+func FixFileName(name, format string) string {
+    base := strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))
+    if base == "" || base == "." || base == "/" {
+        base = "audio"
+    }
+    return base + "." + format
+}
+
+// limitedReader fails with ErrTooLarge once more than limit bytes are read
+type limitedReader struct {
+    r     io.Reader
+    limit int64
+    read  int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+    n, err := l.r.Read(p)
+    l.read += int64(n)
+    if l.read > l.limit {
+        return n, fmt.Errorf("upload exceeds %d bytes: %w", l.limit, ErrTooLarge)
+    }
+    return n, err
+}
+
+// sniffedPart is a validated, size-limited upload stream
+type sniffedPart struct {
+    io.Reader
+    io.Closer
+    rest *multipart.Reader // Parts after the file
+}
+
+// readField stores a text part in form
+func readField(part *multipart.Part, form map[string][]string) error {
+    value, err := io.ReadAll(io.LimitReader(part, maxFieldSize))
+    part.Close()
+    if err != nil {
+        return fmt.Errorf("failed to read form field %s: %w", part.FormName(), err)
+    }
+    form[part.FormName()] = append(form[part.FormName()], string(value))
+    return nil
+}
+
+// readTrailingFields stores the text fields sent after the file in r.Form.
+// The file must have been read to the end.
+func readTrailingFields(r *http.Request, part io.ReadCloser) error {
+    sniffed, ok := part.(sniffedPart)
+    if !ok {
+        return nil
+    }
+    for {
+        next, err := sniffed.rest.NextPart()
+        if err == io.EOF {
+            return nil
+        }
+        if err != nil {
+            return fmt.Errorf("failed to read multipart form: %w", err)
+        }
+        if next.FileName() != "" {
+            next.Close()
+            continue
+        }
+        if err := readField(next, r.Form); err != nil {
+            return err
+        }
+    }
+}
+
+// openAudioPart streams the configured file field, checking its content
+// type by magic bytes and bounding its size
+func openAudioPart(r *http.Request, cfg UploadConfig) (io.ReadCloser, string, error) {
+    reader, err := r.MultipartReader()
+    if err != nil {
+        return nil, "", fmt.Errorf("failed to read multipart form: %w", err)
+    }
+
+    form := r.Form
+    if form == nil {
+        form = make(map[string][]string)
+    }
+    for {
+        part, err := reader.NextPart()
+        if err == io.EOF {
+            return nil, "", fmt.Errorf("failed to get audio file from form: %w", http.ErrMissingFile)
+        }
+        if err != nil {
+            return nil, "", fmt.Errorf("failed to read multipart form: %w", err)
+        }
+
+        if part.FileName() == "" {
+            if err := readField(part, form); err != nil {
+                return nil, "", err
+            }
+            continue
+        }
+
+        if part.FormName() != cfg.FieldName {
+            part.Close()
+            continue
+        }
+
+        r.Form = form
+        r.PostForm = form
+
+        buffered := bufio.NewReaderSize(&limitedReader{r: part, limit: cfg.MaxSize}, 4096)
+        header, err := buffered.Peek(sniffLen)
+        if err != nil && err != io.EOF && !errors.Is(err, bufio.ErrBufferFull) {
+            part.Close()
+            return nil, "", fmt.Errorf("failed to read audio file: %w", err)
+        }
+        format, err := cfg.checkFormat(header)
+        if err != nil {
+            part.Close()
+            return nil, "", err
+        }
+        return sniffedPart{Reader: buffered, Closer: part, rest: reader}, FixFileName(part.FileName(), format), nil
+    }
+}
+
+// Upload is a validated audio file spooled to disk. It can be used as
+// TranscribeRequest.Audio and sent more than once; Close removes it.
+type Upload struct {
+    *SpooledFile
+    FileName string // Client name with the extension matching the content
+    Info     AudioInfo
+}
+
+// ReadAudioUpload stores the audio file of a multipart upload in a
+// temporary file after checking its format, size and duration. Text fields
+// are stored in r.Form.
+func ReadAudioUpload(r *http.Request, cfg UploadConfig) (*Upload, error) {
+    cfg = cfg.withDefaults()
+
+    part, fileName, err := openAudioPart(r, cfg)
+    if err != nil {
+        return nil, err
+    }
+    defer part.Close()
+
+    spooled, err := Spool(part, cfg.SpoolDir)
+    if err != nil {
+        return nil, err
+    }
+
+    info, err := ProbeAudio(spooled, spooled.Size)
+    if err == nil {
+        err = cfg.checkDuration(info)
+    }
+    if err == nil {
+        err = readTrailingFields(r, part)
+    }
+    if err != nil {
+        spooled.Close()
+        return nil, err
+    }
+
+    return &Upload{SpooledFile: spooled, FileName: fileName, Info: *info}, nil
+}
+
+// UploadStatus returns the HTTP status for an error from ReadAudioUpload:
+// 413 or 415 for rejected audio, 400 for malformed requests
+func UploadStatus(err error) int {
+    if errors.Is(err, ErrTooLarge) || errors.Is(err, ErrTooLong) || errors.Is(err, ErrUnsupportedFormat) {
+        return HTTPStatus(err)
+    }
+    var maxBytesErr *http.MaxBytesError
+    if errors.As(err, &maxBytesErr) {
+        return http.StatusRequestEntityTooLarge
+    }
+    return http.StatusBadRequest
+}
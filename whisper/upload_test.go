@@ -0,0 +1,124 @@
+package whisper_test
+
+import (
+    "bytes"
+    "errors"
+    "io"
+    "mime/multipart"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "testing"
+    "time"
+
+    "github.com/gchalakovmmi/PulpuWEB/whisper"
+)
+
+// uploadRequest is a multipart POST with a language field before and a
+// prompt field after the file
+func uploadRequest(t *testing.T, field, fileName string, audio []byte) *http.Request {
+    t.Helper()
+    var body bytes.Buffer
+    form := multipart.NewWriter(&body)
+    form.WriteField("language", "en")
+    part, err := form.CreateFormFile(field, fileName)
+    if err != nil {
+        t.Fatal(err)
+    }
+    part.Write(audio)
+    form.WriteField("prompt", "Names: Pulpu")
+    form.Close()
+
+    r := httptest.NewRequest(http.MethodPost, "/upload", &body)
+    r.Header.Set("Content-Type", form.FormDataContentType())
+    return r
+}
+
+func TestReadAudioUpload(t *testing.T) {
+    audio := wavBytes(t, tone(16000, 1, 2, 440))
+    r := uploadRequest(t, "audio", "../recording.mp3", audio)
+
+    upload, err := whisper.ReadAudioUpload(r, whisper.UploadConfig{SpoolDir: t.TempDir()})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer upload.Close()
+
+    // The name follows the content, not the client
+    if upload.FileName != "recording.wav" {
+        t.Errorf("file name = %q, want recording.wav", upload.FileName)
+    }
+    if upload.Info.Format != whisper.AudioWAV || upload.Info.Duration != 2*time.Second {
+        t.Errorf("info = %+v", upload.Info)
+    }
+    if r.FormValue("language") != "en" || r.FormValue("prompt") != "Names: Pulpu" {
+        t.Errorf("form = %v, want the fields before and after the file", r.Form)
+    }
+    stored, err := io.ReadAll(upload)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(stored, audio) {
+        t.Error("stored audio differs from the upload")
+    }
+
+    name := upload.Name()
+    upload.Close()
+    if _, err := os.Stat(name); !errors.Is(err, os.ErrNotExist) {
+        t.Errorf("spool file left behind: %v", err)
+    }
+}
+
+func TestReadAudioUploadRejects(t *testing.T) {
+    wav := wavBytes(t, tone(16000, 1, 2, 440))
+    tests := []struct {
+        name    string
+        field   string
+        audio   []byte
+        cfg     whisper.UploadConfig
+        wantErr error
+        status  int
+    }{
+        {"not audio", "audio", []byte("#!/bin/sh\nrm -rf /\n"), whisper.UploadConfig{}, whisper.ErrUnsupportedFormat, http.StatusUnsupportedMediaType},
+        {"format not allowed", "audio", wav, whisper.UploadConfig{Formats: []string{whisper.AudioMP3}}, whisper.ErrUnsupportedFormat, http.StatusUnsupportedMediaType},
+        {"too large", "audio", wav, whisper.UploadConfig{MaxSize: 1024}, whisper.ErrTooLarge, http.StatusRequestEntityTooLarge},
+        {"too long", "audio", wav, whisper.UploadConfig{MaxDuration: time.Second}, whisper.ErrTooLong, http.StatusRequestEntityTooLarge},
+        {"wrong field", "file", wav, whisper.UploadConfig{}, http.ErrMissingFile, http.StatusBadRequest},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            tt.cfg.SpoolDir = t.TempDir()
+            _, err := whisper.ReadAudioUpload(uploadRequest(t, tt.field, "clip.wav", tt.audio), tt.cfg)
+            if !errors.Is(err, tt.wantErr) {
+                t.Errorf("err = %v, want %v", err, tt.wantErr)
+            }
+            if status := whisper.UploadStatus(err); status != tt.status {
+                t.Errorf("UploadStatus = %d, want %d", status, tt.status)
+            }
+            if entries, _ := os.ReadDir(tt.cfg.SpoolDir); len(entries) != 0 {
+                t.Errorf("%d spool files left behind", len(entries))
+            }
+        })
+    }
+}
+
+func TestParseAudioFromRequest(t *testing.T) {
+    audio := wavBytes(t, tone(16000, 1, 1, 440))
+    r := uploadRequest(t, "audio", "clip.ogg", audio)
+
+    data, fileName, err := whisper.ParseAudioFromRequest(r)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(data, audio) || fileName != "clip.wav" {
+        t.Errorf("got %d bytes named %q", len(data), fileName)
+    }
+    if r.FormValue("prompt") != "Names: Pulpu" {
+        t.Errorf("form = %v", r.Form)
+    }
+
+    _, _, err = whisper.ParseAudioFromRequest(uploadRequest(t, "audio", "clip.wav", []byte("plain text")))
+    if !errors.Is(err, whisper.ErrUnsupportedFormat) {
+        t.Errorf("err = %v, want ErrUnsupportedFormat", err)
+    }
+}
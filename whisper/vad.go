@@ -0,0 +1,337 @@
+package whisper
+
+import (
+    "bytes"
+    "encoding/json"
+    "math"
+    "slices"
+    "time"
+)
+
+// VADConfig tunes the voice activity detector. Zero fields take the
+// defaults noted below.
+type VADConfig struct {
+    FrameDuration time.Duration // Analysis window, 30ms
+    // ThresholdDB is how far above the noise floor a frame must be to count
+    // as speech, 12 dB. Frames with a high zero-crossing rate, such as
+    // fricatives, need half of it.
+    ThresholdDB float64
+    MinLevelDB  float64       // Frames quieter than this are silence, -50 dBFS
+    MinSpeech   time.Duration // Shorter bursts are dropped as noise, 200ms
+    MinSilence  time.Duration // Shorter gaps do not end a region, 400ms
+    Padding     time.Duration // Audio kept around each region, 200ms
+    // MaxPause is the longest silence kept inside the audio when it is
+    // condensed; longer pauses are cut down to it, 1s
+    MaxPause time.Duration
+}
+
+// withDefaults fills the zero fields
+func (cfg VADConfig) withDefaults() VADConfig {
+    if cfg.FrameDuration <= 0 {
+        cfg.FrameDuration = 30 * time.Millisecond
+    }
+    if cfg.ThresholdDB <= 0 {
+        cfg.ThresholdDB = 12
+    }
+    if cfg.MinLevelDB == 0 {
+        cfg.MinLevelDB = -50
+    }
+    if cfg.MinSpeech <= 0 {
+        cfg.MinSpeech = 200 * time.Millisecond
+    }
+    if cfg.MinSilence <= 0 {
+        cfg.MinSilence = 400 * time.Millisecond
+    }
+    if cfg.Padding <= 0 {
+        cfg.Padding = 200 * time.Millisecond
+    }
+    if cfg.MaxPause <= 0 {
+        cfg.MaxPause = time.Second
+    }
+    return cfg
+}
+
+// SpeechRegion is a stretch of audio containing speech. In JSON the times
+// are seconds, like segment and word times.
+type SpeechRegion struct {
+    Start time.Duration
+    End   time.Duration
+}
+
+type speechRegionJSON struct {
+    Start float64 `json:"start"`
+    End   float64 `json:"end"`
+}
+
+func (r SpeechRegion) MarshalJSON() ([]byte, error) {
+    return json.Marshal(speechRegionJSON{Start: r.Start.Seconds(), End: r.End.Seconds()})
+}
+
+func (r *SpeechRegion) UnmarshalJSON(data []byte) error {
+    var v speechRegionJSON
+    if err := json.Unmarshal(data, &v); err != nil {
+        return err
+    }
+    r.Start = time.Duration(v.Start * float64(time.Second))
+    r.End = time.Duration(v.End * float64(time.Second))
+    return nil
+}
+
+// frameStats returns the level in dBFS and the zero-crossing rate of a
+// frame
+func frameStats(samples []float32) (level, crossings float64) {
+    var energy float64
+    var zc int
+    for i, s := range samples {
+        energy += float64(s) * float64(s)
+        if i > 0 && (s >= 0) != (samples[i-1] >= 0) {
+            zc++
+        }
+    }
+    n := float64(max(len(samples), 1))
+    return 10 * math.Log10(energy/n+1e-12), float64(zc) / n
+}
+
+// isSpeech classifies a frame against the noise floor
+func (cfg VADConfig) isSpeech(level, crossings, floor float64) bool {
+    if level < cfg.MinLevelDB {
+        return false
+    }
+    above := level - floor
+    return above >= cfg.ThresholdDB || (above >= cfg.ThresholdDB/2 && crossings > 0.25)
+}
+
+// DetectSpeech finds the speech regions of pcm from the short-time energy
+// and zero-crossing rate of each frame, measured against the recording's
+// own noise floor. Regions are padded and do not overlap.
+func DetectSpeech(pcm *PCM, cfg VADConfig) []SpeechRegion {
+    cfg = cfg.withDefaults()
+    mono := Downmix(pcm)
+    frameLen := max(1, int(cfg.FrameDuration.Seconds()*float64(mono.SampleRate)))
+    frames := mono.Frames() / frameLen
+    if frames == 0 {
+        return nil
+    }
+
+    levels := make([]float64, frames)
+    crossings := make([]float64, frames)
+    for f := range frames {
+        levels[f], crossings[f] = frameStats(mono.Samples[f*frameLen : (f+1)*frameLen])
+    }
+
+    // The quietest tenth of the frames approximates the background noise
+    sorted := slices.Clone(levels)
+    slices.Sort(sorted)
+    floor := sorted[len(sorted)/10]
+
+    speech := make([]bool, frames)
+    for f := range frames {
+        speech[f] = cfg.isSpeech(levels[f], crossings[f], floor)
+    }
+
+    frameTime := func(f int) time.Duration {
+        return time.Duration(f*frameLen) * time.Second / time.Duration(mono.SampleRate)
+    }
+
+    // Collect runs of speech frames, bridging short gaps
+    var regions []SpeechRegion
+    for f := 0; f < frames; {
+        if !speech[f] {
+            f++
+            continue
+        }
+        start := f
+        for f < frames && speech[f] {
+            f++
+        }
+        region := SpeechRegion{Start: frameTime(start), End: frameTime(f)}
+        if n := len(regions); n > 0 && region.Start-regions[n-1].End < cfg.MinSilence {
+            regions[n-1].End = region.End
+        } else {
+            regions = append(regions, region)
+        }
+    }
+
+    // Drop short bursts and pad the rest
+    total := mono.Duration()
+    var result []SpeechRegion
+    for _, region := range regions {
+        if region.End-region.Start < cfg.MinSpeech {
+            continue
+        }
+        region.Start = max(0, region.Start-cfg.Padding)
+        region.End = min(total, region.End+cfg.Padding)
+        if n := len(result); n > 0 && region.Start <= result[n-1].End {
+            result[n-1].End = region.End
+            continue
+        }
+        result = append(result, region)
+    }
+    return result
+}
+
+// frameAt converts a time to a frame index of pcm
+func frameAt(pcm *PCM, t time.Duration) int {
+    return int(t.Seconds() * float64(pcm.SampleRate))
+}
+
+// TrimSilence cuts the silence before the first and after the last speech
+// region. It returns nil when there is no speech, and the offset of the
+// trimmed audio within the original.
+func TrimSilence(pcm *PCM, cfg VADConfig) (*PCM, time.Duration) {
+    regions := DetectSpeech(pcm, cfg)
+    if len(regions) == 0 {
+        return nil, 0
+    }
+    start, end := regions[0].Start, regions[len(regions)-1].End
+    return pcm.Slice(frameAt(pcm, start), frameAt(pcm, end)), start
+}
+
+// SplitOnPauses cuts pcm at pauses of at least minPause, dropping the
+// silence. Chunk offsets refer to the original audio, so MergeChunks maps
+// the transcripts back onto its timeline.
+func SplitOnPauses(pcm *PCM, minPause time.Duration, cfg VADConfig) []Chunk {
+    var chunks []Chunk
+    var start, end time.Duration
+    for i, region := range DetectSpeech(pcm, cfg) {
+        if i > 0 && region.Start-end >= minPause {
+            chunks = append(chunks, Chunk{Offset: start, PCM: pcm.Slice(frameAt(pcm, start), frameAt(pcm, end))})
+            start = region.Start
+        } else if i == 0 {
+            start = region.Start
+        }
+        end = region.End
+    }
+    if end > start {
+        chunks = append(chunks, Chunk{Offset: start, PCM: pcm.Slice(frameAt(pcm, start), frameAt(pcm, end))})
+    }
+    return chunks
+}
+
+// timelinePiece maps a stretch of condensed audio to the original
+type timelinePiece struct {
+    condensed time.Duration // Start in the condensed audio
+    original  time.Duration // Start in the original audio
+    length    time.Duration
+}
+
+// Timeline maps times in condensed audio back to the original recording
+type Timeline struct {
+    Regions []SpeechRegion // Kept parts of the original, in order
+    pieces  []timelinePiece
+}
+
+// Original converts a time in seconds within the condensed audio to the
+// original audio
+func (tl *Timeline) Original(seconds float64) float64 {
+    if len(tl.pieces) == 0 {
+        return seconds
+    }
+    t := time.Duration(seconds * float64(time.Second))
+    piece := tl.pieces[0]
+    for _, p := range tl.pieces {
+        if p.condensed > t {
+            break
+        }
+        piece = p
+    }
+    // Times inside a shortened pause stay within it
+    return (piece.original + min(t-piece.condensed, piece.length)).Seconds()
+}
+
+// MapResponse moves segment and word times from the condensed audio to the
+// original timeline
+func (tl *Timeline) MapResponse(resp *TranscribeResponse) {
+    for i := range resp.Segments {
+        seg := &resp.Segments[i]
+        seg.Start = tl.Original(seg.Start)
+        seg.End = tl.Original(seg.End)
+        for j := range seg.Words {
+            seg.Words[j].Start = tl.Original(seg.Words[j].Start)
+            seg.Words[j].End = tl.Original(seg.Words[j].End)
+        }
+    }
+    for i := range resp.Words {
+        resp.Words[i].Start = tl.Original(resp.Words[i].Start)
+        resp.Words[i].End = tl.Original(resp.Words[i].End)
+    }
+}
+
+// Condense keeps the speech regions of pcm, dropping leading and trailing
+// silence and shortening pauses to cfg.MaxPause. It returns nil when there
+// is no speech.
+func Condense(pcm *PCM, cfg VADConfig) (*PCM, *Timeline) {
+    cfg = cfg.withDefaults()
+    regions := DetectSpeech(pcm, cfg)
+    if len(regions) == 0 {
+        return nil, &Timeline{}
+    }
+
+    // Keep up to MaxPause of each gap, half on each side of it
+    kept := make([]SpeechRegion, len(regions))
+    copy(kept, regions)
+    for i := 1; i < len(kept); i++ {
+        gap := kept[i].Start - kept[i-1].End
+        if gap <= cfg.MaxPause {
+            kept[i].Start = kept[i-1].End
+            continue
+        }
+        kept[i-1].End += cfg.MaxPause / 2
+        kept[i].Start -= cfg.MaxPause - cfg.MaxPause/2
+    }
+
+    out := &PCM{SampleRate: pcm.SampleRate, Channels: pcm.Channels}
+    tl := &Timeline{Regions: regions}
+    var merged []SpeechRegion
+    for _, region := range kept {
+        if n := len(merged); n > 0 && region.Start <= merged[n-1].End {
+            merged[n-1].End = region.End
+            continue
+        }
+        merged = append(merged, region)
+    }
+    for _, region := range merged {
+        piece := pcm.Slice(frameAt(pcm, region.Start), frameAt(pcm, region.End))
+        tl.pieces = append(tl.pieces, timelinePiece{
+            condensed: out.Duration(),
+            original:  region.Start,
+            length:    piece.Duration(),
+        })
+        out.Samples = append(out.Samples, piece.Samples...)
+    }
+    return out, tl
+}
+
+// applyVAD condenses the request audio. It returns a nil request when the
+// audio holds no speech, and the request unchanged when it cannot be
+// decoded. The audio is decoded in place, so it must be seekable.
+func (ts *TranscribeService) applyVAD(req *TranscribeRequest, cfg VADConfig) (*TranscribeRequest, *Timeline, error) {
+    audio, ok := seekableAudio(req)
+    if !ok {
+        return req, nil, nil
+    }
+    decoder, ok := ts.decoderFor(audioHeader(audio), req.FileName)
+    if !ok {
+        return req, nil, nil
+    }
+    pcm, err := decoder(audio)
+    if err != nil {
+        return req, nil, nil
+    }
+
+    condensed, tl := Condense(pcm, cfg)
+    if condensed == nil {
+        return nil, tl, nil
+    }
+
+    var buf bytes.Buffer
+    if err := EncodeWAV(&buf, Normalize(condensed)); err != nil {
+        return nil, nil, err
+    }
+    trimmed := *req
+    trimmed.Audio = bytes.NewReader(buf.Bytes())
+    trimmed.AudioData = nil
+    trimmed.FileName = FixFileName(req.FileName, AudioWAV)
+    trimmed.ShouldEncode = false
+    return &trimmed, tl, nil
+}
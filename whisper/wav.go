@@ -0,0 +1,176 @@
+package whisper
+
+import (
+    "bufio"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "math"
+)
+
+// WAV format tags
+const (
+    wavFormatPCM        = 1
+    wavFormatFloat      = 3
+    wavFormatExtensible = 0xFFFE
+)
+
+// wavFmtMaxSize is the longest fmt chunk (WAVE_FORMAT_EXTENSIBLE) read
+const wavFmtMaxSize = 40
+
+// DecodeWAV decodes a RIFF/WAVE stream with integer PCM (8, 16, 24 or 32
+// bit) or 32/64-bit float samples
+func DecodeWAV(r io.Reader) (*PCM, error) {
+    br := bufio.NewReader(r)
+
+    var header [12]byte
+    if _, err := io.ReadFull(br, header[:]); err != nil {
+        return nil, fmt.Errorf("failed to read WAV header: %w", err)
+    }
+    if string(header[0:4]) != "RIFF" || string(header[8:12]) != "WAVE" {
+        return nil, fmt.Errorf("not a WAV file")
+    }
+
+    var (
+        format     uint16
+        channels   int
+        sampleRate int
+        bits       int
+        haveFormat bool
+    )
+    for {
+        var chunk [8]byte
+        if _, err := io.ReadFull(br, chunk[:]); err != nil {
+            return nil, fmt.Errorf("WAV file has no data chunk: %w", err)
+        }
+        id := string(chunk[0:4])
+        size := int64(binary.LittleEndian.Uint32(chunk[4:8]))
+
+        switch id {
+        case "fmt ":
+            if size < 16 {
+                return nil, fmt.Errorf("WAV fmt chunk too short")
+            }
+            // The size is untrusted, so the rest is skipped, not buffered
+            fmtChunk := make([]byte, min(size, wavFmtMaxSize))
+            if _, err := io.ReadFull(br, fmtChunk); err != nil {
+                return nil, fmt.Errorf("failed to read WAV fmt chunk: %w", err)
+            }
+            if _, err := br.Discard(int(size - int64(len(fmtChunk)))); err != nil {
+                return nil, fmt.Errorf("failed to read WAV fmt chunk: %w", err)
+            }
+            format = binary.LittleEndian.Uint16(fmtChunk[0:2])
+            channels = int(binary.LittleEndian.Uint16(fmtChunk[2:4]))
+            sampleRate = int(binary.LittleEndian.Uint32(fmtChunk[4:8]))
+            bits = int(binary.LittleEndian.Uint16(fmtChunk[14:16]))
+            if format == wavFormatExtensible && size >= 26 {
+                // The sub-format GUID starts with the real format tag
+                format = binary.LittleEndian.Uint16(fmtChunk[24:26])
+            }
+            haveFormat = true
+
+        case "data":
+            if !haveFormat {
+                return nil, fmt.Errorf("WAV data chunk before fmt chunk")
+            }
+            if channels == 0 || sampleRate == 0 {
+                return nil, fmt.Errorf("invalid WAV format: %d channels at %d Hz", channels, sampleRate)
+            }
+            // Streamed recordings often leave the size unset; read to EOF
+            var data io.Reader = br
+            if size != 0 && size != math.MaxUint32 {
+                data = io.LimitReader(br, size)
+            }
+            samples, err := decodeWAVSamples(data, format, bits)
+            if err != nil {
+                return nil, err
+            }
+            samples = samples[:len(samples)/channels*channels]
+            return &PCM{SampleRate: sampleRate, Channels: channels, Samples: samples}, nil
+
+        default:
+            if _, err := br.Discard(int(size + size%2)); err != nil {
+                return nil, fmt.Errorf("failed to skip WAV %q chunk: %w", id, err)
+            }
+            continue
+        }
+
+        if size%2 == 1 {
+            br.Discard(1) // Chunks are padded to even sizes
+        }
+    }
+}
+
+// decodeWAVSamples converts raw sample data to floats
+func decodeWAVSamples(r io.Reader, format uint16, bits int) ([]float32, error) {
+    var convert func(b []byte) float32
+    switch {
+    case format == wavFormatPCM && bits == 8:
+        convert = func(b []byte) float32 { return (float32(b[0]) - 128) / 128 }
+    case format == wavFormatPCM && bits == 16:
+        convert = func(b []byte) float32 { return float32(int16(binary.LittleEndian.Uint16(b))) / (1 << 15) }
+    case format == wavFormatPCM && bits == 24:
+        convert = func(b []byte) float32 {
+            v := int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8
+            return float32(v) / (1 << 23)
+        }
+    case format == wavFormatPCM && bits == 32:
+        convert = func(b []byte) float32 { return float32(int32(binary.LittleEndian.Uint32(b))) / (1 << 31) }
+    case format == wavFormatFloat && bits == 32:
+        convert = func(b []byte) float32 { return math.Float32frombits(binary.LittleEndian.Uint32(b)) }
+    case format == wavFormatFloat && bits == 64:
+        convert = func(b []byte) float32 { return float32(math.Float64frombits(binary.LittleEndian.Uint64(b))) }
+    default:
+        return nil, fmt.Errorf("unsupported WAV encoding: format %d, %d bits", format, bits)
+    }
+
+    data, err := io.ReadAll(r)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read WAV data: %w", err)
+    }
+
+    width := bits / 8
+    samples := make([]float32, len(data)/width)
+    for i := range samples {
+        samples[i] = convert(data[i*width : (i+1)*width])
+    }
+    return samples, nil
+}
+
+// EncodeWAV writes pcm as a 16-bit PCM WAV file
+func EncodeWAV(w io.Writer, pcm *PCM) error {
+    dataSize := len(pcm.Samples) * 2
+    header := make([]byte, 44)
+    copy(header[0:4], "RIFF")
+    binary.LittleEndian.PutUint32(header[4:8], uint32(36+dataSize))
+    copy(header[8:12], "WAVE")
+    copy(header[12:16], "fmt ")
+    binary.LittleEndian.PutUint32(header[16:20], 16)
+    binary.LittleEndian.PutUint16(header[20:22], wavFormatPCM)
+    binary.LittleEndian.PutUint16(header[22:24], uint16(pcm.Channels))
+    binary.LittleEndian.PutUint32(header[24:28], uint32(pcm.SampleRate))
+    binary.LittleEndian.PutUint32(header[28:32], uint32(pcm.SampleRate*pcm.Channels*2))
+    binary.LittleEndian.PutUint16(header[32:34], uint16(pcm.Channels*2))
+    binary.LittleEndian.PutUint16(header[34:36], 16)
+    copy(header[36:40], "data")
+    binary.LittleEndian.PutUint32(header[40:44], uint32(dataSize))
+
+    bw := bufio.NewWriter(w)
+    if _, err := bw.Write(header); err != nil {
+        return fmt.Errorf("failed to write WAV header: %w", err)
+    }
+    var sample [2]byte
+    for _, s := range pcm.Samples {
+        s = max(-1, min(1, s))
+        binary.LittleEndian.PutUint16(sample[:], uint16(int16(math.Round(float64(s)*math.MaxInt16))))
+        if _, err := bw.Write(sample[:]); err != nil {
+            return fmt.Errorf("failed to write WAV data: %w", err)
+        }
+    }
+    return bw.Flush()
+}
+
+// wavSize returns the size of pcm encoded by EncodeWAV
+func wavSize(pcm *PCM) int64 {
+    return 44 + int64(len(pcm.Samples))*2
+}
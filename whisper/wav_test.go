@@ -0,0 +1,123 @@
+package whisper_test
+
+import (
+    "bytes"
+    "encoding/binary"
+    "math"
+    "testing"
+
+    "github.com/gchalakovmmi/PulpuWEB/whisper"
+)
+
+// riffChunk is a RIFF chunk, padded to an even size
+func riffChunk(id string, data []byte) []byte {
+    chunk := append([]byte(id), binary.LittleEndian.AppendUint32(nil, uint32(len(data)))...)
+    chunk = append(chunk, data...)
+    if len(data)%2 == 1 {
+        chunk = append(chunk, 0)
+    }
+    return chunk
+}
+
+// fmtChunk is the payload of a fmt chunk
+func fmtChunk(format uint16, channels, rate, bits int) []byte {
+    b := binary.LittleEndian.AppendUint16(nil, format)
+    b = binary.LittleEndian.AppendUint16(b, uint16(channels))
+    b = binary.LittleEndian.AppendUint32(b, uint32(rate))
+    b = binary.LittleEndian.AppendUint32(b, uint32(rate*channels*bits/8))
+    b = binary.LittleEndian.AppendUint16(b, uint16(channels*bits/8))
+    return binary.LittleEndian.AppendUint16(b, uint16(bits))
+}
+
+// riffWAV joins chunks into a WAV file
+func riffWAV(chunks ...[]byte) []byte {
+    body := []byte("WAVE")
+    for _, chunk := range chunks {
+        body = append(body, chunk...)
+    }
+    return append(append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...), body...)
+}
+
+func TestDecodeWAV(t *testing.T) {
+    // 0.5 and -0.25 in each encoding
+    pcm24 := []byte{0x00, 0x00, 0x40, 0x00, 0x00, 0xE0}
+    float32s := binary.LittleEndian.AppendUint32(nil, math.Float32bits(0.5))
+    float32s = binary.LittleEndian.AppendUint32(float32s, math.Float32bits(-0.25))
+    float64s := binary.LittleEndian.AppendUint64(nil, math.Float64bits(0.5))
+    float64s = binary.LittleEndian.AppendUint64(float64s, math.Float64bits(-0.25))
+    extensible := append(fmtChunk(0xFFFE, 1, 8000, 16), 22, 0, 16, 0, 0, 0, 0, 0, 1, 0)
+    extensible = append(extensible, make([]byte, 14)...)
+
+    tests := []struct {
+        name string
+        file []byte
+        rate int
+    }{
+        {"8 bit", riffWAV(riffChunk("fmt ", fmtChunk(1, 1, 8000, 8)), riffChunk("data", []byte{192, 96})), 8000},
+        {"16 bit", riffWAV(riffChunk("fmt ", fmtChunk(1, 1, 8000, 16)), riffChunk("data", []byte{0x00, 0x40, 0x00, 0xE0})), 8000},
+        {"24 bit", riffWAV(riffChunk("fmt ", fmtChunk(1, 1, 48000, 24)), riffChunk("data", pcm24)), 48000},
+        {"float32", riffWAV(riffChunk("fmt ", fmtChunk(3, 1, 44100, 32)), riffChunk("data", float32s)), 44100},
+        {"float64", riffWAV(riffChunk("fmt ", fmtChunk(3, 1, 44100, 64)), riffChunk("data", float64s)), 44100},
+        {"extensible", riffWAV(riffChunk("fmt ", extensible), riffChunk("data", []byte{0x00, 0x40, 0x00, 0xE0})), 8000},
+        {"odd chunk before data", riffWAV(
+            riffChunk("fmt ", fmtChunk(1, 1, 8000, 16)),
+            riffChunk("LIST", []byte("odd")),
+            riffChunk("data", []byte{0x00, 0x40, 0x00, 0xE0}),
+        ), 8000},
+        {"streamed without data size", append(
+            riffWAV(riffChunk("fmt ", fmtChunk(1, 1, 8000, 16)), []byte("data\x00\x00\x00\x00")),
+            0x00, 0x40, 0x00, 0xE0,
+        ), 8000},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            pcm, err := whisper.DecodeWAV(bytes.NewReader(tt.file))
+            if err != nil {
+                t.Fatal(err)
+            }
+            if pcm.SampleRate != tt.rate || pcm.Channels != 1 || len(pcm.Samples) != 2 {
+                t.Fatalf("got %d Hz, %d channels, %d samples", pcm.SampleRate, pcm.Channels, len(pcm.Samples))
+            }
+            if math.Abs(float64(pcm.Samples[0])-0.5) > 1e-6 || math.Abs(float64(pcm.Samples[1])+0.25) > 1e-6 {
+                t.Errorf("samples = %v, want [0.5 -0.25]", pcm.Samples)
+            }
+        })
+    }
+}
+
+func TestDecodeWAVErrors(t *testing.T) {
+    tests := []struct {
+        name string
+        file []byte
+    }{
+        {"not RIFF", []byte("OggS\x00\x02\x00\x00\x00\x00\x00\x00")},
+        {"truncated", []byte("RIFF")},
+        {"data before fmt", riffWAV(riffChunk("data", []byte{0, 0}))},
+        {"no data", riffWAV(riffChunk("fmt ", fmtChunk(1, 1, 8000, 16)))},
+        {"no channels", riffWAV(riffChunk("fmt ", fmtChunk(1, 0, 8000, 16)), riffChunk("data", []byte{0, 0}))},
+        {"12 bit", riffWAV(riffChunk("fmt ", fmtChunk(1, 1, 8000, 12)), riffChunk("data", []byte{0, 0}))},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if _, err := whisper.DecodeWAV(bytes.NewReader(tt.file)); err == nil {
+                t.Error("decoded an invalid file")
+            }
+        })
+    }
+}
+
+func TestEncodeWAV(t *testing.T) {
+    pcm := tone(44100, 2, 0.5, 440)
+    decoded, err := whisper.DecodeWAV(bytes.NewReader(wavBytes(t, pcm)))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if decoded.SampleRate != 44100 || decoded.Channels != 2 || len(decoded.Samples) != len(pcm.Samples) {
+        t.Fatalf("got %d Hz, %d channels, %d samples", decoded.SampleRate, decoded.Channels, len(decoded.Samples))
+    }
+    for i, s := range pcm.Samples {
+        if math.Abs(float64(decoded.Samples[i]-s)) > 1.0/(1<<15) {
+            t.Fatalf("sample %d = %v, want %v", i, decoded.Samples[i], s)
+        }
+    }
+}
@@ -0,0 +1,269 @@
+package whisper
+
+import (
+    "bufio"
+    "crypto/sha1"
+    "encoding/base64"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+    "unicode/utf8"
+)
+
+// WebSocket opcodes (RFC 6455 section 5.2)
+const (
+    wsContinuation = 0x0
+    wsText         = 0x1
+    wsBinary       = 0x2
+    wsClose        = 0x8
+    wsPing         = 0x9
+    wsPong         = 0xA
+)
+
+// WebSocket close codes (RFC 6455 section 7.4.1)
+const (
+    wsCloseNormal        = 1000
+    wsCloseGoingAway     = 1001
+    wsCloseProtocolError = 1002
+    wsCloseUnsupported   = 1003
+    wsCloseInvalidData   = 1007
+    wsClosePolicy        = 1008
+    wsCloseTooBig        = 1009
+    wsCloseInternal      = 1011
+    wsCloseTryAgainLater = 1013
+)
+
+// wsGUID is appended to the client key to derive the accept header
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// wsWriteTimeout bounds a write to a client that stopped reading
+const wsWriteTimeout = 10 * time.Second
+
+// wsCloseError is returned by readMessage when the connection ends
+type wsCloseError struct {
+    Code   int
+    Reason string
+}
+
+func (e *wsCloseError) Error() string {
+    return fmt.Sprintf("websocket closed: %d %s", e.Code, e.Reason)
+}
+
+// wsConn is the server side of a WebSocket connection, without extensions
+// or subprotocols
+type wsConn struct {
+    conn       net.Conn
+    br         *bufio.Reader
+    maxMessage int64
+
+    writeMu   sync.Mutex
+    closeOnce sync.Once
+}
+
+// headerContains reports whether a comma-separated header has a token
+func headerContains(h http.Header, name, token string) bool {
+    for _, value := range h.Values(name) {
+        for _, part := range strings.Split(value, ",") {
+            if strings.EqualFold(strings.TrimSpace(part), token) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// isWebSocketUpgrade reports whether r asks for a WebSocket connection
+func isWebSocketUpgrade(r *http.Request) bool {
+    return r.Method == http.MethodGet &&
+        headerContains(r.Header, "Connection", "upgrade") &&
+        headerContains(r.Header, "Upgrade", "websocket")
+}
+
+// upgradeWebSocket completes the opening handshake and takes over the
+// connection. On failure an HTTP error has been written.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request, maxMessage int64) (*wsConn, error) {
+    if !isWebSocketUpgrade(r) {
+        http.Error(w, "WebSocket upgrade required", http.StatusUpgradeRequired)
+        return nil, errors.New("not a websocket upgrade")
+    }
+    if r.Header.Get("Sec-WebSocket-Version") != "13" {
+        w.Header().Set("Sec-WebSocket-Version", "13")
+        http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+        return nil, errors.New("unsupported websocket version")
+    }
+    key := r.Header.Get("Sec-WebSocket-Key")
+    if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+        http.Error(w, "invalid Sec-WebSocket-Key", http.StatusBadRequest)
+        return nil, errors.New("invalid websocket key")
+    }
+
+    hijacker, ok := w.(http.Hijacker)
+    if !ok {
+        http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+        return nil, errors.New("response writer cannot be hijacked")
+    }
+    conn, rw, err := hijacker.Hijack()
+    if err != nil {
+        return nil, fmt.Errorf("failed to hijack connection: %w", err)
+    }
+
+    sum := sha1.Sum([]byte(key + wsGUID))
+    accept := base64.StdEncoding.EncodeToString(sum[:])
+    conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+    _, err = fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+        "Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", accept)
+    if err != nil {
+        conn.Close()
+        return nil, fmt.Errorf("failed to complete handshake: %w", err)
+    }
+    return &wsConn{conn: conn, br: rw.Reader, maxMessage: maxMessage}, nil
+}
+
+// readFrame reads one frame and unmasks its payload
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+    var header [2]byte
+    if _, err := io.ReadFull(c.br, header[:]); err != nil {
+        return false, 0, nil, err
+    }
+    fin = header[0]&0x80 != 0
+    opcode = header[0] & 0x0F
+    if header[0]&0x70 != 0 {
+        return false, 0, nil, &wsCloseError{wsCloseProtocolError, "reserved bits set"}
+    }
+    if header[1]&0x80 == 0 {
+        return false, 0, nil, &wsCloseError{wsCloseProtocolError, "client frames must be masked"}
+    }
+
+    length := int64(header[1] & 0x7F)
+    switch length {
+    case 126:
+        var ext [2]byte
+        if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+            return false, 0, nil, err
+        }
+        length = int64(binary.BigEndian.Uint16(ext[:]))
+    case 127:
+        var ext [8]byte
+        if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+            return false, 0, nil, err
+        }
+        if ext[0]&0x80 != 0 {
+            return false, 0, nil, &wsCloseError{wsCloseProtocolError, "invalid frame length"}
+        }
+        length = int64(binary.BigEndian.Uint64(ext[:]))
+    }
+    if opcode >= wsClose && (length > 125 || !fin) {
+        return false, 0, nil, &wsCloseError{wsCloseProtocolError, "invalid control frame"}
+    }
+    if length > c.maxMessage {
+        return false, 0, nil, &wsCloseError{wsCloseTooBig, "message too big"}
+    }
+
+    var mask [4]byte
+    if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+        return false, 0, nil, err
+    }
+    payload = make([]byte, length)
+    if _, err := io.ReadFull(c.br, payload); err != nil {
+        return false, 0, nil, err
+    }
+    for i := range payload {
+        payload[i] ^= mask[i%4]
+    }
+    return fin, opcode, payload, nil
+}
+
+// readMessage returns the next text or binary message, answering pings and
+// reassembling fragments. A close from the client is echoed and returned
+// as a *wsCloseError.
+func (c *wsConn) readMessage() (byte, []byte, error) {
+    var opcode byte
+    var message []byte
+    for {
+        fin, frameOp, payload, err := c.readFrame()
+        if err != nil {
+            return 0, nil, err
+        }
+
+        switch frameOp {
+        case wsPing:
+            if err := c.writeFrame(wsPong, payload); err != nil {
+                return 0, nil, err
+            }
+            continue
+        case wsPong:
+            continue
+        case wsClose:
+            closeErr := &wsCloseError{Code: wsCloseNormal}
+            if len(payload) >= 2 {
+                closeErr.Code = int(binary.BigEndian.Uint16(payload))
+                closeErr.Reason = string(payload[2:])
+            }
+            c.close(closeErr.Code, "")
+            return 0, nil, closeErr
+        case wsText, wsBinary:
+            if message != nil {
+                return 0, nil, &wsCloseError{wsCloseProtocolError, "expected continuation frame"}
+            }
+            opcode = frameOp
+            message = payload
+        case wsContinuation:
+            if message == nil {
+                return 0, nil, &wsCloseError{wsCloseProtocolError, "unexpected continuation frame"}
+            }
+            if int64(len(message)+len(payload)) > c.maxMessage {
+                return 0, nil, &wsCloseError{wsCloseTooBig, "message too big"}
+            }
+            message = append(message, payload...)
+        default:
+            return 0, nil, &wsCloseError{wsCloseProtocolError, "unknown opcode"}
+        }
+
+        if fin {
+            if opcode == wsText && !utf8.Valid(message) {
+                return 0, nil, &wsCloseError{wsCloseInvalidData, "invalid UTF-8"}
+            }
+            return opcode, message, nil
+        }
+    }
+}
+
+// writeFrame sends one unmasked, unfragmented frame
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+    header := make([]byte, 2, 10)
+    header[0] = 0x80 | opcode
+    switch n := len(payload); {
+    case n <= 125:
+        header[1] = byte(n)
+    case n <= 0xFFFF:
+        header[1] = 126
+        header = binary.BigEndian.AppendUint16(header, uint16(n))
+    default:
+        header[1] = 127
+        header = binary.BigEndian.AppendUint64(header, uint64(n))
+    }
+
+    c.writeMu.Lock()
+    defer c.writeMu.Unlock()
+    c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+    if _, err := c.conn.Write(append(header, payload...)); err != nil {
+        return err
+    }
+    return nil
+}
+
+// close sends a close frame and closes the connection
+func (c *wsConn) close(code int, reason string) {
+    c.closeOnce.Do(func() {
+        payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+        payload = append(payload, reason[:min(len(reason), 123)]...)
+        c.writeFrame(wsClose, payload)
+        c.conn.Close()
+    })
+}
@@ -2,13 +2,17 @@ package whisper
 
 import (
     "bytes"
-    "encoding/json"
+    "cmp"
+    "context"
     "fmt"
     "io"
-    "mime/multipart"
     "net/http"
     "net/url"
     "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
 )
 
 // TranscribeService handles audio transcription
@@ -17,12 +21,88 @@ type TranscribeService struct {
     Provider   string
     APIKey     string // For external providers like Groq
     Model      string // For providers like Groq that require model specification
+
+    // Providers, when set, replaces the fields above with a failover chain
+    // tried in order. Breaker decides when a failing provider is skipped.
+    Providers []ProviderSpec
+    Breaker   BreakerConfig
+
+    // Backend does the transcription. When nil it is built from the
+    // fields above through the provider registry on first use.
+    Backend Transcriber
+
+    // HTTPClient is shared by all outbound requests of the registry-built
+    // backend. Use SetHTTPClient to change it after first use.
+    HTTPClient *http.Client
+
+    // Timeout bounds each SendToWhisper call, 0 means no deadline
+    Timeout time.Duration
+
+    // Spool buffers streamed audio to a temporary file in SpoolDir (or the
+    // default temp directory) before sending, so it can be sent again
+    Spool    bool
+    SpoolDir string
+
+    // Retry controls retries of rate-limited and unavailable providers and
+    // MaxConcurrent bounds the calls in flight to the provider (0 means no
+    // limit). Both apply to the registry-built backend.
+    Retry         RetryConfig
+    MaxConcurrent int
+
+    // Normalize converts audio to 16 kHz mono WAV before sending:
+    // NormalizeAuto (the default), NormalizeAlways or NormalizeOff
+    Normalize string
+
+    // Decoder, when set, decodes formats other than WAV for normalization,
+    // VAD and chunking in place of the decoders from RegisterDecoder
+    Decoder Decoder
+
+    // VAD, when set, drops leading and trailing silence and shortens long
+    // pauses before sending; timestamps are mapped back to the original
+    // audio. Audio without speech is not sent at all.
+    VAD *VADConfig
+
+    // Chunking splits long WAV recordings, or any decodable audio above the
+    // provider's upload limit, and transcribes the pieces in parallel. Nil
+    // disables it.
+    Chunking *ChunkConfig
+
+    // Cache, when set, returns earlier transcripts of the same audio and
+    // options instead of calling the provider. Entries live for CacheTTL,
+    // DefaultCacheTTL when 0 and forever when negative.
+    Cache    Cache
+    CacheTTL time.Duration
+
+    // Quality, when set, flags or drops silent, low-confidence, looping
+    // and hallucinated segments and scores each transcript
+    Quality *QualityConfig
+
+    // Postprocess, when set, corrects transcripts with a vocabulary,
+    // replacements and rules. Its vocabulary is also added to the prompt of
+    // providers that take one.
+    Postprocess *Postprocessor
+
+    mu    sync.Mutex
+    built bool // Backend was built from the fields and may be rebuilt
 }
 
 // NewTranscribeService creates a new transcription service
 func NewTranscribeService() (*TranscribeService, error) {
+    // A failover chain comes from a config file or a list of names
+    var providers []ProviderSpec
+    var breaker BreakerConfig
+    if configPath := os.Getenv("WHISPER_CONFIG"); configPath != "" {
+        var err error
+        providers, breaker, err = LoadProviderConfig(configPath)
+        if err != nil {
+            return nil, err
+        }
+    } else if list := os.Getenv("WHISPER_PROVIDERS"); list != "" {
+        providers = providerSpecsFromEnv(list)
+    }
+
     whisperURL := os.Getenv("WHISPER_URL")
-    if whisperURL == "" {
+    if whisperURL == "" && len(providers) == 0 {
         return nil, fmt.Errorf("WHISPER_URL environment variable is not set")
     }
 
@@ -34,23 +114,212 @@ func NewTranscribeService() (*TranscribeService, error) {
     apiKey := os.Getenv("WHISPER_KEY")
     model := os.Getenv("WHISPER_MODEL")
 
-    return &TranscribeService{
-        WhisperURL: whisperURL,
-        Provider:   provider,
-        APIKey:     apiKey,
-        Model:      model,
-    }, nil
+    timeout := DefaultTimeout
+    if timeoutStr := os.Getenv("WHISPER_TIMEOUT"); timeoutStr != "" {
+        var err error
+        timeout, err = time.ParseDuration(timeoutStr)
+        if err != nil {
+            return nil, fmt.Errorf("invalid WHISPER_TIMEOUT value: %w", err)
+        }
+    }
+
+    chunking, err := getChunkConfig()
+    if err != nil {
+        return nil, err
+    }
+
+    var retry RetryConfig
+    if retriesStr := os.Getenv("WHISPER_MAX_RETRIES"); retriesStr != "" {
+        retries, err := strconv.Atoi(retriesStr)
+        if err != nil || retries < 0 {
+            return nil, fmt.Errorf("invalid WHISPER_MAX_RETRIES value: %q", retriesStr)
+        }
+        retry.MaxAttempts = retries + 1
+    }
+
+    var vad *VADConfig
+    if vadStr := os.Getenv("WHISPER_VAD"); vadStr != "" {
+        enabled, err := strconv.ParseBool(vadStr)
+        if err != nil {
+            return nil, fmt.Errorf("invalid WHISPER_VAD value: %w", err)
+        }
+        if enabled {
+            vad = &VADConfig{}
+        }
+    }
+
+    normalize := os.Getenv("WHISPER_NORMALIZE")
+    switch normalize {
+    case "", NormalizeAuto, NormalizeAlways, NormalizeOff:
+    default:
+        return nil, fmt.Errorf("invalid WHISPER_NORMALIZE value: %q", normalize)
+    }
+    var decoder Decoder
+    if name := os.Getenv("WHISPER_DECODER"); name == "ffmpeg" {
+        decoder = FFmpegDecoder()
+    } else if name != "" {
+        return nil, fmt.Errorf("invalid WHISPER_DECODER value: %q", name)
+    }
+
+    var cache Cache
+    if cacheStr := os.Getenv("WHISPER_CACHE"); cacheStr != "" {
+        cache, err = cacheFromEnv(cacheStr)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    var cacheTTL time.Duration
+    if ttlStr := os.Getenv("WHISPER_CACHE_TTL"); ttlStr != "" {
+        cacheTTL, err = time.ParseDuration(ttlStr)
+        if err != nil {
+            return nil, fmt.Errorf("invalid WHISPER_CACHE_TTL value: %w", err)
+        }
+    }
+
+    quality, err := parseQualityAction(os.Getenv("WHISPER_QUALITY"))
+    if err != nil {
+        return nil, err
+    }
+
+    var postprocess *Postprocessor
+    if postprocessPath := os.Getenv("WHISPER_POSTPROCESS"); postprocessPath != "" {
+        cfg, err := LoadPostprocessConfig(postprocessPath)
+        if err != nil {
+            return nil, err
+        }
+        postprocess, err = NewPostprocessor(cfg)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    var maxConcurrent int
+    if concurrencyStr := os.Getenv("WHISPER_CONCURRENCY"); concurrencyStr != "" {
+        maxConcurrent, err = strconv.Atoi(concurrencyStr)
+        if err != nil {
+            return nil, fmt.Errorf("invalid WHISPER_CONCURRENCY value: %w", err)
+        }
+    }
+
+    ts := &TranscribeService{
+        WhisperURL:    whisperURL,
+        Provider:      provider,
+        APIKey:        apiKey,
+        Model:         model,
+        Providers:     providers,
+        Breaker:       breaker,
+        HTTPClient:    NewHTTPClient(TransportConfig{}),
+        Timeout:       timeout,
+        Normalize:     normalize,
+        Decoder:       decoder,
+        VAD:           vad,
+        Chunking:      chunking,
+        Cache:         cache,
+        CacheTTL:      cacheTTL,
+        Quality:       quality,
+        Postprocess:   postprocess,
+        Retry:         retry,
+        MaxConcurrent: maxConcurrent,
+    }
+
+    // Build the backend now so unknown providers fail at startup
+    if _, err := ts.backend(); err != nil {
+        return nil, err
+    }
+
+    return ts, nil
+}
+
+// SetHTTPClient replaces the client used for outbound requests
+func (ts *TranscribeService) SetHTTPClient(client *http.Client) {
+    ts.mu.Lock()
+    defer ts.mu.Unlock()
+    ts.HTTPClient = client
+    if ts.built {
+        ts.Backend = nil
+        ts.built = false
+    }
+}
+
+// Features reports what the backend supports, e.g. whether uploads in any
+// format should be sent with ShouldEncode
+func (ts *TranscribeService) Features() (Features, error) {
+    backend, err := ts.backend()
+    if err != nil {
+        return Features{}, err
+    }
+    return backend.Features(), nil
 }
 
 // TranscribeRequest represents a transcription request
 type TranscribeRequest struct {
-    AudioData     []byte
-    FileName      string
-    Language      string
-    Task          string
-    OutputFormat  string
-    ShouldEncode  bool
-    Model         string // Override the default model if needed
+    // Audio is streamed to the provider. It takes precedence over AudioData.
+    Audio io.Reader
+
+    // Deprecated: set Audio, e.g. to bytes.NewReader(data), instead.
+    AudioData []byte
+
+    FileName     string
+    Language     string
+    Task         string
+    OutputFormat string
+    ShouldEncode bool
+    Model        string        // Override the default model if needed
+    Timeout      time.Duration // Override the service timeout if set
+
+    // Prompt guides the model's style and spelling, Vocabulary lists names
+    // and terms it should recognize. Both are sent as the initial prompt.
+    Prompt     string
+    Vocabulary []string
+
+    // Temperature sets sampling randomness, 0 keeps the provider default
+    Temperature float64
+
+    // TimestampGranularities asks for GranularitySegment and/or
+    // GranularityWord timings. Word timings fill TranscribeResponse.Words.
+    TimestampGranularities []string
+
+    // Progress, when set, is called with the number of finished chunks as
+    // a long recording is transcribed in pieces. Calls are not concurrent.
+    Progress func(done, total int)
+
+    // NoCache skips the cache lookup; the fresh transcript is still stored
+    NoCache bool
+}
+
+// Tasks
+const (
+    TaskTranscribe = "transcribe"
+    TaskTranslate  = "translate" // Transcribe into English
+)
+
+// Timestamp granularities
+const (
+    GranularitySegment = "segment"
+    GranularityWord    = "word"
+)
+
+// prompt returns the initial prompt with the vocabulary appended
+func (req *TranscribeRequest) prompt() string {
+    if len(req.Vocabulary) == 0 {
+        return req.Prompt
+    }
+    glossary := "Glossary: " + strings.Join(req.Vocabulary, ", ") + "."
+    if req.Prompt == "" {
+        return glossary
+    }
+    return req.Prompt + " " + glossary
+}
+
+// wantsWords reports whether word-level timestamps were requested
+func (req *TranscribeRequest) wantsWords() bool {
+    for _, granularity := range req.TimestampGranularities {
+        if granularity == GranularityWord {
+            return true
+        }
+    }
+    return false
 }
 
 // TranscribeResponse represents a transcription response
@@ -58,204 +327,334 @@ type TranscribeResponse struct {
     Text     string    `json:"text"`
     Segments []Segment `json:"segments"`
     Language string    `json:"language"`
-    Error    string    `json:"error,omitempty"`
+    Duration float64   `json:"duration,omitempty"` // Seconds of audio, when reported
+    Words    []Word    `json:"words,omitempty"`    // All words in order, when requested
+    Provider string    `json:"provider,omitempty"` // Name of the provider that answered
+
+    // SpeechRegions lists the parts of the original audio that were sent
+    // when voice activity detection is enabled
+    SpeechRegions []SpeechRegion `json:"speech_regions,omitempty"`
+    Cached        bool           `json:"cached,omitempty"`  // Served from TranscribeService.Cache
+    Quality       *QualityReport `json:"quality,omitempty"` // Set when TranscribeService.Quality is
+    Error         string         `json:"error,omitempty"`
 }
 
 // Segment represents a segment of the transcribed text
 type Segment struct {
-    ID               int     `json:"id"`
-    Seek             int     `json:"seek"`
-    Start            float64 `json:"start"`
-    End              float64 `json:"end"`
-    Text             string  `json:"text"`
-    Tokens           []int   `json:"tokens"`
-    Temperature      float64 `json:"temperature"`
-    AvgLogprob       float64 `json:"avg_logprob"`
-    CompressionRatio float64 `json:"compression_ratio"`
-    NoSpeechProb     float64 `json:"no_speech_prob"`
+    ID               int      `json:"id"`
+    Seek             int      `json:"seek"`
+    Start            float64  `json:"start"`
+    End              float64  `json:"end"`
+    Text             string   `json:"text"`
+    Tokens           []int    `json:"tokens"`
+    Temperature      float64  `json:"temperature"`
+    AvgLogprob       float64  `json:"avg_logprob"`
+    CompressionRatio float64  `json:"compression_ratio"`
+    NoSpeechProb     float64  `json:"no_speech_prob"`
+    Words            []Word   `json:"words,omitempty"`
+    Flags            []string `json:"flags,omitempty"` // Set by CheckQuality
 }
 
-// ParseAudioFromRequest extracts audio data from an HTTP request
-func ParseAudioFromRequest(r *http.Request) ([]byte, string, error) {
-    if err := r.ParseMultipartForm(10 << 20); err != nil { // 10 MB max
-        return nil, "", fmt.Errorf("failed to parse multipart form: %w", err)
-    }
+// Word is a word with its timing in seconds
+type Word struct {
+    Word        string  `json:"word"`
+    Start       float64 `json:"start"`
+    End         float64 `json:"end"`
+    Probability float64 `json:"probability,omitempty"`
+}
 
-    file, header, err := r.FormFile("audio")
-    if err != nil {
-        return nil, "", fmt.Errorf("failed to get audio file from form: %w", err)
+// linkWords makes the word timings available both per segment and for the
+// whole transcript, whichever form the provider returned them in
+func linkWords(resp *TranscribeResponse) {
+    if len(resp.Words) == 0 {
+        for _, seg := range resp.Segments {
+            resp.Words = append(resp.Words, seg.Words...)
+        }
+        return
     }
-    defer file.Close()
 
-    var buf bytes.Buffer
-    if _, err := io.Copy(&buf, file); err != nil {
-        return nil, "", fmt.Errorf("failed to read audio file: %w", err)
+    // Assign each word to the segment containing its midpoint
+    w := 0
+    for i := range resp.Segments {
+        seg := &resp.Segments[i]
+        if len(seg.Words) > 0 {
+            continue
+        }
+        for w < len(resp.Words) {
+            word := resp.Words[w]
+            mid := (word.Start + word.End) / 2
+            if mid >= seg.End && i < len(resp.Segments)-1 {
+                break
+            }
+            seg.Words = append(seg.Words, word)
+            w++
+        }
     }
-
-    return buf.Bytes(), header.Filename, nil
 }
 
-// SendToWhisper forwards audio data to the appropriate service
-func (ts *TranscribeService) SendToWhisper(req *TranscribeRequest) (*TranscribeResponse, error) {
-    switch ts.Provider {
-    case "groq":
-        return ts.sendToGroq(req)
-    case "docker":
-        fallthrough
-    default:
-        return ts.sendToDocker(req)
+// audio returns the reader to upload, falling back to AudioData
+func (req *TranscribeRequest) audio() io.Reader {
+    if req.Audio != nil {
+        return req.Audio
     }
+    return bytes.NewReader(req.AudioData)
 }
 
-// sendToDocker sends request to the Docker container
-func (ts *TranscribeService) sendToDocker(req *TranscribeRequest) (*TranscribeResponse, error) {
-    body := &bytes.Buffer{}
-    writer := multipart.NewWriter(body)
-
-    part, err := writer.CreateFormFile("audio_file", req.FileName)
+// ParseAudioFromRequest extracts audio data from an HTTP request and checks
+// it against DefaultUploadConfig. The file goes through ReadAudioUpload, so
+// it is spooled to disk while it is checked and the returned name has the
+// extension of the real format. Text fields are stored in r.Form. It holds
+// the whole file in memory; prefer ReadAudioUpload for large uploads.
+func ParseAudioFromRequest(r *http.Request) ([]byte, string, error) {
+    upload, err := ReadAudioUpload(r, DefaultUploadConfig)
     if err != nil {
-        return nil, fmt.Errorf("failed to create form file: %w", err)
+        return nil, "", err
     }
+    defer upload.Close()
 
-    if _, err := io.Copy(part, bytes.NewReader(req.AudioData)); err != nil {
-        return nil, fmt.Errorf("failed to write audio data to form: %w", err)
-    }
-
-    if err := writer.Close(); err != nil {
-        return nil, fmt.Errorf("failed to close multipart writer: %w", err)
+    data := make([]byte, upload.Size)
+    if _, err := io.ReadFull(upload, data); err != nil {
+        return nil, "", fmt.Errorf("failed to read audio file: %w", err)
     }
+    return data, upload.FileName, nil
+}
 
-    // Build the URL with query parameters
-    whisperURL := fmt.Sprintf("%s?encode=%t&task=%s&language=%s&output=%s",
-        ts.WhisperURL, req.ShouldEncode, req.Task, req.Language, req.OutputFormat)
-
-    httpReq, err := http.NewRequest("POST", whisperURL, body)
+// SendToWhisper forwards audio data to the configured provider. Canceling
+// ctx, e.g. because the client disconnected, aborts the outbound request.
+func (ts *TranscribeService) SendToWhisper(ctx context.Context, req *TranscribeRequest) (*TranscribeResponse, error) {
+    backend, req, err := ts.prepare(req)
     if err != nil {
-        return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+        return nil, err
     }
-
-    httpReq.Header.Set("Content-Type", writer.FormDataContentType())
-
-    client := &http.Client{}
-    resp, err := client.Do(httpReq)
-    if err != nil {
-        return nil, fmt.Errorf("failed to send request to Whisper: %w", err)
+    if timeout := ts.timeout(req); timeout > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, timeout)
+        defer cancel()
     }
-    defer resp.Body.Close()
 
-    if resp.StatusCode != http.StatusOK {
-        return nil, fmt.Errorf("Whisper service returned non-OK status: %s", resp.Status)
+    var cacheKey string
+    if ts.Cache != nil {
+        var cached *TranscribeResponse
+        cached, cacheKey, req, err = ts.cacheLookup(ctx, backend, req)
+        if err != nil {
+            return nil, err
+        }
+        if cached != nil {
+            ts.finishResponse(cached)
+            return cached, nil
+        }
     }
 
-    respBody, err := io.ReadAll(resp.Body)
+    req, err = ts.normalizeRequest(backend, req)
     if err != nil {
-        return nil, fmt.Errorf("failed to read response body: %w", err)
+        return nil, err
+    }
+
+    if ts.VAD != nil || ts.Chunking != nil {
+        if _, ok := seekableAudio(req); !ok {
+            // Both decode the audio and may send it as it is, so streams
+            // go to a file rather than into memory
+            spooled, err := Spool(req.audio(), ts.SpoolDir)
+            if err != nil {
+                return nil, err
+            }
+            defer spooled.Close()
+            spooledReq := *req
+            spooledReq.Audio = spooled
+            spooledReq.AudioData = nil
+            req = &spooledReq
+        }
     }
 
-    var result TranscribeResponse
-    if err := json.Unmarshal(respBody, &result); err != nil {
-        return nil, fmt.Errorf("failed to parse Whisper response: %w", err)
+    var timeline *Timeline
+    if ts.VAD != nil {
+        req, timeline, err = ts.applyVAD(req, *ts.VAD)
+        if err != nil {
+            return nil, err
+        }
+        if req == nil {
+            return &TranscribeResponse{Provider: backend.Name()}, nil // Silence
+        }
     }
 
-    return &result, nil
-}
-
-// sendToGroq sends request to Groq API
-func (ts *TranscribeService) sendToGroq(req *TranscribeRequest) (*TranscribeResponse, error) {
-    body := &bytes.Buffer{}
-    writer := multipart.NewWriter(body)
-
-    // Use the model from the service (set via env) unless overridden in the request
-    model := ts.Model
-    if req.Model != "" {
-        model = req.Model
+    var resp *TranscribeResponse
+    if ts.Chunking != nil {
+        resp, err = ts.transcribeChunked(ctx, backend, req, *ts.Chunking)
+    } else {
+        resp, err = ts.transcribe(ctx, backend, req)
     }
-    
-    if model == "" {
-        return nil, fmt.Errorf("model is required for Groq provider")
+    if err != nil {
+        return nil, err
     }
-    
-    // Add model parameter
-    if err := writer.WriteField("model", model); err != nil {
-        return nil, fmt.Errorf("failed to write model field: %w", err)
+    if timeline != nil {
+        timeline.MapResponse(resp)
+        resp.SpeechRegions = timeline.Regions
     }
-
-    // Add response format
-    responseFormat := "json"
-    if req.OutputFormat == "verbose_json" {
-        responseFormat = "verbose_json"
+    if resp.Provider == "" {
+        resp.Provider = backend.Name()
     }
-    if err := writer.WriteField("response_format", responseFormat); err != nil {
-        return nil, fmt.Errorf("failed to write response_format field: %w", err)
-    }
-
-    // Add language if specified
-    if req.Language != "" && req.Language != "auto" {
-        if err := writer.WriteField("language", req.Language); err != nil {
-            return nil, fmt.Errorf("failed to write language field: %w", err)
-        }
+    if cacheKey != "" {
+        ts.cacheStore(ctx, cacheKey, resp)
     }
+    ts.finishResponse(resp)
+    return resp, nil
+}
 
-    // Add audio file
-    part, err := writer.CreateFormFile("file", req.FileName)
+// sendDirect sends audio that is already short 16 kHz mono WAV, such as a
+// live utterance, straight to the backend. It skips the cache and the
+// normalize, VAD and chunking stages, which would only repeat work done by
+// the caller for every clip.
+func (ts *TranscribeService) sendDirect(ctx context.Context, req *TranscribeRequest) (*TranscribeResponse, error) {
+    backend, req, err := ts.prepare(req)
     if err != nil {
-        return nil, fmt.Errorf("failed to create form file: %w", err)
+        return nil, err
     }
-
-    if _, err := io.Copy(part, bytes.NewReader(req.AudioData)); err != nil {
-        return nil, fmt.Errorf("failed to write audio data to form: %w", err)
+    if timeout := ts.timeout(req); timeout > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, timeout)
+        defer cancel()
     }
 
-    if err := writer.Close(); err != nil {
-        return nil, fmt.Errorf("failed to close multipart writer: %w", err)
+    resp, err := backend.Transcribe(ctx, req)
+    if err != nil {
+        return nil, err
+    }
+    if resp.Provider == "" {
+        resp.Provider = backend.Name()
     }
+    ts.finishResponse(resp)
+    return resp, nil
+}
 
-    httpReq, err := http.NewRequest("POST", ts.WhisperURL, body)
+// prepare picks the backend for req, checks that it supports the request
+// and adds the vocabulary
+func (ts *TranscribeService) prepare(req *TranscribeRequest) (Transcriber, *TranscribeRequest, error) {
+    backend, err := ts.backend()
     if err != nil {
-        return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+        return nil, nil, err
     }
-
-    httpReq.Header.Set("Content-Type", writer.FormDataContentType())
-    
-    if ts.APIKey == "" {
-        return nil, fmt.Errorf("API key is required for Groq provider")
+    if err := checkFeatures(backend, req); err != nil {
+        return nil, nil, err
     }
-    httpReq.Header.Set("Authorization", "Bearer "+ts.APIKey)
+    if failover, ok := backend.(*FailoverTranscriber); ok {
+        // Conversion for WAV-only providers is decided per provider
+        backend = failover.withPrepare(ts.normalizeRequest)
+    }
+    return backend, ts.withVocabulary(backend, req), nil
+}
 
-    client := &http.Client{}
-    resp, err := client.Do(httpReq)
-    if err != nil {
-        return nil, fmt.Errorf("failed to send request to Groq: %w", err)
+// timeout returns the request timeout, falling back to the service's
+func (ts *TranscribeService) timeout(req *TranscribeRequest) time.Duration {
+    if req.Timeout > 0 {
+        return req.Timeout
     }
-    defer resp.Body.Close()
+    return ts.Timeout
+}
 
-    if resp.StatusCode != http.StatusOK {
-        body, _ := io.ReadAll(resp.Body)
-        return nil, fmt.Errorf("Groq service returned non-OK status: %s - %s", resp.Status, string(body))
+// finishResponse applies the Quality and Postprocess stages if enabled.
+// Both run after caching, so changing them takes effect at once.
+func (ts *TranscribeService) finishResponse(resp *TranscribeResponse) {
+    if ts.Quality != nil {
+        resp.Quality = CheckQuality(resp, *ts.Quality)
+    }
+    if ts.Postprocess != nil {
+        ts.Postprocess.Apply(resp)
     }
+}
 
-    respBody, err := io.ReadAll(resp.Body)
-    if err != nil {
-        return nil, fmt.Errorf("failed to read response body: %w", err)
+// transcribe sends the audio in one piece, spooling it first if enabled
+func (ts *TranscribeService) transcribe(ctx context.Context, backend Transcriber, req *TranscribeRequest) (*TranscribeResponse, error) {
+    if ts.Spool && req.Audio != nil {
+        if _, ok := req.Audio.(io.Seeker); !ok {
+            spooled, err := Spool(req.Audio, ts.SpoolDir)
+            if err != nil {
+                return nil, err
+            }
+            defer spooled.Close()
+            spooledReq := *req
+            spooledReq.Audio = spooled
+            req = &spooledReq
+        }
     }
 
-    // Parse Groq response
-    var groqResponse struct {
-        Text     string `json:"text"`
-        Language string `json:"language"`
+    return backend.Transcribe(ctx, req)
+}
+
+// backend returns the Transcriber, building it from the service fields for
+// services that were not created by NewTranscribeService
+func (ts *TranscribeService) backend() (Transcriber, error) {
+    ts.mu.Lock()
+    defer ts.mu.Unlock()
+    if ts.Backend != nil {
+        return ts.Backend, nil
+    }
+
+    specs := ts.Providers
+    if len(specs) == 0 {
+        specs = []ProviderSpec{{
+            Provider: cmp.Or(ts.Provider, "docker"),
+            URL:      ts.WhisperURL,
+            APIKey:   ts.APIKey,
+            Model:    ts.Model,
+        }}
+    }
+
+    var chain []Transcriber
+    for _, spec := range specs {
+        backend, err := NewTranscriber(spec.Provider, ProviderConfig{
+            URL:        spec.URL,
+            APIKey:     spec.APIKey,
+            Model:      spec.Model,
+            HTTPClient: ts.HTTPClient,
+        })
+        if err != nil {
+            return nil, err
+        }
+        // The slot is released while waiting to retry
+        maxConcurrent := cmp.Or(spec.MaxConcurrent, ts.MaxConcurrent)
+        chain = append(chain, WithRetry(WithConcurrencyLimit(backend, maxConcurrent), ts.Retry))
     }
 
-    if err := json.Unmarshal(respBody, &groqResponse); err != nil {
-        return nil, fmt.Errorf("failed to parse Groq response: %w", err)
+    backend := chain[0]
+    if len(ts.Providers) > 0 {
+        failover, err := NewFailover(ts.Breaker, chain...)
+        if err != nil {
+            return nil, err
+        }
+        backend = failover
     }
+    ts.Backend = backend
+    ts.built = true
+    return backend, nil
+}
 
-    // Convert to our standard response format
-    result := &TranscribeResponse{
-        Text:     groqResponse.Text,
-        Language: groqResponse.Language,
+// getChunkConfig reads WHISPER_CHUNK_DURATION, which enables chunking, and
+// WHISPER_CHUNK_OVERLAP and WHISPER_CHUNK_CONCURRENCY
+func getChunkConfig() (*ChunkConfig, error) {
+    durationStr := os.Getenv("WHISPER_CHUNK_DURATION")
+    if durationStr == "" {
+        return nil, nil
     }
 
-    return result, nil
+    var cfg ChunkConfig
+    var err error
+    cfg.MaxDuration, err = time.ParseDuration(durationStr)
+    if err != nil {
+        return nil, fmt.Errorf("invalid WHISPER_CHUNK_DURATION value: %w", err)
+    }
+    if overlapStr := os.Getenv("WHISPER_CHUNK_OVERLAP"); overlapStr != "" {
+        cfg.Overlap, err = time.ParseDuration(overlapStr)
+        if err != nil {
+            return nil, fmt.Errorf("invalid WHISPER_CHUNK_OVERLAP value: %w", err)
+        }
+    }
+    if concurrencyStr := os.Getenv("WHISPER_CHUNK_CONCURRENCY"); concurrencyStr != "" {
+        cfg.Concurrency, err = strconv.Atoi(concurrencyStr)
+        if err != nil {
+            return nil, fmt.Errorf("invalid WHISPER_CHUNK_CONCURRENCY value: %w", err)
+        }
+    }
+    return &cfg, nil
 }
 
 // GetWhisperURL returns the Whisper URL with default values if not set
@@ -0,0 +1,130 @@
+package whisper_test
+
+import (
+    "bytes"
+    "context"
+    "math"
+    "testing"
+    "time"
+
+    "github.com/gchalakovmmi/PulpuWEB/whisper"
+    "github.com/gchalakovmmi/PulpuWEB/whisper/whispertest"
+)
+
+// tone is a sine wave at freq Hz, the same on every channel
+func tone(rate, channels int, seconds, freq float64) *whisper.PCM {
+    frames := int(seconds * float64(rate))
+    samples := make([]float32, frames*channels)
+    for i := range frames {
+        v := float32(0.5 * math.Sin(2*math.Pi*freq*float64(i)/float64(rate)))
+        for c := range channels {
+            samples[i*channels+c] = v
+        }
+    }
+    return &whisper.PCM{SampleRate: rate, Channels: channels, Samples: samples}
+}
+
+// wavBytes encodes pcm as a WAV file
+func wavBytes(t *testing.T, pcm *whisper.PCM) []byte {
+    t.Helper()
+    var buf bytes.Buffer
+    if err := whisper.EncodeWAV(&buf, pcm); err != nil {
+        t.Fatal(err)
+    }
+    return buf.Bytes()
+}
+
+// wavRequest is a request for a second of 16 kHz mono audio
+func wavRequest(t *testing.T) *whisper.TranscribeRequest {
+    return &whisper.TranscribeRequest{
+        Audio:    bytes.NewReader(wavBytes(t, tone(16000, 1, 1, 440))),
+        FileName: "clip.wav",
+    }
+}
+
+func TestSendToWhisper(t *testing.T) {
+    srv := whispertest.New()
+    defer srv.Close()
+    srv.Respond(whispertest.Reply{Text: "I counted twenty-five boats."})
+
+    service := srv.Service("groq")
+    resp, err := service.SendToWhisper(context.Background(), wavRequest(t))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if resp.Text != "I counted twenty-five boats." || resp.Provider != "groq" {
+        t.Errorf("got %q from %q", resp.Text, resp.Provider)
+    }
+
+    requests := srv.Requests()
+    if len(requests) != 1 {
+        t.Fatalf("got %d requests, want 1", len(requests))
+    }
+    if got := requests[0].Param("model"); got != "whisper-large-v3" {
+        t.Errorf("model = %q", got)
+    }
+    if requests[0].FileName != "clip.wav" {
+        t.Errorf("file name = %q", requests[0].FileName)
+    }
+}
+
+func TestSendToWhisperPostprocess(t *testing.T) {
+    srv := whispertest.New()
+    defer srv.Close()
+    srv.Respond(whispertest.Reply{Text: "I counted twenty-five boats on the twenty second of May."})
+
+    post, err := whisper.NewPostprocessor(whisper.PostprocessConfig{Numbers: true})
+    if err != nil {
+        t.Fatal(err)
+    }
+    service := srv.Service("groq")
+    service.Postprocess = post
+    service.Quality = &whisper.QualityConfig{}
+
+    resp, err := service.SendToWhisper(context.Background(), wavRequest(t))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if want := "I counted 25 boats on the twenty second of May."; resp.Text != want {
+        t.Errorf("text = %q, want %q", resp.Text, want)
+    }
+    if resp.Quality == nil || resp.Quality.Flagged != 0 {
+        t.Errorf("quality = %+v, want no flagged segments", resp.Quality)
+    }
+}
+
+func TestSendToWhisperCache(t *testing.T) {
+    srv := whispertest.New()
+    defer srv.Close()
+    service := srv.Service("groq")
+    service.Cache = whisper.NewMemoryCache(10)
+
+    send := func() *whisper.TranscribeResponse {
+        t.Helper()
+        resp, err := service.SendToWhisper(context.Background(), wavRequest(t))
+        if err != nil {
+            t.Fatal(err)
+        }
+        return resp
+    }
+
+    if send().Cached || !send().Cached {
+        t.Error("the second request was not served from the cache")
+    }
+    if len(srv.Requests()) != 1 {
+        t.Errorf("got %d requests, want 1", len(srv.Requests()))
+    }
+
+    // Settings that change what is sent change the key
+    service.Chunking = &whisper.ChunkConfig{MaxDuration: time.Minute}
+    if send().Cached {
+        t.Error("a cached transcript was served after enabling chunking")
+    }
+    service.Normalize = whisper.NormalizeOff
+    if send().Cached {
+        t.Error("a cached transcript was served after turning normalization off")
+    }
+    if len(srv.Requests()) != 3 {
+        t.Errorf("got %d requests, want 3", len(srv.Requests()))
+    }
+}
@@ -0,0 +1,104 @@
+package whisper
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "strconv"
+)
+
+func init() {
+    RegisterProvider("whispercpp", newWhisperCppTranscriber)
+}
+
+// whisperCppTranscriber talks to the whisper.cpp example server (/inference)
+type whisperCppTranscriber struct {
+    url    string
+    client *http.Client
+}
+
+func newWhisperCppTranscriber(cfg ProviderConfig) (Transcriber, error) {
+    url := cfg.URL
+    if url == "" {
+        url = "http://localhost:8080/inference"
+    }
+    return &whisperCppTranscriber{url: url, client: cfg.client()}, nil
+}
+
+// Name returns the provider name
+func (c *whisperCppTranscriber) Name() string {
+    return "whispercpp"
+}
+
+// Features reports what the whisper.cpp server supports. It loads a single
+// model at startup and only decodes WAV unless built with ffmpeg support.
+func (c *whisperCppTranscriber) Features() Features {
+    return Features{
+        Translate:   true,
+        Segments:    true,
+        Prompt:      true,
+        Temperature: true,
+        WAVOnly:     true,
+    }
+}
+
+// Health checks that the server answers
+func (c *whisperCppTranscriber) Health(ctx context.Context) error {
+    return probeURL(ctx, c.client, rootURL(c.url), "")
+}
+
+// Transcribe sends request to the whisper.cpp server
+func (c *whisperCppTranscriber) Transcribe(ctx context.Context, req *TranscribeRequest) (*TranscribeResponse, error) {
+    responseFormat := "json"
+    if req.OutputFormat == "verbose_json" {
+        responseFormat = "verbose_json"
+    }
+    fields := []formField{
+        {"response_format", responseFormat},
+        {"translate", fmt.Sprint(req.Task == "translate")},
+    }
+    if req.Language != "" {
+        fields = append(fields, formField{"language", req.Language})
+    }
+    if prompt := req.prompt(); prompt != "" {
+        fields = append(fields, formField{"prompt", prompt})
+    }
+    if req.Temperature != 0 {
+        fields = append(fields, formField{"temperature", strconv.FormatFloat(req.Temperature, 'f', -1, 64)})
+    }
+
+    body, contentType := pipeMultipart(fields, "file", req.FileName, req.audio())
+    defer body.Close()
+
+    httpReq, err := http.NewRequestWithContext(ctx, "POST", c.url, body)
+    if err != nil {
+        return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+    }
+
+    httpReq.Header.Set("Content-Type", contentType)
+
+    resp, err := c.client.Do(httpReq)
+    if err != nil {
+        return nil, sendError("whisper.cpp", ctx, err)
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return nil, statusError("whisper.cpp", resp)
+    }
+
+    respBody, err := io.ReadAll(resp.Body)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read response body: %w", err)
+    }
+
+    var result TranscribeResponse
+    if err := json.Unmarshal(respBody, &result); err != nil {
+        return nil, fmt.Errorf("failed to parse whisper.cpp response: %w", err)
+    }
+    linkWords(&result)
+
+    return &result, nil
+}
@@ -0,0 +1,416 @@
+// Package whispertest runs an in-process fake of the docker ASR webservice
+// and the Groq/OpenAI transcription API, so code using
+// whisper.TranscribeService can be tested without a container or an API
+// key.
+//
+//	srv := whispertest.New()
+//	defer srv.Close()
+//	srv.Respond(whispertest.Reply{Text: "Hello there."}, whispertest.RateLimited(time.Second))
+//	service := srv.Service("groq")
+//	resp, err := service.SendToWhisper(ctx, req)
+//	requests := srv.Requests()
+package whispertest
+
+import (
+    "bytes"
+    "cmp"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "slices"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/gchalakovmmi/PulpuWEB/whisper"
+)
+
+// Endpoints served by the fake
+const (
+    DockerPath = "/asr"
+    GroqPath   = "/openai/v1/audio/transcriptions"
+    OpenAIPath = "/v1/audio/transcriptions"
+)
+
+// Protocols recorded in Request.Protocol
+const (
+    ProtocolDocker = "docker"
+    ProtocolOpenAI = "openai"
+)
+
+// Reply scripts one response. A zero Status answers 200 with the
+// transcript; other statuses send an error in the protocol's format.
+type Reply struct {
+    Text     string
+    Segments []whisper.Segment // One segment spanning Duration when nil
+    Language string            // "en" when empty
+    Duration float64           // Seconds, 1 when zero
+
+    Latency    time.Duration // Delay before answering
+    Status     int
+    Message    string        // Error message for non-200 statuses
+    RetryAfter time.Duration // Sent as Retry-After when set
+    Header     http.Header   // Extra response headers
+}
+
+// RateLimited is a 429 reply asking the client to wait retryAfter
+func RateLimited(retryAfter time.Duration) Reply {
+    return Reply{Status: http.StatusTooManyRequests, Message: "rate limit reached", RetryAfter: retryAfter}
+}
+
+// Fail is an error reply with the given status
+func Fail(status int) Reply {
+    return Reply{Status: status, Message: http.StatusText(status)}
+}
+
+// Request is a call received by the fake
+type Request struct {
+    Protocol string // ProtocolDocker or ProtocolOpenAI
+    Path     string
+    Query    url.Values // The docker service's parameters
+    Form     url.Values // Text fields of the multipart form
+    Header   http.Header
+    FileName string
+    Audio    []byte
+}
+
+// Param returns a docker query parameter or an OpenAI form field
+func (r Request) Param(name string) string {
+    if r.Query.Has(name) {
+        return r.Query.Get(name)
+    }
+    return r.Form.Get(name)
+}
+
+// Server is a fake transcription server. It is safe for concurrent use.
+type Server struct {
+    *httptest.Server
+
+    // APIKey, when set, is required as a Bearer token on the OpenAI
+    // endpoints
+    APIKey string
+
+    mu       sync.Mutex
+    script   []Reply
+    fallback Reply
+    requests []Request
+}
+
+// New starts a fake that answers "Hello world." until scripted otherwise
+func New() *Server {
+    s := &Server{fallback: Reply{Text: "Hello world."}}
+    mux := http.NewServeMux()
+    mux.HandleFunc("POST "+DockerPath, s.docker)
+    mux.HandleFunc("POST "+GroqPath, s.openAI(whisper.TaskTranscribe))
+    mux.HandleFunc("POST /openai/v1/audio/translations", s.openAI(whisper.TaskTranslate))
+    mux.HandleFunc("POST "+OpenAIPath, s.openAI(whisper.TaskTranscribe))
+    mux.HandleFunc("POST /v1/audio/translations", s.openAI(whisper.TaskTranslate))
+    // Health probes
+    mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {})
+    mux.HandleFunc("GET /openai/v1/models", s.models)
+    mux.HandleFunc("GET /v1/models", s.models)
+    s.Server = httptest.NewServer(mux)
+    return s
+}
+
+// DockerURL is the WHISPER_URL of the docker provider
+func (s *Server) DockerURL() string {
+    return s.URL + DockerPath
+}
+
+// GroqURL is the WHISPER_URL of the groq provider
+func (s *Server) GroqURL() string {
+    return s.URL + GroqPath
+}
+
+// OpenAIURL is the WHISPER_URL of the openai and faster-whisper providers
+func (s *Server) OpenAIURL() string {
+    return s.URL + OpenAIPath
+}
+
+// Service returns a TranscribeService using the fake as the named
+// provider: "docker", "groq", "openai" or "faster-whisper". Retries wait
+// at most a few milliseconds.
+func (s *Server) Service(provider string) *whisper.TranscribeService {
+    ts := &whisper.TranscribeService{
+        Provider:   provider,
+        APIKey:     cmp.Or(s.APIKey, "test"),
+        Model:      "whisper-large-v3",
+        HTTPClient: s.Client(),
+        Timeout:    10 * time.Second,
+        Retry:      whisper.RetryConfig{BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond},
+    }
+    switch provider {
+    case "docker":
+        ts.WhisperURL = s.DockerURL()
+    case "groq":
+        ts.WhisperURL = s.GroqURL()
+    default:
+        ts.WhisperURL = s.OpenAIURL()
+    }
+    return ts
+}
+
+// Respond queues replies, used in order by the next requests
+func (s *Server) Respond(replies ...Reply) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.script = append(s.script, replies...)
+}
+
+// SetDefault sets the reply used once the queue is empty
+func (s *Server) SetDefault(reply Reply) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.fallback = reply
+}
+
+// Requests returns the requests received so far
+func (s *Server) Requests() []Request {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return slices.Clone(s.requests)
+}
+
+// Reset forgets recorded requests and queued replies
+func (s *Server) Reset() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.requests = nil
+    s.script = nil
+}
+
+// next records a request and takes its reply
+func (s *Server) next(req Request) Reply {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.requests = append(s.requests, req)
+    if len(s.script) == 0 {
+        return s.fallback
+    }
+    reply := s.script[0]
+    s.script = s.script[1:]
+    return reply
+}
+
+// read parses the multipart form, returning its text fields and the named
+// file
+func read(r *http.Request, fileField string) (url.Values, string, []byte, error) {
+    if err := r.ParseMultipartForm(32 << 20); err != nil {
+        return nil, "", nil, err
+    }
+    file, header, err := r.FormFile(fileField)
+    if err != nil {
+        return url.Values(r.MultipartForm.Value), "", nil, fmt.Errorf("missing %s file", fileField)
+    }
+    defer file.Close()
+    audio, err := io.ReadAll(file)
+    return url.Values(r.MultipartForm.Value), header.Filename, audio, err
+}
+
+// wait applies the reply's latency, returning false if the client gave up
+func wait(r *http.Request, reply Reply) bool {
+    if reply.Latency <= 0 {
+        return true
+    }
+    select {
+    case <-time.After(reply.Latency):
+        return true
+    case <-r.Context().Done():
+        return false
+    }
+}
+
+// writeHeaders sets the reply's extra headers and Retry-After
+func writeHeaders(w http.ResponseWriter, reply Reply) {
+    for name, values := range reply.Header {
+        w.Header()[name] = values
+    }
+    if reply.RetryAfter > 0 {
+        seconds := int((reply.RetryAfter + time.Second - 1) / time.Second)
+        w.Header().Set("Retry-After", strconv.Itoa(seconds))
+    }
+}
+
+// transcript builds the response for a reply
+func transcript(reply Reply, words bool) *whisper.TranscribeResponse {
+    resp := &whisper.TranscribeResponse{
+        Text:     reply.Text,
+        Segments: slices.Clone(reply.Segments),
+        Language: reply.Language,
+        Duration: reply.Duration,
+    }
+    if resp.Language == "" {
+        resp.Language = "en"
+    }
+    if resp.Duration == 0 {
+        resp.Duration = 1
+    }
+    if resp.Segments == nil && strings.TrimSpace(reply.Text) != "" {
+        resp.Segments = []whisper.Segment{{Start: 0, End: resp.Duration, Text: reply.Text, AvgLogprob: -0.2, CompressionRatio: 1.2}}
+    }
+    for i := range resp.Segments {
+        resp.Segments[i].ID = i
+        if words && resp.Segments[i].Words == nil {
+            resp.Segments[i].Words = spreadWords(resp.Segments[i])
+        }
+        resp.Words = append(resp.Words, resp.Segments[i].Words...)
+    }
+    return resp
+}
+
+// spreadWords gives a segment's words even timings
+func spreadWords(seg whisper.Segment) []whisper.Word {
+    fields := strings.Fields(seg.Text)
+    words := make([]whisper.Word, len(fields))
+    step := (seg.End - seg.Start) / float64(max(len(fields), 1))
+    for i, field := range fields {
+        start := seg.Start + float64(i)*step
+        words[i] = whisper.Word{Word: " " + field, Start: start, End: start + step, Probability: 0.9}
+    }
+    return words
+}
+
+// writeText writes a transcript in a text or caption format
+func writeText(w http.ResponseWriter, format string, resp *whisper.TranscribeResponse) {
+    var buf bytes.Buffer
+    if err := whisper.Render(&buf, format, resp, whisper.CaptionOptions{}); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", whisper.CaptionContentType(format))
+    w.Write(buf.Bytes())
+}
+
+// writeJSON writes v as JSON
+func writeJSON(w http.ResponseWriter, status int, v any) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(v)
+}
+
+// docker speaks the whisper-asr-webservice /asr protocol
+func (s *Server) docker(w http.ResponseWriter, r *http.Request) {
+    form, fileName, audio, err := read(r, "audio_file")
+    query := r.URL.Query()
+    reply := s.next(Request{
+        Protocol: ProtocolDocker,
+        Path:     r.URL.Path,
+        Query:    query,
+        Form:     form,
+        Header:   r.Header.Clone(),
+        FileName: fileName,
+        Audio:    audio,
+    })
+    if !wait(r, reply) {
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+        return
+    }
+    writeHeaders(w, reply)
+    if reply.Status != 0 && reply.Status != http.StatusOK {
+        http.Error(w, reply.Message, reply.Status)
+        return
+    }
+
+    resp := transcript(reply, query.Get("word_timestamps") == "true")
+    resp.Words = nil // Only in segments
+    switch output := query.Get("output"); output {
+    case "", "txt":
+        writeText(w, whisper.FormatText, resp)
+    case whisper.FormatSRT, whisper.FormatVTT, whisper.FormatTSV:
+        writeText(w, output, resp)
+    case "json":
+        writeJSON(w, http.StatusOK, resp)
+    default:
+        http.Error(w, "unsupported output "+output, http.StatusUnprocessableEntity)
+    }
+}
+
+// openAIError writes an error in the OpenAI format
+func openAIError(w http.ResponseWriter, status int, message string) {
+    writeJSON(w, status, map[string]any{
+        "error": map[string]string{"message": message, "type": "invalid_request_error"},
+    })
+}
+
+// openAI speaks the Groq/OpenAI transcription and translation protocol
+func (s *Server) openAI(task string) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        form, fileName, audio, err := read(r, "file")
+        reply := s.next(Request{
+            Protocol: ProtocolOpenAI,
+            Path:     r.URL.Path,
+            Query:    r.URL.Query(),
+            Form:     form,
+            Header:   r.Header.Clone(),
+            FileName: fileName,
+            Audio:    audio,
+        })
+        if !wait(r, reply) {
+            return
+        }
+        if s.APIKey != "" && r.Header.Get("Authorization") != "Bearer "+s.APIKey {
+            openAIError(w, http.StatusUnauthorized, "Invalid API Key")
+            return
+        }
+        if err != nil {
+            openAIError(w, http.StatusBadRequest, err.Error())
+            return
+        }
+        if form.Get("model") == "" {
+            openAIError(w, http.StatusBadRequest, "model is required")
+            return
+        }
+        writeHeaders(w, reply)
+        if reply.Status != 0 && reply.Status != http.StatusOK {
+            openAIError(w, reply.Status, reply.Message)
+            return
+        }
+
+        words := slices.Contains(form["timestamp_granularities[]"], whisper.GranularityWord)
+        resp := transcript(reply, words)
+        if task == whisper.TaskTranslate {
+            resp.Language = "english"
+        }
+        switch format := form.Get("response_format"); format {
+        case "", "json":
+            writeJSON(w, http.StatusOK, map[string]string{"text": resp.Text})
+        case "text":
+            writeText(w, whisper.FormatText, resp)
+        case whisper.FormatSRT, whisper.FormatVTT:
+            writeText(w, format, resp)
+        case "verbose_json":
+            for i := range resp.Segments {
+                resp.Segments[i].Words = nil // Only at the top level
+            }
+            if !words {
+                resp.Words = nil
+            }
+            writeJSON(w, http.StatusOK, struct {
+                Task string `json:"task"`
+                *whisper.TranscribeResponse
+            }{task, resp})
+        default:
+            openAIError(w, http.StatusBadRequest, "unsupported response_format "+format)
+        }
+    }
+}
+
+// models answers the OpenAI health probe
+func (s *Server) models(w http.ResponseWriter, r *http.Request) {
+    if s.APIKey != "" && r.Header.Get("Authorization") != "Bearer "+s.APIKey {
+        openAIError(w, http.StatusUnauthorized, "Invalid API Key")
+        return
+    }
+    writeJSON(w, http.StatusOK, map[string]any{
+        "object": "list",
+        "data":   []map[string]string{{"id": "whisper-large-v3", "object": "model"}},
+    })
+}